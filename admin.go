@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"text/template"
+
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const defaultAlertJob = "broadcast-box"
+
+var alertRulesTemplate = template.Must(template.New("alert-rules").Parse(`groups:
+  - name: broadcast-box
+    rules:
+      - alert: BroadcastBoxDown
+        expr: up{job="{{.Job}}"} == 0
+        for: 1m
+        labels:
+          severity: critical
+        annotations:
+          summary: "Broadcast Box {{"{{ $labels.instance }}"}} is down"
+
+      - alert: BroadcastBoxDatabaseUnreachable
+        expr: broadcast_box_database_up{job="{{.Job}}"} == 0
+        for: 1m
+        labels:
+          severity: critical
+        annotations:
+          summary: "Broadcast Box {{"{{ $labels.instance }}"}} can't reach Postgres, publishers can't authenticate"
+
+      - alert: BroadcastBoxStreamDown
+        expr: broadcast_box_stream_live{job="{{.Job}}"} == 0 and on(instance, stream_key) broadcast_box_stream_viewers{job="{{.Job}}"} > 0
+        for: {{.StreamDownFor}}
+        labels:
+          severity: warning
+        annotations:
+          summary: "Stream {{"{{ $labels.stream_key }}"}} has viewers waiting but no publisher"
+
+      - alert: BroadcastBoxPacketLossHigh
+        expr: |
+          rate(broadcast_box_stream_video_packets_lost_total{job="{{.Job}}"}[5m])
+            / (rate(broadcast_box_stream_video_packets_lost_total{job="{{.Job}}"}[5m]) + rate(broadcast_box_stream_video_packets_received_total{job="{{.Job}}"}[5m]))
+            > {{.PacketLoss}}
+        for: 5m
+        labels:
+          severity: warning
+        annotations:
+          summary: "Publisher of {{"{{ $labels.stream_key }}"}} loses {{"{{ $value | humanizePercentage }}"}} of video packets"
+`))
+
+// adminFromRequest authenticates operators with `Authorization: Bearer <ADMIN_TOKEN>`. The admin API
+// is disabled if ADMIN_TOKEN is not set. On failure the error is written to res and false is returned.
+func adminFromRequest(res http.ResponseWriter, req *http.Request) bool {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		logHTTPError(res, "Admin API is disabled", http.StatusNotFound)
+		return false
+	}
+
+	token, ok := extractBearerToken(req.Header.Get("Authorization"))
+	if !ok || len(token) != 1 || subtle.ConstantTimeCompare([]byte(token[0]), []byte(adminToken)) != 1 {
+		logHTTPError(res, "Invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// adminScopeFromRequest authenticates operators like adminFromRequest, and also the admins of a tenant with the
+// admin token of their tenant. tenant is empty for operators, who may manage every tenant.
+func adminScopeFromRequest(res http.ResponseWriter, req *http.Request) (tenant string, ok bool) {
+	if token, ok := extractBearerToken(req.Header.Get("Authorization")); ok && len(token) == 1 && token[0] != "" {
+		if t := webrtc.TenantByAdminToken(dbPool, req.Context(), token[0]); t != nil {
+			return t.Name, true
+		}
+	}
+
+	return "", adminFromRequest(res, req)
+}
+
+// alertRulesHandler renders recommended Prometheus alerting rules for the metrics of this server.
+// Pass `?job=` if Prometheus scrapes Broadcast Box under a job name other than broadcast-box.
+func alertRulesHandler(res http.ResponseWriter, req *http.Request) {
+	if !adminFromRequest(res, req) {
+		return
+	}
+
+	job := req.URL.Query().Get("job")
+	if job == "" {
+		job = defaultAlertJob
+	}
+
+	// Idle publishers are only reaped after WHIP_IDLE_TIMEOUT, don't page before that
+	streamDownFor := "2m"
+	if idleTimeout, err := strconv.Atoi(os.Getenv("WHIP_IDLE_TIMEOUT")); err == nil && idleTimeout > 120 {
+		streamDownFor = strconv.Itoa(idleTimeout) + "s"
+	}
+
+	res.Header().Add("Content-Type", "application/yaml")
+	if err := alertRulesTemplate.Execute(res, map[string]any{
+		"Job":           job,
+		"PacketLoss":    webrtc.PacketLossAlertThreshold,
+		"StreamDownFor": streamDownFor,
+	}); err != nil {
+		log.Println(err)
+	}
+}
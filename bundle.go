@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	bundleTimeout = time.Minute
+
+	// Bundles of a few thousand streamers are a few megabytes
+	maxBundleSize = 64 << 20
+)
+
+// adminBundleHandler exports the configuration of this instance with `GET` and replaces it with `PUT`
+func adminBundleHandler(res http.ResponseWriter, req *http.Request) {
+	if !adminFromRequest(res, req) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		bundle, err := webrtc.ExportBundle(dbPool, req.Context())
+		if err != nil {
+			log.Println(err)
+			logHTTPError(res, "Could not export", http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Add("Content-Type", "application/json")
+		res.Header().Add("Content-Disposition", `attachment; filename="broadcast-box-bundle.json"`)
+		if err := json.NewEncoder(res).Encode(bundle); err != nil {
+			log.Println(err)
+		}
+	case http.MethodPut:
+		var bundle webrtc.Bundle
+		if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxBundleSize)).Decode(&bundle); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := webrtc.ImportBundle(dbPool, req.Context(), &bundle); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runBundle runs `broadcast-box export [file]` and `broadcast-box import <file>` against POSTGRES_URL, the file is
+// stdout or stdin if it is missing or `-`. It returns the exit code.
+func runBundle(command string, args []string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), bundleTimeout)
+	defer cancel()
+
+	pool, err := pgxpool.New(ctx, os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer pool.Close()
+
+	path := "-"
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	if command == "export" {
+		err = exportBundle(ctx, pool, path)
+	} else {
+		err = importBundle(ctx, pool, path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func exportBundle(ctx context.Context, pool *pgxpool.Pool, path string) error {
+	bundle, err := webrtc.ExportBundle(pool, ctx)
+	if err != nil {
+		return err
+	}
+
+	if path == "-" {
+		return encodeBundle(os.Stdout, bundle)
+	}
+
+	// Bundles contain auth tokens, only the owner may read them
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := encodeBundle(f, bundle); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func encodeBundle(w io.Writer, bundle *webrtc.Bundle) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(bundle)
+}
+
+func importBundle(ctx context.Context, pool *pgxpool.Pool, path string) error {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var bundle webrtc.Bundle
+	if err := json.NewDecoder(in).Decode(&bundle); err != nil {
+		return err
+	}
+
+	if err := webrtc.ImportBundle(pool, ctx, &bundle); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Imported the bundle exported at %s\n", bundle.ExportedAt.Format(time.RFC3339))
+	return nil
+}
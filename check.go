@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/patrikrog/broadcast-box/internal/migrations"
+	"github.com/pion/stun/v3"
+)
+
+const checkTimeout = 5 * time.Second
+
+// Tables of the schema the migrations create
+var requiredTables = []string{
+	"streamers", "tenants", "stream_key_usage", "recording_heatmap", "bookmarks", "streamer_notifications",
+	"stream_summaries", "stream_aliases", "stream_settings", "recording_events", "autostart_rules",
+	"recording_jobs", "stream_groups", "recordings", "publish_links", "recording_objects",
+}
+
+type checkReport struct {
+	failed bool
+}
+
+func (r *checkReport) ok(name, format string, a ...any) {
+	fmt.Printf("ok    %-10s %s\n", name, fmt.Sprintf(format, a...))
+}
+
+func (r *checkReport) fail(name, format string, a ...any) {
+	r.failed = true
+	fmt.Printf("FAIL  %-10s %s\n", name, fmt.Sprintf(format, a...))
+}
+
+// runCheck validates the loaded configuration and what it points to without starting the server. It prints
+// a report and returns the exit code, non-zero if any check failed, so it can gate deployments.
+func runCheck() int {
+	report := &checkReport{}
+
+	if _, err := responseHeadersFromEnv(); err != nil {
+		report.fail("config", "%s", err)
+	} else {
+		report.ok("config", "Loaded")
+	}
+
+	checkDatabase(report)
+	checkTLS(report)
+	checkSTUNServers(report)
+
+	if report.failed {
+		return 1
+	}
+	return 0
+}
+
+func checkDatabase(report *checkReport) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(ctx, os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		report.fail("postgres", "Could not connect: %s", err)
+		return
+	}
+	defer conn.Close(context.Background())
+	report.ok("postgres", "Connected")
+
+	rows, err := conn.Query(ctx, `SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()`)
+	if err != nil {
+		report.fail("schema", "Could not list tables: %s", err)
+		return
+	}
+
+	tables, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		report.fail("schema", "Could not list tables: %s", err)
+		return
+	}
+
+	missing := []string{}
+	for _, table := range requiredTables {
+		if !slices.Contains(tables, table) {
+			missing = append(missing, table)
+		}
+	}
+
+	if len(missing) != 0 {
+		report.fail("schema", "Missing tables %s, run broadcast-box migrate", strings.Join(missing, ", "))
+	} else {
+		report.ok("schema", "All %d tables exist", len(requiredTables))
+	}
+
+	pending, err := migrations.Pending(ctx, conn)
+	if err != nil {
+		report.fail("migrations", "Could not list applied migrations: %s", err)
+	} else if len(pending) != 0 {
+		report.fail("migrations", "Pending %s, run broadcast-box migrate", strings.Join(pending, ", "))
+	} else {
+		report.ok("migrations", "All %d migrations applied", len(migrations.Versions()))
+	}
+}
+
+func checkTLS(report *checkReport) {
+	tlsKey, tlsCert := os.Getenv("SSL_KEY"), os.Getenv("SSL_CERT")
+	if tlsKey == "" && tlsCert == "" {
+		return
+	} else if tlsKey == "" || tlsCert == "" {
+		report.fail("tls", "SSL_CERT and SSL_KEY must both be set")
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		report.fail("tls", "%s", err)
+		return
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		report.fail("tls", "%s", err)
+		return
+	}
+
+	if time.Now().After(leaf.NotAfter) {
+		report.fail("tls", "Certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	} else {
+		report.ok("tls", "Certificate valid until %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// checkSTUNServers sends a binding request to every configured STUN server
+func checkSTUNServers(report *checkReport) {
+	stunServers := os.Getenv("STUN_SERVERS")
+	if stunServers == "" {
+		return
+	}
+
+	for _, stunServer := range strings.Split(stunServers, "|") {
+		mappedAddress, err := probeSTUNServer(stunServer)
+		if err != nil {
+			report.fail("stun", "%s: %s", stunServer, err)
+		} else {
+			report.ok("stun", "%s sees this host as %s", stunServer, mappedAddress)
+		}
+	}
+}
+
+func probeSTUNServer(stunServer string) (string, error) {
+	conn, err := net.DialTimeout("udp", stunServer, checkTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(checkTimeout)); err != nil {
+		return "", err
+	}
+
+	request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	if _, err = conn.Write(request.Raw); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	response := &stun.Message{Raw: buf[:n]}
+	if err = response.Decode(); err != nil {
+		return "", err
+	} else if response.Type != stun.BindingSuccess {
+		return "", fmt.Errorf("Unexpected response %s", response.Type)
+	}
+
+	var mappedAddress stun.XORMappedAddress
+	if err = mappedAddress.GetFrom(response); err != nil {
+		return "", err
+	}
+
+	return mappedAddress.String(), nil
+}
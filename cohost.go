@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const defaultCohostInviteLifetime = 10 * 60
+
+type (
+	cohostInviteRequestJSON struct {
+		Guest string `json:"guest"`
+
+		// Lifetime of the invite in seconds
+		ExpiresIn int64 `json:"expiresIn"`
+	}
+
+	cohostInviteResponseJSON struct {
+		Token     string `json:"token"`
+		ExpiresAt int64  `json:"expiresAt"`
+	}
+)
+
+// cohostHandler lets the host of a stream invite a co-host (POST) or remove the current one (DELETE)
+func cohostHandler(res http.ResponseWriter, req *http.Request) {
+	streamer := streamerFromRequest(res, req)
+	if streamer == nil {
+		return
+	} else if streamer.StreamKey != req.PathValue("streamkey") {
+		logHTTPError(res, "Not an authorized streamer", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		r := cohostInviteRequestJSON{ExpiresIn: defaultCohostInviteLifetime}
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		} else if r.ExpiresIn <= 0 {
+			logHTTPError(res, "Invalid invite lifetime", http.StatusBadRequest)
+			return
+		}
+
+		lifetime := time.Duration(r.ExpiresIn) * time.Second
+		token, err := webrtc.CreateCohostInvite(streamer.StreamKey, r.Guest, lifetime)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res.Header().Add("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(cohostInviteResponseJSON{Token: token, ExpiresAt: time.Now().Add(lifetime).Unix()}); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+		}
+	case http.MethodDelete:
+		if err := webrtc.RemoveCohost(streamer.StreamKey); err != nil {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+		}
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// cohostWHIPHandler accepts the WHIP offer of an invited guest, authenticated by `Bearer <inviteToken>`
+func cohostWHIPHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodDelete {
+		return
+	}
+
+	token, ok := extractBearerToken(req.Header.Get("Authorization"))
+	if !ok || len(token) != 1 {
+		logHTTPError(res, "Invalid co-host invite", http.StatusUnauthorized)
+		return
+	}
+
+	offer, err := io.ReadAll(req.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, guestSessionId, err := webrtc.WHIPGuest(req.Context(), string(offer), token[0])
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res.Header().Add("Location", "/api/whip/cohost/"+guestSessionId)
+	res.Header().Add("Content-Type", "application/sdp")
+	res.WriteHeader(http.StatusCreated)
+	fmt.Fprint(res, answer)
+}
+
+// cohostSessionHandler is the resource of a guest, DELETE disconnects it. The unguessable session ID authenticates
+// the guest, its invite token was used up.
+func cohostSessionHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := webrtc.CohostDelete(req.PathValue("guestSessionId"))
+	if errors.Is(err, webrtc.ErrUnknownWHIPSession) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/metrics"
+)
+
+const (
+	defaultSlowQueryThreshold = 500 * time.Millisecond
+
+	// Slow queries are logged up to this many characters
+	maxLoggedQueryLength = 200
+)
+
+// databaseTracer times every query by its operation and logs those slower than its threshold, zero logs none
+type databaseTracer struct {
+	slowQuery time.Duration
+	duration  *metrics.Histogram
+}
+
+type queryStartKey struct{}
+
+type queryStart struct {
+	sql string
+	at  time.Time
+}
+
+// newDatabasePool connects to POSTGRES_URL with every query instrumented, and exposes the stats of the pool
+func newDatabasePool(ctx context.Context) (*pgxpool.Pool, error) {
+	tracer := &databaseTracer{slowQuery: defaultSlowQueryThreshold}
+	if v := os.Getenv("POSTGRES_SLOW_QUERY_MS"); v != "" {
+		ms, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid POSTGRES_SLOW_QUERY_MS %q", v)
+		}
+		tracer.slowQuery = time.Duration(ms) * time.Millisecond
+	}
+
+	config, err := pgxpool.ParseConfig(os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		return nil, err
+	}
+	tracer.duration = metrics.NewHistogram("broadcast_box_postgres_query_duration_seconds", "Time Postgres queries took by operation",
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}, "operation")
+	config.ConnConfig.Tracer = tracer
+
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.NewGaugeFunc("broadcast_box_postgres_connections", "Connections of the Postgres pool by state", func() []metrics.Sample {
+		stat := pool.Stat()
+		return []metrics.Sample{
+			{LabelValues: []string{"in_use"}, Value: float64(stat.AcquiredConns())},
+			{LabelValues: []string{"idle"}, Value: float64(stat.IdleConns())},
+			{LabelValues: []string{"constructing"}, Value: float64(stat.ConstructingConns())},
+		}
+	}, "state")
+	metrics.NewGaugeFunc("broadcast_box_postgres_max_connections", "Connections the Postgres pool may open", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(pool.Stat().MaxConns())}}
+	})
+	metrics.NewCounterFunc("broadcast_box_postgres_acquire_waits_total", "Queries that waited for a connection because the Postgres pool had none idle", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(pool.Stat().EmptyAcquireCount())}}
+	})
+	metrics.NewCounterFunc("broadcast_box_postgres_acquire_wait_seconds_total", "Time queries waited for a connection of the Postgres pool", func() []metrics.Sample {
+		return []metrics.Sample{{Value: pool.Stat().AcquireDuration().Seconds()}}
+	})
+
+	return pool, nil
+}
+
+func (t *databaseTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryStartKey{}, queryStart{sql: data.SQL, at: time.Now()})
+}
+
+func (t *databaseTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(queryStartKey{}).(queryStart)
+	if !ok {
+		return
+	}
+
+	elapsed := time.Since(start.at)
+	t.duration.Observe(elapsed.Seconds(), queryOperation(start.sql))
+
+	if t.slowQuery != 0 && elapsed >= t.slowQuery {
+		query := strings.Join(strings.Fields(start.sql), " ")
+		if len(query) > maxLoggedQueryLength {
+			query = query[:maxLoggedQueryLength] + "..."
+		}
+
+		if data.Err != nil {
+			log.Printf("Slow query took %s and failed (%v): %s", elapsed.Round(time.Millisecond), data.Err, query)
+		} else {
+			log.Printf("Slow query took %s: %s", elapsed.Round(time.Millisecond), query)
+		}
+	}
+}
+
+// queryOperation is the statement type of sql, like select or insert, to label its duration without unbounded label values
+func queryOperation(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "other"
+	}
+
+	switch operation := strings.ToLower(fields[0]); operation {
+	case "select", "insert", "update", "delete", "with", "create", "alter", "drop":
+		return operation
+	}
+	return "other"
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/patrikrog/broadcast-box/internal/playbacktoken"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+// embedTemplate is a dependency free WHEP player meant to be loaded in an iframe.
+// It reconnects automatically when the stream goes away or the connection fails.
+var embedTemplate = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{.StreamKey}}</title>
+    <style>
+      html, body { margin: 0; height: 100%; background: #000; }
+      video { width: 100%; height: 100%; object-fit: contain; }
+    </style>
+  </head>
+  <body>
+    <video id="player" autoplay muted playsinline controls></video>
+    <script>
+      const streamKey = {{.StreamKey}}
+      const token = {{.Token}}
+      const reconnectDelay = 3000
+
+      const watchStream = () => {
+        const peerConnection = new RTCPeerConnection()
+        peerConnection.addTransceiver('audio', { direction: 'recvonly' })
+        peerConnection.addTransceiver('video', { direction: 'recvonly' })
+
+        let reconnecting = false
+        const reconnect = () => {
+          if (reconnecting) {
+            return
+          }
+          reconnecting = true
+
+          peerConnection.close()
+          setTimeout(watchStream, reconnectDelay)
+        }
+
+        peerConnection.ontrack = event => {
+          document.getElementById('player').srcObject = event.streams[0]
+        }
+
+        peerConnection.oniceconnectionstatechange = () => {
+          if (['failed', 'disconnected', 'closed'].includes(peerConnection.iceConnectionState)) {
+            reconnect()
+          }
+        }
+
+        peerConnection.createOffer()
+          .then(offer => peerConnection.setLocalDescription(offer))
+          .then(() => fetch('/api/whep', {
+            method: 'POST',
+            body: peerConnection.localDescription.sdp,
+            headers: {
+              Authorization: 'Bearer ' + streamKey + (token ? ';' + token : ''),
+              'Content-Type': 'application/sdp'
+            }
+          }))
+          .then(r => {
+            if (r.status !== 201) {
+              throw new Error('WHEP request failed with ' + r.status)
+            }
+            return r.text()
+          })
+          .then(answer => peerConnection.setRemoteDescription({ sdp: answer, type: 'answer' }))
+          .catch(err => {
+            console.error(err)
+            reconnect()
+          })
+      }
+
+      watchStream()
+    </script>
+  </body>
+</html>
+`))
+
+func embedHandler(res http.ResponseWriter, req *http.Request) {
+	streamKey := req.PathValue("streamkey")
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+
+	// Tokens and settings belong to the stream key, the player keeps using the alias it was embedded with
+	resolvedStreamKey := resolveStreamKey(req.Context(), streamKey)
+
+	token := req.URL.Query().Get("token")
+	if playbacktoken.Enabled() {
+		if err := playbacktoken.Verify(token, resolvedStreamKey); err != nil {
+			logHTTPError(res, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := webrtc.CheckOriginAllowed(resolvedStreamKey, req.Host, req.Header.Get("Origin"), req.Header.Get("Referer")); err != nil {
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Browsers refuse to show the player on other sites, also if they didn't send a Referer
+	frameAncestors := "*"
+	if settings, err := webrtc.GetStreamSettings(dbPool, req.Context(), resolvedStreamKey); err == nil && len(settings.AllowedOrigins) != 0 {
+		frameAncestors = "'self' " + strings.Join(settings.AllowedOrigins, " ")
+	} else if val := os.Getenv("EMBED_FRAME_ANCESTORS"); val != "" {
+		frameAncestors = strings.Join(strings.Split(val, "|"), " ")
+	}
+
+	res.Header().Set("Content-Security-Policy", "frame-ancestors "+frameAncestors)
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+
+	if err := embedTemplate.Execute(res, struct{ StreamKey, Token string }{streamKey, token}); err != nil {
+		log.Println(err)
+	}
+}
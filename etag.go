@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Read-heavy routes whose Cache-Control can be configured with HTTP_CACHE_CONTROL
+const (
+	cacheRouteStatus     = "status"
+	cacheRouteDirectory  = "directory"
+	cacheRouteStreams    = "streams"
+	cacheRouteRecordings = "recordings"
+
+	// Responses may be stored, but are revalidated with their ETag first
+	defaultCacheControl = "no-cache"
+)
+
+var cacheControls = map[string]string{}
+
+// etagOf is a strong ETag of the JSON representation of v
+func etagOf(v any) string {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// preconditionFailed checks the If-Match and If-None-Match headers of a write against the current ETag
+// of the resource, empty if it doesn't exist. On failure 412 is written to res and true is returned.
+func preconditionFailed(res http.ResponseWriter, req *http.Request, current string) bool {
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, current) {
+		logHTTPError(res, "Resource has been modified", http.StatusPreconditionFailed)
+		return true
+	}
+
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, current) {
+		logHTTPError(res, "Resource already exists", http.StatusPreconditionFailed)
+		return true
+	}
+
+	return false
+}
+
+func etagMatches(header, current string) bool {
+	if current == "" {
+		return false
+	}
+
+	for _, etag := range strings.Split(header, ",") {
+		if etag = strings.TrimSpace(etag); etag == "*" || etag == current {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configureCacheControl reads HTTP_CACHE_CONTROL as `route=Cache-Control` pairs delineated by '|'
+func configureCacheControl() error {
+	if os.Getenv("HTTP_CACHE_CONTROL") == "" {
+		return nil
+	}
+
+	routes := []string{cacheRouteStatus, cacheRouteDirectory, cacheRouteStreams, cacheRouteRecordings}
+	for _, val := range strings.Split(os.Getenv("HTTP_CACHE_CONTROL"), "|") {
+		route, cacheControl, ok := strings.Cut(val, "=")
+		if route = strings.TrimSpace(route); !ok || !slices.Contains(routes, route) {
+			return fmt.Errorf("HTTP_CACHE_CONTROL has an invalid route `%s`, expected one of %s", val, strings.Join(routes, ", "))
+		}
+
+		cacheControls[route] = strings.TrimSpace(cacheControl)
+	}
+
+	return nil
+}
+
+func cacheControlFor(route string) string {
+	if cacheControl, ok := cacheControls[route]; ok {
+		return cacheControl
+	}
+
+	return defaultCacheControl
+}
+
+// writeCacheableJSON writes v with an ETag, and Last-Modified unless lastModified is zero, so CDNs and browsers can
+// revalidate it. Requests with a matching If-None-Match or If-Modified-Since get 304 Not Modified.
+func writeCacheableJSON(res http.ResponseWriter, req *http.Request, cacheControl string, v any, lastModified time.Time) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body = append(body, '\n')
+
+	sum := sha256.Sum256(body)
+	res.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	res.Header().Set("Cache-Control", cacheControl)
+
+	http.ServeContent(res, req, "", lastModified, bytes.NewReader(body))
+}
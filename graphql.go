@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+type graphqlRequestJSON struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables"`
+	OperationName string         `json:"operationName"`
+}
+
+var (
+	graphqlVideoStream = graphql.NewObject(graphql.ObjectConfig{
+		Name: "VideoStream",
+		Fields: graphql.Fields{
+			"rid":              &graphql.Field{Type: graphql.String},
+			"packetsReceived":  &graphql.Field{Type: graphql.Float},
+			"lastKeyFrameSeen": &graphql.Field{Type: graphql.DateTime},
+			"width":            &graphql.Field{Type: graphql.Int},
+			"height":           &graphql.Field{Type: graphql.Int},
+			"bitrate":          &graphql.Field{Type: graphql.Float},
+			"packetLoss":       &graphql.Field{Type: graphql.Float},
+			"targetBitrate":    &graphql.Field{Type: graphql.Float},
+		},
+	})
+
+	graphqlAudioStream = graphql.NewObject(graphql.ObjectConfig{
+		Name: "AudioStream",
+		Fields: graphql.Fields{
+			"id":              &graphql.Field{Type: graphql.String},
+			"language":        &graphql.Field{Type: graphql.String},
+			"packetsReceived": &graphql.Field{Type: graphql.Float},
+		},
+	})
+
+	graphqlSession = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Session",
+		Fields: graphql.Fields{
+			"id":             &graphql.Field{Type: graphql.String},
+			"currentLayer":   &graphql.Field{Type: graphql.String},
+			"packetsWritten": &graphql.Field{Type: graphql.Float},
+			"playoutDelay":   &graphql.Field{Type: graphql.Int},
+		},
+	})
+
+	graphqlStreamStatus = graphql.NewObject(graphql.ObjectConfig{
+		Name: "StreamStatus",
+		Fields: graphql.Fields{
+			"streamer":             &graphql.Field{Type: graphql.String},
+			"firstSeenEpoch":       &graphql.Field{Type: graphql.Float},
+			"audioPacketsReceived": &graphql.Field{Type: graphql.Float},
+			"videoStreams":         &graphql.Field{Type: graphql.NewList(graphqlVideoStream)},
+			"audioStreams":         &graphql.Field{Type: graphql.NewList(graphqlAudioStream)},
+			"sessions": &graphql.Field{
+				Type: graphql.NewList(graphqlSession),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(webrtc.StreamStatus).WHEPSessions, nil
+				},
+			},
+			"cohost": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	graphqlStream = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Stream",
+		Fields: graphql.Fields{
+			"streamKey":    &graphql.Field{Type: graphql.String, Description: "The alias of the stream if it has one"},
+			"live":         &graphql.Field{Type: graphql.Boolean},
+			"streamer":     &graphql.Field{Type: graphql.String},
+			"viewerCount":  &graphql.Field{Type: graphql.Int},
+			"thumbnailUrl": &graphql.Field{Type: graphql.String},
+			"title": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(webrtc.DirectoryEntry).Title, nil
+				},
+			},
+			"description": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(webrtc.DirectoryEntry).Description, nil
+				},
+			},
+			"status": &graphql.Field{
+				Type:        graphqlStreamStatus,
+				Description: "Publisher, tracks and sessions, null if the stream is offline",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					entry := p.Source.(webrtc.DirectoryEntry)
+					if !entry.Live {
+						return nil, nil
+					}
+					return webrtc.GetStreamStatus(resolveStreamKey(p.Context, entry.StreamKey)), nil
+				},
+			},
+		},
+	})
+
+	graphqlStreamSummary = graphql.NewObject(graphql.ObjectConfig{
+		Name: "StreamSummary",
+		Fields: graphql.Fields{
+			"streamKey":           &graphql.Field{Type: graphql.String},
+			"startedAt":           &graphql.Field{Type: graphql.DateTime},
+			"endedAt":             &graphql.Field{Type: graphql.DateTime},
+			"duration":            &graphql.Field{Type: graphql.Int},
+			"peakViewers":         &graphql.Field{Type: graphql.Int},
+			"averageBitrate":      &graphql.Field{Type: graphql.Float},
+			"videoPacketsSkipped": &graphql.Field{Type: graphql.Float},
+			"recordings": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Uploaded recordings of the broadcast with their key and url, encoded as JSON",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					data, err := json.Marshal(p.Source.(webrtc.StreamSummary).Recordings)
+					return string(data), err
+				},
+			},
+			"viewerDevices": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Viewers counted by browser, operating system, device class and video codec, encoded as JSON",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					data, err := json.Marshal(p.Source.(webrtc.StreamSummary).ViewerDevices)
+					return string(data), err
+				},
+			},
+		},
+	})
+
+	graphqlEvent = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Event",
+		Fields: graphql.Fields{
+			"type":      &graphql.Field{Type: graphql.String},
+			"streamKey": &graphql.Field{Type: graphql.String},
+			"streamer":  &graphql.Field{Type: graphql.String},
+			"time":      &graphql.Field{Type: graphql.DateTime},
+			"data": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Event specific data encoded as JSON",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					e := p.Source.(events.Event)
+					if e.Data == nil {
+						return nil, nil
+					}
+
+					data, err := json.Marshal(e.Data)
+					return string(data), err
+				},
+			},
+		},
+	})
+
+	graphqlSchema = mustGraphQLSchema()
+)
+
+func mustGraphQLSchema() graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"streams": &graphql.Field{
+					Type: graphql.NewList(graphqlStream),
+					Args: graphql.FieldConfigArgument{
+						"liveOnly": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+					},
+					Resolve: func(p graphql.ResolveParams) (any, error) {
+						streamKeys, err := store.GetStreamKeys(p.Context)
+						if err != nil {
+							return nil, err
+						}
+
+						return publicDirectory(p.Context, webrtc.ExpandStreamKeys(streamKeys), p.Args["liveOnly"].(bool))
+					},
+				},
+				"stream": &graphql.Field{
+					Type: graphqlStream,
+					Args: graphql.FieldConfigArgument{
+						"streamKey": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					},
+					Resolve: func(p graphql.ResolveParams) (any, error) {
+						entries, err := publicDirectory(p.Context, []string{resolveStreamKey(p.Context, p.Args["streamKey"].(string))}, false)
+						if err != nil {
+							return nil, err
+						}
+						return entries[0], nil
+					},
+				},
+				"summaries": &graphql.Field{
+					Type:        graphql.NewList(graphqlStreamSummary),
+					Description: "Most recent broadcasts on a stream key",
+					Args: graphql.FieldConfigArgument{
+						"streamKey": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					},
+					Resolve: func(p graphql.ResolveParams) (any, error) {
+						return webrtc.GetStreamKeySummaries(dbPool, p.Context, p.Args["streamKey"].(string))
+					},
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"events": &graphql.Field{
+					Type:        graphqlEvent,
+					Description: "Stream events as they happen, optionally only of one stream key",
+					Args: graphql.FieldConfigArgument{
+						"streamKey": &graphql.ArgumentConfig{Type: graphql.String},
+					},
+					Resolve: func(p graphql.ResolveParams) (any, error) {
+						return p.Source, nil
+					},
+					Subscribe: func(p graphql.ResolveParams) (any, error) {
+						streamKey, _ := p.Args["streamKey"].(string)
+
+						// Never closed, handlers may still be running after unsubscribing
+						c := make(chan any, 16)
+						unsubscribe := events.Subscribe(func(e events.Event) {
+							if streamKey != "" && e.StreamKey != streamKey {
+								return
+							}
+
+							select {
+							case c <- e:
+							default:
+							}
+						})
+
+						go func() {
+							<-p.Context.Done()
+							unsubscribe()
+						}()
+
+						return c, nil
+					},
+				},
+			},
+		}),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return schema
+}
+
+// graphqlHandler serves the GraphQL API for dashboards. Queries are POSTed as JSON, subscriptions
+// are answered as Server-Sent Events if the request accepts `text/event-stream`.
+func graphqlHandler(res http.ResponseWriter, req *http.Request) {
+	if !adminFromRequest(res, req) {
+		return
+	}
+
+	var r graphqlRequestJSON
+	if req.Method == http.MethodGet {
+		r.Query = req.URL.Query().Get("query")
+		r.OperationName = req.URL.Query().Get("operationName")
+	} else if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params := graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  r.Query,
+		VariableValues: r.Variables,
+		OperationName:  r.OperationName,
+		Context:        req.Context(),
+	}
+
+	if !strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		res.Header().Add("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(graphql.Do(params)); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		logHTTPError(res, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	results := graphql.Subscribe(params)
+	defer func() {
+		// The subscription blocks until its results are read
+		go func() {
+			for range results {
+			}
+		}()
+	}()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case result, ok := <-results:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(result)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			fmt.Fprint(res, "event: next\n")
+			fmt.Fprintf(res, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+// Stream keys a single group may have
+const maxStreamGroupKeys = 100
+
+// groupStatusHandler returns the live status of every stream key of a group, for event pages showing all stages
+func groupStatusHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	group, err := webrtc.GetStreamGroup(dbPool, req.Context(), req.PathValue("name"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		logHTTPError(res, "Group does not exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, "Could not get group", http.StatusInternalServerError)
+		return
+	}
+
+	writeCacheableJSON(res, req, cacheControlFor(cacheRouteStatus), webrtc.GetStreamGroupStatus(group), time.Time{})
+}
+
+// portalGroupsHandler manages the stream groups of the streamer. A group bundles the stream keys of an event, like
+// the stages of a conference, with one status endpoint, combined analytics and one webhook.
+func portalGroupsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	name := req.PathValue("name")
+	switch req.Method {
+	case http.MethodPut:
+		var g webrtc.StreamGroup
+		if err := json.NewDecoder(req.Body).Decode(&g); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g.Name = name
+
+		if !validateStreamKey(g.Name) {
+			logHTTPError(res, "Invalid group name format", http.StatusBadRequest)
+			return
+		} else if len(g.StreamKeys) == 0 || len(g.StreamKeys) > maxStreamGroupKeys {
+			logHTTPError(res, fmt.Sprintf("Group must have between 1 and %d stream keys", maxStreamGroupKeys), http.StatusBadRequest)
+			return
+		}
+
+		for _, streamKey := range g.StreamKeys {
+			if streamKey == "" {
+				logHTTPError(res, "Stream key was not set", http.StatusBadRequest)
+				return
+			} else if !ownsStreamKey(res, req, account, streamKey) {
+				return
+			}
+		}
+
+		if err := webrtc.PutStreamGroup(dbPool, req.Context(), account.Name, g); errors.Is(err, webrtc.ErrStreamGroupTaken) {
+			logHTTPError(res, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(g); err != nil {
+			log.Println(err)
+		}
+	case http.MethodDelete:
+		if err := webrtc.DeleteStreamGroup(dbPool, req.Context(), account.Name, name); err != nil {
+			logHTTPError(res, "Group does not exist", http.StatusNotFound)
+			return
+		}
+	default:
+		groups, err := webrtc.GetStreamGroups(dbPool, req.Context(), account.Name)
+		if err != nil {
+			logHTTPError(res, "Could not get groups", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(groups); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+// portalGroupAnalyticsHandler combines the summaries of the recent broadcasts of every stream key of a group
+func portalGroupAnalyticsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	groups, err := webrtc.GetStreamGroups(dbPool, req.Context(), account.Name)
+	if err != nil {
+		logHTTPError(res, "Could not get groups", http.StatusInternalServerError)
+		return
+	}
+
+	for _, g := range groups {
+		if g.Name != req.PathValue("name") {
+			continue
+		}
+
+		analytics, err := webrtc.GetStreamGroupAnalytics(dbPool, req.Context(), &g)
+		if err != nil {
+			logHTTPError(res, "Could not get stream summaries", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(analytics); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	logHTTPError(res, "Group does not exist", http.StatusNotFound)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// responseHeadersFromEnv returns the headers operators configured to be sent with every response.
+// HTTP_RESPONSE_HEADERS lists `Name: value` pairs delineated by '|', HTTP_SERVER_NAME sets the Server header.
+func responseHeadersFromEnv() (http.Header, error) {
+	headers := http.Header{}
+
+	if val := os.Getenv("HTTP_RESPONSE_HEADERS"); val != "" {
+		for _, header := range strings.Split(val, "|") {
+			name, value, ok := strings.Cut(header, ":")
+			name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+			if !ok || name == "" || strings.ContainsAny(name, " \t") {
+				return nil, fmt.Errorf("HTTP_RESPONSE_HEADERS has an invalid header `%s`, expected `Name: value`", header)
+			}
+
+			headers.Add(name, value)
+		}
+	}
+
+	if val := os.Getenv("HTTP_SERVER_NAME"); val != "" {
+		headers.Set("Server", val)
+	}
+
+	return headers, nil
+}
+
+// responseHeadersHandler adds headers to every response of next. Handlers that set one of the headers
+// themselves, like the Content-Security-Policy of embeds, replace the configured value.
+func responseHeadersHandler(headers http.Header, next http.Handler) http.Handler {
+	if len(headers) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		for name, values := range headers {
+			res.Header()[name] = append([]string(nil), values...)
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+type (
+	heartbeatRequestJSON struct {
+		// Empty on the first heartbeat
+		ViewerID string `json:"viewerId"`
+		Output   string `json:"output"`
+	}
+
+	heartbeatResponseJSON struct {
+		ViewerID string `json:"viewerId"`
+		// Seconds until the next heartbeat is expected
+		Interval int64 `json:"interval"`
+	}
+)
+
+// heartbeatHandler counts viewers of HTTP outputs like HLS, which have no connection Broadcast Box could see.
+// Players POST a heartbeat every interval and DELETE /api/heartbeat/{streamkey}/{viewerid} when they stop.
+func heartbeatHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	streamKey := req.PathValue("streamkey")
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+	streamKey = resolveStreamKey(req.Context(), streamKey)
+
+	switch req.Method {
+	case http.MethodPost:
+		var r heartbeatRequestJSON
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		viewerId, err := webrtc.HTTPViewerHeartbeat(streamKey, r.ViewerID, r.Output, req.UserAgent())
+		if errors.Is(err, webrtc.ErrHTTPViewerOutput) {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		} else if errors.Is(err, webrtc.ErrOutputNotAllowed) {
+			logHTTPError(res, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(heartbeatResponseJSON{ViewerID: viewerId, Interval: int64(webrtc.HTTPViewerInterval().Seconds())}); err != nil {
+			log.Println(err)
+		}
+	case http.MethodDelete:
+		if err := webrtc.HTTPViewerLeave(streamKey, req.PathValue("viewerid")); err != nil {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+// Request IDs of proxies in front of Broadcast Box are kept, anything that doesn't look like one is replaced
+var validRequestId = regexp.MustCompile(`^[a-zA-Z0-9_\-\.:]{1,128}$`)
+
+// errorJSON is the body of every error response, as application/problem+json
+type errorJSON struct {
+	// Code is derived from the status, e.g. `not_found`, so clients don't have to parse Message
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+func logHTTPError(w http.ResponseWriter, err string, code int) {
+	logHTTPErrorDetails(w, err, code, nil)
+}
+
+// logHTTPErrorDetails is logHTTPError with details for clients, like the limit a request exceeded
+func logHTTPErrorDetails(w http.ResponseWriter, err string, code int, details any) {
+	requestId := w.Header().Get(requestIdHeader)
+	if requestId != "" {
+		log.Printf("%s (request %s)", err, requestId)
+	} else {
+		log.Println(err)
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	if encodeErr := json.NewEncoder(w).Encode(errorJSON{
+		Code:      strings.ReplaceAll(strings.ToLower(http.StatusText(code)), " ", "_"),
+		Message:   err,
+		Details:   details,
+		RequestId: requestId,
+	}); encodeErr != nil {
+		log.Println(encodeErr)
+	}
+}
+
+// requestIdHandler gives every request an X-Request-Id, sent back with the response and in the body of errors
+func requestIdHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requestId := req.Header.Get(requestIdHeader)
+		if !validRequestId.MatchString(requestId) {
+			requestId = uuid.New().String()
+		}
+		res.Header().Set(requestIdHeader, requestId)
+
+		next.ServeHTTP(res, req)
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/playbacktoken"
+	"github.com/patrikrog/broadcast-box/internal/turn"
+)
+
+// iceConfigHandler returns the ICE servers a viewer passes to its RTCPeerConnection, with TURN credentials of its
+// own. With PLAYBACK_TOKEN_SECRET it takes the same `Authorization: Bearer <streamkey>;<token>` as WHEP, and the
+// credentials expire with the playback token.
+func iceConfigHandler(res http.ResponseWriter, req *http.Request) {
+	token, ok := extractBearerToken(req.Header.Get("Authorization"))
+	if !ok || !validateStreamKey(token[0]) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+
+	notAfter := time.Time{}
+	if playbacktoken.Enabled() {
+		if len(token) != 2 {
+			logHTTPError(res, "Playback token was not set", http.StatusUnauthorized)
+			return
+		}
+
+		expiresAt, err := playbacktoken.ExpiresAt(token[1], token[0])
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusForbidden)
+			return
+		}
+		notAfter = expiresAt
+	}
+
+	config, err := turn.Config(resolveStreamKey(req.Context(), token[0]), notAfter)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(res).Encode(config); err != nil {
+		log.Println(err)
+	}
+}
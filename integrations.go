@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/patrikrog/broadcast-box/internal/integrations"
+)
+
+// integrationEventsHandler is the polling trigger for Zapier and IFTTT. It lists the recent events of the
+// streamer's stream keys newest first, `?event=stream_started` only lists one kind.
+func integrationEventsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := accountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	streamKeys, err := store.StreamerStreamKeys(req.Context(), account.AuthToken)
+	if err != nil {
+		logHTTPError(res, "Could not get stream keys", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(integrations.Recent(streamKeys, req.URL.Query().Get("event"))); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,207 @@
+// Package autostart runs actions like recording or restreaming whenever a streamer goes live
+package autostart
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+const (
+	ActionRecord   = "record"
+	ActionRestream = "restream"
+
+	autostartTimeout = 30 * time.Second
+)
+
+// Rule starts Action when the streamer goes live on StreamKey, or any of their stream keys if StreamKey is empty
+type Rule struct {
+	ID        int64  `json:"id"`
+	StreamKey string `json:"streamKey,omitempty"`
+	Action    string `json:"action"`
+	// Restream destination, like rtmp://live.twitch.tv/app/<key>
+	Target string `json:"target,omitempty"`
+}
+
+// Handler starts the action of rule for a stream that just went live
+type Handler func(streamKey string, rule Rule) error
+
+var (
+	// ErrNoRestreamer is returned for restream rules while no handler pushes streams to their target
+	ErrNoRestreamer = errors.New("Restreaming is not supported, no restreamer is configured")
+
+	handlers     = map[string]Handler{}
+	handlersLock sync.RWMutex
+)
+
+// RegisterAction sets the handler that runs rules of action. Record rules without a handler are only
+// published as stream.autostart events, so an external service can act on them. Restream rules can only
+// be created once a handler for them is registered.
+func RegisterAction(action string, handler Handler) {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	handlers[action] = handler
+}
+
+// Configure evaluates the rules of every streamer that goes live. Rules whose action outputAllowed refuses for the
+// stream key are skipped, so nothing records or restreams what the streamer doesn't allow.
+func Configure(pool *pgxpool.Pool, outputAllowed func(streamKey, action string) error) {
+	events.Subscribe(func(e events.Event) {
+		if e.Type != events.StreamStart || e.Streamer == "" {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), autostartTimeout)
+		defer cancel()
+
+		rules, err := Get(pool, ctx, e.Streamer)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, rule := range rules {
+			if rule.StreamKey != "" && rule.StreamKey != e.StreamKey {
+				continue
+			} else if rule.Action == ActionRestream && !registered(ActionRestream) {
+				// Rules created before restream rules were refused, or imported from a bundle
+				log.Printf("Autostart %s for %s skipped: %v", rule.Action, e.StreamKey, ErrNoRestreamer)
+				continue
+			} else if err := outputAllowed(e.StreamKey, rule.Action); err != nil {
+				log.Printf("Autostart %s for %s skipped: %v", rule.Action, e.StreamKey, err)
+				continue
+			}
+
+			events.Publish(events.Event{Type: events.Autostart, StreamKey: e.StreamKey, Streamer: e.Streamer, Data: rule})
+
+			handlersLock.RLock()
+			handler, ok := handlers[rule.Action]
+			handlersLock.RUnlock()
+
+			if ok {
+				if err := handler(e.StreamKey, rule); err != nil {
+					log.Printf("Autostart %s for %s failed: %v", rule.Action, e.StreamKey, err)
+				}
+			}
+		}
+	})
+}
+
+// registered reports if a handler runs rules of action
+func registered(action string) bool {
+	handlersLock.RLock()
+	defer handlersLock.RUnlock()
+
+	_, ok := handlers[action]
+	return ok
+}
+
+func Get(pool *pgxpool.Pool, ctx context.Context, streamer string) ([]Rule, error) {
+	query := `SELECT id, stream_key, action, target FROM autostart_rules
+		 WHERE streamer = @streamer
+		 ORDER BY id`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{"streamer": streamer})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Rule, error) {
+		var r Rule
+		err := row.Scan(&r.ID, &r.StreamKey, &r.Action, &r.Target)
+		return r, err
+	})
+}
+
+func Add(pool *pgxpool.Pool, ctx context.Context, streamer string, r Rule) (*Rule, error) {
+	if err := validate(r); err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO autostart_rules (streamer, stream_key, action, target)
+		 VALUES (@streamer, @streamKey, @action, @target)
+		 RETURNING id`
+	if err := pool.QueryRow(ctx, query, pgx.NamedArgs{
+		"streamer":  streamer,
+		"streamKey": r.StreamKey,
+		"action":    r.Action,
+		"target":    r.Target,
+	}).Scan(&r.ID); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func Delete(pool *pgxpool.Pool, ctx context.Context, streamer string, id int64) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM autostart_rules WHERE id = @id AND streamer = @streamer`, pgx.NamedArgs{
+		"id":       id,
+		"streamer": streamer,
+	})
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetRule returns the rule id of streamer, pgx.ErrNoRows if there is none
+func GetRule(pool *pgxpool.Pool, ctx context.Context, streamer string, id int64) (*Rule, error) {
+	query := `SELECT id,stream_key,action,target FROM autostart_rules
+		 WHERE id = @id AND streamer = @streamer`
+	var r Rule
+	if err := pool.QueryRow(ctx, query, pgx.NamedArgs{
+		"id":       id,
+		"streamer": streamer,
+	}).Scan(&r.ID, &r.StreamKey, &r.Action, &r.Target); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// Update replaces the rule with the ID of r, pgx.ErrNoRows if the streamer has no such rule
+func Update(pool *pgxpool.Pool, ctx context.Context, streamer string, r Rule) (*Rule, error) {
+	if err := validate(r); err != nil {
+		return nil, err
+	}
+
+	tag, err := pool.Exec(ctx, `UPDATE autostart_rules
+		 SET stream_key = @streamKey, action = @action, target = @target
+		 WHERE id = @id AND streamer = @streamer`, pgx.NamedArgs{
+		"id":        r.ID,
+		"streamer":  streamer,
+		"streamKey": r.StreamKey,
+		"action":    r.Action,
+		"target":    r.Target,
+	})
+	if err != nil {
+		return nil, err
+	} else if tag.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+
+	return &r, nil
+}
+
+func validate(r Rule) error {
+	switch {
+	case r.Action != ActionRecord && r.Action != ActionRestream:
+		return errors.New("Rule action must be record or restream")
+	case r.Action == ActionRestream && !registered(ActionRestream):
+		return ErrNoRestreamer
+	case r.Action == ActionRestream && !strings.Contains(r.Target, "://"):
+		return errors.New("Restream rules require a target URL")
+	}
+
+	return nil
+}
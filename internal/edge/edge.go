@@ -0,0 +1,131 @@
+// Package edge picks the edge node of a clustered deployment that is closest to a viewer, by latency the
+// player measured or by the country a load balancer or CDN determined from the viewer's IP
+package edge
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Reasons a node was selected
+const (
+	ReasonLatency = "latency"
+	ReasonCountry = "country"
+	ReasonDefault = "default"
+)
+
+type (
+	// Node is an edge of the cluster
+	Node struct {
+		Name      string   `json:"name"`
+		URL       string   `json:"url"`
+		Countries []string `json:"countries,omitempty"`
+	}
+
+	// Selection is the node picked for a viewer, with every node so players can measure latency to them
+	Selection struct {
+		Node
+		Reason string `json:"reason"`
+		Nodes  []Node `json:"nodes"`
+	}
+)
+
+var (
+	nodes []Node
+
+	// Name of this instance among nodes, and if WHEP requests are redirected to the selected node
+	self     string
+	redirect bool
+
+	// Header a load balancer or CDN sets to the viewer's ISO 3166 country, like CF-IPCountry
+	countryHeader string
+)
+
+// Configure reads EDGE_NODES as `name=url;countries` delineated by '|', like
+// `eu=https://eu.example.com;DE,FR,GB|us=https://us.example.com;US,CA`. Edge selection is disabled if it isn't set.
+func Configure() error {
+	nodes = nil
+	if os.Getenv("EDGE_NODES") == "" {
+		return nil
+	}
+
+	for _, val := range strings.Split(os.Getenv("EDGE_NODES"), "|") {
+		name, rest, ok := strings.Cut(val, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("EDGE_NODES has an invalid node `%s`, expected `name=url;countries`", val)
+		}
+
+		url, countries, _ := strings.Cut(rest, ";")
+		node := Node{Name: name, URL: strings.TrimSuffix(url, "/")}
+		for _, country := range strings.Split(countries, ",") {
+			if country = strings.ToUpper(strings.TrimSpace(country)); country != "" {
+				node.Countries = append(node.Countries, country)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+
+	self, redirect = os.Getenv("EDGE_NAME"), os.Getenv("EDGE_REDIRECT") == "true"
+	countryHeader = os.Getenv("EDGE_COUNTRY_HEADER")
+	if redirect && !slices.ContainsFunc(nodes, func(n Node) bool { return n.Name == self }) {
+		return errors.New("EDGE_NAME must be one of EDGE_NODES to redirect")
+	}
+
+	return nil
+}
+
+func Enabled() bool {
+	return len(nodes) != 0
+}
+
+// Select picks the node for the viewer of req. Round trip times in milliseconds the player measured to the
+// nodes are passed as `?rtt=eu:40,us:120` and win over the country of the viewer. Without either the
+// first node is selected.
+func Select(req *http.Request) Selection {
+	selection := Selection{Node: nodes[0], Reason: ReasonDefault, Nodes: nodes}
+
+	bestRTT := -1.0
+	for _, measurement := range strings.Split(req.URL.Query().Get("rtt"), ",") {
+		name, val, _ := strings.Cut(measurement, ":")
+		rtt, err := strconv.ParseFloat(val, 64)
+		if err != nil || rtt < 0 || (bestRTT >= 0 && rtt >= bestRTT) {
+			continue
+		}
+
+		if i := slices.IndexFunc(nodes, func(n Node) bool { return n.Name == name }); i != -1 {
+			selection.Node, selection.Reason, bestRTT = nodes[i], ReasonLatency, rtt
+		}
+	}
+	if bestRTT >= 0 {
+		return selection
+	}
+
+	if countryHeader != "" {
+		country := strings.ToUpper(req.Header.Get(countryHeader))
+		if i := slices.IndexFunc(nodes, func(n Node) bool { return slices.Contains(n.Countries, country) }); i != -1 {
+			selection.Node, selection.Reason = nodes[i], ReasonCountry
+		}
+	}
+
+	return selection
+}
+
+// RedirectURL returns where a WHEP request should go instead, if EDGE_REDIRECT is enabled and another
+// node is better for the viewer. Viewers without latency measurements or a known country stay.
+func RedirectURL(req *http.Request) (string, bool) {
+	if !redirect {
+		return "", false
+	}
+
+	selection := Select(req)
+	if selection.Reason == ReasonDefault || selection.Name == self {
+		return "", false
+	}
+
+	return selection.URL + req.URL.RequestURI(), true
+}
@@ -0,0 +1,161 @@
+// Package eventbus publishes stream events to NATS or Kafka, for platforms that consume events in their
+// own streaming pipelines instead of via webhooks.
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// StreamStats is only published to the event bus, webhooks would be flooded by it
+	StreamStats = "stream.stats"
+
+	defaultSubject = "broadcast-box.{type}"
+	publishTimeout = 10 * time.Second
+)
+
+type publisher interface {
+	publish(ctx context.Context, subject, key string, body []byte) error
+	close() error
+}
+
+// The publisher of EVENT_BUS_URL, nil if it isn't set
+var bus publisher
+
+type natsPublisher struct {
+	conn *nats.Conn
+}
+
+func (n *natsPublisher) publish(_ context.Context, subject, _ string, body []byte) error {
+	return n.conn.Publish(subject, body)
+}
+
+// close sends the messages that are still buffered
+func (n *natsPublisher) close() error {
+	return n.conn.Drain()
+}
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// Messages are keyed by stream key so events of a stream stay in order
+func (k *kafkaPublisher) publish(ctx context.Context, topic, key string, body []byte) error {
+	return k.writer.WriteMessages(ctx, kafka.Message{Topic: topic, Key: []byte(key), Value: body})
+}
+
+func (k *kafkaPublisher) close() error {
+	return k.writer.Close()
+}
+
+// Configure publishes every event to the NATS server or Kafka brokers in EVENT_BUS_URL, on the subject (or
+// topic) EVENT_BUS_SUBJECT. If EVENT_BUS_STATS_INTERVAL is set the status of live streams is published as
+// stream.stats events every that many seconds.
+func Configure() error {
+	if os.Getenv("EVENT_BUS_URL") == "" {
+		return nil
+	}
+
+	p, err := newPublisher(os.Getenv("EVENT_BUS_URL"))
+	if err != nil {
+		return err
+	}
+	bus = p
+
+	subject := os.Getenv("EVENT_BUS_SUBJECT")
+	if subject == "" {
+		subject = defaultSubject
+	}
+
+	events.Subscribe(func(e events.Event) {
+		publish(p, subject, e)
+	})
+
+	if val := os.Getenv("EVENT_BUS_STATS_INTERVAL"); val != "" {
+		interval, err := strconv.Atoi(val)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("Invalid EVENT_BUS_STATS_INTERVAL %s", val)
+		}
+
+		go publishStats(p, subject, time.Duration(interval)*time.Second)
+	}
+
+	return nil
+}
+
+// Close disconnects from the event bus once the events in flight were sent
+func Close() error {
+	if bus == nil {
+		return nil
+	}
+
+	return bus.close()
+}
+
+func newPublisher(busURL string) (publisher, error) {
+	u, err := url.Parse(busURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "nats", "tls":
+		conn, err := nats.Connect(busURL, nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, err
+		}
+
+		return &natsPublisher{conn: conn}, nil
+	case "kafka":
+		return &kafkaPublisher{writer: &kafka.Writer{
+			Addr:                   kafka.TCP(strings.Split(u.Host, ",")...),
+			Balancer:               &kafka.Hash{},
+			AllowAutoTopicCreation: true,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported EVENT_BUS_URL scheme %s, expected nats or kafka", u.Scheme)
+	}
+}
+
+func publish(p publisher, subject string, e events.Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	subject = strings.ReplaceAll(subject, "{type}", e.Type)
+	if err := p.publish(ctx, subject, e.StreamKey, body); err != nil {
+		log.Printf("Event bus publish to %s failed: %v", subject, err)
+	}
+}
+
+func publishStats(p publisher, subject string, interval time.Duration) {
+	for range time.NewTicker(interval).C {
+		for streamKey, status := range webrtc.LiveStreamStatuses() {
+			publish(p, subject, events.Event{
+				Type:      StreamStats,
+				StreamKey: streamKey,
+				Streamer:  status.Streamer,
+				Time:      time.Now(),
+				Data:      status,
+			})
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Package events distributes stream lifecycle events to subscribers like webhooks and notifications
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	StreamStart = "stream.start"
+	StreamEnd   = "stream.end"
+	CohostJoin  = "stream.cohost.join"
+	CohostLeave = "stream.cohost.leave"
+	Autostart   = "stream.autostart"
+	Metadata    = "stream.metadata"
+	MediaChange = "stream.media.change"
+	// Sent with STREAM_OFFLINE_POLICY=media when a connected publisher stops or resumes sending media
+	StreamOffline = "stream.offline"
+	StreamOnline  = "stream.online"
+	// Sent when the audio or video of a live stream is muted or unmuted
+	StreamMute = "stream.mute"
+	// Sent when a streamer hits the panic button, Data has the action taken
+	StreamPanic = "stream.panic"
+	// Sent when an ad break starts or ends
+	AdBreak = "stream.adbreak"
+	// Sent by Recorders once the file of a recording is complete, Data is its path or URL
+	RecordingFinalized = "recording.finalized"
+	// Sent when a recording left behind by a crashed instance was recovered or could not be
+	RecordingRecovered = "recording.recovered"
+	// Sent when usage of a quota reaches QUOTA_WARNING_PERCENT of its limit, before it is enforced
+	QuotaWarning = "quota.warning"
+)
+
+type Event struct {
+	Type      string    `json:"type"`
+	StreamKey string    `json:"streamKey"`
+	Streamer  string    `json:"streamer,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Time      time.Time `json:"time"`
+	Data      any       `json:"data,omitempty"`
+}
+
+var (
+	handlers      = map[int]func(Event){}
+	nextHandlerId int
+	handlersLock  sync.RWMutex
+)
+
+// Subscribe registers handler to be called for every published event. The returned func
+// unregisters it again.
+func Subscribe(handler func(Event)) func() {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	id := nextHandlerId
+	nextHandlerId++
+	handlers[id] = handler
+
+	return func() {
+		handlersLock.Lock()
+		defer handlersLock.Unlock()
+
+		delete(handlers, id)
+	}
+}
+
+// Publish delivers an event to all subscribers. Handlers run in their own goroutine so slow
+// subscribers never block media.
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	handlersLock.RLock()
+	defer handlersLock.RUnlock()
+
+	for _, handler := range handlers {
+		go handler(e)
+	}
+}
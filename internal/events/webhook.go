@@ -0,0 +1,102 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+
+	SignatureHeader = "X-Broadcast-Box-Signature"
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// ConfigureWebhooks POSTs every event as JSON to the URLs in EVENT_WEBHOOK_URL. If EVENT_WEBHOOK_SECRET
+// is set the body is signed with HMAC-SHA256 in the X-Broadcast-Box-Signature header.
+func ConfigureWebhooks() {
+	if os.Getenv("EVENT_WEBHOOK_URL") == "" {
+		return
+	}
+
+	urls := strings.Split(os.Getenv("EVENT_WEBHOOK_URL"), "|")
+	Subscribe(func(e Event) {
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, url := range urls {
+			if err := PostJSON(url, body); err != nil {
+				log.Printf("Event webhook to %s failed: %v", url, err)
+			}
+		}
+	})
+}
+
+// PostJSON sends a signed JSON body to a webhook
+func PostJSON(url string, body []byte) error {
+	headers := map[string]string{}
+	if signature := Signature(body); signature != "" {
+		headers[SignatureHeader] = signature
+	}
+
+	return post(url, headers, body)
+}
+
+// Signature is the value of the SignatureHeader for a webhook body, empty if EVENT_WEBHOOK_SECRET is not set
+func Signature(body []byte) string {
+	secret := os.Getenv("EVENT_WEBHOOK_SECRET")
+	if secret == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// PostJSONWithAuthorization sends a JSON body to an API that requires an Authorization header
+func PostJSONWithAuthorization(url, authorization string, body []byte) error {
+	headers := map[string]string{}
+	if authorization != "" {
+		headers["Authorization"] = authorization
+	}
+
+	return post(url, headers, body)
+}
+
+func post(url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected HTTP StatusCode %d", res.StatusCode)
+	}
+
+	return nil
+}
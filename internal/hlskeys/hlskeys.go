@@ -0,0 +1,143 @@
+// Package hlskeys encrypts HLS segments with AES-128 keys that rotate per stream. Players fetch the keys
+// from an endpoint gated by playback tokens, so HLS has access control comparable to WHEP.
+package hlskeys
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRotation = 10 * time.Minute
+
+	// Keys stay available this many rotations, so players still find the keys of segments in their playlist
+	retainedRotations = 3
+)
+
+var ErrUnknownKey = errors.New("HLS key does not exist")
+
+// Key encrypts the segments of a stream until it is rotated
+type Key struct {
+	ID        uint64
+	Bytes     []byte
+	CreatedAt time.Time
+}
+
+var (
+	enabled  bool
+	rotation = defaultRotation
+
+	keys     = map[string][]Key{}
+	keysLock sync.Mutex
+)
+
+// Configure enables encryption if HLS_ENCRYPTION is `aes-128`. HLS_KEY_ROTATION sets the seconds a key is used.
+func Configure() error {
+	switch val := os.Getenv("HLS_ENCRYPTION"); val {
+	case "":
+		return nil
+	case "aes-128":
+		enabled = true
+	default:
+		return errors.New("HLS_ENCRYPTION must be aes-128, SAMPLE-AES is not supported")
+	}
+
+	if val := os.Getenv("HLS_KEY_ROTATION"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil || seconds <= 0 {
+			return errors.New("HLS_KEY_ROTATION must be a number of seconds")
+		}
+		rotation = time.Duration(seconds) * time.Second
+	}
+
+	return nil
+}
+
+func Enabled() bool {
+	return enabled
+}
+
+// Current returns the key new segments of streamKey are encrypted with, creating one when the last was rotated
+func Current(streamKey string) (Key, error) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+
+	now := time.Now()
+	streamKeys := keys[streamKey]
+	if len(streamKeys) != 0 && now.Sub(streamKeys[len(streamKeys)-1].CreatedAt) < rotation {
+		return streamKeys[len(streamKeys)-1], nil
+	}
+
+	key := Key{Bytes: make([]byte, aes.BlockSize), CreatedAt: now}
+	if _, err := rand.Read(key.Bytes); err != nil {
+		return Key{}, err
+	}
+	if len(streamKeys) != 0 {
+		key.ID = streamKeys[len(streamKeys)-1].ID + 1
+	}
+
+	for len(streamKeys) != 0 && now.Sub(streamKeys[0].CreatedAt) > rotation*retainedRotations {
+		streamKeys = streamKeys[1:]
+	}
+	keys[streamKey] = append(streamKeys, key)
+
+	return key, nil
+}
+
+// Get returns a key of streamKey that hasn't expired yet
+func Get(streamKey string, id uint64) (Key, error) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+
+	for _, key := range keys[streamKey] {
+		if key.ID == id && time.Since(key.CreatedAt) <= rotation*retainedRotations {
+			return key, nil
+		}
+	}
+
+	return Key{}, ErrUnknownKey
+}
+
+// Forget drops the keys of a stream whose HLS output ended
+func Forget(streamKey string) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+
+	delete(keys, streamKey)
+}
+
+// IV returns the initialization vector of a segment, its media sequence number like HLS does when no IV is given
+func IV(mediaSequence uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], mediaSequence)
+	return iv
+}
+
+// Encrypt encrypts a segment with AES-128-CBC and PKCS7 padding
+func Encrypt(key Key, mediaSequence uint64, segment []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := aes.BlockSize - len(segment)%aes.BlockSize
+	encrypted := append(bytes.Clone(segment), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, IV(mediaSequence)).CryptBlocks(encrypted, encrypted)
+
+	return encrypted, nil
+}
+
+// Tag returns the EXT-X-KEY tag of a playlist for the segments that follow it. keyURI is where players fetch
+// the key, including their playback token. No IV is given, so players use the media sequence number like IV does.
+func Tag(keyURI string) string {
+	return fmt.Sprintf(`#EXT-X-KEY:METHOD=AES-128,URI="%s"`, keyURI)
+}
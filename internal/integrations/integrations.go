@@ -0,0 +1,106 @@
+// Package integrations keeps recent stream events in a flat, stable format for no-code tools like Zapier
+// and IFTTT, which poll for new items instead of receiving webhooks.
+package integrations
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const maxEvents = 500
+
+// Event names of the integration schema. They are part of the public API, never rename them.
+const (
+	StreamStarted = "stream_started"
+	StreamEnded   = "stream_ended"
+	CohostJoined  = "cohost_joined"
+	CohostLeft    = "cohost_left"
+)
+
+// Event is the integration schema. Fields are flat strings so no-code tools can map them directly,
+// new fields may be added but existing ones never change.
+type Event struct {
+	ID           string `json:"id"`
+	Event        string `json:"event"`
+	StreamKey    string `json:"stream_key"`
+	Streamer     string `json:"streamer"`
+	Title        string `json:"title"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	OccurredAt   string `json:"occurred_at"`
+}
+
+var (
+	eventNames = map[string]string{
+		events.StreamStart: StreamStarted,
+		events.StreamEnd:   StreamEnded,
+		events.CohostJoin:  CohostJoined,
+		events.CohostLeave: CohostLeft,
+	}
+
+	// IDs are unique across restarts so pollers never mistake a new event for one they have seen
+	idPrefix = time.Now().UnixNano()
+	nextId   uint64
+
+	recent     []Event
+	recentLock sync.Mutex
+)
+
+// Configure starts keeping the most recent events
+func Configure() {
+	events.Subscribe(func(e events.Event) {
+		name, ok := eventNames[e.Type]
+		if !ok {
+			return
+		}
+
+		title := webrtc.GetStreamMetadata(e.StreamKey).Title
+		if title == "" {
+			title = e.StreamKey
+		}
+
+		url := ""
+		if publicURL := os.Getenv("PUBLIC_URL"); publicURL != "" {
+			url = strings.TrimSuffix(publicURL, "/") + "/" + e.StreamKey
+		}
+
+		recentLock.Lock()
+		defer recentLock.Unlock()
+
+		nextId++
+		recent = append(recent, Event{
+			ID:           fmt.Sprintf("%d-%d", idPrefix, nextId),
+			Event:        name,
+			StreamKey:    e.StreamKey,
+			Streamer:     e.Streamer,
+			Title:        title,
+			URL:          url,
+			ThumbnailURL: webrtc.ThumbnailURL(e.StreamKey),
+			OccurredAt:   e.Time.UTC().Format(time.RFC3339),
+		})
+		if len(recent) > maxEvents {
+			recent = recent[len(recent)-maxEvents:]
+		}
+	})
+}
+
+// Recent returns the events of streamKeys newest first, only events called name if it is not empty
+func Recent(streamKeys []string, name string) []Event {
+	recentLock.Lock()
+	defer recentLock.Unlock()
+
+	matching := []Event{}
+	for i := len(recent) - 1; i >= 0; i-- {
+		if webrtc.MatchStreamKey(streamKeys, recent[i].StreamKey) && (name == "" || recent[i].Event == name) {
+			matching = append(matching, recent[i])
+		}
+	}
+
+	return matching
+}
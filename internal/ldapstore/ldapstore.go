@@ -0,0 +1,248 @@
+// Package ldapstore resolves streamers from LDAP or Active Directory instead of the streamers table.
+// Streamers authenticate with `Authorization: Bearer <streamKey>;<username>:<password>` and may publish to
+// the stream keys of their groups: membership of a group whose CN is LDAP_GROUP_PREFIX followed by a
+// stream key grants that stream key, e.g. broadcast-townhall grants townhall.
+package ldapstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/patrikrog/broadcast-box/internal/plugin"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	defaultUserFilter  = "(&(objectClass=user)(sAMAccountName={username}))"
+	defaultGroupFilter = "(&(objectClass=group)(cn={prefix}*))"
+	defaultGroupPrefix = "broadcast-"
+	defaultCacheTTL    = 5 * time.Minute
+)
+
+var errReadOnly = errors.New("Streamers are managed in LDAP")
+
+type (
+	config struct {
+		url, bindDN, bindPassword, baseDN string
+		userFilter, groupFilter, prefix   string
+		cacheTTL                          time.Duration
+	}
+
+	cachedStreamer struct {
+		name       string
+		streamKeys []string
+		expires    time.Time
+	}
+
+	store struct {
+		config
+
+		// Successful logins by hash of the credentials, so LDAP isn't asked on every request
+		cache     map[[sha256.Size]byte]cachedStreamer
+		cacheLock sync.Mutex
+	}
+)
+
+// New connects to LDAP_URL to verify the configuration, it is registered as the ldap store
+func New() (plugin.Store, error) {
+	c := config{
+		url:          os.Getenv("LDAP_URL"),
+		bindDN:       os.Getenv("LDAP_BIND_DN"),
+		bindPassword: os.Getenv("LDAP_BIND_PASSWORD"),
+		baseDN:       os.Getenv("LDAP_BASE_DN"),
+		userFilter:   valueOrDefault(os.Getenv("LDAP_USER_FILTER"), defaultUserFilter),
+		groupFilter:  valueOrDefault(os.Getenv("LDAP_GROUP_FILTER"), defaultGroupFilter),
+		prefix:       valueOrDefault(os.Getenv("LDAP_GROUP_PREFIX"), defaultGroupPrefix),
+		cacheTTL:     defaultCacheTTL,
+	}
+
+	if c.url == "" || c.baseDN == "" {
+		return nil, errors.New("LDAP_URL and LDAP_BASE_DN are required for the ldap store")
+	}
+
+	if val := os.Getenv("LDAP_CACHE_TTL"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("Invalid LDAP_CACHE_TTL %s", val)
+		}
+		c.cacheTTL = time.Duration(seconds) * time.Second
+	}
+
+	s := &store{config: c, cache: map[[sha256.Size]byte]cachedStreamer{}}
+	conn, err := s.serviceConn()
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+
+	return s, nil
+}
+
+func valueOrDefault(val, fallback string) string {
+	if val == "" {
+		return fallback
+	}
+
+	return val
+}
+
+// serviceConn is bound as LDAP_BIND_DN, or anonymously if it is not set
+func (s *store) serviceConn() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(s.url)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.bindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(s.bindDN, s.bindPassword)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (s *store) streamKeyOfGroup(cn string) (string, bool) {
+	streamKey, ok := strings.CutPrefix(cn, s.prefix)
+	return streamKey, ok && streamKey != ""
+}
+
+// authenticate binds as the user of authToken (`username:password`) and returns their name and stream keys
+func (s *store) authenticate(authToken string) (*cachedStreamer, error) {
+	key := sha256.Sum256([]byte(authToken))
+
+	s.cacheLock.Lock()
+	cached, ok := s.cache[key]
+	s.cacheLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return &cached, nil
+	}
+
+	username, password, ok := strings.Cut(authToken, ":")
+	if !ok || username == "" || password == "" {
+		return nil, errors.New("Auth token must be username:password")
+	}
+
+	conn, err := s.serviceConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		s.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		strings.ReplaceAll(s.userFilter, "{username}", ldap.EscapeFilter(username)),
+		[]string{"cn", "memberOf"}, nil,
+	))
+	if err != nil {
+		return nil, err
+	} else if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("Unknown LDAP user %s", username)
+	}
+
+	user := result.Entries[0]
+	if err := conn.Bind(user.DN, password); err != nil {
+		return nil, err
+	}
+
+	streamer := cachedStreamer{
+		name:       valueOrDefault(user.GetAttributeValue("cn"), username),
+		streamKeys: []string{},
+		expires:    time.Now().Add(s.cacheTTL),
+	}
+	for _, groupDN := range user.GetAttributeValues("memberOf") {
+		dn, err := ldap.ParseDN(groupDN)
+		if err != nil || len(dn.RDNs) == 0 {
+			continue
+		}
+
+		for _, attribute := range dn.RDNs[0].Attributes {
+			if streamKey, ok := s.streamKeyOfGroup(attribute.Value); ok && strings.EqualFold(attribute.Type, "cn") {
+				streamer.streamKeys = append(streamer.streamKeys, streamKey)
+			}
+		}
+	}
+
+	s.cacheLock.Lock()
+	s.cache[key] = streamer
+	s.cacheLock.Unlock()
+
+	return &streamer, nil
+}
+
+func (s *store) GetStreamKeys(_ context.Context) ([]string, error) {
+	conn, err := s.serviceConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		s.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		strings.ReplaceAll(s.groupFilter, "{prefix}", ldap.EscapeFilter(s.prefix)),
+		[]string{"cn"}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	streamKeys := []string{}
+	for _, group := range result.Entries {
+		if streamKey, ok := s.streamKeyOfGroup(group.GetAttributeValue("cn")); ok {
+			streamKeys = append(streamKeys, streamKey)
+		}
+	}
+
+	return streamKeys, nil
+}
+
+func (s *store) Streamer(_ context.Context, streamKey, authToken string) *webrtc.Streamer {
+	streamer, err := s.authenticate(authToken)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LDAP authentication failed: %v\n", err)
+		return nil
+	} else if !webrtc.MatchStreamKey(streamer.streamKeys, streamKey) {
+		return nil
+	}
+
+	return &webrtc.Streamer{Name: streamer.name, AuthToken: authToken, StreamKey: streamKey}
+}
+
+func (s *store) StreamerByAuthToken(_ context.Context, authToken string) *webrtc.Streamer {
+	streamer, err := s.authenticate(authToken)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LDAP authentication failed: %v\n", err)
+		return nil
+	}
+
+	return &webrtc.Streamer{Name: streamer.name, AuthToken: authToken}
+}
+
+func (s *store) StreamerStreamKeys(_ context.Context, authToken string) ([]string, error) {
+	streamer, err := s.authenticate(authToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamer.streamKeys, nil
+}
+
+func (s *store) RotateAuthToken(context.Context, string) (string, error) {
+	return "", errReadOnly
+}
+
+func (s *store) ProvisionStreamer(context.Context, string, string, string, *time.Time, uint64, int) error {
+	return errReadOnly
+}
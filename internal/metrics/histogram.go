@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Histogram counts observations in cumulative buckets, partitioned by label values if it has labels
+type Histogram struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+
+	lock   sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var histograms []*Histogram
+
+// NewHistogram creates and registers a histogram with the given upper bounds. It is exposed by Handler.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+
+	h := &Histogram{name: name, help: help, buckets: buckets, labels: labels, series: map[string]*histogramSeries{}}
+
+	countersLock.Lock()
+	defer countersLock.Unlock()
+
+	histograms = append(histograms, h)
+	return h
+}
+
+// Observe adds a value to the histogram for the given label values, in the order the labels were declared
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("%s expects %d label values", h.name, len(h.labels)))
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key := formatLabels(h.labels, labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	// Histograms without labels are exposed before their first observation
+	if len(h.labels) == 0 && len(h.series) == 0 {
+		h.series[""] = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+	}
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s, labels := h.series[k], k
+		if labels != "" {
+			labels += ","
+		}
+
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, labels, strconv.FormatFloat(bound, 'g', -1, 64), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, labels, s.count)
+
+		if k == "" {
+			fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, s.sum, h.name, s.count)
+		} else {
+			fmt.Fprintf(w, "%s_sum{%s} %g\n%s_count{%s} %d\n", h.name, k, s.sum, h.name, k, s.count)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Package metrics exposes counters, gauges and histograms in the Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	lock   sync.Mutex
+	values map[string]uint64
+}
+
+// Sample is one value of a metric whose values are collected on every scrape
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type funcMetric struct {
+	name, help, kind string
+	labels           []string
+	collect          func() []Sample
+}
+
+var (
+	counters     []*CounterVec
+	funcMetrics  []*funcMetric
+	countersLock sync.Mutex
+)
+
+// NewCounterVec creates and registers a counter. It is exposed by Handler.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]uint64{}}
+
+	countersLock.Lock()
+	defer countersLock.Unlock()
+
+	counters = append(counters, c)
+	return c
+}
+
+// NewGaugeFunc registers a gauge whose values are returned by collect on every scrape
+func NewGaugeFunc(name, help string, collect func() []Sample, labels ...string) {
+	registerFunc(&funcMetric{name: name, help: help, kind: "gauge", labels: labels, collect: collect})
+}
+
+// NewCounterFunc registers a counter whose values are returned by collect on every scrape
+func NewCounterFunc(name, help string, collect func() []Sample, labels ...string) {
+	registerFunc(&funcMetric{name: name, help: help, kind: "counter", labels: labels, collect: collect})
+}
+
+func registerFunc(m *funcMetric) {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+
+	funcMetrics = append(funcMetrics, m)
+}
+
+// Inc increments the counter for the given label values, in the order the labels were declared
+func (c *CounterVec) Inc(labelValues ...string) {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("%s expects %d label values", c.name, len(c.labels)))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.values[formatLabels(c.labels, labelValues)]++
+}
+
+func formatLabels(labels, labelValues []string) string {
+	pairs := make([]string, len(labels))
+	for i := range labels {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labelValues[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, labels[i], value)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, k, c.values[k])
+	}
+}
+
+func (m *funcMetric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	for _, sample := range m.collect() {
+		if len(m.labels) == 0 {
+			fmt.Fprintf(w, "%s %g\n", m.name, sample.Value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %g\n", m.name, formatLabels(m.labels, sample.LabelValues), sample.Value)
+		}
+	}
+}
+
+// Handler serves all registered metrics for Prometheus to scrape
+func Handler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "text/plain; version=0.0.4")
+
+	countersLock.Lock()
+	defer countersLock.Unlock()
+
+	for _, c := range counters {
+		c.write(res)
+	}
+
+	for _, m := range funcMetrics {
+		m.write(res)
+	}
+
+	for _, h := range histograms {
+		h.write(res)
+	}
+}
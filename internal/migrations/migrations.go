@@ -0,0 +1,142 @@
+// Package migrations applies the database schema. Migrations are SQL files embedded in the binary, named by their
+// version like 0002_add_column.sql, and applied in order once each. Applied versions are kept in schema_migrations.
+package migrations
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// Serializes instances applying migrations against the same database at once
+const advisoryLockID = 0x62626d67
+
+// SQLSTATE of queries on a table that doesn't exist
+const undefinedTable = "42P01"
+
+type migration struct {
+	version string
+	sql     string
+}
+
+func load() ([]migration, error) {
+	names, err := fs.Glob(files, "sql/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	migrations := make([]migration, 0, len(names))
+	for _, name := range names {
+		sql, err := files.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: strings.TrimSuffix(path.Base(name), ".sql"), sql: string(sql)})
+	}
+
+	return migrations, nil
+}
+
+// Versions returns the versions of every embedded migration in the order they are applied
+func Versions() []string {
+	migrations, err := load()
+	if err != nil {
+		return nil
+	}
+
+	versions := make([]string, 0, len(migrations))
+	for _, m := range migrations {
+		versions = append(versions, m.version)
+	}
+	return versions
+}
+
+// Apply applies the migrations that weren't yet and returns their versions. Everything happens in one transaction,
+// if a migration fails none of them are applied.
+func Apply(ctx context.Context, db interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}) ([]string, error) {
+	migrations, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx) //nolint
+
+	if _, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, advisoryLockID); err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	appliedVersions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []string{}
+	for _, m := range migrations {
+		if slices.Contains(appliedVersions, m.version) {
+			continue
+		}
+
+		if _, err = tx.Exec(ctx, m.sql); err != nil {
+			return nil, fmt.Errorf("Migration %s failed: %w", m.version, err)
+		} else if _, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, m.version); err != nil {
+			return nil, err
+		}
+		applied = append(applied, m.version)
+	}
+
+	return applied, tx.Commit(ctx)
+}
+
+// Pending returns the versions of the migrations that weren't applied yet
+func Pending(ctx context.Context, db interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}) ([]string, error) {
+	appliedVersions := []string{}
+	rows, err := db.Query(ctx, `SELECT version FROM schema_migrations`)
+	if err == nil {
+		appliedVersions, err = pgx.CollectRows(rows, pgx.RowTo[string])
+	}
+	// Nothing was applied yet if schema_migrations doesn't exist
+	var pgErr *pgconn.PgError
+	if err != nil && !(errors.As(err, &pgErr) && pgErr.Code == undefinedTable) {
+		return nil, err
+	}
+
+	pending := []string{}
+	for _, version := range Versions() {
+		if !slices.Contains(appliedVersions, version) {
+			pending = append(pending, version)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,154 @@
+-- The schema before migrations were embedded. Deployments that created it by hand already have parts of it, so
+-- everything is created only if it doesn't exist, and columns added to a table after it was first documented are added
+-- to tables created before them.
+
+CREATE TABLE IF NOT EXISTS streamers (
+    name        TEXT NOT NULL,
+    auth_token  TEXT NOT NULL,
+    stream_key  TEXT[] NOT NULL,
+    expires_at  TIMESTAMPTZ,
+    max_bitrate BIGINT NOT NULL DEFAULT 0,
+    max_viewers INTEGER NOT NULL DEFAULT 0,
+    record      BOOLEAN NOT NULL DEFAULT false,
+    tenant      TEXT NOT NULL DEFAULT ''
+);
+ALTER TABLE streamers ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE streamers ADD COLUMN IF NOT EXISTS max_bitrate BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE streamers ADD COLUMN IF NOT EXISTS max_viewers INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE streamers ADD COLUMN IF NOT EXISTS record BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE streamers ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS tenants (
+    name        TEXT PRIMARY KEY,
+    admin_token TEXT NOT NULL UNIQUE,
+    max_streams INTEGER NOT NULL DEFAULT 0,
+    max_viewers INTEGER NOT NULL DEFAULT 0,
+    webhook_url TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS stream_key_usage (
+    stream_key        TEXT PRIMARY KEY,
+    last_published_at TIMESTAMPTZ NOT NULL,
+    sessions          BIGINT NOT NULL DEFAULT 0,
+    seconds           BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recording_heatmap (
+    stream_key        TEXT NOT NULL,
+    stream_started_at TIMESTAMPTZ NOT NULL,
+    bucket            BIGINT NOT NULL,
+    views             BIGINT NOT NULL,
+    PRIMARY KEY (stream_key, stream_started_at, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS bookmarks (
+    id                BIGSERIAL PRIMARY KEY,
+    stream_key        TEXT NOT NULL,
+    owner             TEXT NOT NULL,
+    label             TEXT NOT NULL DEFAULT '',
+    stream_started_at TIMESTAMPTZ NOT NULL,
+    media_time        BIGINT NOT NULL,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS bookmarks_owner_stream_key ON bookmarks (owner, stream_key);
+
+CREATE TABLE IF NOT EXISTS streamer_notifications (
+    id        BIGSERIAL PRIMARY KEY,
+    streamer  TEXT NOT NULL,
+    kind      TEXT NOT NULL,
+    bot_token TEXT NOT NULL,
+    channel   TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS stream_summaries (
+    id              BIGSERIAL PRIMARY KEY,
+    streamer        TEXT NOT NULL,
+    stream_key      TEXT NOT NULL,
+    started_at      TIMESTAMPTZ NOT NULL,
+    ended_at        TIMESTAMPTZ NOT NULL,
+    peak_viewers    INTEGER NOT NULL,
+    average_bitrate BIGINT NOT NULL,
+    packets_lost    BIGINT NOT NULL,
+    viewer_devices  JSONB
+);
+ALTER TABLE stream_summaries ADD COLUMN IF NOT EXISTS viewer_devices JSONB;
+CREATE INDEX IF NOT EXISTS stream_summaries_streamer ON stream_summaries (streamer, ended_at);
+
+CREATE TABLE IF NOT EXISTS stream_aliases (
+    alias      TEXT PRIMARY KEY,
+    stream_key TEXT NOT NULL,
+    owner      TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS stream_settings (
+    stream_key TEXT PRIMARY KEY,
+    settings   JSONB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS recording_events (
+    id                BIGSERIAL PRIMARY KEY,
+    stream_key        TEXT NOT NULL,
+    stream_started_at TIMESTAMPTZ NOT NULL,
+    media_time        BIGINT NOT NULL,
+    type              TEXT NOT NULL,
+    data              JSONB
+);
+CREATE INDEX IF NOT EXISTS recording_events_stream_key ON recording_events (stream_key, stream_started_at, media_time);
+
+CREATE TABLE IF NOT EXISTS autostart_rules (
+    id         BIGSERIAL PRIMARY KEY,
+    streamer   TEXT NOT NULL,
+    stream_key TEXT NOT NULL DEFAULT '',
+    action     TEXT NOT NULL,
+    target     TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS recording_jobs (
+    id          BIGSERIAL PRIMARY KEY,
+    stream_key  TEXT NOT NULL,
+    location    TEXT NOT NULL,
+    hook        TEXT NOT NULL,
+    status      TEXT NOT NULL,
+    error       TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS recording_jobs_stream_key ON recording_jobs (stream_key, id);
+
+CREATE TABLE IF NOT EXISTS stream_groups (
+    name        TEXT PRIMARY KEY,
+    owner       TEXT NOT NULL,
+    stream_keys TEXT[] NOT NULL,
+    webhook_url TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS stream_groups_stream_keys ON stream_groups USING GIN (stream_keys);
+
+CREATE TABLE IF NOT EXISTS recordings (
+    id          BIGSERIAL PRIMARY KEY,
+    stream_key  TEXT NOT NULL,
+    recorder    TEXT NOT NULL,
+    state       TEXT NOT NULL,
+    location    TEXT NOT NULL DEFAULT '',
+    error       TEXT NOT NULL DEFAULT '',
+    started_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS recordings_state ON recordings (state, updated_at);
+
+CREATE TABLE IF NOT EXISTS publish_links (
+    token_hash TEXT PRIMARY KEY,
+    stream_key TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS recording_objects (
+    id         BIGSERIAL PRIMARY KEY,
+    stream_key TEXT NOT NULL,
+    object_key TEXT NOT NULL UNIQUE,
+    size       BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS recording_objects_stream_key ON recording_objects (stream_key, created_at);
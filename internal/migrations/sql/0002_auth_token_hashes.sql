@@ -0,0 +1,5 @@
+-- Auth tokens are stored as Argon2id hashes, found by a short prefix of their SHA-256. Existing plaintext tokens keep an
+-- empty lookup until broadcast-box migrate re-hashes them.
+
+ALTER TABLE streamers ADD COLUMN IF NOT EXISTS auth_token_lookup TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS streamers_auth_token_lookup ON streamers (auth_token_lookup);
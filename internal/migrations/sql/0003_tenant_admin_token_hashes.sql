@@ -0,0 +1,5 @@
+-- Admin tokens of tenants are stored as Argon2id hashes like auth tokens, found by a short prefix of their SHA-256.
+-- Existing plaintext tokens keep an empty lookup until broadcast-box migrate re-hashes them.
+
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS admin_token_lookup TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS tenants_admin_token_lookup ON tenants (admin_token_lookup);
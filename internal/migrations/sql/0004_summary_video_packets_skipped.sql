@@ -0,0 +1,4 @@
+-- packets_lost counted the video packets skipped in the sequence numbers of the publisher, retransmissions that
+-- arrived later were never subtracted. It is named after that now.
+
+ALTER TABLE stream_summaries RENAME COLUMN packets_lost TO video_packets_skipped;
@@ -0,0 +1,105 @@
+// Package mqtt publishes whether streams are live and how many viewers they have to an MQTT broker, so
+// home automation like Home Assistant can react when a broadcast starts.
+package mqtt
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	defaultTopicPrefix   = "broadcast-box"
+	viewerUpdateInterval = 5 * time.Second
+	publishTimeout       = 10 * time.Second
+
+	// Quality of service at least once, so state changes aren't lost when the broker is briefly unreachable
+	qos = 1
+)
+
+var (
+	client paho.Client
+	prefix string
+
+	viewerCounts = map[string]int{}
+)
+
+// Configure connects to MQTT_URL. Topics are retained so subscribers get the current state right away:
+//
+//	<prefix>/status               online or offline, the latter set by the broker if Broadcast Box goes away
+//	<prefix>/<streamkey>/state    online or offline
+//	<prefix>/<streamkey>/viewers  number of viewers
+//
+// The broker doesn't need to be up yet, connecting is retried in the background.
+func Configure() {
+	if os.Getenv("MQTT_URL") == "" {
+		return
+	}
+
+	prefix = strings.TrimSuffix(os.Getenv("MQTT_TOPIC_PREFIX"), "/")
+	if prefix == "" {
+		prefix = defaultTopicPrefix
+	}
+
+	statusTopic := prefix + "/status"
+	options := paho.NewClientOptions().
+		AddBroker(os.Getenv("MQTT_URL")).
+		SetClientID(os.Getenv("MQTT_CLIENT_ID")).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(statusTopic, "offline", qos, true).
+		SetOnConnectHandler(func(c paho.Client) {
+			publish(statusTopic, "online")
+		})
+
+	client = paho.NewClient(options)
+	client.Connect()
+
+	events.Subscribe(func(e events.Event) {
+		switch e.Type {
+		case events.StreamStart:
+			publish(prefix+"/"+e.StreamKey+"/state", "online")
+		case events.StreamEnd:
+			publish(prefix+"/"+e.StreamKey+"/state", "offline")
+		}
+	})
+
+	go publishViewerCounts()
+}
+
+func publish(topic, payload string) {
+	token := client.Publish(topic, qos, true, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		log.Printf("MQTT publish to %s timed out", topic)
+	} else if err := token.Error(); err != nil {
+		log.Printf("MQTT publish to %s failed: %v", topic, err)
+	}
+}
+
+// publishViewerCounts publishes the viewer count of a stream whenever it changed, and 0 once it ended
+func publishViewerCounts() {
+	for range time.NewTicker(viewerUpdateInterval).C {
+		current := map[string]int{}
+		for streamKey, status := range webrtc.LiveStreamStatuses() {
+			current[streamKey] = status.Viewers()
+		}
+
+		for streamKey := range viewerCounts {
+			if _, ok := current[streamKey]; !ok {
+				publish(prefix+"/"+streamKey+"/viewers", "0")
+			}
+		}
+		for streamKey, count := range current {
+			if previous, ok := viewerCounts[streamKey]; !ok || previous != count {
+				publish(prefix+"/"+streamKey+"/viewers", strconv.Itoa(count))
+			}
+		}
+		viewerCounts = current
+	}
+}
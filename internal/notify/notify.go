@@ -0,0 +1,172 @@
+// Package notify posts "now live" messages to Discord and Telegram channels configured by streamers
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	KindDiscord  = "discord"
+	KindTelegram = "telegram"
+
+	notifyTimeout = 30 * time.Second
+)
+
+var (
+	discordChannelPattern = regexp.MustCompile(`^\d+$`)
+	telegramTokenPattern  = regexp.MustCompile(`^\d+:[A-Za-z0-9_-]+$`)
+)
+
+type Notification struct {
+	ID       int64  `json:"id"`
+	Kind     string `json:"kind"`
+	BotToken string `json:"botToken,omitempty"`
+	// Discord channel ID or Telegram chat ID
+	Channel string `json:"channel"`
+}
+
+// Configure sends notifications for every stream that goes live
+func Configure(pool *pgxpool.Pool) {
+	events.Subscribe(func(e events.Event) {
+		if e.Type != events.StreamStart || e.Streamer == "" {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+
+		notifications, err := Get(pool, ctx, e.Streamer)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, n := range notifications {
+			if err := send(n, e.StreamKey, e.Streamer); err != nil {
+				log.Printf("%s notification for %s failed: %v", n.Kind, e.StreamKey, err)
+			}
+		}
+	})
+}
+
+func Get(pool *pgxpool.Pool, ctx context.Context, streamer string) ([]Notification, error) {
+	query := `SELECT id, kind, bot_token, channel FROM streamer_notifications
+		 WHERE streamer = @streamer
+		 ORDER BY id`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{"streamer": streamer})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Notification, error) {
+		var n Notification
+		err := row.Scan(&n.ID, &n.Kind, &n.BotToken, &n.Channel)
+		return n, err
+	})
+}
+
+func Add(pool *pgxpool.Pool, ctx context.Context, streamer string, n Notification) (*Notification, error) {
+	if n.Kind != KindDiscord && n.Kind != KindTelegram {
+		return nil, errors.New("Notification kind must be discord or telegram")
+	} else if n.BotToken == "" || n.Channel == "" {
+		return nil, errors.New("Notification requires a bot token and channel")
+	} else if n.Kind == KindDiscord && !discordChannelPattern.MatchString(n.Channel) {
+		return nil, errors.New("Discord channel must be a channel ID")
+	} else if n.Kind == KindTelegram && !telegramTokenPattern.MatchString(n.BotToken) {
+		return nil, errors.New("Telegram bot token must look like 123456:ABC-DEF")
+	}
+
+	query := `INSERT INTO streamer_notifications (streamer, kind, bot_token, channel)
+		 VALUES (@streamer, @kind, @botToken, @channel)
+		 RETURNING id`
+	if err := pool.QueryRow(ctx, query, pgx.NamedArgs{
+		"streamer": streamer,
+		"kind":     n.Kind,
+		"botToken": n.BotToken,
+		"channel":  n.Channel,
+	}).Scan(&n.ID); err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+func Delete(pool *pgxpool.Pool, ctx context.Context, streamer string, id int64) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM streamer_notifications WHERE id = @id AND streamer = @streamer`, pgx.NamedArgs{
+		"id":       id,
+		"streamer": streamer,
+	})
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
+
+func message(streamKey, streamer string) string {
+	title := webrtc.GetStreamMetadata(streamKey).Title
+	if title == "" {
+		title = streamKey
+	}
+
+	msg := fmt.Sprintf("%s is now live: %s", streamer, title)
+	if publicURL := os.Getenv("PUBLIC_URL"); publicURL != "" {
+		msg += "\n" + strings.TrimSuffix(publicURL, "/") + "/" + streamKey
+	}
+
+	return msg
+}
+
+func send(n Notification, streamKey, streamer string) error {
+	msg, thumbnail := message(streamKey, streamer), webrtc.ThumbnailURL(streamKey)
+
+	switch n.Kind {
+	case KindDiscord:
+		body := map[string]any{"content": msg}
+		if thumbnail != "" {
+			body["embeds"] = []any{map[string]any{"image": map[string]string{"url": thumbnail}}}
+		}
+
+		return post("https://discord.com/api/v10/channels/"+url.PathEscape(n.Channel)+"/messages", "Bot "+n.BotToken, body)
+	case KindTelegram:
+		if thumbnail != "" {
+			return post("https://api.telegram.org/bot"+url.PathEscape(n.BotToken)+"/sendPhoto", "", map[string]string{
+				"chat_id": n.Channel,
+				"photo":   thumbnail,
+				"caption": msg,
+			})
+		}
+
+		return post("https://api.telegram.org/bot"+url.PathEscape(n.BotToken)+"/sendMessage", "", map[string]string{
+			"chat_id": n.Channel,
+			"text":    msg,
+		})
+	}
+
+	return fmt.Errorf("Unknown notification kind %s", n.Kind)
+}
+
+func post(url, authorization string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	return events.PostJSONWithAuthorization(url, authorization, payload)
+}
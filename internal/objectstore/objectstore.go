@@ -0,0 +1,195 @@
+// Package objectstore uploads HTTP streaming segments, manifests and recordings to S3 compatible object storage,
+// so they can be served by a CDN instead of Broadcast Box.
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	requestTimeout = 30 * time.Second
+
+	amzDateFormat = "20060102T150405Z"
+	amzDayFormat  = "20060102"
+)
+
+var (
+	client = &http.Client{Timeout: requestTimeout}
+
+	// Files can take longer than requestTimeout, their uploads end with the context instead
+	fileClient = &http.Client{}
+)
+
+// Enabled reports if segments should be written to object storage instead of served locally
+func Enabled() bool {
+	return os.Getenv("S3_BUCKET") != ""
+}
+
+// URL returns where viewers fetch an object from. This is S3_PUBLIC_URL (usually a CDN in front of
+// the bucket) if set, otherwise the bucket itself.
+func URL(key string) string {
+	if publicURL := os.Getenv("S3_PUBLIC_URL"); publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/") + "/" + key
+	}
+
+	return objectURL(key).String()
+}
+
+// Put uploads an object, replacing it if it exists
+func Put(ctx context.Context, key, contentType, cacheControl string, body []byte) error {
+	headers := map[string]string{"Content-Type": contentType}
+	if cacheControl != "" {
+		headers["Cache-Control"] = cacheControl
+	}
+
+	return do(ctx, client, http.MethodPut, key, headers, bytes.NewReader(body), int64(len(body)), payloadHash(body))
+}
+
+// PutFile uploads the file at path without reading it into memory, and returns its size
+func PutFile(ctx context.Context, key, contentType, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// The signature covers the payload, so the file is read twice
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, err
+	} else if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return size, do(ctx, fileClient, http.MethodPut, key, map[string]string{"Content-Type": contentType}, f, size, hex.EncodeToString(hash.Sum(nil)))
+}
+
+// Delete removes an object, deleting an object that doesn't exist is not an error
+func Delete(ctx context.Context, key string) error {
+	return do(ctx, client, http.MethodDelete, key, nil, nil, 0, payloadHash(nil))
+}
+
+// objectURL uses path style addressing, which every S3 compatible service supports
+func objectURL(key string) *url.URL {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3." + region() + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		u = &url.URL{}
+	}
+
+	u.Path += "/" + os.Getenv("S3_BUCKET") + "/" + key
+	return u
+}
+
+func region() string {
+	if region := os.Getenv("S3_REGION"); region != "" {
+		return region
+	}
+
+	return "us-east-1"
+}
+
+func do(ctx context.Context, c *http.Client, method, key string, headers map[string]string, body io.Reader, size int64, hash string) error {
+	u := objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	sign(req, hash, time.Now().UTC())
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s failed with %d: %s", method, key, res.StatusCode, msg)
+	}
+
+	return nil
+}
+
+func payloadHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, whose body has the SHA-256 hash
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func sign(req *http.Request, hash string, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncodePath(req.URL.Path),
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date:" + req.Header.Get("X-Amz-Date"),
+		"",
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := now.Format(amzDayFormat) + "/" + region() + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format(amzDateFormat) + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := []byte("AWS4" + os.Getenv("S3_SECRET_ACCESS_KEY"))
+	for _, part := range []string{now.Format(amzDayFormat), region(), "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		os.Getenv("S3_ACCESS_KEY_ID"), scope, signedHeaders, hex.EncodeToString(hmacSHA256(signingKey, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncodePath encodes everything but unreserved characters and the path separators
+func uriEncodePath(path string) string {
+	var b strings.Builder
+	for _, c := range []byte(path) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,73 @@
+// Package playbacktoken signs and verifies tokens that allow playback of a single stream key
+// until they expire. Tokens are only required when PLAYBACK_TOKEN_SECRET is set.
+package playbacktoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalid = errors.New("Invalid playback token")
+	ErrExpired = errors.New("Playback token has expired")
+)
+
+// Enabled reports if playback requires a signed token
+func Enabled() bool {
+	return os.Getenv("PLAYBACK_TOKEN_SECRET") != ""
+}
+
+func signature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("PLAYBACK_TOKEN_SECRET")))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns a token that allows playback of streamKey until expires
+func Sign(streamKey string, expires time.Time) (string, error) {
+	if !Enabled() {
+		return "", errors.New("PLAYBACK_TOKEN_SECRET is not set")
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(streamKey + "|" + strconv.FormatInt(expires.Unix(), 10)))
+	return payload + "." + signature(payload), nil
+}
+
+// Verify checks that token was signed for streamKey and hasn't expired
+func Verify(token, streamKey string) error {
+	_, err := ExpiresAt(token, streamKey)
+	return err
+}
+
+// ExpiresAt verifies token like Verify and returns when it expires
+func ExpiresAt(token, streamKey string) (time.Time, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signature(payload))) {
+		return time.Time{}, ErrInvalid
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return time.Time{}, ErrInvalid
+	}
+
+	tokenStreamKey, expiresStr, ok := strings.Cut(string(decoded), "|")
+	if !ok || tokenStreamKey != streamKey {
+		return time.Time{}, ErrInvalid
+	}
+
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrInvalid
+	} else if time.Now().Unix() > expires {
+		return time.Time{}, ErrExpired
+	}
+
+	return time.Unix(expires, 0), nil
+}
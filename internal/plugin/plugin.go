@@ -0,0 +1,140 @@
+// Package plugin lets forks add storage, recording and notification backends without patching core
+// files. Backends register themselves from an init func, usually in a file behind a build tag:
+//
+//	//go:build mysql
+//
+//	package main
+//
+//	func init() {
+//		plugin.RegisterStore("mysql", newMySQLStore)
+//	}
+//
+// and are compiled in with `go build -tags mysql`.
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	defaultStore  = "postgres"
+	pluginTimeout = 30 * time.Second
+)
+
+type (
+	// Store persists streamers and authenticates them
+	Store interface {
+		// GetStreamKeys returns every stream key of every streamer
+		GetStreamKeys(ctx context.Context) ([]string, error)
+		// Streamer returns the streamer that may publish to streamKey with authToken, nil if there is none
+		Streamer(ctx context.Context, streamKey, authToken string) *webrtc.Streamer
+		// StreamerByAuthToken returns the streamer with authToken, nil if there is none
+		StreamerByAuthToken(ctx context.Context, authToken string) *webrtc.Streamer
+		// StreamerStreamKeys returns the stream keys of the streamer with authToken
+		StreamerStreamKeys(ctx context.Context, authToken string) ([]string, error)
+		// RotateAuthToken replaces authToken with a new random token and returns it
+		RotateAuthToken(ctx context.Context, authToken string) (string, error)
+		// ProvisionStreamer creates a streamer for a single stream key, expiresAt may be nil
+		ProvisionStreamer(ctx context.Context, name, streamKey, authToken string, expiresAt *time.Time, maxBitrate uint64, maxViewers int) error
+	}
+
+	// Recorder records streams. Recordings are started by autostart rules and stopped when the stream ends. Once
+	// the file of a recording is complete the Recorder calls RecordingFinalized.
+	Recorder interface {
+		Start(ctx context.Context, streamKey string) error
+		Stop(ctx context.Context, streamKey string) error
+	}
+
+	// Notifier receives every stream event
+	Notifier interface {
+		Notify(ctx context.Context, e events.Event) error
+	}
+)
+
+var (
+	stores    = map[string]func() (Store, error){}
+	recorders = map[string]Recorder{}
+	notifiers = map[string]Notifier{}
+	lock      sync.Mutex
+)
+
+// RegisterStore makes a Store selectable with the STORE environment variable
+func RegisterStore(name string, factory func() (Store, error)) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	stores[name] = factory
+}
+
+// RegisterRecorder adds a Recorder, every registered Recorder is used
+func RegisterRecorder(name string, r Recorder) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	recorders[name] = r
+}
+
+// RegisterNotifier adds a Notifier, every registered Notifier is used
+func RegisterNotifier(name string, n Notifier) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	notifiers[name] = n
+}
+
+// Configure connects the registered Recorders and Notifiers to stream events and returns the Store
+// selected by STORE, postgres by default.
+func Configure() (Store, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	name := os.Getenv("STORE")
+	if name == "" {
+		name = defaultStore
+	}
+
+	factory, ok := stores[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown store %s, available are %v", name, registeredStores())
+	}
+
+	store, err := factory()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, n := range notifiers {
+		name, n := name, n
+		events.Subscribe(func(e events.Event) {
+			ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+			defer cancel()
+
+			if err := n.Notify(ctx, e); err != nil {
+				log.Printf("Notifier %s failed: %v", name, err)
+			}
+		})
+	}
+
+	configureRecorders()
+
+	return store, nil
+}
+
+func registeredStores() []string {
+	names := []string{}
+	for name := range stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,42 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+type postgresStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresStore is the default Store, it keeps streamers in the streamers table
+func NewPostgresStore(pool *pgxpool.Pool) Store {
+	return &postgresStore{pool: pool}
+}
+
+func (p *postgresStore) GetStreamKeys(ctx context.Context) ([]string, error) {
+	return webrtc.GetStreamKeys(p.pool, ctx)
+}
+
+func (p *postgresStore) Streamer(ctx context.Context, streamKey, authToken string) *webrtc.Streamer {
+	return webrtc.NewStreamer(p.pool, ctx, []string{streamKey, authToken})
+}
+
+func (p *postgresStore) StreamerByAuthToken(ctx context.Context, authToken string) *webrtc.Streamer {
+	return webrtc.StreamerByAuthToken(p.pool, ctx, authToken)
+}
+
+func (p *postgresStore) StreamerStreamKeys(ctx context.Context, authToken string) ([]string, error) {
+	return webrtc.GetStreamerStreamKeys(p.pool, ctx, authToken)
+}
+
+func (p *postgresStore) RotateAuthToken(ctx context.Context, authToken string) (string, error) {
+	return webrtc.RotateAuthToken(p.pool, ctx, authToken)
+}
+
+func (p *postgresStore) ProvisionStreamer(ctx context.Context, name, streamKey, authToken string, expiresAt *time.Time, maxBitrate uint64, maxViewers int) error {
+	return webrtc.ProvisionStreamer(p.pool, ctx, name, streamKey, authToken, expiresAt, maxBitrate, maxViewers)
+}
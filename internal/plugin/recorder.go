@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/patrikrog/broadcast-box/internal/autostart"
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+var (
+	// Stream keys a record rule started the Recorders for
+	recordedStreams     = map[string]bool{}
+	recordedStreamsLock sync.Mutex
+)
+
+// configureRecorders starts every Recorder for record autostart rules, RECORD_ALL_STREAMS and streamers with the
+// record flag, and stops them when the stream ends. With STREAM_OFFLINE_POLICY=media recordings also stop while the
+// stream is offline and start again once it is online.
+func configureRecorders() {
+	if len(recorders) == 0 {
+		return
+	}
+
+	autostart.RegisterAction(autostart.ActionRecord, func(streamKey string, _ autostart.Rule) error {
+		recordedStreamsLock.Lock()
+		recordedStreams[streamKey] = true
+		recordedStreamsLock.Unlock()
+
+		return startRecorders(streamKey)
+	})
+
+	events.Subscribe(func(e events.Event) {
+		switch e.Type {
+		case events.StreamStart:
+			if !webrtc.StreamRecorded(e.StreamKey) {
+				return
+			}
+
+			recordedStreamsLock.Lock()
+			recordedStreams[e.StreamKey] = true
+			recordedStreamsLock.Unlock()
+
+			if err := startRecorders(e.StreamKey); err != nil {
+				log.Printf("Recorders failed to start %s: %v", e.StreamKey, err)
+			}
+		case events.StreamEnd:
+			recordedStreamsLock.Lock()
+			delete(recordedStreams, e.StreamKey)
+			recordedStreamsLock.Unlock()
+
+			stopRecorders(e.StreamKey)
+		case events.StreamOffline:
+			stopRecorders(e.StreamKey)
+		case events.StreamOnline:
+			recordedStreamsLock.Lock()
+			recorded := recordedStreams[e.StreamKey]
+			recordedStreamsLock.Unlock()
+
+			if recorded {
+				if err := startRecorders(e.StreamKey); err != nil {
+					log.Printf("Recorders failed to start %s: %v", e.StreamKey, err)
+				}
+			}
+		}
+	})
+}
+
+// StopRecorders stops the Recorders of every recorded stream, so their recordings are complete before the process
+// exits
+func StopRecorders() {
+	recordedStreamsLock.Lock()
+	streamKeys := []string{}
+	for streamKey := range recordedStreams {
+		streamKeys = append(streamKeys, streamKey)
+	}
+	recordedStreams = map[string]bool{}
+	recordedStreamsLock.Unlock()
+
+	for _, streamKey := range streamKeys {
+		stopRecorders(streamKey)
+	}
+}
+
+// RecordingFinalized announces that the recording of streamKey at location, a path or URL, is complete and can be
+// post-processed
+func RecordingFinalized(streamKey, location string) {
+	events.Publish(events.Event{
+		Type:      events.RecordingFinalized,
+		StreamKey: streamKey,
+		Tenant:    webrtc.StreamTenant(streamKey),
+		Data:      location,
+	})
+}
+
+func startRecorders(streamKey string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+
+	errs := []error{}
+	for name, r := range recorders {
+		if err := r.Start(ctx, streamKey); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		recordingStarted(ctx, name, streamKey)
+	}
+
+	return errors.Join(errs...)
+}
+
+func stopRecorders(streamKey string) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+
+	for name, r := range recorders {
+		if err := r.Stop(ctx, streamKey); err != nil {
+			log.Printf("Recorder %s failed to stop %s: %v", name, streamKey, err)
+		}
+
+		recordingStopped(ctx, name, streamKey)
+	}
+}
@@ -0,0 +1,221 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/scheduler"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	RecordingStateRecording  = "recording"
+	RecordingStateStopped    = "stopped"
+	RecordingStateRecovering = "recovering"
+	RecordingStateRecovered  = "recovered"
+	RecordingStateFailed     = "failed"
+
+	// Running recordings are touched this often, a recording that wasn't touched for recordingStaleAfter belongs to
+	// an instance that crashed
+	recordingHeartbeatInterval = time.Minute
+	recordingStaleAfter        = 3 * time.Minute
+
+	// Remuxing a long recording takes a while
+	recordingRecoveryTimeout = 10 * time.Minute
+)
+
+// Recoverer is implemented by Recorders that can salvage a recording left behind by a crash, e.g. by remuxing the
+// partial file. It returns the location of the finalized recording.
+type Recoverer interface {
+	Recover(ctx context.Context, streamKey string, startedAt time.Time) (location string, err error)
+}
+
+// RecordingRecovery is the data of a recording.recovered event
+type RecordingRecovery struct {
+	Recorder string `json:"recorder"`
+	State    string `json:"state"`
+	Location string `json:"location,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type runningRecording struct {
+	recorder, streamKey string
+}
+
+var (
+	errNoRecoverer = errors.New("Recorder can't recover recordings")
+
+	recordingsPool *pgxpool.Pool
+
+	// IDs of the recordings rows of the Recorders running on this instance
+	runningRecordings     = map[runningRecording]int64{}
+	runningRecordingsLock sync.Mutex
+)
+
+// ConfigureRecordingRecovery keeps the state of every recording in Postgres. Recordings an instance left behind when
+// it crashed are handed to the Recoverer of their Recorder, on startup and while running.
+func ConfigureRecordingRecovery(pool *pgxpool.Pool) {
+	if len(recorders) == 0 {
+		return
+	}
+	recordingsPool = pool
+
+	go recoverRecordings()
+	scheduler.Register("recording-heartbeat", recordingHeartbeatInterval, func(context.Context) error {
+		touchRecordings()
+		recoverRecordings()
+		return nil
+	})
+}
+
+// recordingStarted stores that recorder started recording streamKey
+func recordingStarted(ctx context.Context, recorder, streamKey string) {
+	if recordingsPool == nil {
+		return
+	}
+
+	var id int64
+	err := recordingsPool.QueryRow(ctx, `INSERT INTO recordings (stream_key, recorder, state) VALUES (@streamKey, @recorder, @state) RETURNING id`, pgx.NamedArgs{
+		"streamKey": streamKey,
+		"recorder":  recorder,
+		"state":     RecordingStateRecording,
+	}).Scan(&id)
+	if err != nil {
+		log.Printf("Recording of %s by %s could not be saved: %v", streamKey, recorder, err)
+		return
+	}
+
+	runningRecordingsLock.Lock()
+	runningRecordings[runningRecording{recorder, streamKey}] = id
+	runningRecordingsLock.Unlock()
+}
+
+// recordingStopped stores that recorder stopped recording streamKey
+func recordingStopped(ctx context.Context, recorder, streamKey string) {
+	runningRecordingsLock.Lock()
+	id, ok := runningRecordings[runningRecording{recorder, streamKey}]
+	delete(runningRecordings, runningRecording{recorder, streamKey})
+	runningRecordingsLock.Unlock()
+	if !ok {
+		return
+	}
+
+	if err := finishRecording(ctx, id, RecordingStateStopped, "", ""); err != nil {
+		log.Printf("Recording of %s by %s could not be saved: %v", streamKey, recorder, err)
+	}
+}
+
+// touchRecordings marks the recordings of this instance as alive
+func touchRecordings() {
+	runningRecordingsLock.Lock()
+	ids := make([]int64, 0, len(runningRecordings))
+	for _, id := range runningRecordings {
+		ids = append(ids, id)
+	}
+	runningRecordingsLock.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+
+	if _, err := recordingsPool.Exec(ctx, `UPDATE recordings SET updated_at = now() WHERE id = ANY(@ids)`, pgx.NamedArgs{
+		"ids": ids,
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// recoverRecordings claims the recordings no instance touched for recordingStaleAfter and recovers them. Claiming
+// is atomic, so with several instances every recording is recovered once.
+func recoverRecordings() {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+
+	rows, err := recordingsPool.Query(ctx, `UPDATE recordings SET state = @recovering, updated_at = now()
+		 WHERE state = @recording AND updated_at < now() - make_interval(secs => @staleAfter)
+		 RETURNING id, stream_key, recorder, started_at`, pgx.NamedArgs{
+		"recovering": RecordingStateRecovering,
+		"recording":  RecordingStateRecording,
+		"staleAfter": recordingStaleAfter.Seconds(),
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	type staleRecording struct {
+		id                  int64
+		streamKey, recorder string
+		startedAt           time.Time
+	}
+	stale, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (staleRecording, error) {
+		var r staleRecording
+		err := row.Scan(&r.id, &r.streamKey, &r.recorder, &r.startedAt)
+		return r, err
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, r := range stale {
+		recovery := RecordingRecovery{Recorder: r.recorder, State: RecordingStateRecovered}
+		location, err := recoverRecording(r.recorder, r.streamKey, r.startedAt)
+		if err != nil {
+			log.Printf("Recording of %s by %s could not be recovered: %v", r.streamKey, r.recorder, err)
+			recovery.State, recovery.Error = RecordingStateFailed, err.Error()
+		} else {
+			recovery.Location = location
+		}
+
+		finishCtx, finishCancel := context.WithTimeout(context.Background(), pluginTimeout)
+		if err := finishRecording(finishCtx, r.id, recovery.State, recovery.Location, recovery.Error); err != nil {
+			log.Printf("Recording of %s by %s could not be saved: %v", r.streamKey, r.recorder, err)
+		}
+		finishCancel()
+
+		events.Publish(events.Event{
+			Type:      events.RecordingRecovered,
+			StreamKey: r.streamKey,
+			Tenant:    webrtc.StreamTenant(r.streamKey),
+			Data:      recovery,
+		})
+		if recovery.State == RecordingStateRecovered {
+			RecordingFinalized(r.streamKey, location)
+		}
+	}
+}
+
+// recoverRecording hands a stale recording to the Recoverer of its Recorder
+func recoverRecording(recorder, streamKey string, startedAt time.Time) (string, error) {
+	lock.Lock()
+	r, ok := recorders[recorder].(Recoverer)
+	lock.Unlock()
+	if !ok {
+		return "", errNoRecoverer
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), recordingRecoveryTimeout)
+	defer cancel()
+
+	return r.Recover(ctx, streamKey, startedAt)
+}
+
+func finishRecording(ctx context.Context, id int64, state, location, message string) error {
+	_, err := recordingsPool.Exec(ctx, `UPDATE recordings SET state = @state, location = @location, error = @error, updated_at = now(), finished_at = now()
+		 WHERE id = @id`, pgx.NamedArgs{
+		"id":       id,
+		"state":    state,
+		"location": location,
+		"error":    message,
+	})
+	return err
+}
@@ -0,0 +1,212 @@
+// Package postprocess runs commands and webhooks for recordings once their file is complete, e.g. to transcode them,
+// generate a contact sheet or tell an editor, and uploads them to object storage. The outcome of every hook is kept
+// in Postgres.
+package postprocess
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+
+	defaultTimeout = time.Hour
+	saveTimeout    = 10 * time.Second
+
+	// Output of a failed command kept as its error
+	maxErrorLength = 1024
+)
+
+// Job is one hook run for a recording
+type Job struct {
+	ID         int64      `json:"id"`
+	StreamKey  string     `json:"streamKey"`
+	Location   string     `json:"location"`
+	Hook       string     `json:"hook"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+type webhookJSON struct {
+	ID        int64  `json:"id"`
+	StreamKey string `json:"streamKey"`
+	Location  string `json:"location"`
+}
+
+var (
+	command     []string
+	webhookURLs []string
+	timeout     = defaultTimeout
+)
+
+// Configure uploads with RECORDING_UPLOAD, and runs RECORDING_POSTPROCESS_COMMAND and RECORDING_POSTPROCESS_WEBHOOK_URL
+// for every recording.finalized event
+func Configure(pool *pgxpool.Pool) error {
+	if err := configureUpload(); err != nil {
+		return err
+	}
+
+	command = strings.Fields(os.Getenv("RECORDING_POSTPROCESS_COMMAND"))
+	if val := os.Getenv("RECORDING_POSTPROCESS_WEBHOOK_URL"); val != "" {
+		webhookURLs = strings.Split(val, "|")
+	}
+
+	if val := os.Getenv("RECORDING_POSTPROCESS_TIMEOUT"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("RECORDING_POSTPROCESS_TIMEOUT must be a positive number of seconds, got `%s`", val)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	if !upload && len(command) == 0 && len(webhookURLs) == 0 {
+		return nil
+	}
+
+	events.Subscribe(func(e events.Event) {
+		location, ok := e.Data.(string)
+		if e.Type != events.RecordingFinalized || !ok {
+			return
+		}
+
+		if upload && localFile(location) {
+			run(pool, e.StreamKey, location, "upload", func(ctx context.Context, _ int64) error {
+				return uploadRecording(ctx, pool, e.StreamKey, location)
+			})
+		}
+
+		if len(command) != 0 {
+			run(pool, e.StreamKey, location, "command", func(ctx context.Context, id int64) error {
+				return runCommand(ctx, id, e.StreamKey, location)
+			})
+		}
+
+		for _, webhookURL := range webhookURLs {
+			// Only the host is kept, the URL may contain credentials
+			hook := "webhook"
+			if u, err := url.Parse(webhookURL); err == nil {
+				hook += " " + u.Host
+			}
+
+			run(pool, e.StreamKey, location, hook, func(_ context.Context, id int64) error {
+				body, err := json.Marshal(webhookJSON{ID: id, StreamKey: e.StreamKey, Location: location})
+				if err != nil {
+					return err
+				}
+
+				return events.PostJSON(webhookURL, body)
+			})
+		}
+	})
+
+	return nil
+}
+
+// run tracks a hook as a Job while it runs. Hooks of a recording run one after another, the upload first and the
+// command next.
+func run(pool *pgxpool.Pool, streamKey, location, hook string, f func(ctx context.Context, id int64) error) {
+	id, err := start(pool, streamKey, location, hook)
+	if err != nil {
+		log.Printf("Post-processing %s of %s could not be saved: %v", hook, location, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	status, message := StatusSucceeded, ""
+	if err := f(ctx, id); err != nil {
+		log.Printf("Post-processing %s of %s failed: %v", hook, location, err)
+		status, message = StatusFailed, err.Error()
+	}
+
+	if id != 0 {
+		if err := finish(pool, id, status, message); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// runCommand passes the recording as the last argument, and as environment variables with the job ID
+func runCommand(ctx context.Context, id int64, streamKey, location string) error {
+	cmd := exec.CommandContext(ctx, command[0], append(command[1:], location)...)
+	cmd.Env = append(os.Environ(),
+		"BROADCAST_BOX_JOB_ID="+strconv.FormatInt(id, 10),
+		"BROADCAST_BOX_STREAM_KEY="+streamKey,
+		"BROADCAST_BOX_RECORDING="+location,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			if len(message) > maxErrorLength {
+				message = message[len(message)-maxErrorLength:]
+			}
+			return fmt.Errorf("%w: %s", err, message)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func start(pool *pgxpool.Pool, streamKey, location, hook string) (id int64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), saveTimeout)
+	defer cancel()
+
+	query := `INSERT INTO recording_jobs (stream_key, location, hook, status)
+		 VALUES (@streamKey, @location, @hook, @status)
+		 RETURNING id`
+	err = pool.QueryRow(ctx, query, pgx.NamedArgs{
+		"streamKey": streamKey,
+		"location":  location,
+		"hook":      hook,
+		"status":    StatusRunning,
+	}).Scan(&id)
+
+	return id, err
+}
+
+func finish(pool *pgxpool.Pool, id int64, status, message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), saveTimeout)
+	defer cancel()
+
+	query := `UPDATE recording_jobs SET status = @status, error = @error, finished_at = now() WHERE id = @id`
+	_, err := pool.Exec(ctx, query, pgx.NamedArgs{"id": id, "status": status, "error": message})
+
+	return err
+}
+
+// Get returns the post-processing jobs of the recordings of streamKey, newest first
+func Get(pool *pgxpool.Pool, ctx context.Context, streamKey string) ([]Job, error) {
+	query := `SELECT id, stream_key, location, hook, status, error, created_at, finished_at FROM recording_jobs
+		 WHERE stream_key = @streamKey
+		 ORDER BY id DESC
+		 LIMIT 100`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{"streamKey": streamKey})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Job, error) {
+		var j Job
+		err := row.Scan(&j.ID, &j.StreamKey, &j.Location, &j.Hook, &j.Status, &j.Error, &j.CreatedAt, &j.FinishedAt)
+		return j, err
+	})
+}
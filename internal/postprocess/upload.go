@@ -0,0 +1,111 @@
+package postprocess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/objectstore"
+)
+
+const defaultUploadPrefix = "recordings/"
+
+// Object is a recording uploaded to object storage
+type Object struct {
+	StreamKey string    `json:"streamKey"`
+	Key       string    `json:"key"`
+	URL       string    `json:"url"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+var (
+	upload       bool
+	uploadPrefix = defaultUploadPrefix
+)
+
+// configureUpload reads RECORDING_UPLOAD and RECORDING_UPLOAD_PREFIX, uploads use the S3_* settings of objectstore
+func configureUpload() error {
+	if os.Getenv("RECORDING_UPLOAD") != "true" {
+		return nil
+	} else if os.Getenv("S3_BUCKET") == "" {
+		return errors.New("RECORDING_UPLOAD requires S3_BUCKET")
+	}
+
+	upload = true
+	if val, ok := os.LookupEnv("RECORDING_UPLOAD_PREFIX"); ok {
+		uploadPrefix = val
+	}
+
+	return nil
+}
+
+// localFile reports whether location is a file on this instance, recorders may also return URLs
+func localFile(location string) bool {
+	info, err := os.Stat(location)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// uploadRecording uploads the file at location to <prefix><streamKey>/<file name> and stores its key
+func uploadRecording(ctx context.Context, pool *pgxpool.Pool, streamKey, location string) error {
+	key := uploadPrefix + path.Join(streamKey, filepath.Base(location))
+	size, err := objectstore.PutFile(ctx, key, contentTypeOf(location), location)
+	if err != nil {
+		return err
+	}
+
+	_, err = pool.Exec(ctx, `INSERT INTO recording_objects (stream_key, object_key, size) VALUES (@streamKey, @objectKey, @size)
+		 ON CONFLICT (object_key) DO UPDATE SET size = @size, created_at = now()`, pgx.NamedArgs{
+		"streamKey": streamKey,
+		"objectKey": key,
+		"size":      size,
+	})
+	if err != nil {
+		return fmt.Errorf("Uploaded %s but could not save it: %w", key, err)
+	}
+
+	return nil
+}
+
+func contentTypeOf(location string) string {
+	switch ext := strings.ToLower(filepath.Ext(location)); ext {
+	case ".mkv":
+		return "video/x-matroska"
+	case ".webm":
+		return "video/webm"
+	case ".mp4":
+		return "video/mp4"
+	default:
+		if contentType := mime.TypeByExtension(ext); contentType != "" {
+			return contentType
+		}
+		return "application/octet-stream"
+	}
+}
+
+// GetObjects returns the uploaded recordings of streamKey, newest first
+func GetObjects(pool *pgxpool.Pool, ctx context.Context, streamKey string) ([]Object, error) {
+	query := `SELECT stream_key, object_key, size, created_at FROM recording_objects
+		 WHERE stream_key = @streamKey
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT 1000`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{"streamKey": streamKey})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Object, error) {
+		var o Object
+		err := row.Scan(&o.StreamKey, &o.Key, &o.Size, &o.CreatedAt)
+		o.URL = objectstore.URL(o.Key)
+		return o, err
+	})
+}
@@ -0,0 +1,85 @@
+// Package provisioning asks an external service whether an unknown stream key may publish
+package provisioning
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+const provisioningTimeout = 10 * time.Second
+
+var client = &http.Client{Timeout: provisioningTimeout}
+
+type (
+	requestJSON struct {
+		StreamKey string `json:"streamKey"`
+		AuthToken string `json:"authToken"`
+	}
+
+	// Quotas limit a provisioned streamer, zero means unlimited
+	Quotas struct {
+		// Bits per second publishers are asked not to exceed
+		MaxBitrate uint64 `json:"maxBitrate"`
+		MaxViewers int    `json:"maxViewers"`
+	}
+
+	// Result is the response of the provisioning webhook
+	Result struct {
+		Allow bool   `json:"allow"`
+		Name  string `json:"name"`
+		// Seconds the stream key and auth token stay valid, zero never expires
+		ExpiresIn int64  `json:"expiresIn"`
+		Quotas    Quotas `json:"quotas"`
+	}
+)
+
+// Enabled reports if PROVISIONING_WEBHOOK_URL is set
+func Enabled() bool {
+	return os.Getenv("PROVISIONING_WEBHOOK_URL") != ""
+}
+
+// Provision POSTs the credentials of an unknown publisher to PROVISIONING_WEBHOOK_URL. The request
+// is signed like event webhooks.
+func Provision(ctx context.Context, streamKey, authToken string) (*Result, error) {
+	body, err := json.Marshal(requestJSON{StreamKey: streamKey, AuthToken: authToken})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, os.Getenv("PROVISIONING_WEBHOOK_URL"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if signature := events.Signature(body); signature != "" {
+		req.Header.Set(events.SignatureHeader, signature)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("Unexpected HTTP StatusCode %d", res.StatusCode)
+	}
+
+	result := &Result{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return nil, err
+	} else if result.Allow && result.Name == "" {
+		return nil, errors.New("Provisioning webhook did not return a streamer name")
+	}
+
+	return result, nil
+}
@@ -0,0 +1,208 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// AMF0 markers, see the Action Message Format specification
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0A
+	amfDate        = 0x0B
+	amfLongString  = 0x0C
+)
+
+// Objects and arrays nested deeper are rejected, commands of publishers nest two levels at most
+const maxAMFDepth = 32
+
+var (
+	errInvalidAMF = errors.New("Invalid AMF0")
+	errAMFTooDeep = errors.New("AMF0 values are nested too deep")
+)
+
+// decodeAMF decodes every value of an AMF0 payload. Numbers are float64, objects and ECMA arrays
+// map[string]any, null and undefined nil.
+func decodeAMF(payload []byte) ([]any, error) {
+	r := bytes.NewReader(payload)
+	values := []any{}
+	for r.Len() != 0 {
+		value, err := decodeAMFValue(r, 0)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// decodeAMFValue decodes the next value of r, depth is how many objects and arrays it is nested in
+func decodeAMFValue(r *bytes.Reader, depth int) (any, error) {
+	if depth > maxAMFDepth {
+		return nil, errAMFTooDeep
+	}
+
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, errInvalidAMF
+	}
+
+	switch marker {
+	case amfNumber:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, errInvalidAMF
+		}
+		return math.Float64frombits(bits), nil
+	case amfBoolean:
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errInvalidAMF
+		}
+		return b != 0, nil
+	case amfString:
+		return decodeAMFString(r, 2)
+	case amfLongString:
+		return decodeAMFString(r, 4)
+	case amfObject:
+		return decodeAMFObject(r, depth+1)
+	case amfECMAArray:
+		// The count is only a hint, the properties end like those of an object. Each takes at least three bytes.
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil || int64(count) > int64(r.Len()) {
+			return nil, errInvalidAMF
+		}
+		return decodeAMFObject(r, depth+1)
+	case amfStrictArray:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil || int64(count) > int64(r.Len()) {
+			return nil, errInvalidAMF
+		}
+
+		values := make([]any, 0, count)
+		for i := uint32(0); i < count; i++ {
+			value, err := decodeAMFValue(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case amfDate:
+		// Milliseconds since the epoch and a time zone that is always zero
+		var date struct {
+			Milliseconds float64
+			TimeZone     int16
+		}
+		if err := binary.Read(r, binary.BigEndian, &date); err != nil {
+			return nil, errInvalidAMF
+		}
+		return date.Milliseconds, nil
+	case amfNull, amfUndefined:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported AMF0 marker %d", marker)
+}
+
+func decodeAMFString(r *bytes.Reader, lengthSize int) (string, error) {
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBytes[4-lengthSize:]); err != nil {
+		return "", errInvalidAMF
+	}
+
+	length := binary.BigEndian.Uint32(lengthBytes)
+	if int64(length) > int64(r.Len()) {
+		return "", errInvalidAMF
+	}
+
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", errInvalidAMF
+	}
+	return string(s), nil
+}
+
+func decodeAMFObject(r *bytes.Reader, depth int) (map[string]any, error) {
+	object := map[string]any{}
+	for {
+		key, err := decodeAMFString(r, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "" {
+			if marker, err := r.ReadByte(); err != nil || marker != amfObjectEnd {
+				return nil, errInvalidAMF
+			}
+			return object, nil
+		}
+
+		if object[key], err = decodeAMFValue(r, depth); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// encodeAMF encodes values as AMF0, the types are those decodeAMF returns
+func encodeAMF(values ...any) []byte {
+	buf := &bytes.Buffer{}
+	for _, value := range values {
+		encodeAMFValue(buf, value)
+	}
+
+	return buf.Bytes()
+}
+
+func encodeAMFValue(buf *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case float64:
+		buf.WriteByte(amfNumber)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case bool:
+		buf.WriteByte(amfBoolean)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case string:
+		buf.WriteByte(amfString)
+		encodeAMFString(buf, v)
+	case map[string]any:
+		buf.WriteByte(amfObject)
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			encodeAMFString(buf, key)
+			encodeAMFValue(buf, v[key])
+		}
+		encodeAMFString(buf, "")
+		buf.WriteByte(amfObjectEnd)
+	default:
+		buf.WriteByte(amfNull)
+	}
+}
+
+func encodeAMFString(buf *bytes.Buffer, s string) {
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
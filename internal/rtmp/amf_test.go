@@ -0,0 +1,105 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeAMF(t *testing.T) {
+	// Strict arrays of one element nested in each other, the last holds null
+	nestedArrays := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{amfStrictArray, 0, 0, 0, 1}, depth), amfNull)
+	}
+
+	for _, test := range []struct {
+		name   string
+		input  []byte
+		values []any
+		err    error
+	}{
+		{
+			name:   "connect command",
+			input:  encodeAMF("connect", float64(1), map[string]any{"app": "live", "tcUrl": "rtmp://localhost/live"}),
+			values: []any{"connect", float64(1), map[string]any{"app": "live", "tcUrl": "rtmp://localhost/live"}},
+		},
+		{
+			name:   "ECMA array",
+			input:  []byte{amfECMAArray, 0, 0, 0, 1, 0, 1, 'a', amfBoolean, 1, 0, 0, amfObjectEnd},
+			values: []any{map[string]any{"a": true}},
+		},
+		{
+			name:   "nested arrays within the limit",
+			input:  nestedArrays(maxAMFDepth),
+			values: []any{nestedValue(maxAMFDepth)},
+		},
+		{
+			name:  "nested arrays beyond the limit",
+			input: nestedArrays(100000),
+			err:   errAMFTooDeep,
+		},
+		{
+			name:  "nested objects beyond the limit",
+			input: bytes.Repeat([]byte{amfObject, 0, 1, 'a'}, 100000),
+			err:   errAMFTooDeep,
+		},
+		{
+			name:  "strict array longer than the payload",
+			input: []byte{amfStrictArray, 0xFF, 0xFF, 0xFF, 0xFF, amfNull},
+			err:   errInvalidAMF,
+		},
+		{
+			name:  "ECMA array longer than the payload",
+			input: []byte{amfECMAArray, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, amfObjectEnd},
+			err:   errInvalidAMF,
+		},
+		{
+			name:  "string longer than the payload",
+			input: []byte{amfString, 0, 10, 'a'},
+			err:   errInvalidAMF,
+		},
+		{
+			name:  "object without end",
+			input: []byte{amfObject, 0, 1, 'a', amfNull},
+			err:   errInvalidAMF,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := decodeAMF(test.input)
+			switch {
+			case test.err == nil && err != nil:
+				t.Fatalf("Unexpected error %v", err)
+			case test.err != nil && !errors.Is(err, test.err):
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			case test.err == nil && !reflect.DeepEqual(values, test.values):
+				t.Fatalf("Expected %v, got %v", test.values, values)
+			}
+		})
+	}
+}
+
+// nestedValue is what nested strict arrays of depth decode to
+func nestedValue(depth int) any {
+	if depth == 0 {
+		return nil
+	}
+
+	return []any{nestedValue(depth - 1)}
+}
+
+func FuzzDecodeAMF(f *testing.F) {
+	f.Add(encodeAMF("connect", float64(1), map[string]any{"app": "live"}))
+	f.Add(encodeAMF("publish", float64(5), nil, "streamkey", "live"))
+	f.Add(bytes.Repeat([]byte{amfStrictArray, 0, 0, 0, 1}, 1000))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		values, err := decodeAMF(input)
+		if err != nil {
+			return
+		}
+
+		// Whatever decoded must encode again
+		encodeAMF(values...)
+	})
+}
@@ -0,0 +1,226 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Message types, see the RTMP specification
+const (
+	messageSetChunkSize     = 1
+	messageAbort            = 2
+	messageAcknowledgement  = 3
+	messageUserControl      = 4
+	messageWindowAckSize    = 5
+	messageSetPeerBandwidth = 6
+	messageAudio            = 8
+	messageVideo            = 9
+	messageDataAMF3         = 15
+	messageCommandAMF3      = 17
+	messageDataAMF0         = 18
+	messageCommandAMF0      = 20
+)
+
+const (
+	defaultChunkSize = 128
+
+	// Larger messages are rejected instead of buffered, no encoder sends frames this large
+	maxMessageSize = 16 << 20
+
+	// Partial messages of all chunk streams of a connection together, and chunk streams a connection may use.
+	// Encoders use a handful of chunk streams.
+	maxBufferedSize = 2 * maxMessageSize
+	maxChunkStreams = 64
+
+	extendedTimestamp = 0xFFFFFF
+)
+
+var (
+	errMessageTooLarge   = errors.New("RTMP message is too large")
+	errTooManyBuffered   = errors.New("RTMP messages buffered exceed the limit")
+	errTooManyStreams    = errors.New("RTMP connection uses too many chunk streams")
+	errMessageHeaderSwap = errors.New("RTMP chunk header changes a message that is partially received")
+)
+
+type (
+	message struct {
+		typeID    uint8
+		streamID  uint32
+		timestamp uint32
+		payload   []byte
+	}
+
+	// chunkStream is the state of a chunk stream ID, chunk headers only carry what changed since its last chunk
+	chunkStream struct {
+		timestamp uint32
+		// Timestamp field of the last header with one, the delta for the next message if its header has none
+		timestampField uint32
+		extended       bool
+
+		length   uint32
+		typeID   uint8
+		streamID uint32
+
+		// The message received so far
+		payload []byte
+	}
+
+	// chunkReader reassembles the messages of the peer from their chunks
+	chunkReader struct {
+		r         *bufio.Reader
+		chunkSize uint32
+		streams   map[uint32]*chunkStream
+		// Bytes of the partial messages of all chunk streams
+		buffered int
+	}
+
+	// chunkWriter sends messages as chunks
+	chunkWriter struct {
+		w         io.Writer
+		chunkSize uint32
+	}
+)
+
+func newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{r: bufio.NewReader(r), chunkSize: defaultChunkSize, streams: map[uint32]*chunkStream{}}
+}
+
+// read returns the next complete message, reading as many chunks as it takes
+func (c *chunkReader) read() (message, error) {
+	for {
+		basicHeader, err := c.r.ReadByte()
+		if err != nil {
+			return message{}, err
+		}
+
+		format, chunkStreamID := basicHeader>>6, uint32(basicHeader&0x3F)
+		switch chunkStreamID {
+		case 0:
+			b, err := c.r.ReadByte()
+			if err != nil {
+				return message{}, err
+			}
+			chunkStreamID = uint32(b) + 64
+		case 1:
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(c.r, b); err != nil {
+				return message{}, err
+			}
+			chunkStreamID = uint32(binary.LittleEndian.Uint16(b)) + 64
+		}
+
+		cs, ok := c.streams[chunkStreamID]
+		if !ok {
+			if format != 0 {
+				return message{}, fmt.Errorf("Chunk stream %d starts without a full header", chunkStreamID)
+			} else if len(c.streams) >= maxChunkStreams {
+				return message{}, errTooManyStreams
+			}
+			cs = &chunkStream{}
+			c.streams[chunkStreamID] = cs
+		}
+
+		header := make([]byte, []int{11, 7, 3, 0}[format])
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			return message{}, err
+		}
+
+		if format <= 2 {
+			cs.timestampField = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+			cs.extended = cs.timestampField == extendedTimestamp
+		}
+		if format <= 1 {
+			length, typeID := uint32(header[3])<<16|uint32(header[4])<<8|uint32(header[5]), header[6]
+			// Only the first chunk of a message may set its length and type
+			if cs.payload != nil && (length != cs.length || typeID != cs.typeID) {
+				return message{}, errMessageHeaderSwap
+			}
+			cs.length, cs.typeID = length, typeID
+		}
+		if format == 0 {
+			cs.streamID = binary.LittleEndian.Uint32(header[7:])
+		}
+
+		// Also repeated in the chunks that continue a message with an extended timestamp
+		if cs.extended {
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(c.r, b); err != nil {
+				return message{}, err
+			}
+			if format <= 2 {
+				cs.timestampField = binary.BigEndian.Uint32(b)
+			}
+		}
+
+		if cs.payload == nil {
+			if cs.length > maxMessageSize {
+				return message{}, errMessageTooLarge
+			}
+
+			if format == 0 {
+				cs.timestamp = cs.timestampField
+			} else {
+				cs.timestamp += cs.timestampField
+			}
+			// The payload grows with the chunks that arrive, a header alone reserves nothing
+			cs.payload = []byte{}
+		}
+
+		chunk := int(min(c.chunkSize, cs.length-uint32(len(cs.payload))))
+		if c.buffered+chunk > maxBufferedSize {
+			return message{}, errTooManyBuffered
+		}
+
+		start := len(cs.payload)
+		cs.payload = slices.Grow(cs.payload, chunk)[:start+chunk]
+		if _, err := io.ReadFull(c.r, cs.payload[start:]); err != nil {
+			return message{}, err
+		}
+		c.buffered += chunk
+
+		if uint32(len(cs.payload)) == cs.length {
+			msg := message{typeID: cs.typeID, streamID: cs.streamID, timestamp: cs.timestamp, payload: cs.payload}
+			c.buffered -= len(cs.payload)
+			cs.payload = nil
+			return msg, nil
+		}
+	}
+}
+
+// abort drops the partial message of a chunk stream
+func (c *chunkReader) abort(chunkStreamID uint32) {
+	if cs, ok := c.streams[chunkStreamID]; ok {
+		c.buffered -= len(cs.payload)
+		cs.payload = nil
+	}
+}
+
+// write sends payload as a message on chunkStreamID, which must be below 64
+func (c *chunkWriter) write(chunkStreamID uint32, typeID uint8, streamID uint32, payload []byte) error {
+	header := []byte{
+		byte(chunkStreamID),
+		0, 0, 0,
+		byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+		typeID,
+		0, 0, 0, 0,
+	}
+	binary.LittleEndian.PutUint32(header[8:], streamID)
+
+	buf := header
+	for len(payload) != 0 {
+		chunk := min(int(c.chunkSize), len(payload))
+		buf = append(buf, payload[:chunk]...)
+		payload = payload[chunk:]
+
+		if len(payload) != 0 {
+			buf = append(buf, 0xC0|byte(chunkStreamID))
+		}
+	}
+
+	_, err := c.w.Write(buf)
+	return err
+}
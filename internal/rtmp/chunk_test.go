@@ -0,0 +1,136 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// fullHeader is a format 0 chunk header of chunk stream 3
+func fullHeader(length int, typeID uint8) []byte {
+	return []byte{0x03, 0, 0, 0, byte(length >> 16), byte(length >> 8), byte(length), typeID, 1, 0, 0, 0}
+}
+
+// lengthHeader is a format 1 chunk header of chunk stream 3
+func lengthHeader(length int, typeID uint8) []byte {
+	return []byte{0x43, 0, 0, 0, byte(length >> 16), byte(length >> 8), byte(length), typeID}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestChunkReaderRead(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xAB}, 300)
+
+	manyStreams := []byte{}
+	for i := 0; i <= maxChunkStreams; i++ {
+		// Empty messages on chunk streams 64 and up
+		manyStreams = append(manyStreams, 0x00, byte(i), 0, 0, 0, 0, 0, 0, messageVideo, 1, 0, 0, 0)
+	}
+
+	for _, test := range []struct {
+		name    string
+		input   []byte
+		payload []byte
+		err     error
+	}{
+		{
+			name:    "single chunk",
+			input:   concat(fullHeader(100, messageVideo), payload[:100]),
+			payload: payload[:100],
+		},
+		{
+			name:    "continued by format 3 chunks",
+			input:   concat(fullHeader(300, messageVideo), payload[:128], []byte{0xC3}, payload[128:256], []byte{0xC3}, payload[256:]),
+			payload: payload,
+		},
+		{
+			name:    "empty message",
+			input:   fullHeader(0, messageVideo),
+			payload: []byte{},
+		},
+		{
+			name:  "length changed during a message",
+			input: concat(fullHeader(200, messageVideo), payload[:128], lengthHeader(1000, messageVideo), payload[:128]),
+			err:   errMessageHeaderSwap,
+		},
+		{
+			name:  "type changed during a message",
+			input: concat(fullHeader(200, messageVideo), payload[:128], lengthHeader(200, messageAudio), payload[:72]),
+			err:   errMessageHeaderSwap,
+		},
+		{
+			name:  "too many chunk streams",
+			input: manyStreams,
+			err:   errTooManyStreams,
+		},
+		{
+			name:  "starts without a full header",
+			input: concat([]byte{0xC3}, payload[:10]),
+			err:   errors.New("Chunk stream 3 starts without a full header"),
+		},
+		{
+			name:  "truncated",
+			input: concat(fullHeader(100, messageVideo), payload[:50]),
+			err:   io.ErrUnexpectedEOF,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newChunkReader(bytes.NewReader(test.input))
+			msg, err := c.read()
+			// Errors may only show after the first messages
+			for nextErr := err; nextErr == nil; {
+				_, nextErr = c.read()
+				if !errors.Is(nextErr, io.EOF) {
+					err = nextErr
+				}
+			}
+
+			switch {
+			case test.err == nil && err != nil:
+				t.Fatalf("Unexpected error %v", err)
+			case test.err != nil && (err == nil || (!errors.Is(err, test.err) && err.Error() != test.err.Error())):
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			case test.err == nil && !bytes.Equal(msg.payload, test.payload):
+				t.Fatalf("Expected payload of %d bytes, got %d", len(test.payload), len(msg.payload))
+			}
+		})
+	}
+}
+
+func TestChunkReaderBufferLimit(t *testing.T) {
+	// Three chunk streams each send all but the last byte of the largest message the header can announce
+	const length = 0xFFFFFF
+	input := []byte{}
+	for chunkStreamID := byte(3); chunkStreamID < 6; chunkStreamID++ {
+		header := fullHeader(length, messageVideo)
+		header[0] = chunkStreamID
+		input = append(append(input, header...), make([]byte, length-1)...)
+	}
+
+	c := newChunkReader(bytes.NewReader(input))
+	c.chunkSize = length - 1
+	if _, err := c.read(); !errors.Is(err, errTooManyBuffered) {
+		t.Fatalf("Expected %v, got %v", errTooManyBuffered, err)
+	}
+}
+
+func FuzzChunkReader(f *testing.F) {
+	f.Add(concat(fullHeader(100, messageVideo), bytes.Repeat([]byte{1}, 100)))
+	f.Add(concat(fullHeader(200, messageVideo), make([]byte, 128), lengthHeader(1000, messageVideo), make([]byte, 128)))
+	f.Add(concat(fullHeader(300, messageVideo), make([]byte, 128), []byte{0xC3}, make([]byte, 128), []byte{0xC3}, make([]byte, 44)))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		c := newChunkReader(bytes.NewReader(input))
+		for {
+			msg, err := c.read()
+			if err != nil {
+				return
+			} else if len(msg.payload) > maxMessageSize {
+				t.Fatalf("Message of %d bytes", len(msg.payload))
+			}
+		}
+	})
+}
@@ -0,0 +1,511 @@
+// Package rtmp accepts publishers that use RTMP, like encoders that predate WHIP. They publish to
+// rtmp://host/live/<streamkey>?token=<authtoken>, their H264 is fed into the stream the same way WHIP video is.
+package rtmp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	// Application publishers connect to, the path of their URL before the stream key
+	application = "live"
+
+	handshakeSize    = 1536
+	handshakeTimeout = 10 * time.Second
+
+	// A publisher that sends nothing for this long is disconnected
+	readTimeout         = 30 * time.Second
+	authenticateTimeout = 10 * time.Second
+	acceptRetryDelay    = time.Second
+
+	// Sizes announced to publishers after they connected
+	chunkSize     = 4096
+	windowAckSize = 2500000
+
+	publishStreamID = 1
+
+	chunkStreamControl = 2
+	chunkStreamCommand = 3
+	chunkStreamStatus  = 5
+
+	userControlStreamBegin = 0
+
+	flvKeyframe       = 1
+	flvCodecH264      = 7
+	flvExHeader       = 0x80
+	avcSequenceHeader = 0
+	avcNALU           = 1
+)
+
+// Authenticate returns the streamer that may publish to streamKey with token, nil if there is none
+type Authenticate func(ctx context.Context, streamKey, token string) *webrtc.Streamer
+
+type (
+	conn struct {
+		netConn net.Conn
+		reader  *chunkReader
+		writer  *chunkWriter
+
+		// Bytes received, the publisher waits for an acknowledgement every ackWindow bytes
+		received                *countingReader
+		ackWindow, acknowledged uint64
+
+		tcURL     string
+		publisher *webrtc.RTMPPublisher
+
+		// From the AVC sequence header, naluLengthSize is zero until it was received
+		sps, pps       [][]byte
+		naluLengthSize int
+	}
+
+	countingReader struct {
+		r io.Reader
+		n uint64
+	}
+)
+
+var (
+	listener     net.Listener
+	authenticate Authenticate
+
+	conns        = map[net.Conn]struct{}{}
+	connsClosed  bool
+	connsLock    sync.Mutex
+	connsRunning sync.WaitGroup
+
+	errInvalidAVCConfig = errors.New("Invalid AVC sequence header")
+)
+
+// Configure accepts RTMP publishers on RTMP_ADDRESS, like `:1935`. Nothing is listened on if it isn't set.
+func Configure(a Authenticate) (err error) {
+	address := os.Getenv("RTMP_ADDRESS")
+	if address == "" {
+		return nil
+	}
+
+	if listener, err = net.Listen("tcp", address); err != nil {
+		return err
+	}
+	authenticate = a
+
+	log.Println("Running RTMP Server at " + address)
+	go serve()
+	return nil
+}
+
+// Close stops accepting publishers and disconnects those that are connected, their streams end
+func Close(ctx context.Context) error {
+	if listener == nil {
+		return nil
+	}
+	err := listener.Close()
+
+	connsLock.Lock()
+	connsClosed = true
+	for c := range conns {
+		c.Close()
+	}
+	connsLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		connsRunning.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func serve() {
+	for {
+		netConn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Println(err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		connsLock.Lock()
+		if connsClosed {
+			connsLock.Unlock()
+			netConn.Close()
+			return
+		}
+		conns[netConn] = struct{}{}
+		connsRunning.Add(1)
+		connsLock.Unlock()
+
+		go func() {
+			defer func() {
+				connsLock.Lock()
+				delete(conns, netConn)
+				connsLock.Unlock()
+				connsRunning.Done()
+			}()
+			// A connection that hits a bug only ends itself, not every stream of the server
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("RTMP connection from %s panicked: %v", netConn.RemoteAddr(), r)
+				}
+			}()
+
+			if err := handle(netConn); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("RTMP connection from %s: %v", netConn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func handle(netConn net.Conn) error {
+	defer netConn.Close()
+
+	received := &countingReader{r: netConn}
+	c := &conn{
+		netConn:  netConn,
+		reader:   newChunkReader(received),
+		writer:   &chunkWriter{w: netConn, chunkSize: defaultChunkSize},
+		received: received,
+	}
+
+	if err := netConn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	} else if err = c.handshake(); err != nil {
+		return err
+	} else if err = netConn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	defer func() {
+		if c.publisher != nil {
+			c.publisher.Close()
+		}
+	}()
+
+	for {
+		if err := netConn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+
+		msg, err := c.reader.read()
+		if err != nil {
+			return err
+		}
+
+		if done, err := c.handleMessage(msg); err != nil || done {
+			return err
+		} else if err = c.acknowledge(); err != nil {
+			return err
+		}
+	}
+}
+
+// handshake is the simple handshake of the RTMP specification, publishers don't require the digest of Flash Player
+func (c *conn) handshake() error {
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(c.reader.r, c0c1); err != nil {
+		return err
+	} else if c0c1[0] != 3 {
+		return fmt.Errorf("Unsupported RTMP version %d", c0c1[0])
+	}
+
+	// S1 is a zero time, four zero bytes and random bytes, S2 echoes C1
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	s0s1s2[0] = 3
+	if _, err := rand.Read(s0s1s2[9 : 1+handshakeSize]); err != nil {
+		return err
+	}
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+	if _, err := c.netConn.Write(s0s1s2); err != nil {
+		return err
+	}
+
+	_, err := io.ReadFull(c.reader.r, make([]byte, handshakeSize))
+	return err
+}
+
+// handleMessage acts on a message of the publisher, done is set when the publisher stopped
+func (c *conn) handleMessage(msg message) (done bool, err error) {
+	switch msg.typeID {
+	case messageSetChunkSize:
+		if len(msg.payload) < 4 {
+			return false, errors.New("Invalid chunk size")
+		}
+
+		size := binary.BigEndian.Uint32(msg.payload) & 0x7FFFFFFF
+		if size == 0 || size > maxMessageSize {
+			return false, fmt.Errorf("Invalid chunk size %d", size)
+		}
+		c.reader.chunkSize = size
+	case messageAbort:
+		if len(msg.payload) >= 4 {
+			c.reader.abort(binary.BigEndian.Uint32(msg.payload))
+		}
+	case messageWindowAckSize:
+		if len(msg.payload) >= 4 {
+			c.ackWindow = uint64(binary.BigEndian.Uint32(msg.payload))
+		}
+	case messageCommandAMF3, messageCommandAMF0:
+		payload := msg.payload
+		// AMF3 commands start with a format byte, followed by AMF0 values
+		if msg.typeID == messageCommandAMF3 && len(payload) != 0 {
+			payload = payload[1:]
+		}
+
+		values, err := decodeAMF(payload)
+		if err != nil {
+			return false, err
+		}
+		return c.command(values)
+	case messageVideo:
+		return false, c.video(msg)
+	}
+
+	// Audio, metadata and user control events aren't needed
+	return false, nil
+}
+
+func (c *conn) command(values []any) (done bool, err error) {
+	if len(values) < 2 {
+		return false, nil
+	}
+
+	name, _ := values[0].(string)
+	transactionID, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		properties := map[string]any{}
+		if len(values) > 2 {
+			properties, _ = values[2].(map[string]any)
+		}
+
+		app, _ := properties["app"].(string)
+		app, _, _ = strings.Cut(app, "?")
+		if app = strings.Trim(app, "/"); app != application {
+			err = fmt.Errorf("Unknown application %q", app)
+			return true, errors.Join(err, c.sendCommand(chunkStreamCommand, 0, "_error", transactionID, nil, status("error", "NetConnection.Connect.Rejected", err.Error())))
+		}
+		c.tcURL, _ = properties["tcUrl"].(string)
+
+		windowAckSizePayload := binary.BigEndian.AppendUint32(nil, windowAckSize)
+		if err := c.writer.write(chunkStreamControl, messageWindowAckSize, 0, windowAckSizePayload); err != nil {
+			return false, err
+		} else if err = c.writer.write(chunkStreamControl, messageSetPeerBandwidth, 0, append(windowAckSizePayload, 2)); err != nil {
+			return false, err
+		} else if err = c.writer.write(chunkStreamControl, messageSetChunkSize, 0, binary.BigEndian.AppendUint32(nil, chunkSize)); err != nil {
+			return false, err
+		}
+		c.writer.chunkSize = chunkSize
+
+		return false, c.sendCommand(chunkStreamCommand, 0, "_result", transactionID,
+			map[string]any{"fmsVer": "FMS/3,0,1,123", "capabilities": float64(31)},
+			map[string]any{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": float64(0)},
+		)
+	case "releaseStream", "FCPublish":
+		return false, c.sendCommand(chunkStreamCommand, 0, "_result", transactionID, nil, nil)
+	case "createStream":
+		return false, c.sendCommand(chunkStreamCommand, 0, "_result", transactionID, nil, float64(publishStreamID))
+	case "publish":
+		if len(values) < 4 {
+			return false, errors.New("publish without a stream key")
+		}
+
+		name, _ := values[3].(string)
+		return false, c.publish(name)
+	case "FCUnpublish", "deleteStream", "closeStream":
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// publish starts the stream of name, the stream key followed by `?token=<authtoken>`. The token may also be part
+// of the URL the publisher connected to.
+func (c *conn) publish(name string) error {
+	if c.publisher != nil {
+		return errors.New("Already publishing")
+	}
+
+	streamKey, query, _ := strings.Cut(name, "?")
+	params, _ := url.ParseQuery(query)
+	token := params.Get("token")
+	if tcURL, err := url.Parse(c.tcURL); token == "" && err == nil {
+		token = tcURL.Query().Get("token")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authenticateTimeout)
+	streamer := authenticate(ctx, streamKey, token)
+	cancel()
+	if streamer == nil {
+		err := errors.New("Not an authorized streamer")
+		return errors.Join(err, c.sendStatus("error", "NetStream.Publish.Denied", err.Error()))
+	}
+
+	publisher, err := webrtc.RTMP(streamer, c.netConn)
+	if errors.Is(err, webrtc.ErrStreamAlreadyLive) {
+		return errors.Join(err, c.sendStatus("error", "NetStream.Publish.BadName", err.Error()))
+	} else if err != nil {
+		return errors.Join(err, c.sendStatus("error", "NetStream.Publish.Failed", err.Error()))
+	}
+	c.publisher = publisher
+
+	userControl := binary.BigEndian.AppendUint16(nil, userControlStreamBegin)
+	if err = c.writer.write(chunkStreamControl, messageUserControl, 0, binary.BigEndian.AppendUint32(userControl, publishStreamID)); err != nil {
+		return err
+	}
+	return c.sendStatus("status", "NetStream.Publish.Start", "Publishing "+streamKey+".")
+}
+
+// video forwards the H264 of a FLV video tag. Keyframes are sent with the SPS and PPS of the sequence header, so
+// viewers that join can decode them.
+func (c *conn) video(msg message) error {
+	payload := msg.payload
+	if c.publisher == nil || len(payload) < 5 {
+		return nil
+	}
+
+	frameType, codecID := payload[0]>>4, payload[0]&0x0F
+	if payload[0]&flvExHeader != 0 || codecID != flvCodecH264 {
+		return errors.New("Only H264 video is supported")
+	}
+
+	switch payload[1] {
+	case avcSequenceHeader:
+		return c.parseAVCConfig(payload[5:])
+	case avcNALU:
+		if c.naluLengthSize == 0 {
+			return nil
+		}
+
+		nalus := [][]byte{}
+		for b := payload[5:]; len(b) != 0; {
+			nalu, rest, ok := lengthPrefixed(b, c.naluLengthSize)
+			if !ok {
+				return errors.New("Invalid H264 NALU length")
+			}
+			nalus, b = append(nalus, nalu), rest
+		}
+
+		if frameType == flvKeyframe && !hasSPS(nalus) {
+			nalus = append(append(append([][]byte{}, c.sps...), c.pps...), nalus...)
+		}
+
+		// The composition time offset is signed and 24 bit
+		compositionTime := int32(uint32(payload[2])<<24|uint32(payload[3])<<16|uint32(payload[4])<<8) >> 8
+		return c.publisher.WriteH264(nalus, time.Duration(int64(msg.timestamp)+int64(compositionTime))*time.Millisecond)
+	}
+
+	return nil
+}
+
+// parseAVCConfig reads the SPS, PPS and NALU length of an AVCDecoderConfigurationRecord
+func (c *conn) parseAVCConfig(b []byte) error {
+	if len(b) < 6 {
+		return errInvalidAVCConfig
+	}
+
+	naluLengthSize := int(b[4]&0x03) + 1
+	sps, pps := [][]byte{}, [][]byte{}
+
+	count := int(b[5] & 0x1F)
+	b = b[6:]
+	for i := 0; i < count; i++ {
+		nalu, rest, ok := lengthPrefixed(b, 2)
+		if !ok {
+			return errInvalidAVCConfig
+		}
+		sps, b = append(sps, nalu), rest
+	}
+
+	if len(b) < 1 {
+		return errInvalidAVCConfig
+	}
+	count = int(b[0])
+	b = b[1:]
+	for i := 0; i < count; i++ {
+		nalu, rest, ok := lengthPrefixed(b, 2)
+		if !ok {
+			return errInvalidAVCConfig
+		}
+		pps, b = append(pps, nalu), rest
+	}
+
+	c.sps, c.pps, c.naluLengthSize = sps, pps, naluLengthSize
+	return nil
+}
+
+func (c *conn) sendCommand(chunkStreamID, streamID uint32, values ...any) error {
+	return c.writer.write(chunkStreamID, messageCommandAMF0, streamID, encodeAMF(values...))
+}
+
+func (c *conn) sendStatus(level, code, description string) error {
+	return c.sendCommand(chunkStreamStatus, publishStreamID, "onStatus", float64(0), nil, status(level, code, description))
+}
+
+// acknowledge tells the publisher how much was received once it sent a window worth of bytes
+func (c *conn) acknowledge() error {
+	if c.ackWindow == 0 || c.received.n-c.acknowledged < c.ackWindow {
+		return nil
+	}
+
+	c.acknowledged = c.received.n
+	return c.writer.write(chunkStreamControl, messageAcknowledgement, 0, binary.BigEndian.AppendUint32(nil, uint32(c.received.n)))
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += uint64(n)
+	return n, err
+}
+
+func status(level, code, description string) map[string]any {
+	return map[string]any{"level": level, "code": code, "description": description}
+}
+
+// lengthPrefixed splits b after a big endian length of size bytes and the bytes it counts
+func lengthPrefixed(b []byte, size int) (value, rest []byte, ok bool) {
+	if len(b) < size {
+		return nil, nil, false
+	}
+
+	length := 0
+	for _, l := range b[:size] {
+		length = length<<8 | int(l)
+	}
+
+	if len(b) < size+length {
+		return nil, nil, false
+	}
+	return b[size : size+length], b[size+length:], true
+}
+
+func hasSPS(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		if len(nalu) != 0 && nalu[0]&0x1F == 7 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,197 @@
+// Package scheduler runs periodic maintenance jobs, like flushing analytics, sweeping expired tokens or checking
+// certificates. Every job runs in its own goroutine, one run at a time, and reports how its last run went.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/metrics"
+)
+
+// Runs are spread by up to this fraction of their interval, so instances started together don't hit Postgres at once
+const jitter = 0.1
+
+type (
+	// Status is how a job did so far
+	Status struct {
+		Name            string     `json:"name"`
+		IntervalSeconds float64    `json:"intervalSeconds"`
+		Running         bool       `json:"running"`
+		Runs            uint64     `json:"runs"`
+		Failures        uint64     `json:"failures"`
+		LastRunAt       *time.Time `json:"lastRunAt,omitempty"`
+		LastSuccessAt   *time.Time `json:"lastSuccessAt,omitempty"`
+		// Seconds the last run took
+		LastDuration float64   `json:"lastDuration"`
+		LastError    string    `json:"lastError,omitempty"`
+		NextRunAt    time.Time `json:"nextRunAt"`
+	}
+
+	job struct {
+		interval time.Duration
+		run      func(context.Context) error
+
+		lock   sync.Mutex
+		status Status
+	}
+)
+
+var (
+	jobs     = map[string]*job{}
+	jobsLock sync.Mutex
+
+	jobRuns     *metrics.CounterVec
+	metricsOnce sync.Once
+
+	// Closed by Stop, runs in progress are waited for
+	stopping    = make(chan struct{})
+	stopOnce    sync.Once
+	runsRunning sync.WaitGroup
+)
+
+// Register runs run every interval, give or take the jitter, until Stop is called. A run gets the interval as
+// deadline, errors and panics are logged and kept as its status.
+func Register(name string, interval time.Duration, run func(context.Context) error) {
+	metricsOnce.Do(configureMetrics)
+
+	j := &job{interval: interval, run: run, status: Status{Name: name, IntervalSeconds: interval.Seconds()}}
+
+	jobsLock.Lock()
+	if _, ok := jobs[name]; ok {
+		jobsLock.Unlock()
+		panic("scheduler: job " + name + " is registered twice")
+	}
+	jobs[name] = j
+	jobsLock.Unlock()
+
+	go j.loop()
+}
+
+// Stop ends every job and waits for runs in progress until ctx is done
+func Stop(ctx context.Context) error {
+	stopOnce.Do(func() { close(stopping) })
+
+	done := make(chan struct{})
+	go func() {
+		runsRunning.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Jobs returns the status of every job by name
+func Jobs() []Status {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	statuses := make([]Status, 0, len(jobs))
+	for _, j := range jobs {
+		statuses = append(statuses, j.getStatus())
+	}
+
+	sort.Slice(statuses, func(i, k int) bool {
+		return statuses[i].Name < statuses[k].Name
+	})
+	return statuses
+}
+
+func (j *job) loop() {
+	for {
+		delay := j.interval + time.Duration((rand.Float64()*2-1)*jitter*float64(j.interval))
+
+		j.lock.Lock()
+		j.status.NextRunAt = time.Now().Add(delay)
+		j.lock.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-stopping:
+			return
+		}
+
+		runsRunning.Add(1)
+		j.runOnce()
+		runsRunning.Done()
+	}
+}
+
+func (j *job) runOnce() {
+	startedAt := time.Now()
+
+	j.lock.Lock()
+	j.status.Running = true
+	j.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), j.interval)
+	defer cancel()
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+
+		return j.run(ctx)
+	}()
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastRunAt = &startedAt
+	j.status.LastDuration = time.Since(startedAt).Seconds()
+	if err != nil {
+		log.Printf("Job %s failed: %v", j.status.Name, err)
+		j.status.Failures++
+		j.status.LastError = err.Error()
+		jobRuns.Inc(j.status.Name, "failure")
+		return
+	}
+
+	j.status.LastSuccessAt = &startedAt
+	j.status.LastError = ""
+	jobRuns.Inc(j.status.Name, "success")
+}
+
+func (j *job) getStatus() Status {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.status
+}
+
+func configureMetrics() {
+	jobRuns = metrics.NewCounterVec("broadcast_box_job_runs_total", "Runs of maintenance jobs", "job", "result")
+	metrics.NewGaugeFunc("broadcast_box_job_last_success_timestamp_seconds", "Unix time the last successful run of a maintenance job started", func() []metrics.Sample {
+		samples := []metrics.Sample{}
+		for _, s := range Jobs() {
+			if s.LastSuccessAt != nil {
+				samples = append(samples, metrics.Sample{LabelValues: []string{s.Name}, Value: float64(s.LastSuccessAt.Unix())})
+			}
+		}
+		return samples
+	}, "job")
+	metrics.NewGaugeFunc("broadcast_box_job_duration_seconds", "Seconds the last run of a maintenance job took", func() []metrics.Sample {
+		samples := []metrics.Sample{}
+		for _, s := range Jobs() {
+			if s.LastRunAt != nil {
+				samples = append(samples, metrics.Sample{LabelValues: []string{s.Name}, Value: s.LastDuration})
+			}
+		}
+		return samples
+	}, "job")
+}
@@ -0,0 +1,218 @@
+// Package sessionstore shares WHEP sessions between Broadcast Box instances via Redis. Any instance can
+// answer the SSE and layer endpoints of a session, so load balancers don't need sticky sessions.
+package sessionstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	keyPrefix     = "broadcast-box:whep:"
+	channelPrefix = "broadcast-box:node:"
+
+	// Sessions are refreshed every refreshInterval and expire if their instance stops refreshing them
+	refreshInterval = 5 * time.Second
+	sessionTTL      = 3 * refreshInterval
+)
+
+// ErrUnknownSession is returned for sessions that no instance has registered
+var ErrUnknownSession = errors.New("WHEP session does not exist")
+
+type (
+	// Callbacks into the WHEP implementation of this instance
+	Callbacks struct {
+		// Layers returns the layers event of a local session, an error once the session ended
+		Layers func(whepSessionId string) ([]byte, error)
+		// ApplyLayerRequest handles a layer request that another instance received for a local session
+		ApplyLayerRequest func(whepSessionId string, body []byte)
+		// Delete ends a local session that another instance received a DELETE for
+		Delete func(whepSessionId string)
+	}
+
+	forwardedRequest struct {
+		WHEPSessionId string          `json:"whepSessionId"`
+		Body          json.RawMessage `json:"body,omitempty"`
+		Delete        bool            `json:"delete,omitempty"`
+	}
+)
+
+var (
+	client    *redis.Client
+	pubsub    *redis.PubSub
+	nodeId    string
+	callbacks Callbacks
+	closed    = make(chan struct{})
+
+	localSessions     = map[string]string{}
+	localSessionsLock sync.Mutex
+)
+
+// Configure connects to REDIS_URL. The store is disabled if it isn't set.
+func Configure(c Callbacks) error {
+	if os.Getenv("REDIS_URL") == "" {
+		return nil
+	}
+
+	opts, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+	if err != nil {
+		return err
+	}
+
+	client, nodeId, callbacks = redis.NewClient(opts), uuid.New().String(), c
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return err
+	}
+
+	pubsub = client.Subscribe(context.Background(), channelPrefix+nodeId)
+	go subscribe()
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				refresh()
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close removes the sessions of this instance from the store and disconnects from Redis
+func Close(ctx context.Context) error {
+	if !Enabled() {
+		return nil
+	}
+	close(closed)
+
+	localSessionsLock.Lock()
+	keys := []string{}
+	for whepSessionId := range localSessions {
+		keys = append(keys, keyPrefix+whepSessionId)
+	}
+	localSessionsLock.Unlock()
+
+	errs := []error{}
+	if len(keys) != 0 {
+		errs = append(errs, client.Del(ctx, keys...).Err())
+	}
+	return errors.Join(append(errs, pubsub.Close(), client.Close())...)
+}
+
+func Enabled() bool {
+	return client != nil
+}
+
+// Register announces a WHEP session of this instance
+func Register(whepSessionId, streamKey string) {
+	if !Enabled() {
+		return
+	}
+
+	localSessionsLock.Lock()
+	localSessions[whepSessionId] = streamKey
+	localSessionsLock.Unlock()
+
+	store(context.Background(), whepSessionId, streamKey)
+}
+
+// Layers returns the last layers event the owning instance stored for a session
+func Layers(ctx context.Context, whepSessionId string) ([]byte, error) {
+	layers, err := client.HGet(ctx, keyPrefix+whepSessionId, "layers").Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrUnknownSession
+	}
+
+	return layers, err
+}
+
+// Forward sends a layer request to the instance that owns the session
+func Forward(ctx context.Context, whepSessionId string, body []byte) error {
+	return forward(ctx, forwardedRequest{WHEPSessionId: whepSessionId, Body: body})
+}
+
+// ForwardDelete asks the instance that owns the session to end it
+func ForwardDelete(ctx context.Context, whepSessionId string) error {
+	return forward(ctx, forwardedRequest{WHEPSessionId: whepSessionId, Delete: true})
+}
+
+func forward(ctx context.Context, r forwardedRequest) error {
+	node, err := client.HGet(ctx, keyPrefix+r.WHEPSessionId, "node").Result()
+	if errors.Is(err, redis.Nil) {
+		return ErrUnknownSession
+	} else if err != nil {
+		return err
+	}
+
+	msg, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return client.Publish(ctx, channelPrefix+node, msg).Err()
+}
+
+func subscribe() {
+	for msg := range pubsub.Channel() {
+		var r forwardedRequest
+		if err := json.Unmarshal([]byte(msg.Payload), &r); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if r.Delete {
+			callbacks.Delete(r.WHEPSessionId)
+		} else {
+			callbacks.ApplyLayerRequest(r.WHEPSessionId, r.Body)
+		}
+	}
+}
+
+func store(ctx context.Context, whepSessionId, streamKey string) {
+	layers, err := callbacks.Layers(whepSessionId)
+	if err != nil {
+		localSessionsLock.Lock()
+		delete(localSessions, whepSessionId)
+		localSessionsLock.Unlock()
+
+		if err := client.Del(ctx, keyPrefix+whepSessionId).Err(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	key := keyPrefix + whepSessionId
+	if _, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "node", nodeId, "streamKey", streamKey, "layers", layers)
+		pipe.Expire(ctx, key, sessionTTL)
+		return nil
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+func refresh() {
+	localSessionsLock.Lock()
+	sessions := make(map[string]string, len(localSessions))
+	for whepSessionId, streamKey := range localSessions {
+		sessions[whepSessionId] = streamKey
+	}
+	localSessionsLock.Unlock()
+
+	for whepSessionId, streamKey := range sessions {
+		store(context.Background(), whepSessionId, streamKey)
+	}
+}
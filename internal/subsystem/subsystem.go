@@ -0,0 +1,201 @@
+// Package subsystem starts the parts of the server, like the database, the WebRTC engine or the HTTP listeners, in
+// the order of their dependencies and stops them in reverse. A subsystem that fails to start stops those started
+// before it, instead of exiting with the others still running.
+package subsystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds Start and Stop of subsystems without a Timeout
+const DefaultTimeout = 10 * time.Second
+
+// Subsystem is a part of the server with its own lifecycle
+type Subsystem struct {
+	Name string
+	// Subsystems that must be running before this one starts, it is stopped before them
+	DependsOn []string
+	Start     func(ctx context.Context) error
+	// Optional, for subsystems that only read their configuration
+	Stop func(ctx context.Context) error
+	// Bounds Start and Stop each
+	Timeout time.Duration
+}
+
+var (
+	subsystems     = map[string]*Subsystem{}
+	order          []string
+	started        []*Subsystem
+	subsystemsLock sync.Mutex
+
+	failures = make(chan error, 1)
+)
+
+// Register adds a subsystem. Subsystems are registered before Run, in any order.
+func Register(s Subsystem) {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+
+	if _, ok := subsystems[s.Name]; ok {
+		panic("subsystem: " + s.Name + " is registered twice")
+	}
+	if s.Timeout == 0 {
+		s.Timeout = DefaultTimeout
+	}
+
+	subsystems[s.Name] = &s
+	order = append(order, s.Name)
+}
+
+// Fail reports that a running subsystem broke, like a listener that stopped serving. Run stops every subsystem and
+// returns err.
+func Fail(name string, err error) {
+	select {
+	case failures <- fmt.Errorf("%s failed: %w", name, err):
+	default:
+	}
+}
+
+// Run starts every subsystem and blocks until ctx is done or a subsystem failed, then stops them. The error of a
+// failed start or subsystem is logged and returned after the others were stopped.
+func Run(ctx context.Context) error {
+	if err := start(); err != nil {
+		log.Printf("Shutting down, %v", err)
+		stop()
+		return err
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Println("Shutting down")
+	case err = <-failures:
+		log.Printf("Shutting down, %v", err)
+	}
+
+	stop()
+	return err
+}
+
+// sorted returns the subsystems so each comes after its dependencies, in the order they were registered otherwise
+func sorted() ([]*Subsystem, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := map[string]int{}
+	result := []*Subsystem{}
+
+	var visit func(name, dependent string) error
+	visit = func(name, dependent string) error {
+		s, ok := subsystems[name]
+		if !ok {
+			return fmt.Errorf("%s depends on %s, which is not registered", dependent, name)
+		}
+
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("%s and %s depend on each other", dependent, name)
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, dependency := range s.DependsOn {
+			if err := visit(dependency, name); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+
+		result = append(result, s)
+		return nil
+	}
+
+	for _, name := range order {
+		if err := visit(name, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func start() error {
+	subsystemsLock.Lock()
+	all, err := sorted()
+	subsystemsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range all {
+		startedAt := time.Now()
+		if err := call(s.Start, s.Timeout); err != nil {
+			return fmt.Errorf("Starting %s failed: %w", s.Name, err)
+		}
+
+		subsystemsLock.Lock()
+		started = append(started, s)
+		subsystemsLock.Unlock()
+
+		log.Printf("Started %s in %s", s.Name, time.Since(startedAt).Round(time.Millisecond))
+	}
+
+	return nil
+}
+
+// stop stops the started subsystems in reverse order. A subsystem that fails or times out is logged, the ones it
+// depends on are still stopped.
+func stop() {
+	subsystemsLock.Lock()
+	toStop := started
+	started = nil
+	subsystemsLock.Unlock()
+
+	for i := len(toStop) - 1; i >= 0; i-- {
+		s := toStop[i]
+		if s.Stop == nil {
+			continue
+		}
+
+		stoppedAt := time.Now()
+		if err := call(s.Stop, s.Timeout); err != nil {
+			log.Printf("Stopping %s failed: %v", s.Name, err)
+			continue
+		}
+
+		log.Printf("Stopped %s in %s", s.Name, time.Since(stoppedAt).Round(time.Millisecond))
+	}
+}
+
+// call runs f with a deadline of timeout. A f that ignores its context is abandoned when the deadline passed.
+func call(f func(context.Context) error, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+
+		done <- f(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.New("timed out after " + timeout.String())
+	}
+}
@@ -0,0 +1,282 @@
+// Package tokenexchange verifies the session a viewer has on the operator's main site, so it can be exchanged
+// for a playback token. Sessions are JWTs signed with SSO_JWT_SECRET, or are checked by SSO_INTROSPECTION_URL.
+package tokenexchange
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCookieName    = "session"
+	introspectionTimeout = 10 * time.Second
+)
+
+var (
+	ErrNoSession = errors.New("No platform session")
+	ErrDenied    = errors.New("Platform session does not allow playback")
+
+	introspectionClient = &http.Client{Timeout: introspectionTimeout}
+)
+
+type (
+	jwtHeader struct {
+		Alg string `json:"alg"`
+	}
+
+	jwtClaims struct {
+		Sub     string          `json:"sub"`
+		Exp     int64           `json:"exp"`
+		Nbf     int64           `json:"nbf"`
+		Aud     json.RawMessage `json:"aud"`
+		Streams []string        `json:"streams"`
+	}
+
+	introspectionRequest struct {
+		StreamKey string `json:"streamKey,omitempty"`
+	}
+
+	introspectionResponse struct {
+		Allow     bool   `json:"allow"`
+		ExpiresIn int64  `json:"expiresIn"`
+		Subject   string `json:"subject"`
+	}
+)
+
+// Enabled reports if platform sessions can be exchanged for playback tokens
+func Enabled() bool {
+	return os.Getenv("SSO_JWT_SECRET") != "" || os.Getenv("SSO_INTROSPECTION_URL") != ""
+}
+
+// Authorize checks that the platform session of req allows playback of streamKey. It returns when the
+// session expires, the zero time if that is unknown.
+func Authorize(req *http.Request, streamKey string) (time.Time, error) {
+	if secret := os.Getenv("SSO_JWT_SECRET"); secret != "" {
+		session := sessionFromRequest(req)
+		if session == "" {
+			return time.Time{}, ErrNoSession
+		}
+
+		return verifyJWT(session, secret, streamKey)
+	}
+
+	r, err := introspect(req, streamKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if r.ExpiresIn > 0 {
+		return time.Now().Add(time.Duration(r.ExpiresIn) * time.Second), nil
+	}
+	return time.Time{}, nil
+}
+
+// Viewer checks that the platform session of req allows playback of streamKey like Authorize, and returns its subject
+func Viewer(req *http.Request, streamKey string) (string, error) {
+	if secret := os.Getenv("SSO_JWT_SECRET"); secret != "" {
+		session := sessionFromRequest(req)
+		if session == "" {
+			return "", ErrNoSession
+		}
+
+		claims, err := verifyJWTClaims(session, secret)
+		if err != nil {
+			return "", err
+		} else if !claims.allowsStream(streamKey) || claims.Sub == "" {
+			return "", ErrDenied
+		}
+		return claims.Sub, nil
+	}
+
+	r, err := introspect(req, streamKey)
+	if err != nil {
+		return "", err
+	} else if r.Subject == "" {
+		return "", ErrDenied
+	}
+	return r.Subject, nil
+}
+
+// Identify returns the subject of the platform session of req, the `sub` claim of a JWT or the `subject` the
+// introspection URL answered with
+func Identify(req *http.Request) (string, error) {
+	if secret := os.Getenv("SSO_JWT_SECRET"); secret != "" {
+		session := sessionFromRequest(req)
+		if session == "" {
+			return "", ErrNoSession
+		}
+
+		claims, err := verifyJWTClaims(session, secret)
+		if err != nil {
+			return "", err
+		} else if claims.Sub == "" {
+			return "", ErrDenied
+		}
+		return claims.Sub, nil
+	}
+
+	r, err := introspect(req, "")
+	if err != nil {
+		return "", err
+	} else if r.Subject == "" {
+		return "", ErrDenied
+	}
+	return r.Subject, nil
+}
+
+// sessionFromRequest returns the bearer token of req, or the session cookie of the platform
+func sessionFromRequest(req *http.Request) string {
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+
+	cookieName := os.Getenv("SSO_COOKIE_NAME")
+	if cookieName == "" {
+		cookieName = defaultCookieName
+	}
+
+	if cookie, err := req.Cookie(cookieName); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// verifyJWT checks a HS256 JWT. If it has a streams claim streamKey or "*" must be listed in it.
+func verifyJWT(token, secret, streamKey string) (time.Time, error) {
+	claims, err := verifyJWTClaims(token, secret)
+	if err != nil {
+		return time.Time{}, err
+	} else if !claims.allowsStream(streamKey) {
+		return time.Time{}, ErrDenied
+	}
+
+	return time.Unix(claims.Exp, 0), nil
+}
+
+// allowsStream reports if the streams claim, if there is one, lists streamKey or "*"
+func (c jwtClaims) allowsStream(streamKey string) bool {
+	return c.Streams == nil || slices.Contains(c.Streams, streamKey) || slices.Contains(c.Streams, "*")
+}
+
+// verifyJWTClaims checks the signature, lifetime and audience of a HS256 JWT and returns its claims
+func verifyJWTClaims(token, secret string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, ErrDenied
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return jwtClaims{}, ErrDenied
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return jwtClaims{}, ErrDenied
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return jwtClaims{}, ErrDenied
+	}
+
+	now := time.Now().Unix()
+	switch {
+	case claims.Exp == 0 || now >= claims.Exp:
+		return jwtClaims{}, ErrDenied
+	case claims.Nbf != 0 && now < claims.Nbf:
+		return jwtClaims{}, ErrDenied
+	case !audienceMatches(claims.Aud, os.Getenv("SSO_JWT_AUDIENCE")):
+		return jwtClaims{}, ErrDenied
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(decoded, v)
+}
+
+// audienceMatches checks the aud claim, which may be a string or a list, if an audience is required
+func audienceMatches(aud json.RawMessage, required string) bool {
+	if required == "" {
+		return true
+	}
+
+	var single string
+	if err := json.Unmarshal(aud, &single); err == nil {
+		return single == required
+	}
+
+	var list []string
+	if err := json.Unmarshal(aud, &list); err == nil {
+		return slices.Contains(list, required)
+	}
+
+	return false
+}
+
+// introspect forwards the cookies and Authorization header of req to SSO_INTROSPECTION_URL, which
+// answers with `{"allow": true, "expiresIn": <seconds>, "subject": "..."}`. streamKey is left out when identifying the session.
+func introspect(req *http.Request, streamKey string) (*introspectionResponse, error) {
+	if req.Header.Get("Authorization") == "" && req.Header.Get("Cookie") == "" {
+		return nil, ErrNoSession
+	}
+
+	body, err := json.Marshal(introspectionRequest{StreamKey: streamKey})
+	if err != nil {
+		return nil, err
+	}
+
+	introspectionReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, os.Getenv("SSO_INTROSPECTION_URL"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	introspectionReq.Header.Set("Content-Type", "application/json")
+	for _, header := range []string{"Authorization", "Cookie"} {
+		if val := req.Header.Get(header); val != "" {
+			introspectionReq.Header.Set(header, val)
+		}
+	}
+
+	res, err := introspectionClient.Do(introspectionReq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return nil, ErrDenied
+	case res.StatusCode >= 300:
+		return nil, fmt.Errorf("Unexpected HTTP StatusCode %d", res.StatusCode)
+	}
+
+	var r introspectionResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, err
+	} else if !r.Allow {
+		return nil, ErrDenied
+	}
+
+	return &r, nil
+}
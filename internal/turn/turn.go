@@ -0,0 +1,106 @@
+// Package turn vends short-lived credentials for a shared TURN fleet, using the TURN REST API scheme that coturn
+// implements with `use-auth-secret`. Viewers never see the shared secret, and a leaked credential expires on its own.
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCredentialTTL = 10 * time.Minute
+
+type (
+	// ICEServer is an RTCIceServer of the WebRTC API
+	ICEServer struct {
+		URLs       []string `json:"urls"`
+		Username   string   `json:"username,omitempty"`
+		Credential string   `json:"credential,omitempty"`
+	}
+
+	// ICEConfig can be passed to `new RTCPeerConnection()` as it is
+	ICEConfig struct {
+		ICEServers []ICEServer `json:"iceServers"`
+		// When the TURN credentials expire, nil if there are none
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	}
+)
+
+var (
+	servers       []string
+	secret        string
+	credentialTTL = defaultCredentialTTL
+)
+
+// Configure reads TURN_SERVERS, TURN_SECRET and TURN_CREDENTIAL_TTL
+func Configure() error {
+	if val := os.Getenv("TURN_SERVERS"); val != "" {
+		servers = strings.Split(val, "|")
+	}
+
+	secret = os.Getenv("TURN_SECRET")
+	if len(servers) != 0 && secret == "" {
+		return errors.New("TURN_SERVERS requires TURN_SECRET")
+	}
+
+	if val := os.Getenv("TURN_CREDENTIAL_TTL"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil || seconds <= 0 {
+			return errors.New("TURN_CREDENTIAL_TTL must be a number of seconds")
+		}
+		credentialTTL = time.Duration(seconds) * time.Second
+	}
+
+	return nil
+}
+
+// Enabled reports if TURN_SERVERS are configured
+func Enabled() bool {
+	return len(servers) != 0
+}
+
+// Config returns the ICE servers for a viewer of streamKey, the STUN servers and the TURN servers with credentials
+// of their own. The credentials expire after TURN_CREDENTIAL_TTL, or at notAfter if it is earlier and not zero.
+func Config(streamKey string, notAfter time.Time) (ICEConfig, error) {
+	config := ICEConfig{ICEServers: []ICEServer{}}
+	if stunServers := os.Getenv("STUN_SERVERS"); stunServers != "" {
+		for _, stunServer := range strings.Split(stunServers, "|") {
+			config.ICEServers = append(config.ICEServers, ICEServer{URLs: []string{"stun:" + stunServer}})
+		}
+	}
+
+	if !Enabled() {
+		return config, nil
+	}
+
+	expiresAt := time.Now().Add(credentialTTL)
+	if !notAfter.IsZero() && notAfter.Before(expiresAt) {
+		expiresAt = notAfter
+	}
+
+	// Every session gets a username of its own, so TURN servers can tell them apart in their logs and quotas
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return ICEConfig{}, err
+	}
+
+	username := strconv.FormatInt(expiresAt.Unix(), 10) + ":" + streamKey + ":" + hex.EncodeToString(nonce)
+	config.ICEServers = append(config.ICEServers, ICEServer{URLs: servers, Username: username, Credential: credential(username)})
+	config.ExpiresAt = &expiresAt
+
+	return config, nil
+}
+
+// credential is the password a TURN server with the same secret derives from username, the scheme mandates HMAC-SHA1
+func credential(username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
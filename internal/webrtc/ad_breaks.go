@@ -0,0 +1,204 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+const (
+	AdBreakStart = "start"
+	AdBreakEnd   = "end"
+)
+
+var (
+	ErrAdBreakActive   = errors.New("An ad break was already started")
+	ErrNoActiveAdBreak = errors.New("No ad break was started")
+)
+
+type (
+	// AdBreak marks the start or end of an ad break on a stream, for downstream ad insertion. It is the
+	// equivalent of a SCTE-35 splice_insert, see SCTE35.
+	AdBreak struct {
+		// Same for the start and end of a break
+		ID    uint32 `json:"id"`
+		State string `json:"state"`
+		// Planned length of a break in seconds, zero if it is ended explicitly
+		Duration float64   `json:"duration,omitempty"`
+		Time     time.Time `json:"time"`
+	}
+
+	// adBreakMessage is sent to viewers with a DataChannel
+	adBreakMessage struct {
+		Type string `json:"type"`
+		AdBreak
+	}
+
+	activeAdBreak struct {
+		adBreak AdBreak
+		timer   *time.Timer
+	}
+)
+
+// StartAdBreak signals the start of an ad break on a live stream. Breaks with a duration end on their own.
+func StartAdBreak(streamKey string, duration time.Duration) (AdBreak, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() {
+		return AdBreak{}, errors.New("Stream is not live")
+	} else if stream.adBreak != nil {
+		return AdBreak{}, ErrAdBreakActive
+	}
+
+	stream.nextAdBreakID++
+	adBreak := AdBreak{ID: stream.nextAdBreakID, State: AdBreakStart, Duration: duration.Seconds(), Time: time.Now()}
+	stream.adBreak = &activeAdBreak{adBreak: adBreak}
+
+	if duration > 0 {
+		stream.adBreak.timer = time.AfterFunc(duration, func() {
+			streamMapLock.Lock()
+			defer streamMapLock.Unlock()
+
+			if stream.adBreak != nil && stream.adBreak.adBreak.ID == adBreak.ID {
+				stream.endAdBreak(streamKey)
+			}
+		})
+	}
+
+	stream.signalAdBreak(streamKey, adBreak)
+	return adBreak, nil
+}
+
+// EndAdBreak signals the end of the ad break of a stream
+func EndAdBreak(streamKey string) (AdBreak, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || stream.adBreak == nil {
+		return AdBreak{}, ErrNoActiveAdBreak
+	}
+
+	return stream.endAdBreak(streamKey), nil
+}
+
+// endAdBreak must be called with streamMapLock held
+func (s *stream) endAdBreak(streamKey string) AdBreak {
+	if s.adBreak.timer != nil {
+		s.adBreak.timer.Stop()
+	}
+
+	adBreak := AdBreak{ID: s.adBreak.adBreak.ID, State: AdBreakEnd, Time: time.Now()}
+	s.adBreak = nil
+	s.signalAdBreak(streamKey, adBreak)
+	return adBreak
+}
+
+// signalAdBreak hands the marker to viewers, outputs and event subscribers. Must be called with streamMapLock held.
+func (s *stream) signalAdBreak(streamKey string, adBreak AdBreak) {
+	if msg, err := json.Marshal(adBreakMessage{Type: "adBreak", AdBreak: adBreak}); err != nil {
+		log.Println(err)
+	} else {
+		s.sendDataChannelMessage(msg)
+	}
+
+	s.sendMarkerToOutputs(&adBreak)
+
+	streamerName := ""
+	if s.streamer != nil {
+		streamerName = s.streamer.Name
+	}
+	events.Publish(events.Event{Type: events.AdBreak, StreamKey: streamKey, Streamer: streamerName, Tenant: s.tenant(), Data: adBreak})
+}
+
+// SCTE35 encodes the marker as a SCTE-35 splice_info_section with an immediate splice_insert, like it is
+// carried in the SCTE35-OUT and SCTE35-IN attributes of HLS EXT-X-DATERANGE tags
+func (a AdBreak) SCTE35() []byte {
+	command := &bitWriter{}
+	command.write(uint64(a.ID), 32) // splice_event_id
+	command.write(0, 1)             // splice_event_cancel_indicator
+	command.write(0x7F, 7)          // reserved
+
+	durationFlag := a.State == AdBreakStart && a.Duration > 0
+	command.write(boolBit(a.State == AdBreakStart), 1) // out_of_network_indicator
+	command.write(1, 1)                                // program_splice_flag
+	command.write(boolBit(durationFlag), 1)            // duration_flag
+	command.write(1, 1)                                // splice_immediate_flag
+	command.write(1, 1)                                // event_id_compliance_flag
+	command.write(0x7, 3)                              // reserved
+	if durationFlag {
+		command.write(1, 1)    // auto_return
+		command.write(0x3F, 6) // reserved
+		command.write(uint64(a.Duration*90000), 33)
+	}
+	command.write(0, 16) // unique_program_id
+	command.write(0, 8)  // avail_num
+	command.write(0, 8)  // avails_expected
+
+	// Everything after section_length, including the CRC
+	sectionLength := 11 + len(command.bytes) + 2 + 4
+
+	section := &bitWriter{}
+	section.write(0xFC, 8) // table_id
+	section.write(0, 1)    // section_syntax_indicator
+	section.write(0, 1)    // private_indicator
+	section.write(0x3, 2)  // sap_type, not specified
+	section.write(uint64(sectionLength), 12)
+	section.write(0, 8)      // protocol_version
+	section.write(0, 1)      // encrypted_packet
+	section.write(0, 6)      // encryption_algorithm
+	section.write(0, 33)     // pts_adjustment
+	section.write(0, 8)      // cw_index
+	section.write(0xFFF, 12) // tier
+	section.write(uint64(len(command.bytes)), 12)
+	section.write(0x05, 8) // splice_command_type, splice_insert
+	section.bytes = append(section.bytes, command.bytes...)
+	section.write(0, 16) // descriptor_loop_length
+	section.write(uint64(mpeg2CRC32(section.bytes)), 32)
+
+	return section.bytes
+}
+
+// bitWriter writes big endian bit fields, they must add up to whole bytes before bytes are appended directly
+type bitWriter struct {
+	bytes []byte
+	bits  int
+}
+
+func (w *bitWriter) write(value uint64, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.bytes = append(w.bytes, 0)
+		}
+		w.bytes[len(w.bytes)-1] |= byte(value>>i&1) << (7 - w.bits%8)
+		w.bits++
+	}
+}
+
+func boolBit(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// mpeg2CRC32 is the CRC of MPEG-2 sections, which SCTE-35 uses
+func mpeg2CRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,154 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Resolved aliases are cached for this long, so viewers joining at once don't each query Postgres
+const streamAliasCacheTTL = 10 * time.Second
+
+// StreamAlias is a public name of a stream, viewers use it instead of the stream key
+type StreamAlias struct {
+	Alias     string `json:"alias"`
+	StreamKey string `json:"streamKey"`
+}
+
+type streamAliasCacheEntry struct {
+	streamKey string
+	expiresAt time.Time
+}
+
+// ErrStreamAliasTaken is returned when another streamer owns the alias
+var ErrStreamAliasTaken = errors.New("Alias is taken")
+
+var (
+	streamAliasCache     = map[string]streamAliasCacheEntry{}
+	streamAliasCacheLock sync.Mutex
+)
+
+// ResolveStreamAlias returns the stream key an alias points to, pgx.ErrNoRows if it is no alias
+func ResolveStreamAlias(pool *pgxpool.Pool, ctx context.Context, alias string) (string, error) {
+	streamAliasCacheLock.Lock()
+	entry, ok := streamAliasCache[alias]
+	streamAliasCacheLock.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		if entry.streamKey == "" {
+			return "", pgx.ErrNoRows
+		}
+		return entry.streamKey, nil
+	}
+
+	streamKey := ""
+	err := pool.QueryRow(ctx, `SELECT stream_key FROM stream_aliases WHERE alias = @alias`, pgx.NamedArgs{
+		"alias": alias,
+	}).Scan(&streamKey)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+
+	// Names that are no alias are cached too, most lookups are for plain stream keys
+	streamAliasCacheLock.Lock()
+	streamAliasCache[alias] = streamAliasCacheEntry{streamKey: streamKey, expiresAt: time.Now().Add(streamAliasCacheTTL)}
+	for cached, entry := range streamAliasCache {
+		if time.Now().After(entry.expiresAt) {
+			delete(streamAliasCache, cached)
+		}
+	}
+	streamAliasCacheLock.Unlock()
+
+	return streamKey, err
+}
+
+// GetStreamAliases returns the aliases of a streamer
+func GetStreamAliases(pool *pgxpool.Pool, ctx context.Context, owner string) ([]StreamAlias, error) {
+	rows, err := pool.Query(ctx, `SELECT alias, stream_key FROM stream_aliases WHERE owner = @owner ORDER BY alias`, pgx.NamedArgs{
+		"owner": owner,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (StreamAlias, error) {
+		var a StreamAlias
+		err := row.Scan(&a.Alias, &a.StreamKey)
+		return a, err
+	})
+}
+
+// GetAliasesOfStreamKeys returns the first alias of each of the given stream keys that has one
+func GetAliasesOfStreamKeys(pool *pgxpool.Pool, ctx context.Context, streamKeys []string) (map[string]string, error) {
+	rows, err := pool.Query(ctx, `SELECT alias, stream_key FROM stream_aliases WHERE stream_key = ANY(@streamKeys) ORDER BY alias`, pgx.NamedArgs{
+		"streamKeys": streamKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (StreamAlias, error) {
+		var a StreamAlias
+		err := row.Scan(&a.Alias, &a.StreamKey)
+		return a, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aliasOf := map[string]string{}
+	for _, a := range aliases {
+		if _, ok := aliasOf[a.StreamKey]; !ok {
+			aliasOf[a.StreamKey] = a.Alias
+		}
+	}
+	return aliasOf, nil
+}
+
+// PutStreamAlias points an alias of owner to streamKey, creating it if needed
+func PutStreamAlias(pool *pgxpool.Pool, ctx context.Context, owner string, a StreamAlias) error {
+	query := `INSERT INTO stream_aliases (alias, stream_key, owner)
+		 VALUES (@alias, @streamKey, @owner)
+		 ON CONFLICT (alias) DO UPDATE SET stream_key = EXCLUDED.stream_key
+		 WHERE stream_aliases.owner = EXCLUDED.owner`
+	tag, err := pool.Exec(ctx, query, pgx.NamedArgs{
+		"alias":     a.Alias,
+		"streamKey": a.StreamKey,
+		"owner":     owner,
+	})
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return ErrStreamAliasTaken
+	}
+
+	forgetStreamAlias(a.Alias)
+	return nil
+}
+
+// DeleteStreamAlias removes an alias of owner
+func DeleteStreamAlias(pool *pgxpool.Pool, ctx context.Context, owner, alias string) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM stream_aliases WHERE alias = @alias AND owner = @owner`, pgx.NamedArgs{
+		"alias": alias,
+		"owner": owner,
+	})
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	forgetStreamAlias(alias)
+	return nil
+}
+
+// forgetStreamAlias drops an alias from the cache of this instance, other instances see the change after streamAliasCacheTTL
+func forgetStreamAlias(alias string) {
+	streamAliasCacheLock.Lock()
+	defer streamAliasCacheLock.Unlock()
+
+	delete(streamAliasCache, alias)
+}
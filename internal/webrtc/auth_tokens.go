@@ -0,0 +1,184 @@
+package webrtc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for auth tokens, the OWASP minimum. Every publish and portal request verifies one hash.
+const (
+	authTokenHashTime    = 2
+	authTokenHashMemory  = 19 * 1024
+	authTokenHashThreads = 1
+	authTokenHashLength  = 32
+	authTokenSaltLength  = 16
+
+	authTokenHashPrefix = "$argon2id$"
+
+	// Hex digits of the SHA-256 of a token stored next to its hash. Requests authenticated by the token alone find their
+	// streamer by it without hashing every row, and it is too short to recover the token from.
+	authTokenLookupLength = 4
+)
+
+// Each hash takes authTokenHashMemory KiB, at most this many are computed at once so a flood of requests with auth
+// tokens can't exhaust memory. Requests beyond it wait for a slot.
+var authTokenHashSlots = make(chan struct{}, runtime.NumCPU())
+
+// configureAuthTokens reads AUTH_TOKEN_HASH_CONCURRENCY
+func configureAuthTokens() error {
+	if val := os.Getenv("AUTH_TOKEN_HASH_CONCURRENCY"); val != "" {
+		concurrency, err := strconv.Atoi(val)
+		if err != nil || concurrency < 1 {
+			return fmt.Errorf("Invalid AUTH_TOKEN_HASH_CONCURRENCY %q", val)
+		}
+		authTokenHashSlots = make(chan struct{}, concurrency)
+	}
+
+	return nil
+}
+
+// authTokenIDKey is argon2.IDKey limited to len(authTokenHashSlots) at once
+func authTokenIDKey(authToken string, salt []byte, time, memory uint32, threads uint8, length uint32) []byte {
+	slots := authTokenHashSlots
+	slots <- struct{}{}
+	defer func() { <-slots }()
+
+	return argon2.IDKey([]byte(authToken), salt, time, memory, threads, length)
+}
+
+// hashAuthToken returns the Argon2id hash of authToken in the PHC string format, with a random salt
+func hashAuthToken(authToken string) (string, error) {
+	salt := make([]byte, authTokenSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := authTokenIDKey(authToken, salt, authTokenHashTime, authTokenHashMemory, authTokenHashThreads, authTokenHashLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", authTokenHashPrefix, argon2.Version, authTokenHashMemory, authTokenHashTime, authTokenHashThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// verifyAuthToken reports whether authToken matches stored in constant time. Tokens stored before they were hashed
+// are compared as they are until they are re-hashed.
+func verifyAuthToken(authToken, stored string) bool {
+	if !strings.HasPrefix(stored, authTokenHashPrefix) {
+		return subtle.ConstantTimeCompare([]byte(authToken), []byte(stored)) == 1
+	}
+
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	} else if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(authTokenIDKey(authToken, salt, time, memory, threads, uint32(len(hash))), hash) == 1
+}
+
+func authTokenLookup(authToken string) string {
+	sum := sha256.Sum256([]byte(authToken))
+	return hex.EncodeToString(sum[:])[:authTokenLookupLength]
+}
+
+// streamerByAuthToken returns the name of the streamer authToken belongs to and its auth_token as stored, to address
+// the row in further queries. pgx.ErrNoRows if there is none.
+func streamerByAuthToken(pool *pgxpool.Pool, ctx context.Context, authToken string) (name, storedAuthToken string, err error) {
+	query := `SELECT name, auth_token FROM streamers
+		 WHERE auth_token_lookup = @lookup OR (auth_token_lookup = '' AND auth_token = @authToken)`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
+		"lookup":    authTokenLookup(authToken),
+		"authToken": authToken,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	candidates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (c [2]string, err error) {
+		err = row.Scan(&c[0], &c[1])
+		return c, err
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, c := range candidates {
+		if verifyAuthToken(authToken, c[1]) {
+			return c[0], c[1], nil
+		}
+	}
+
+	return "", "", pgx.ErrNoRows
+}
+
+// HashAuthTokens re-hashes the auth tokens of streamers and admin tokens of tenants stored before they were hashed,
+// and returns how many. It is a one-off migration, running it again only hashes tokens that were written in plaintext
+// since, like those of imported bundles.
+func HashAuthTokens(pool *pgxpool.Pool, ctx context.Context) (int, error) {
+	hashed := 0
+	for _, column := range []struct{ table, token, lookup string }{
+		{"streamers", "auth_token", "auth_token_lookup"},
+		{"tenants", "admin_token", "admin_token_lookup"},
+	} {
+		rows, err := pool.Query(ctx, fmt.Sprintf(`SELECT DISTINCT %s FROM %s WHERE %s = ''`, column.token, column.table, column.lookup))
+		if err != nil {
+			return hashed, err
+		}
+		tokens, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return hashed, err
+		}
+
+		for _, token := range tokens {
+			if strings.HasPrefix(token, authTokenHashPrefix) {
+				continue
+			}
+
+			hash, err := hashAuthToken(token)
+			if err != nil {
+				return hashed, err
+			}
+
+			tag, err := pool.Exec(ctx, fmt.Sprintf(`UPDATE %[1]s SET %[2]s = @hash, %[3]s = @lookup
+				 WHERE %[2]s = @token AND %[3]s = ''`, column.table, column.token, column.lookup), pgx.NamedArgs{
+				"token":  token,
+				"hash":   hash,
+				"lookup": authTokenLookup(token),
+			})
+			if err != nil {
+				return hashed, err
+			}
+			hashed += int(tag.RowsAffected())
+		}
+	}
+
+	return hashed, nil
+}
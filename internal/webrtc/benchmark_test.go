@@ -0,0 +1,164 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Benchmarks of packet fan-out, WHEP session setup and teardown and SDP handling. make bench compares them
+// against a baseline with benchstat, so regressions are caught before they ship.
+
+// Viewers a stream has in the fan-out benchmarks
+const benchmarkViewers = 100
+
+// discardWriter stands in for the SRTP stream of a viewer
+type discardWriter struct{}
+
+func (discardWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	return header.MarshalSize() + len(payload), nil
+}
+
+func (discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func newBenchmarkStream() (*stream, error) {
+	s := &stream{whepSessions: map[string]*whepSession{}}
+	for i := 0; i < benchmarkViewers; i++ {
+		audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+		if err != nil {
+			return nil, err
+		}
+
+		session := &whepSession{
+			audioTrack: audioTrack,
+			videoTrack: &trackMultiCodec{id: "video", streamID: "pion", writeStream: discardWriter{}},
+		}
+		session.audioLayer.Store("")
+		session.currentLayer.Store("")
+		s.whepSessions[uuid.New().String()] = session
+	}
+
+	return s, nil
+}
+
+func benchmarkPacket() *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 102, SSRC: 1},
+		Payload: make([]byte, 1200),
+	}
+}
+
+func BenchmarkVideoFanOut(b *testing.B) {
+	s, err := newBenchmarkStream()
+	if err != nil {
+		b.Fatal(err)
+	}
+	rtpPkt, source := benchmarkPacket(), &senderReportSource{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rtpPkt.SequenceNumber++
+		rtpPkt.Timestamp += 3000
+
+		s.whepSessionsLock.RLock()
+		for _, whepSession := range s.whepSessions {
+			whepSession.sendVideoPacket(rtpPkt, source, videoTrackLabelDefault, 3000, 1, videoTrackCodecH264, false)
+		}
+		s.whepSessionsLock.RUnlock()
+	}
+}
+
+func BenchmarkAudioFanOut(b *testing.B) {
+	s, err := newBenchmarkStream()
+	if err != nil {
+		b.Fatal(err)
+	}
+	rtpPkt, source := benchmarkPacket(), &senderReportSource{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rtpPkt.SequenceNumber++
+		rtpPkt.Timestamp += opusFrameDuration
+
+		s.whepSessionsLock.RLock()
+		for _, whepSession := range s.whepSessions {
+			whepSession.sendAudioPacket(rtpPkt, source, "0", rtpPkt.SequenceNumber, rtpPkt.Timestamp)
+		}
+		s.whepSessionsLock.RUnlock()
+	}
+}
+
+// BenchmarkWHEPSessionAddRemove covers the bookkeeping of a viewer joining and leaving, without ICE and DTLS
+func BenchmarkWHEPSessionAddRemove(b *testing.B) {
+	streamMapLock.Lock()
+	if streamMap == nil {
+		streamMap = map[string]*stream{}
+	}
+	streamMapLock.Unlock()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		whepSessionId := uuid.New().String()
+		Sessions.begin(whepSessionId, SessionWHEP, "benchmark")
+
+		streamMapLock.Lock()
+		s, err := getStream(nil, "benchmark", false)
+		if err != nil {
+			streamMapLock.Unlock()
+			b.Fatal(err)
+		}
+
+		Sessions.attachWHEP(s, whepSessionId, &whepSession{})
+
+		removeSession("benchmark", whepSessionId)
+		streamMapLock.Unlock()
+	}
+}
+
+// benchmarkOffer is a simulcast offer like the ones OBS sends
+var benchmarkOffer = "v=0\r\n" +
+	"o=- 4215775240449105457 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=group:BUNDLE 0 1\r\n" +
+	"a=extmap-allow-mixed\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:0\r\n" +
+	"a=lang:en\r\n" +
+	"a=sendonly\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"a=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 102\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:1\r\n" +
+	"a=extmap:4 urn:ietf:params:rtp-hdrext:sdes:mid\r\n" +
+	"a=extmap:10 urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id\r\n" +
+	"a=sendonly\r\n" +
+	"a=rtpmap:102 H264/90000\r\n" +
+	"a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f\r\n" +
+	"a=rid:low send max-width=640\r\n" +
+	"a=rid:mid send max-width=1280\r\n" +
+	"a=rid:high send max-width=1920\r\n" +
+	"a=simulcast:send low;mid;high\r\n"
+
+func BenchmarkApplyEncoderQuirks(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ApplyEncoderQuirks(benchmarkOffer, "OBS-Studio/30.1", "application/sdp")
+	}
+}
+
+func BenchmarkAudioLanguages(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		audioLanguages(benchmarkOffer)
+	}
+}
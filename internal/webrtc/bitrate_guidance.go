@@ -0,0 +1,111 @@
+package webrtc
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	defaultPublisherMaxBitrate = 10_000_000
+	publisherMinBitrate        = 300_000
+
+	// Loss thresholds and reactions from the loss based controller of GCC
+	// https://datatracker.ietf.org/doc/html/draft-ietf-rmcat-gcc-02#section-6
+	guidanceLowLoss       = 0.02
+	guidanceHighLoss      = 0.10
+	guidanceIncreaseRatio = 1.08
+)
+
+// bitrateGuidance watches the packet loss of a publisher's video track and tells the encoder to lower
+// its bitrate via REMB when the uplink is congested. Guidance only starts once congestion is first seen,
+// encoders that estimate bandwidth themselves are left alone until then.
+type bitrateGuidance struct {
+	enabled    bool
+	maxBitrate float64
+
+	active        bool
+	capped        bool
+	targetBitrate float64
+
+	received, lost uint64
+
+	// Exposed via the status API
+	lastTarget   atomic.Uint64
+	lastLossRate atomic.Uint64
+}
+
+// newBitrateGuidance creates the guidance for a video track. A non zero quota is the bitrate the publisher
+// may not exceed, guidance is then always enabled.
+func newBitrateGuidance(quota uint64) *bitrateGuidance {
+	g := &bitrateGuidance{
+		enabled:    os.Getenv("PUBLISHER_BITRATE_GUIDANCE") == "true",
+		maxBitrate: defaultPublisherMaxBitrate,
+	}
+
+	if val := os.Getenv("PUBLISHER_MAX_BITRATE"); val != "" {
+		if maxBitrate, err := strconv.ParseFloat(val, 64); err == nil && maxBitrate > publisherMinBitrate {
+			g.maxBitrate = maxBitrate
+		}
+	}
+
+	if quota != 0 {
+		g.enabled, g.capped = true, true
+		g.maxBitrate = min(g.maxBitrate, max(float64(quota), publisherMinBitrate))
+	}
+
+	g.targetBitrate = g.maxBitrate
+	return g
+}
+
+func (g *bitrateGuidance) onPacket(sequenceDiff int) {
+	g.received++
+	if sequenceDiff > 1 {
+		g.lost += uint64(sequenceDiff - 1)
+	}
+}
+
+// update is called once per bitrate window with the bitrate that was received during it
+func (g *bitrateGuidance) update(peerConnection *webrtc.PeerConnection, ssrc webrtc.SSRC, receivedBitrate uint64) error {
+	expected := g.received + g.lost
+	if expected == 0 {
+		return nil
+	}
+
+	lossRate := float64(g.lost) / float64(expected)
+	g.received, g.lost = 0, 0
+	g.lastLossRate.Store(uint64(lossRate * 10000))
+
+	if !g.enabled {
+		return nil
+	}
+
+	// Publishers above their quota are guided down even without congestion
+	if g.capped && float64(receivedBitrate) > g.maxBitrate {
+		g.active = true
+	}
+
+	switch {
+	case lossRate > guidanceHighLoss:
+		g.active = true
+		g.targetBitrate = float64(receivedBitrate) * (1 - 0.5*lossRate)
+	case lossRate < guidanceLowLoss:
+		g.targetBitrate *= guidanceIncreaseRatio
+	}
+	g.targetBitrate = min(max(g.targetBitrate, publisherMinBitrate), g.maxBitrate)
+
+	if !g.active {
+		return nil
+	}
+
+	g.lastTarget.Store(uint64(g.targetBitrate))
+	return peerConnection.WriteRTCP([]rtcp.Packet{
+		&rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: float32(g.targetBitrate),
+			SSRCs:   []uint32{uint32(ssrc)},
+		},
+	})
+}
@@ -0,0 +1,75 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Bookmark struct {
+	ID        int64  `json:"id"`
+	StreamKey string `json:"streamKey"`
+	Label     string `json:"label"`
+	// Unix seconds of when the broadcast containing the bookmark started
+	StreamStartedAt uint64 `json:"streamStartedAt"`
+	// Milliseconds since the start of the broadcast, this is the offset into its recording
+	MediaTime int64     `json:"mediaTime"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func AddBookmark(pool *pgxpool.Pool, ctx context.Context, owner string, b Bookmark) (*Bookmark, error) {
+	query := `INSERT INTO bookmarks (stream_key, owner, label, stream_started_at, media_time)
+		 VALUES (@streamKey, @owner, @label, to_timestamp(@streamStartedAt), @mediaTime)
+		 RETURNING id, created_at`
+	row := pool.QueryRow(ctx, query, pgx.NamedArgs{
+		"streamKey":       b.StreamKey,
+		"owner":           owner,
+		"label":           b.Label,
+		"streamStartedAt": b.StreamStartedAt,
+		"mediaTime":       b.MediaTime,
+	})
+	if err := row.Scan(&b.ID, &b.CreatedAt); err != nil {
+		fmt.Fprintf(os.Stderr, "QueryRow failed: %v\n", err)
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+func GetBookmarks(pool *pgxpool.Pool, ctx context.Context, owner, streamKey string) ([]Bookmark, error) {
+	query := `SELECT id, stream_key, label, extract(epoch FROM stream_started_at)::bigint, media_time, created_at
+		 FROM bookmarks
+		 WHERE owner = @owner AND stream_key = @streamKey
+		 ORDER BY stream_started_at DESC, media_time`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
+		"owner":     owner,
+		"streamKey": streamKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Bookmark, error) {
+		var b Bookmark
+		err := row.Scan(&b.ID, &b.StreamKey, &b.Label, &b.StreamStartedAt, &b.MediaTime, &b.CreatedAt)
+		return b, err
+	})
+}
+
+func DeleteBookmark(pool *pgxpool.Pool, ctx context.Context, owner string, id int64) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM bookmarks WHERE id = @id AND owner = @owner`, pgx.NamedArgs{
+		"id":    id,
+		"owner": owner,
+	})
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
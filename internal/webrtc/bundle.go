@@ -0,0 +1,108 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const bundleVersion = 1
+
+// Tables a bundle carries, in the order they are restored. Their rows are the configuration of an instance,
+// what was streamed and recorded stays behind.
+var bundleTables = []string{
+	"tenants", "streamers", "stream_settings", "stream_aliases", "stream_groups", "autostart_rules", "streamer_notifications",
+}
+
+// Bundled tables with a BIGSERIAL id
+var bundleSerialTables = []string{"autostart_rules", "streamer_notifications"}
+
+// Bundle is the configuration of an instance: tenants, streamers, stream settings, aliases, groups, autostart rules with
+// their restream targets, and notifications. Rows are kept as JSON objects of their columns.
+type Bundle struct {
+	Version    int                          `json:"version"`
+	ExportedAt time.Time                    `json:"exportedAt"`
+	Tables     map[string][]json.RawMessage `json:"tables"`
+}
+
+// ExportBundle reads every bundled table in one snapshot
+func ExportBundle(pool *pgxpool.Pool, ctx context.Context) (*Bundle, error) {
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx) //nolint
+
+	b := &Bundle{Version: bundleVersion, ExportedAt: time.Now().UTC(), Tables: map[string][]json.RawMessage{}}
+	for _, table := range bundleTables {
+		rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT to_jsonb(t) FROM %s t`, table))
+		if err != nil {
+			return nil, err
+		}
+
+		if b.Tables[table], err = pgx.CollectRows(rows, pgx.RowTo[json.RawMessage]); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// ImportBundle replaces the bundled tables with the rows of b in one transaction, nothing changes if any row
+// doesn't fit the schema. Tables missing from b are emptied.
+func ImportBundle(pool *pgxpool.Pool, ctx context.Context, b *Bundle) error {
+	if b.Version != bundleVersion {
+		return fmt.Errorf("Unsupported bundle version %d", b.Version)
+	}
+	for table := range b.Tables {
+		if !slices.Contains(bundleTables, table) {
+			return fmt.Errorf("Unknown table %q in bundle", table)
+		}
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //nolint
+
+	for _, table := range bundleTables {
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s`, table)); err != nil {
+			return err
+		}
+
+		for _, row := range b.Tables[table] {
+			// Only the columns of the row are inserted, columns added since the export get their defaults
+			fields := map[string]json.RawMessage{}
+			if err := json.Unmarshal(row, &fields); err != nil {
+				return fmt.Errorf("Row of %s is not an object: %w", table, err)
+			}
+
+			columns := []string{}
+			for column := range fields {
+				columns = append(columns, pgx.Identifier{column}.Sanitize())
+			}
+			slices.Sort(columns)
+
+			query := fmt.Sprintf(`INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM jsonb_populate_record(NULL::%[1]s, @row::jsonb)`, table, strings.Join(columns, ", "))
+			if _, err := tx.Exec(ctx, query, pgx.NamedArgs{"row": string(row)}); err != nil {
+				return fmt.Errorf("Row of %s could not be imported: %w", table, err)
+			}
+		}
+
+		// Rows keep their IDs, new ones continue after them
+		if slices.Contains(bundleSerialTables, table) {
+			if _, err := tx.Exec(ctx, fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %[1]s`, table)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,233 @@
+package webrtc
+
+import (
+	"errors"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CPU usage is measured over this long
+	capacitySampleInterval = 10 * time.Second
+
+	defaultCapacityCPUTarget = 0.8
+
+	// Clock ticks per second of /proc/self/stat, USER_HZ is 100 on every Linux architecture Broadcast Box runs on
+	procClockTicks = 100
+)
+
+type (
+	// StreamCapacity is what a stream consumes and how many more viewers it could get with the remaining headroom
+	StreamCapacity struct {
+		StreamKey string `json:"streamKey"`
+		Viewers   int    `json:"viewers"`
+		// Bits per second received from the publisher and sent to the WHEP sessions
+		IngressBitrate uint64 `json:"ingressBitrate"`
+		EgressBitrate  uint64 `json:"egressBitrate"`
+		// CPU cores used, the process usage shared by the packets the stream received and forwarded
+		CPUUsage float64 `json:"cpuUsage"`
+		// Viewers of this stream alone that fit into the headroom, at the bitrate of its highest layer
+		AdditionalViewers int `json:"additionalViewers"`
+	}
+
+	// Capacity of this instance derived from its live usage, to know when to scale before a big event
+	Capacity struct {
+		// CPU cores used by the process, -1 where /proc is not available
+		CPUUsage float64 `json:"cpuUsage"`
+		CPUCores int     `json:"cpuCores"`
+		// Share of CPUCores that may be used, CAPACITY_CPU_TARGET
+		CPUTarget float64 `json:"cpuTarget"`
+		// Bits per second sent to all WHEP sessions, and what CAPACITY_EGRESS_BITRATE says the uplink carries
+		EgressBitrate  uint64 `json:"egressBitrate"`
+		EgressCapacity uint64 `json:"egressCapacity,omitempty"`
+		// Viewers that fit into the headroom at the average bitrate and CPU usage of the current ones, -1 if there are none
+		AdditionalViewers int              `json:"additionalViewers"`
+		Streams           []StreamCapacity `json:"streams"`
+	}
+
+	capacitySample struct {
+		cpuUsage float64
+		// CPU cores used per stream key
+		streams map[string]float64
+	}
+
+	streamPackets struct {
+		received uint64
+		viewers  int
+	}
+)
+
+var (
+	capacityCPUTarget      = defaultCapacityCPUTarget
+	capacityEgressCapacity uint64
+
+	lastCapacitySample capacitySample
+	capacitySampleLock sync.Mutex
+)
+
+func configureCapacity() error {
+	if val := os.Getenv("CAPACITY_EGRESS_BITRATE"); val != "" {
+		bitrate, err := strconv.ParseUint(val, 10, 64)
+		if err != nil || bitrate == 0 {
+			return errors.New("CAPACITY_EGRESS_BITRATE must be a number of bits per second")
+		}
+		capacityEgressCapacity = bitrate
+	}
+
+	if val := os.Getenv("CAPACITY_CPU_TARGET"); val != "" {
+		target, err := strconv.ParseFloat(val, 64)
+		if err != nil || target <= 0 || target > 100 {
+			return errors.New("CAPACITY_CPU_TARGET must be a percentage between 0 and 100")
+		}
+		capacityCPUTarget = target / 100
+	}
+
+	lastCapacitySample = capacitySample{cpuUsage: -1, streams: map[string]float64{}}
+	go func() {
+		previousCPU, previousPackets, previousTime := processCPUSeconds(), streamPacketsReceived(), time.Now()
+
+		ticker := time.NewTicker(capacitySampleInterval)
+		for range ticker.C {
+			cpu, packets, now := processCPUSeconds(), streamPacketsReceived(), time.Now()
+			sample := capacitySample{cpuUsage: -1, streams: map[string]float64{}}
+			if cpu >= 0 && previousCPU >= 0 {
+				sample.cpuUsage = (cpu - previousCPU) / now.Sub(previousTime).Seconds()
+			}
+
+			// Most of the CPU is spent per packet and receiver of it, the publisher and every viewer
+			handled, total := map[string]uint64{}, uint64(0)
+			for streamKey, p := range packets {
+				handled[streamKey] = (p.received - min(previousPackets[streamKey].received, p.received)) * uint64(1+p.viewers)
+				total += handled[streamKey]
+			}
+			for streamKey := range packets {
+				if total != 0 && sample.cpuUsage > 0 {
+					sample.streams[streamKey] = sample.cpuUsage * float64(handled[streamKey]) / float64(total)
+				}
+			}
+
+			capacitySampleLock.Lock()
+			lastCapacitySample = sample
+			capacitySampleLock.Unlock()
+
+			previousCPU, previousPackets, previousTime = cpu, packets, now
+		}
+	}()
+
+	return nil
+}
+
+// streamPacketsReceived returns how many packets each stream received and how many viewers it has
+func streamPacketsReceived() map[string]streamPackets {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	packets := map[string]streamPackets{}
+	for streamKey, s := range streamMap {
+		p := streamPackets{received: s.audioPacketsReceived.Load()}
+		for _, videoTrack := range s.videoTracks {
+			p.received += videoTrack.packetsReceived.Load()
+		}
+
+		p.viewers = Sessions.viewers(s)
+
+		packets[streamKey] = p
+	}
+
+	return packets
+}
+
+// processCPUSeconds returns the CPU time the process used, -1 where /proc is not available
+func processCPUSeconds() float64 {
+	stat, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return -1
+	}
+
+	// The command name may contain spaces, the fields after it are fixed. utime and stime are the 14th and 15th.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 13 {
+		return -1
+	}
+
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return -1
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return -1
+	}
+
+	return float64(utime+stime) / procClockTicks
+}
+
+// GetCapacity returns what every stream consumes and projects how many more viewers this instance can take
+func GetCapacity() Capacity {
+	capacitySampleLock.Lock()
+	sample := lastCapacitySample
+	capacitySampleLock.Unlock()
+
+	capacity := Capacity{
+		CPUUsage:       sample.cpuUsage,
+		CPUCores:       runtime.NumCPU(),
+		CPUTarget:      capacityCPUTarget,
+		EgressCapacity: capacityEgressCapacity,
+		Streams:        []StreamCapacity{},
+	}
+
+	streamMapLock.Lock()
+	viewers := 0
+	highestLayers := map[string]uint64{}
+	for streamKey, s := range streamMap {
+		streamCapacity := StreamCapacity{StreamKey: streamKey, EgressBitrate: s.egressBitrate(), CPUUsage: sample.streams[streamKey]}
+		for _, videoTrack := range s.videoTracks {
+			streamCapacity.IngressBitrate += videoTrack.bitrate.Load()
+			highestLayers[streamKey] = max(highestLayers[streamKey], videoTrack.bitrate.Load())
+		}
+
+		streamCapacity.Viewers = Sessions.viewers(s)
+
+		viewers += streamCapacity.Viewers
+		capacity.EgressBitrate += streamCapacity.EgressBitrate
+		capacity.Streams = append(capacity.Streams, streamCapacity)
+	}
+	streamMapLock.Unlock()
+
+	cpuHeadroom := float64(capacity.CPUCores)*capacity.CPUTarget - capacity.CPUUsage
+	egressHeadroom := float64(capacity.EgressCapacity) - float64(capacity.EgressBitrate)
+
+	// additionalViewers divides the headroom by what a viewer costs, constraints that aren't known are skipped
+	additionalViewers := func(cpuPerViewer, bitratePerViewer float64) int {
+		fits := math.Inf(1)
+		if capacity.CPUUsage >= 0 && cpuPerViewer > 0 {
+			fits = min(fits, cpuHeadroom/cpuPerViewer)
+		}
+		if capacity.EgressCapacity != 0 && bitratePerViewer > 0 {
+			fits = min(fits, egressHeadroom/bitratePerViewer)
+		}
+
+		if math.IsInf(fits, 1) {
+			return -1
+		}
+		return int(max(fits, 0))
+	}
+
+	capacity.AdditionalViewers = -1
+	if viewers != 0 {
+		capacity.AdditionalViewers = additionalViewers(capacity.CPUUsage/float64(viewers), float64(capacity.EgressBitrate)/float64(viewers))
+	}
+
+	for i, streamCapacity := range capacity.Streams {
+		// The publisher handles every packet as well
+		cpuPerViewer := streamCapacity.CPUUsage / float64(1+streamCapacity.Viewers)
+		capacity.Streams[i].AdditionalViewers = additionalViewers(cpuPerViewer, float64(highestLayers[streamCapacity.StreamKey]))
+	}
+
+	return capacity
+}
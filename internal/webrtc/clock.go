@@ -0,0 +1,101 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type (
+	// mediaClock maps the RTP timestamps of a track to the server wall clock
+	mediaClock struct {
+		mu             sync.Mutex
+		clockRate      uint32
+		rtpTimestamp   uint32
+		mediaTimestamp int64
+		wallClock      time.Time
+	}
+
+	StreamClockTrack struct {
+		RID          string `json:"rid"`
+		ClockRate    uint32 `json:"clockRate"`
+		RTPTimestamp uint32 `json:"rtpTimestamp"`
+		// Milliseconds of media since the first packet of the track
+		MediaTime int64 `json:"mediaTime"`
+		// Unix milliseconds at which RTPTimestamp was received
+		WallClock int64 `json:"wallClock"`
+	}
+
+	StreamClock struct {
+		FirstSeenEpoch uint64             `json:"firstSeenEpoch"`
+		VideoTracks    []StreamClockTrack `json:"videoTracks"`
+	}
+)
+
+func (c *mediaClock) update(rtpTimestamp uint32, timeDiff int64, clockRate uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.clockRate = clockRate
+	c.rtpTimestamp = rtpTimestamp
+	c.mediaTimestamp += timeDiff
+	c.wallClock = time.Now()
+}
+
+func (c *mediaClock) sample(rid string) StreamClockTrack {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := StreamClockTrack{
+		RID:          rid,
+		ClockRate:    c.clockRate,
+		RTPTimestamp: c.rtpTimestamp,
+	}
+
+	if c.clockRate != 0 {
+		s.MediaTime = c.mediaTimestamp * 1000 / int64(c.clockRate)
+	}
+
+	if !c.wallClock.IsZero() {
+		s.WallClock = c.wallClock.UnixMilli()
+	}
+
+	return s
+}
+
+// GetStreamClock returns the latest RTP timestamp to wall clock mapping for every video track
+// of a stream. Viewers combine it with the server time from the clock endpoint to
+// synchronize to the same media moment.
+func GetStreamClock(streamKey string) (StreamClock, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() {
+		return StreamClock{}, errors.New("Stream is not live")
+	}
+
+	clock := StreamClock{
+		FirstSeenEpoch: stream.firstSeenEpoch,
+		VideoTracks:    []StreamClockTrack{},
+	}
+	for _, videoTrack := range stream.videoTracks {
+		clock.VideoTracks = append(clock.VideoTracks, videoTrack.clock.sample(videoTrack.rid))
+	}
+
+	return clock, nil
+}
+
+// CurrentMediaTime returns when the live stream started and the milliseconds of media
+// that have been received since then
+func CurrentMediaTime(streamKey string) (uint64, int64, error) {
+	clock, err := GetStreamClock(streamKey)
+	if err != nil {
+		return 0, 0, err
+	} else if len(clock.VideoTracks) == 0 || clock.VideoTracks[0].WallClock == 0 {
+		return 0, 0, errors.New("Stream has no media yet")
+	}
+
+	track := clock.VideoTracks[0]
+	return clock.FirstSeenEpoch, track.MediaTime + time.Now().UnixMilli() - track.WallClock, nil
+}
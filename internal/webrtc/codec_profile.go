@@ -0,0 +1,108 @@
+package webrtc
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const defaultCodecProfile = "compatibility"
+
+type (
+	// CodecProfile is the set of codecs and header extensions offered to publishers and viewers. Fewer
+	// codecs make SDPs smaller and negotiation faster, but encoders and players lacking them can't connect.
+	CodecProfile struct {
+		Name        string  `json:"name"`
+		Description string  `json:"description"`
+		AudioCodecs []Codec `json:"audioCodecs"`
+		VideoCodecs []Codec `json:"videoCodecs"`
+		// Video codecs get a RTX payload type (the codec's payload type + 1) for retransmissions
+		RTX              bool     `json:"rtx"`
+		HeaderExtensions []string `json:"headerExtensions"`
+	}
+
+	Codec struct {
+		MimeType    string `json:"mimeType"`
+		PayloadType uint8  `json:"payloadType"`
+		ClockRate   uint32 `json:"clockRate"`
+		Channels    uint16 `json:"channels,omitempty"`
+		SDPFmtpLine string `json:"sdpFmtpLine,omitempty"`
+	}
+)
+
+var (
+	opusCodec = Codec{MimeType: webrtc.MimeTypeOpus, PayloadType: 111, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+
+	h264BaselineCodec            = Codec{MimeType: webrtc.MimeTypeH264, PayloadType: 102, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"}
+	h264ConstrainedBaselineCodec = Codec{MimeType: webrtc.MimeTypeH264, PayloadType: 106, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"}
+	av1Codec                     = Codec{MimeType: webrtc.MimeTypeAV1, PayloadType: 45, ClockRate: 90000}
+	vp9Profile0Codec             = Codec{MimeType: webrtc.MimeTypeVP9, PayloadType: 98, ClockRate: 90000, SDPFmtpLine: "profile-id=0"}
+	vp9Profile2Codec             = Codec{MimeType: webrtc.MimeTypeVP9, PayloadType: 100, ClockRate: 90000, SDPFmtpLine: "profile-id=2"}
+	h265Codec                    = Codec{MimeType: webrtc.MimeTypeH265, PayloadType: 113, ClockRate: 90000, SDPFmtpLine: "level-id=93;profile-id=1;tier-flag=0;tx-mode=SRST"}
+
+	codecProfiles = []CodecProfile{
+		{
+			Name:        "compatibility",
+			Description: "Every supported codec, including H264 without packetization mode 1 for older hardware encoders",
+			AudioCodecs: []Codec{opusCodec},
+			VideoCodecs: []Codec{
+				h264BaselineCodec,
+				{MimeType: webrtc.MimeTypeH264, PayloadType: 104, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f"},
+				h264ConstrainedBaselineCodec,
+				{MimeType: webrtc.MimeTypeH264, PayloadType: 108, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f"},
+				{MimeType: webrtc.MimeTypeH264, PayloadType: 39, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=4d001f"},
+				av1Codec,
+				vp9Profile0Codec,
+				vp9Profile2Codec,
+				h265Codec,
+			},
+			RTX:              true,
+			HeaderExtensions: []string{playoutDelayExtensionURI},
+		},
+		{
+			Name:             "quality",
+			Description:      "Modern codecs first, for the best picture at a given bitrate",
+			AudioCodecs:      []Codec{opusCodec},
+			VideoCodecs:      []Codec{av1Codec, h265Codec, vp9Profile2Codec, vp9Profile0Codec, h264ConstrainedBaselineCodec},
+			RTX:              true,
+			HeaderExtensions: []string{playoutDelayExtensionURI},
+		},
+		{
+			Name:             "low-latency",
+			Description:      "H264 only and no RTX, the smallest SDPs and quickest negotiation",
+			AudioCodecs:      []Codec{opusCodec},
+			VideoCodecs:      []Codec{h264ConstrainedBaselineCodec, h264BaselineCodec},
+			HeaderExtensions: []string{playoutDelayExtensionURI},
+		},
+	}
+
+	// codecProfile is selected by CODEC_PROFILE when Configure is called
+	codecProfile = codecProfiles[0]
+)
+
+// CodecProfiles returns the profiles CODEC_PROFILE can select
+func CodecProfiles() []CodecProfile {
+	return codecProfiles
+}
+
+// ActiveCodecProfile returns the profile codecs are negotiated with
+func ActiveCodecProfile() CodecProfile {
+	return codecProfile
+}
+
+func configureCodecProfile() error {
+	name := os.Getenv("CODEC_PROFILE")
+	if name == "" {
+		name = defaultCodecProfile
+	}
+
+	for _, profile := range codecProfiles {
+		if profile.Name == name {
+			codecProfile = profile
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unknown CODEC_PROFILE %s", name)
+}
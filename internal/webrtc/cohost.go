@@ -0,0 +1,284 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Timestamp gap of a guest reconnecting, one frame at 30fps in the 90kHz video clock
+const guestVideoSwitchGap = 3000
+
+type (
+	// guestPublisher is a co-host whose WHIP session is attached to the host's stream
+	guestPublisher struct {
+		name           string
+		sessionId      string
+		peerConnection *webrtc.PeerConnection
+		pliChan        chan any
+
+		ctx    context.Context
+		cancel func()
+
+		packetsReceived                        atomic.Uint64
+		audioSenderReports, videoSenderReports senderReportSource
+	}
+
+	cohostInvite struct {
+		streamKey string
+		guestName string
+		expires   time.Time
+	}
+)
+
+var (
+	cohostInvites     = map[string]cohostInvite{}
+	cohostInvitesLock sync.Mutex
+)
+
+// CreateCohostInvite returns a one time token that lets guestName publish into the host's stream
+func CreateCohostInvite(streamKey, guestName string, ttl time.Duration) (string, error) {
+	if guestName == "" {
+		return "", errors.New("Guest name must not be empty")
+	}
+
+	token, err := generateAuthToken()
+	if err != nil {
+		return "", err
+	}
+
+	cohostInvitesLock.Lock()
+	defer cohostInvitesLock.Unlock()
+
+	for t, invite := range cohostInvites {
+		if time.Now().After(invite.expires) {
+			delete(cohostInvites, t)
+		}
+	}
+
+	cohostInvites[token] = cohostInvite{streamKey: streamKey, guestName: guestName, expires: time.Now().Add(ttl)}
+	return token, nil
+}
+
+func consumeCohostInvite(token string) (cohostInvite, error) {
+	cohostInvitesLock.Lock()
+	defer cohostInvitesLock.Unlock()
+
+	invite, ok := cohostInvites[token]
+	if !ok || time.Now().After(invite.expires) {
+		return cohostInvite{}, errors.New("Invalid co-host invite")
+	}
+
+	delete(cohostInvites, token)
+	return invite, nil
+}
+
+// WHIPGuest attaches the WHIP session of an invited guest to a live host stream and returns its session ID. Viewers
+// receive the guest as a second audio and video track. Negotiation is abandoned when ctx is done.
+func WHIPGuest(ctx context.Context, offer, inviteToken string) (answer string, guestSessionId string, err error) {
+	maybePrintOfferAnswer(offer, true)
+
+	invite, err := consumeCohostInvite(inviteToken)
+	if err != nil {
+		return "", "", err
+	}
+
+	peerConnection, err := newPeerConnection(apiWhip)
+	if err != nil {
+		return "", "", err
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+	defer func() {
+		if err != nil {
+			closePeerConnection(peerConnection)
+		}
+	}()
+
+	stream, ok := streamMap[invite.streamKey]
+	if !ok || !stream.hasWHIPClient.Load() {
+		return "", "", errors.New("Host is not live")
+	} else if stream.guest != nil {
+		return "", "", errors.New("Stream already has a co-host")
+	}
+
+	guest := &guestPublisher{
+		name:           invite.guestName,
+		peerConnection: peerConnection,
+		pliChan:        make(chan any, 50),
+	}
+	guest.ctx, guest.cancel = context.WithCancel(stream.whipActiveContext)
+	guest.sessionId = Sessions.begin("", SessionCohost, invite.streamKey)
+
+	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver) {
+		if strings.HasPrefix(remoteTrack.Codec().RTPCodecCapability.MimeType, "audio") {
+			go stream.readSenderReports(rtpReceiver, remoteTrack, &guest.audioSenderReports)
+			guestWriter(remoteTrack, stream, guest, false)
+		} else {
+			go stream.readSenderReports(rtpReceiver, remoteTrack, &guest.videoSenderReports)
+			go guestPLIWriter(remoteTrack, stream, guest)
+			guestWriter(remoteTrack, stream, guest, true)
+		}
+	})
+
+	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
+			closePeerConnection(peerConnection)
+			removeGuest(invite.streamKey, guest)
+		}
+	})
+
+	if err = negotiate(ctx, peerConnection, offer); err != nil {
+		guest.cancel()
+		Sessions.setState(guest.sessionId, SessionClosed)
+		return "", "", err
+	}
+
+	stream.guest = guest
+	Sessions.setLive(guest.sessionId)
+	events.Publish(events.Event{Type: events.CohostJoin, StreamKey: invite.streamKey, Data: map[string]string{"guest": guest.name}})
+
+	return maybePrintOfferAnswer(appendAnswer(peerConnection.LocalDescription().SDP), false), guest.sessionId, nil
+}
+
+// RemoveCohost disconnects the guest of a stream
+func RemoveCohost(streamKey string) error {
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	if !ok || stream.guest == nil {
+		streamMapLock.Unlock()
+		return errors.New("Stream has no co-host")
+	}
+	guest := stream.guest
+	streamMapLock.Unlock()
+
+	err := closePeerConnectionAndWait(guest.peerConnection)
+	removeGuest(streamKey, guest)
+	return err
+}
+
+// CohostDelete disconnects the guest with the session ID WHIPGuest returned, when the guest ends its WHIP session
+func CohostDelete(guestSessionId string) error {
+	streamKey, ok := Sessions.streamKeyOf(guestSessionId, SessionCohost)
+	if !ok {
+		return ErrUnknownWHIPSession
+	}
+
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	if !ok || stream.guest == nil || stream.guest.sessionId != guestSessionId {
+		streamMapLock.Unlock()
+		return ErrUnknownWHIPSession
+	}
+	guest := stream.guest
+	streamMapLock.Unlock()
+
+	err := closePeerConnectionAndWait(guest.peerConnection)
+	removeGuest(streamKey, guest)
+	return err
+}
+
+func (s *stream) requestGuestKeyframe() {
+	streamMapLock.Lock()
+	guest := s.guest
+	streamMapLock.Unlock()
+
+	if guest == nil {
+		return
+	}
+
+	select {
+	case guest.pliChan <- true:
+	default:
+	}
+}
+
+func removeGuest(streamKey string, guest *guestPublisher) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	guest.cancel()
+	Sessions.setState(guest.sessionId, SessionClosed)
+	if stream, ok := streamMap[streamKey]; ok && stream.guest == guest {
+		stream.whepSessionsLock.RLock()
+		stream.sendGoodbye(true, "Co-host left")
+		stream.whepSessionsLock.RUnlock()
+
+		stream.guest = nil
+		events.Publish(events.Event{Type: events.CohostLeave, StreamKey: streamKey, Data: map[string]string{"guest": guest.name}})
+	}
+}
+
+func guestPLIWriter(remoteTrack *webrtc.TrackRemote, stream *stream, guest *guestPublisher) {
+	defer stream.trackGoroutine()()
+
+	for {
+		select {
+		case <-guest.ctx.Done():
+			return
+		case <-guest.pliChan:
+			if err := guest.peerConnection.WriteRTCP([]rtcp.Packet{
+				&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())},
+			}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func guestWriter(remoteTrack *webrtc.TrackRemote, stream *stream, guest *guestPublisher, isVideo bool) {
+	defer stream.trackGoroutine()()
+
+	codec := getVideoTrackCodec(remoteTrack.Codec().RTPCodecCapability.MimeType)
+	source := guest.name + remoteTrack.ID()
+
+	rtpBuf := make([]byte, 1500)
+	rtpPkt := &rtp.Packet{}
+	for {
+		rtpRead, _, err := remoteTrack.Read(rtpBuf)
+		switch {
+		case errors.Is(err, io.EOF):
+			return
+		case err != nil:
+			log.Println(err)
+			return
+		}
+
+		if err = rtpPkt.Unmarshal(rtpBuf[:rtpRead]); err != nil {
+			log.Println(err)
+			return
+		}
+
+		guest.packetsReceived.Add(1)
+		rtpPkt.Extension = false
+		rtpPkt.Extensions = nil
+		sequenceNumber, timestamp := rtpPkt.SequenceNumber, rtpPkt.Timestamp
+
+		Sessions.eachViewer(stream, func(_ string, whepSession *whepSession) {
+			if isVideo {
+				whepSession.guestVideoRewriter.rewrite(rtpPkt, source, sequenceNumber, timestamp, guestVideoSwitchGap)
+				whepSession.guestVideoStats.onPacket(&guest.videoSenderReports, timestamp, rtpPkt.Timestamp, len(rtpPkt.Payload))
+				err = whepSession.guestVideoTrack.WriteRTP(rtpPkt, codec)
+			} else {
+				whepSession.guestAudioRewriter.rewrite(rtpPkt, source, sequenceNumber, timestamp, opusFrameDuration)
+				whepSession.guestAudioStats.onPacket(&guest.audioSenderReports, timestamp, rtpPkt.Timestamp, len(rtpPkt.Payload))
+				err = whepSession.guestAudioTrack.WriteRTP(rtpPkt)
+			}
+
+			if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				log.Println(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package webrtc
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	congestionControlGCC   = "gcc"
+	congestionControlFixed = "fixed"
+	congestionControlNADA  = "nada"
+
+	defaultEgressTargetBitrate = 1_000_000
+	egressMinBitrate           = 100_000
+	egressMaxBitrate           = 10_000_000
+
+	// Send rate of a viewer is measured over windows of this length
+	egressSendRateWindow = time.Second
+
+	// Packets of a viewer whose send time is remembered until the viewer acknowledges them
+	nadaPacketHistory = 4096
+
+	// Default parameters of RFC 8698, in seconds
+	// https://datatracker.ietf.org/doc/html/rfc8698#section-6.3
+	nadaQueueEpsilon   = 0.010
+	nadaFilterDelay    = 0.120
+	nadaMaxGamma       = 0.5
+	nadaQueueBound     = 0.050
+	nadaLossPenalty    = 0.010
+	nadaLossReference  = 0.01
+	nadaReferenceDelay = 0.010
+	nadaKappa          = 0.5
+	nadaEta            = 2.0
+	nadaTau            = 0.5
+	nadaInterval       = 0.100
+	// Viewers don't report their RTT over TWCC, the ramp up assumes a typical one
+	nadaAssumedRTT = 0.100
+	// Weight of the newest feedback in the smoothed loss ratio
+	nadaLossSmoothing = 0.1
+)
+
+type (
+	// egressEstimator estimates the bandwidth to a viewer with EGRESS_CONGESTION_CONTROL and measures what the viewer is
+	// actually sent, so operators can compare the strategies for their networks
+	egressEstimator struct {
+		cc.BandwidthEstimator
+
+		// Paces what the viewer is sent if EGRESS_PACING is set
+		pacer *egressPacer
+
+		sendRate atomic.Uint64
+
+		mu          sync.Mutex
+		windowStart time.Time
+		windowBytes int
+	}
+
+	// fixedEstimator assumes every viewer can receive EGRESS_TARGET_BITRATE
+	fixedEstimator struct {
+		targetBitrate int
+	}
+
+	// nadaEstimator is the sender side of NADA, RFC 8698, driven by the queuing delay and loss in the TWCC feedback of
+	// the viewer. Only the gradual and accelerated ramp up updates are implemented, without ECN.
+	nadaEstimator struct {
+		mu      sync.Mutex
+		created time.Time
+		sent    [nadaPacketHistory]nadaPacket
+
+		rate            float64
+		prevCongestion  float64
+		lossRatio       float64
+		queueDelay      float64
+		baseDelay       time.Duration
+		hasBaseDelay    bool
+		lastUpdate      time.Time
+		onTargetBitrate func(int)
+	}
+
+	nadaPacket struct {
+		valid          bool
+		sequenceNumber uint16
+		size           int
+		sentAt         time.Duration
+	}
+)
+
+var (
+	egressCongestionControl string
+	egressTargetBitrate     = defaultEgressTargetBitrate
+
+	// The CC interceptor hands out the estimator of a PeerConnection while it is created, WHEP sessions are created
+	// one at a time so each gets its own
+	egressEstimatorLock    sync.Mutex
+	egressEstimatorCreated *egressEstimator
+)
+
+// configureCongestionControl adds the bandwidth estimation of EGRESS_CONGESTION_CONTROL to the interceptors of viewers
+func configureCongestionControl(interceptorRegistry *interceptor.Registry) error {
+	if val := os.Getenv("EGRESS_TARGET_BITRATE"); val != "" {
+		bitrate, err := strconv.Atoi(val)
+		if err != nil || bitrate < egressMinBitrate || bitrate > egressMaxBitrate {
+			return fmt.Errorf("EGRESS_TARGET_BITRATE must be between %d and %d bits per second", egressMinBitrate, egressMaxBitrate)
+		}
+		egressTargetBitrate = bitrate
+	}
+
+	var newEstimator func() (cc.BandwidthEstimator, error)
+	switch egressCongestionControl = os.Getenv("EGRESS_CONGESTION_CONTROL"); egressCongestionControl {
+	case "":
+		return nil
+	case congestionControlGCC:
+		newEstimator = func() (cc.BandwidthEstimator, error) {
+			// EGRESS_PACING paces the media before the estimator sees it, the pacer of GCC would only add delay
+			return gcc.NewSendSideBWE(
+				gcc.SendSideBWEInitialBitrate(egressTargetBitrate),
+				gcc.SendSideBWEMinBitrate(egressMinBitrate),
+				gcc.SendSideBWEMaxBitrate(egressMaxBitrate),
+				gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+			)
+		}
+	case congestionControlFixed:
+		newEstimator = func() (cc.BandwidthEstimator, error) {
+			return &fixedEstimator{targetBitrate: egressTargetBitrate}, nil
+		}
+	case congestionControlNADA:
+		newEstimator = func() (cc.BandwidthEstimator, error) {
+			return &nadaEstimator{created: time.Now(), rate: float64(egressTargetBitrate)}, nil
+		}
+	default:
+		return fmt.Errorf("Invalid EGRESS_CONGESTION_CONTROL %q, must be gcc, fixed or nada", egressCongestionControl)
+	}
+
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		estimator, err := newEstimator()
+		if err != nil {
+			return nil, err
+		}
+		return &egressEstimator{BandwidthEstimator: estimator}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		egressEstimatorCreated, _ = estimator.(*egressEstimator)
+	})
+	interceptorRegistry.Add(congestionController)
+
+	// Added last so the sequence number is set before the estimator sees a packet
+	headerExtension, err := twcc.NewHeaderExtensionInterceptor()
+	if err != nil {
+		return err
+	}
+	interceptorRegistry.Add(headerExtension)
+
+	return nil
+}
+
+// newWHEPPeerConnection creates the PeerConnection of a viewer and its estimator, nil if EGRESS_CONGESTION_CONTROL is unset
+func newWHEPPeerConnection() (*webrtc.PeerConnection, *egressEstimator, error) {
+	if egressCongestionControl == "" {
+		peerConnection, err := newPeerConnection(apiWhep)
+		return peerConnection, nil, err
+	}
+
+	egressEstimatorLock.Lock()
+	defer egressEstimatorLock.Unlock()
+
+	egressEstimatorCreated, egressPacerCreated = nil, nil
+	peerConnection, err := newPeerConnection(apiWhep)
+	if egressEstimatorCreated != nil && egressPacerCreated != nil {
+		egressEstimatorCreated.pacer = egressPacerCreated
+		egressPacerCreated.estimator.Store(egressEstimatorCreated)
+	}
+
+	return peerConnection, egressEstimatorCreated, err
+}
+
+func (e *egressEstimator) AddStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return e.BandwidthEstimator.AddStream(info, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		e.mu.Lock()
+		if now := time.Now(); now.Sub(e.windowStart) >= egressSendRateWindow {
+			if !e.windowStart.IsZero() {
+				e.sendRate.Store(uint64(float64(e.windowBytes*8) / now.Sub(e.windowStart).Seconds()))
+			}
+			e.windowStart, e.windowBytes = now, 0
+		}
+		e.windowBytes += header.MarshalSize() + len(payload)
+		e.mu.Unlock()
+
+		return writer.Write(header, payload, attributes)
+	}))
+}
+
+// bitrates returns the bits per second the viewer is estimated to be able to receive and is actually sent
+func (e *egressEstimator) bitrates() (estimated, sent uint64) {
+	return uint64(max(e.GetTargetBitrate(), 0)), e.sendRate.Load()
+}
+
+func (f *fixedEstimator) AddStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return writer
+}
+
+func (f *fixedEstimator) WriteRTCP([]rtcp.Packet, interceptor.Attributes) error { return nil }
+
+func (f *fixedEstimator) GetTargetBitrate() int { return f.targetBitrate }
+
+func (f *fixedEstimator) OnTargetBitrateChange(func(int)) {}
+
+func (f *fixedEstimator) GetStats() map[string]interface{} {
+	return map[string]interface{}{"targetBitrate": f.targetBitrate}
+}
+
+func (f *fixedEstimator) Close() error { return nil }
+
+func (n *nadaEstimator) AddStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	extensionID := 0
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == sdp.TransportCCURI {
+			extensionID = extension.ID
+		}
+	}
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if extensionID != 0 {
+			var transportCC rtp.TransportCCExtension
+			if payload := header.GetExtension(uint8(extensionID)); payload != nil && transportCC.Unmarshal(payload) == nil {
+				n.mu.Lock()
+				n.sent[transportCC.TransportSequence%nadaPacketHistory] = nadaPacket{
+					valid:          true,
+					sequenceNumber: transportCC.TransportSequence,
+					size:           header.MarshalSize() + len(payload),
+					sentAt:         time.Since(n.created),
+				}
+				n.mu.Unlock()
+			}
+		}
+
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+func (n *nadaEstimator) WriteRTCP(pkts []rtcp.Packet, _ interceptor.Attributes) error {
+	for _, pkt := range pkts {
+		if feedback, ok := pkt.(*rtcp.TransportLayerCC); ok {
+			n.onFeedback(feedback)
+		}
+	}
+
+	return nil
+}
+
+// onFeedback updates the reference rate with the queuing delay and loss of the packets a TWCC feedback acknowledges
+func (n *nadaEstimator) onFeedback(feedback *rtcp.TransportLayerCC) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	received, lost, receivedBytes := 0, 0, 0
+	queueDelay := math.Inf(1)
+	var firstArrival, lastArrival time.Duration
+
+	arrival := time.Duration(feedback.ReferenceTime) * 64 * time.Millisecond
+	sequenceNumber, statuses, deltaIndex := feedback.BaseSequenceNumber, uint16(0), 0
+	onStatus := func(symbol uint16) {
+		if statuses == feedback.PacketStatusCount {
+			return
+		}
+		statuses++
+
+		packet := n.sent[sequenceNumber%nadaPacketHistory]
+		known := packet.valid && packet.sequenceNumber == sequenceNumber
+		sequenceNumber++
+
+		if symbol == rtcp.TypeTCCPacketNotReceived {
+			if known {
+				lost++
+			}
+			return
+		} else if symbol != rtcp.TypeTCCPacketReceivedWithoutDelta && deltaIndex < len(feedback.RecvDeltas) {
+			arrival += time.Duration(feedback.RecvDeltas[deltaIndex].Delta) * time.Microsecond
+			deltaIndex++
+		}
+
+		if !known {
+			return
+		}
+
+		// The clocks of server and viewer aren't synchronized, the lowest one way delay seen is taken as the
+		// delay without queuing
+		oneWayDelay := arrival - packet.sentAt
+		if !n.hasBaseDelay || oneWayDelay < n.baseDelay {
+			n.baseDelay, n.hasBaseDelay = oneWayDelay, true
+		}
+		queueDelay = min(queueDelay, (oneWayDelay - n.baseDelay).Seconds())
+
+		if received == 0 {
+			firstArrival = arrival
+		}
+		lastArrival = arrival
+		received++
+		receivedBytes += packet.size
+	}
+
+	for _, chunk := range feedback.PacketChunks {
+		switch chunk := chunk.(type) {
+		case *rtcp.RunLengthChunk:
+			for range chunk.RunLength {
+				onStatus(chunk.PacketStatusSymbol)
+			}
+		case *rtcp.StatusVectorChunk:
+			for _, symbol := range chunk.SymbolList {
+				onStatus(symbol)
+			}
+		}
+	}
+
+	if received == 0 && lost == 0 {
+		return
+	} else if received == 0 {
+		queueDelay = n.queueDelay
+	}
+
+	now := time.Now()
+	interval := nadaInterval
+	if !n.lastUpdate.IsZero() {
+		interval = min(now.Sub(n.lastUpdate).Seconds(), nadaInterval)
+	}
+
+	n.lossRatio += nadaLossSmoothing * (float64(lost)/float64(received+lost) - n.lossRatio)
+	n.queueDelay = queueDelay
+	congestion := queueDelay + nadaLossPenalty*math.Pow(n.lossRatio/nadaLossReference, 2)
+
+	receivedRate := 0.0
+	if span := (lastArrival - firstArrival).Seconds(); span > 0 {
+		receivedRate = float64(receivedBytes*8) / span
+	}
+
+	if queueDelay < nadaQueueEpsilon && lost == 0 && receivedRate != 0 {
+		// Accelerated ramp up, the path isn't congested
+		gamma := min(nadaMaxGamma, nadaQueueBound/(nadaAssumedRTT+nadaInterval+nadaFilterDelay))
+		n.rate = max(n.rate, (1+gamma)*receivedRate)
+	} else {
+		offset := congestion - nadaReferenceDelay*egressMaxBitrate/n.rate
+		diff := congestion - n.prevCongestion
+		n.rate -= nadaKappa*(interval/nadaTau)*(offset/nadaTau)*n.rate + nadaKappa*nadaEta*(diff/nadaTau)*n.rate
+	}
+
+	n.rate = min(max(n.rate, egressMinBitrate), egressMaxBitrate)
+	n.prevCongestion, n.lastUpdate = congestion, now
+
+	if n.onTargetBitrate != nil {
+		n.onTargetBitrate(int(n.rate))
+	}
+}
+
+func (n *nadaEstimator) GetTargetBitrate() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return int(n.rate)
+}
+
+func (n *nadaEstimator) OnTargetBitrateChange(f func(int)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.onTargetBitrate = f
+}
+
+func (n *nadaEstimator) GetStats() map[string]interface{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return map[string]interface{}{
+		"targetBitrate": int(n.rate),
+		"queueDelay":    n.queueDelay * 1000,
+		"lossRatio":     n.lossRatio,
+	}
+}
+
+func (n *nadaEstimator) Close() error { return nil }
@@ -0,0 +1,56 @@
+package webrtc
+
+import (
+	"os"
+	"strings"
+)
+
+type DirectoryEntry struct {
+	StreamKey      string              `json:"streamKey"`
+	Live           bool                `json:"live"`
+	Streamer       string              `json:"streamer,omitempty"`
+	FirstSeenEpoch uint64              `json:"firstSeenEpoch,omitempty"`
+	ViewerCount    int                 `json:"viewerCount"`
+	VideoStreams   []StreamStatusVideo `json:"videoStreams"`
+	ThumbnailURL   string              `json:"thumbnailUrl,omitempty"`
+	StreamMetadata
+}
+
+// GetDirectory combines the status and metadata of the given stream keys into
+// one listing, live streams are listed first.
+func GetDirectory(streamKeys []string, liveOnly bool) []DirectoryEntry {
+	live, offline := []DirectoryEntry{}, []DirectoryEntry{}
+
+	for _, streamKey := range streamKeys {
+		entry := DirectoryEntry{
+			StreamKey:      streamKey,
+			VideoStreams:   []StreamStatusVideo{},
+			StreamMetadata: GetStreamMetadata(streamKey),
+		}
+
+		streamMapLock.Lock()
+		if stream, ok := streamMap[streamKey]; ok && stream.online() {
+			status := stream.status()
+
+			entry.Live = true
+			entry.Streamer = status.Streamer
+			entry.FirstSeenEpoch = status.FirstSeenEpoch
+			entry.ViewerCount = status.Viewers()
+			entry.VideoStreams = status.VideoStreams
+		}
+		streamMapLock.Unlock()
+
+		if entry.Live {
+			entry.ThumbnailURL = ThumbnailURL(streamKey)
+			live = append(live, entry)
+		} else if !liveOnly {
+			offline = append(offline, entry)
+		}
+	}
+
+	return append(live, offline...)
+}
+
+func ThumbnailURL(streamKey string) string {
+	return strings.ReplaceAll(os.Getenv("THUMBNAIL_URL_TEMPLATE"), "{streamkey}", streamKey)
+}
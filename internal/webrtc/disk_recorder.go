@@ -0,0 +1,433 @@
+package webrtc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	defaultRecordingSegmentDuration = 10 * time.Minute
+	defaultRecordingMinFreeMB       = 1024
+
+	// Free space is checked this often while recording, and before every new file
+	recordingDiskCheckInterval = 10 * time.Second
+
+	// A stream without H264 video is recorded audio only once no keyframe arrived for this long
+	recordingVideoWait = 5 * time.Second
+
+	// Audio only recordings have no keyframes to start clusters at
+	recordingAudioClusterDuration = 5 * time.Second
+
+	recordingFileExtension = ".mkv"
+
+	recordingVideoTrackNumber = 1
+	recordingAudioTrackNumber = 2
+)
+
+type (
+	// DiskRecorder writes the H264 video and Opus audio of streams to Matroska files in RECORDING_DIR, one
+	// directory per stream key. A new file is started every RECORDING_SEGMENT_DURATION and when the publisher
+	// reconnects. It is a plugin Recorder, and recovers recordings a crashed instance left behind.
+	DiskRecorder struct {
+		dir             string
+		segmentDuration time.Duration
+		minFreeBytes    uint64
+
+		recordings     map[string]*diskRecording
+		recordingsLock sync.Mutex
+	}
+
+	diskRecording struct {
+		recorder  *DiskRecorder
+		streamKey string
+		stop      chan struct{}
+		done      chan struct{}
+
+		file      *os.File
+		mkv       *mkvWriter
+		path      string
+		basePTS   time.Duration
+		startedAt time.Time
+		hasVideo  bool
+		// A new file is started at the next keyframe
+		rotate bool
+
+		// Below RECORDING_MIN_FREE_MB nothing is written until enough space was freed
+		diskFull      bool
+		lastDiskCheck time.Time
+
+		video            *h264FrameAssembler
+		audioTrackID     string
+		firstAudioPTS    time.Duration
+		firstAudioPTSSet bool
+	}
+
+	// recordingFile counts what is written to a recording
+	recordingFile struct {
+		f *os.File
+	}
+)
+
+var (
+	diskRecorder *DiskRecorder
+
+	// RECORD_ALL_STREAMS records every stream, without an autostart rule or the record flag of its streamer
+	recordAllStreams bool
+
+	recordingBytesWritten atomic.Uint64
+	recordingDiskFull     atomic.Uint64
+)
+
+// configureDiskRecording reads RECORDING_DIR, RECORDING_SEGMENT_DURATION, RECORDING_MIN_FREE_MB and RECORD_ALL_STREAMS
+func configureDiskRecording() error {
+	recordAllStreams = os.Getenv("RECORD_ALL_STREAMS") == "true"
+
+	dir := os.Getenv("RECORDING_DIR")
+	if dir == "" {
+		return nil
+	}
+
+	r := &DiskRecorder{
+		dir:             dir,
+		segmentDuration: defaultRecordingSegmentDuration,
+		minFreeBytes:    defaultRecordingMinFreeMB << 20,
+		recordings:      map[string]*diskRecording{},
+	}
+
+	if v := os.Getenv("RECORDING_SEGMENT_DURATION"); v != "" {
+		seconds, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || seconds == 0 {
+			return fmt.Errorf("Invalid RECORDING_SEGMENT_DURATION %q", v)
+		}
+		r.segmentDuration = time.Duration(seconds) * time.Second
+	}
+
+	if v := os.Getenv("RECORDING_MIN_FREE_MB"); v != "" {
+		mb, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid RECORDING_MIN_FREE_MB %q", v)
+		}
+		r.minFreeBytes = mb << 20
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	diskRecorder = r
+	return nil
+}
+
+// ConfiguredDiskRecorder returns the recorder of RECORDING_DIR, nil if it isn't set
+func ConfiguredDiskRecorder() *DiskRecorder {
+	return diskRecorder
+}
+
+// StreamRecorded reports whether streamKey is recorded without an autostart rule, because of RECORD_ALL_STREAMS or
+// the record flag of its streamer
+func StreamRecorded(streamKey string) bool {
+	if recordAllStreams {
+		return true
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	return ok && stream.streamer != nil && stream.streamer.Record
+}
+
+// Start records streamKey until Stop, it does nothing if the stream is already recorded
+func (r *DiskRecorder) Start(_ context.Context, streamKey string) error {
+	streamDir, err := r.streamDir(streamKey)
+	if err != nil {
+		return err
+	}
+
+	r.recordingsLock.Lock()
+	defer r.recordingsLock.Unlock()
+
+	if _, ok := r.recordings[streamKey]; ok {
+		return nil
+	} else if err := os.MkdirAll(streamDir, 0o755); err != nil {
+		return err
+	}
+
+	packets, detach, err := AttachOutput(streamKey, OutputRecording)
+	if err != nil {
+		return err
+	}
+
+	recording := &diskRecording{
+		recorder:  r,
+		streamKey: streamKey,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	recording.video = newH264FrameAssembler(recording.writeVideoFrame)
+	r.recordings[streamKey] = recording
+
+	go func() {
+		defer close(recording.done)
+		defer detach()
+
+		recording.run(packets)
+	}()
+
+	return nil
+}
+
+// Stop finishes the file being written and returns once it was finalized
+func (r *DiskRecorder) Stop(_ context.Context, streamKey string) error {
+	r.recordingsLock.Lock()
+	recording, ok := r.recordings[streamKey]
+	delete(r.recordings, streamKey)
+	r.recordingsLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	close(recording.stop)
+	<-recording.done
+	return nil
+}
+
+// Recover returns the last file of a recording a crashed instance left behind. Its clusters were written as they
+// completed, so it plays up to the crash without remuxing. Earlier files were finalized when they were rotated.
+func (r *DiskRecorder) Recover(_ context.Context, streamKey string, startedAt time.Time) (string, error) {
+	streamDir, err := r.streamDir(streamKey)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(streamDir)
+	if err != nil {
+		return "", err
+	}
+
+	location, latest := "", startedAt
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || !strings.HasSuffix(entry.Name(), recordingFileExtension) || info.ModTime().Before(latest) {
+			continue
+		}
+
+		location, latest = filepath.Join(streamDir, entry.Name()), info.ModTime()
+	}
+
+	if location == "" {
+		return "", fmt.Errorf("No recording of %s since %s in %s", streamKey, startedAt.Format(time.RFC3339), streamDir)
+	}
+
+	return location, nil
+}
+
+// RecordingCount returns how many streams are recorded to disk
+func (r *DiskRecorder) RecordingCount() int {
+	r.recordingsLock.Lock()
+	defer r.recordingsLock.Unlock()
+
+	return len(r.recordings)
+}
+
+func (r *DiskRecorder) streamDir(streamKey string) (string, error) {
+	if streamKey == "" || streamKey == "." || streamKey == ".." || strings.ContainsAny(streamKey, `/\`) {
+		return "", fmt.Errorf("Stream key %q can't be recorded", streamKey)
+	}
+
+	return filepath.Join(r.dir, streamKey), nil
+}
+
+func (d *diskRecording) run(packets <-chan OutputPacket) {
+	defer d.closeFile()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case p := <-packets:
+			d.handlePacket(p)
+		}
+	}
+}
+
+func (d *diskRecording) handlePacket(p OutputPacket) {
+	if p.Packet == nil {
+		return
+	}
+
+	if p.Discontinuity {
+		// The publisher reconnected, its SPS and timestamps may have changed
+		d.video.reset()
+		d.rotate = true
+	}
+
+	if d.file != nil && time.Since(d.lastDiskCheck) >= recordingDiskCheckInterval && !d.enoughDiskSpace() {
+		d.closeFile()
+	}
+
+	if p.Video {
+		d.video.push(p)
+	} else {
+		d.handleAudioPacket(p)
+	}
+}
+
+func (d *diskRecording) writeVideoFrame(frame h264Frame) {
+	if frame.keyframe && (d.file == nil || d.rotate || !d.hasVideo || time.Since(d.startedAt) >= d.recorder.segmentDuration) {
+		d.openFile(frame.pts, true)
+	}
+	if d.file == nil || !d.hasVideo {
+		return
+	}
+
+	d.writeBlock(recordingVideoTrackNumber, frame.pts, frame.keyframe, frame.keyframe, frame.data)
+}
+
+func (d *diskRecording) handleAudioPacket(p OutputPacket) {
+	if !strings.EqualFold(p.MimeType, webrtc.MimeTypeOpus) {
+		return
+	} else if d.audioTrackID == "" {
+		d.audioTrackID = p.TrackID
+	}
+	if p.TrackID != d.audioTrackID || len(p.Packet.Payload) == 0 {
+		return
+	}
+
+	if !d.firstAudioPTSSet {
+		d.firstAudioPTS, d.firstAudioPTSSet = p.PTS, true
+	}
+
+	// Streams without H264 video are recorded audio only, until a keyframe starts a file with video
+	if d.file == nil && !d.video.found() && p.PTS-d.firstAudioPTS >= recordingVideoWait {
+		d.openFile(p.PTS, false)
+	}
+	if d.file == nil || p.PTS < d.basePTS {
+		return
+	}
+
+	newCluster := !d.hasVideo && (p.PTS-d.basePTS).Milliseconds()-d.mkv.clusterTimecode >= recordingAudioClusterDuration.Milliseconds()
+	d.writeBlock(recordingAudioTrackNumber, p.PTS, true, newCluster, p.Packet.Payload)
+}
+
+func (d *diskRecording) writeBlock(track uint64, pts time.Duration, keyframe, newCluster bool, frame []byte) {
+	if err := d.mkv.writeBlock(track, (pts - d.basePTS).Milliseconds(), keyframe, newCluster, frame); err != nil {
+		log.Printf("Recording of %s failed: %v", d.streamKey, err)
+		d.closeFile()
+	}
+}
+
+// openFile finishes the current file and starts a new one at pts, if there is enough free space
+func (d *diskRecording) openFile(pts time.Duration, withVideo bool) {
+	if withVideo && !d.video.hasParameterSets() {
+		return
+	}
+
+	d.closeFile()
+	if d.diskFull && time.Since(d.lastDiskCheck) < recordingDiskCheckInterval {
+		return
+	} else if !d.enoughDiskSpace() {
+		return
+	}
+
+	tracks := []mkvTrack{}
+	if withVideo {
+		width, height, err := parseH264SPSResolution(d.video.sps[1:])
+		if err != nil {
+			log.Printf("Recording of %s has no resolution: %v", d.streamKey, err)
+		}
+
+		tracks = append(tracks, mkvTrack{
+			number:       recordingVideoTrackNumber,
+			video:        true,
+			codecID:      "V_MPEG4/ISO/AVC",
+			codecPrivate: avcDecoderConfiguration(d.video.sps, d.video.pps),
+			width:        width,
+			height:       height,
+		})
+	}
+	tracks = append(tracks, mkvTrack{number: recordingAudioTrackNumber, codecID: "A_OPUS", codecPrivate: opusHead()})
+
+	name := time.Now().UTC().Format("20060102T150405Z")
+	path := filepath.Join(d.recorder.dir, d.streamKey, name+recordingFileExtension)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	for i := 1; errors.Is(err, os.ErrExist); i++ {
+		path = filepath.Join(d.recorder.dir, d.streamKey, name+"-"+strconv.Itoa(i)+recordingFileExtension)
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	}
+	if err != nil {
+		log.Printf("Recording of %s failed: %v", d.streamKey, err)
+		return
+	}
+
+	d.file, d.path, d.basePTS, d.startedAt, d.hasVideo, d.rotate = file, path, pts, time.Now(), withVideo, false
+	d.mkv = &mkvWriter{w: bufio.NewWriter(recordingFile{file})}
+	if err := d.mkv.writeHeader(tracks); err != nil {
+		log.Printf("Recording of %s failed: %v", d.streamKey, err)
+		d.closeFile()
+	}
+}
+
+// closeFile finishes the file being written and announces it as recording.finalized
+func (d *diskRecording) closeFile() {
+	if d.file == nil {
+		return
+	}
+
+	err := d.mkv.w.Flush()
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Recording of %s failed: %v", d.streamKey, err)
+	} else {
+		events.Publish(events.Event{
+			Type:      events.RecordingFinalized,
+			StreamKey: d.streamKey,
+			Tenant:    StreamTenant(d.streamKey),
+			Data:      d.path,
+		})
+	}
+
+	d.file, d.mkv, d.path = nil, nil, ""
+}
+
+// enoughDiskSpace checks RECORDING_MIN_FREE_MB. Where free space can't be determined recording always continues.
+func (d *diskRecording) enoughDiskSpace() bool {
+	d.lastDiskCheck = time.Now()
+
+	free, err := diskFreeBytes(d.recorder.dir)
+	if err != nil || free >= d.recorder.minFreeBytes {
+		if d.diskFull {
+			log.Printf("Recording of %s continues, %d MB are free again", d.streamKey, free>>20)
+		}
+		d.diskFull = false
+		return true
+	}
+
+	if !d.diskFull {
+		log.Printf("Recording of %s paused, only %d MB are free in %s", d.streamKey, free>>20, d.recorder.dir)
+		recordingDiskFull.Add(1)
+	}
+	d.diskFull = true
+	return false
+}
+
+func (f recordingFile) Write(b []byte) (int, error) {
+	n, err := f.f.Write(b)
+	recordingBytesWritten.Add(uint64(n))
+	return n, err
+}
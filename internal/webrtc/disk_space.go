@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package webrtc
+
+import "syscall"
+
+// diskFreeBytes returns the space available to unprivileged users on the filesystem of dir
+func diskFreeBytes(dir string) (uint64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil //nolint
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package webrtc
+
+import "errors"
+
+func diskFreeBytes(string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,76 @@
+package webrtc
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Bits per second a single stream may send to all of its WebRTC viewers, zero is unlimited
+	streamMaxEgressBitrate uint64
+	// Where viewers turned away by the egress cap are pointed to, `{streamkey}` is replaced
+	streamEgressFallbackURL string
+
+	ErrStreamEgressLimit = errors.New("Stream reached its egress limit")
+)
+
+func configureEgressCap() error {
+	if val := os.Getenv("STREAM_MAX_EGRESS_BITRATE"); val != "" {
+		bitrate, err := strconv.ParseUint(val, 10, 64)
+		if err != nil || bitrate == 0 {
+			return errors.New("STREAM_MAX_EGRESS_BITRATE must be a number of bits per second")
+		}
+		streamMaxEgressBitrate = bitrate
+	}
+
+	streamEgressFallbackURL = os.Getenv("STREAM_EGRESS_FALLBACK_URL")
+	return nil
+}
+
+// EgressFallbackURL returns where viewers of streamKey that hit the egress cap can watch instead, like its HLS
+// output, empty if STREAM_EGRESS_FALLBACK_URL isn't set
+func EgressFallbackURL(streamKey string) string {
+	if streamEgressFallbackURL == "" {
+		return ""
+	}
+
+	return strings.ReplaceAll(streamEgressFallbackURL, "{streamkey}", streamKey)
+}
+
+// egressBitrate estimates the bits per second s sends to its WebRTC viewers from the bitrate of the video layer
+// each of them receives. streamMapLock must be held.
+func (s *stream) egressBitrate() uint64 {
+	layerBitrates := map[string]uint64{}
+	for _, videoTrack := range s.videoTracks {
+		layerBitrates[videoTrack.rid] = videoTrack.bitrate.Load()
+	}
+
+	egress := uint64(0)
+	Sessions.eachViewer(s, func(_ string, whepSession *whepSession) {
+		if layer, ok := whepSession.currentLayer.Load().(string); ok {
+			egress += layerBitrates[layer]
+		}
+	})
+
+	return egress
+}
+
+// checkEgressCap returns ErrStreamEgressLimit if another viewer would take s over STREAM_MAX_EGRESS_BITRATE.
+// Viewers still negotiating and the new one are assumed to receive the highest layer. streamMapLock must be held.
+func (s *stream) checkEgressCap() error {
+	if streamMaxEgressBitrate == 0 {
+		return nil
+	}
+
+	highestLayer := uint64(0)
+	for _, videoTrack := range s.videoTracks {
+		highestLayer = max(highestLayer, videoTrack.bitrate.Load())
+	}
+
+	if s.egressBitrate()+uint64(s.pendingWHEPSessions+1)*highestLayer > streamMaxEgressBitrate {
+		return ErrStreamEgressLimit
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package webrtc
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultFirstFrameDeadline = time.Second
+
+	// A publisher that doesn't answer keyframe requests, or has no video, isn't asked forever
+	maxFirstFrameRequests = 10
+)
+
+var (
+	// A viewer that did not get a keyframe this long after it connected asks the publisher again, zero disables it
+	firstFrameDeadline = defaultFirstFrameDeadline
+
+	firstFrameDeadlinesMissed atomic.Uint64
+)
+
+// configureFirstFrame reads FIRST_FRAME_DEADLINE_MS
+func configureFirstFrame() error {
+	if v := os.Getenv("FIRST_FRAME_DEADLINE_MS"); v != "" {
+		ms, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid FIRST_FRAME_DEADLINE_MS %q", v)
+		}
+		firstFrameDeadline = time.Duration(ms) * time.Millisecond
+	}
+
+	return nil
+}
+
+// requestKeyframe sends a PLI for this layer only, viewers of the other layers aren't sent a keyframe they don't need
+func (t *videoTrack) requestKeyframe() {
+	select {
+	case t.pliChan <- true:
+	default:
+	}
+}
+
+// startViewer starts a viewer that just connected at the last keyframe of its layer. If the keyframe cache has
+// none the publisher is asked for one right away, and again every FIRST_FRAME_DEADLINE_MS until it arrives.
+func (s *stream) startViewer(whepSessionId string) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	s.whepSessionsLock.Lock()
+	defer s.whepSessionsLock.Unlock()
+
+	w, ok := s.whepSessions[whepSessionId]
+	if !ok {
+		return
+	}
+
+	w.connectedAt.Store(time.Now().UnixNano())
+	if s.replayKeyframeCache(w) {
+		return
+	}
+
+	w.waitingForKeyframe.Store(true)
+	s.requestViewerKeyframe(w)
+
+	if firstFrameDeadline != 0 {
+		go s.enforceFirstFrameDeadline(whepSessionId)
+	}
+}
+
+// requestViewerKeyframe asks for a keyframe of the layer w receives, or of every layer if it hasn't got one yet.
+// Must be called with streamMapLock held.
+func (s *stream) requestViewerKeyframe(w *whepSession) {
+	layer, _ := w.currentLayer.Load().(string)
+	for _, videoTrack := range s.videoTracks {
+		if layer == "" || layer == videoTrack.rid {
+			videoTrack.requestKeyframe()
+		}
+	}
+}
+
+// enforceFirstFrameDeadline repeats the keyframe request of a viewer until it got its first frame, in case the PLI
+// or the keyframe was lost
+func (s *stream) enforceFirstFrameDeadline(whepSessionId string) {
+	defer s.trackGoroutine()()
+
+	ticker := time.NewTicker(firstFrameDeadline)
+	defer ticker.Stop()
+
+	for range maxFirstFrameRequests {
+		select {
+		case <-s.whipActiveContext.Done():
+			return
+		case <-ticker.C:
+		}
+
+		streamMapLock.Lock()
+		s.whepSessionsLock.RLock()
+		w, ok := s.whepSessions[whepSessionId]
+		waiting := ok && w.connectedAt.Load() != 0
+		if waiting && len(s.videoTracks) != 0 {
+			firstFrameDeadlinesMissed.Add(1)
+			s.requestViewerKeyframe(w)
+		}
+		s.whepSessionsLock.RUnlock()
+		streamMapLock.Unlock()
+
+		if !waiting {
+			return
+		}
+	}
+}
+
+// onFirstFrame records the time to first frame once w is sent its first packet after it connected
+func (w *whepSession) onFirstFrame() {
+	if connectedAt := w.connectedAt.Swap(0); connectedAt != 0 && whepTimeToFirstFrame != nil {
+		whepTimeToFirstFrame.Observe(time.Since(time.Unix(0, connectedAt)).Seconds())
+	}
+}
@@ -0,0 +1,203 @@
+package webrtc
+
+import (
+	"encoding/binary"
+)
+
+// Sample flags of trun, see ISO/IEC 14496-12 8.8.3.1
+const (
+	fmp4SampleFlagsSync    = 0x02000000
+	fmp4SampleFlagsNonSync = 0x01010000
+
+	fmp4TrunDataOffset   = 0x000001
+	fmp4TrunDuration     = 0x000100
+	fmp4TrunSize         = 0x000200
+	fmp4TrunFlags        = 0x000400
+	fmp4TfhdDefaultBase  = 0x020000
+	fmp4TkhdEnabledMovie = 0x000003
+)
+
+type (
+	// fmp4Track is a track of a fragmented MP4 stream, H264 video or Opus audio
+	fmp4Track struct {
+		id        uint32
+		video     bool
+		timescale uint32
+		// Video only
+		width, height int
+		sps, pps      []byte
+	}
+
+	fmp4Sample struct {
+		data     []byte
+		duration uint32
+		keyframe bool
+	}
+
+	// fmp4Run is what a media segment carries of one track
+	fmp4Run struct {
+		trackID uint32
+		// Decode time of the first sample in the timescale of the track
+		baseDecodeTime uint64
+		samples        []fmp4Sample
+	}
+)
+
+func mp4Box(boxType string, children ...[]byte) []byte {
+	size := 8
+	for _, c := range children {
+		size += len(c)
+	}
+
+	box := binary.BigEndian.AppendUint32(make([]byte, 0, size), uint32(size))
+	box = append(box, boxType...)
+	for _, c := range children {
+		box = append(box, c...)
+	}
+
+	return box
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, children ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(boxType, append([][]byte{header}, children...)...)
+}
+
+func mp4Uint16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func mp4Uint32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// mp4Matrix is the unity transformation matrix of mvhd and tkhd
+func mp4Matrix() []byte {
+	matrix := []byte{}
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		matrix = binary.BigEndian.AppendUint32(matrix, v)
+	}
+
+	return matrix
+}
+
+// fmp4Init returns the initialization segment (ftyp and moov) of tracks
+func fmp4Init(tracks []fmp4Track) []byte {
+	traks, trexs := [][]byte{}, [][]byte{}
+	nextTrackID := uint32(1)
+	for _, t := range tracks {
+		traks = append(traks, t.trak())
+		trexs = append(trexs, mp4FullBox("trex", 0, 0, mp4Uint32(t.id), mp4Uint32(1), mp4Uint32(0), mp4Uint32(0), mp4Uint32(0)))
+		nextTrackID = max(nextTrackID, t.id+1)
+	}
+
+	ftyp := mp4Box("ftyp", []byte("iso5"), mp4Uint32(512), []byte("iso5iso6mp41"))
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		mp4Uint32(0), mp4Uint32(0), // creation and modification time
+		mp4Uint32(1000), mp4Uint32(0), // timescale and duration
+		mp4Uint32(0x00010000), mp4Uint16(0x0100), make([]byte, 10), // rate, volume, reserved
+		mp4Matrix(), make([]byte, 24), mp4Uint32(nextTrackID),
+	)
+
+	moov := mp4Box("moov", append(append([][]byte{mvhd}, traks...), mp4Box("mvex", trexs...))...)
+	return append(ftyp, moov...)
+}
+
+func (t fmp4Track) trak() []byte {
+	volume, handler, name := uint16(0x0100), "soun", "SoundHandler"
+	if t.video {
+		volume, handler, name = 0, "vide", "VideoHandler"
+	}
+
+	tkhd := mp4FullBox("tkhd", 0, fmp4TkhdEnabledMovie,
+		mp4Uint32(0), mp4Uint32(0), mp4Uint32(t.id), mp4Uint32(0), mp4Uint32(0), // times, track ID, reserved, duration
+		make([]byte, 8), mp4Uint16(0), mp4Uint16(0), mp4Uint16(volume), mp4Uint16(0), // reserved, layer, alternate group
+		mp4Matrix(), mp4Uint32(uint32(t.width)<<16), mp4Uint32(uint32(t.height)<<16),
+	)
+
+	mdhd := mp4FullBox("mdhd", 0, 0, mp4Uint32(0), mp4Uint32(0), mp4Uint32(t.timescale), mp4Uint32(0), mp4Uint16(0x55C4), mp4Uint16(0)) // und
+	hdlr := mp4FullBox("hdlr", 0, 0, mp4Uint32(0), []byte(handler), make([]byte, 12), append([]byte(name), 0))
+
+	mediaHeader := mp4FullBox("smhd", 0, 0, mp4Uint16(0), mp4Uint16(0))
+	if t.video {
+		mediaHeader = mp4FullBox("vmhd", 0, 1, mp4Uint16(0), make([]byte, 6))
+	}
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Uint32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, mp4Uint32(1), t.sampleEntry()),
+		mp4FullBox("stts", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsc", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsz", 0, 0, mp4Uint32(0), mp4Uint32(0)),
+		mp4FullBox("stco", 0, 0, mp4Uint32(0)),
+	)
+
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mediaHeader, dinf, stbl)))
+}
+
+func (t fmp4Track) sampleEntry() []byte {
+	// Reserved and data_reference_index of every sample entry
+	header := append(make([]byte, 6), mp4Uint16(1)...)
+
+	if t.video {
+		return mp4Box("avc1", header,
+			make([]byte, 16), mp4Uint16(uint16(t.width)), mp4Uint16(uint16(t.height)),
+			mp4Uint32(0x00480000), mp4Uint32(0x00480000), mp4Uint32(0), mp4Uint16(1), // 72 dpi, reserved, frame count
+			make([]byte, 32), mp4Uint16(0x0018), mp4Uint16(0xFFFF), // compressor name, depth, pre_defined
+			mp4Box("avcC", avcDecoderConfiguration(t.sps, t.pps)),
+		)
+	}
+
+	// dOps is OpusHead without its magic signature and in big endian, see https://opus-codec.org/docs/opus_in_isobmff.html
+	dOps := []byte{0, 2}
+	dOps = binary.BigEndian.AppendUint16(dOps, 0)
+	dOps = binary.BigEndian.AppendUint32(dOps, 48000)
+	dOps = append(dOps, 0, 0, 0)
+
+	return mp4Box("Opus", header,
+		make([]byte, 8), mp4Uint16(2), mp4Uint16(16), mp4Uint32(0), mp4Uint32(48000<<16), // channels, sample size, sample rate
+		mp4Box("dOps", dOps),
+	)
+}
+
+// fmp4Segment returns a media segment (moof and mdat) with the samples of runs
+func fmp4Segment(sequence uint32, runs []fmp4Run) []byte {
+	moof := func(dataOffsets []uint32) []byte {
+		trafs := [][]byte{mp4FullBox("mfhd", 0, 0, mp4Uint32(sequence))}
+		for i, r := range runs {
+			samples := []byte{}
+			for _, s := range r.samples {
+				flags := uint32(fmp4SampleFlagsSync)
+				if !s.keyframe {
+					flags = fmp4SampleFlagsNonSync
+				}
+
+				samples = binary.BigEndian.AppendUint32(samples, s.duration)
+				samples = binary.BigEndian.AppendUint32(samples, uint32(len(s.data)))
+				samples = binary.BigEndian.AppendUint32(samples, flags)
+			}
+
+			trafs = append(trafs, mp4Box("traf",
+				mp4FullBox("tfhd", 0, fmp4TfhdDefaultBase, mp4Uint32(r.trackID)),
+				mp4FullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, r.baseDecodeTime)),
+				mp4FullBox("trun", 0, fmp4TrunDataOffset|fmp4TrunDuration|fmp4TrunSize|fmp4TrunFlags,
+					mp4Uint32(uint32(len(r.samples))), mp4Uint32(dataOffsets[i]), samples),
+			))
+		}
+
+		return mp4Box("moof", trafs...)
+	}
+
+	// Offsets are relative to the moof, whose size doesn't depend on them
+	dataOffsets := make([]uint32, len(runs))
+	offset := uint32(len(moof(dataOffsets))) + 8
+	data := [][]byte{}
+	for i, r := range runs {
+		dataOffsets[i] = offset
+		for _, s := range r.samples {
+			data = append(data, s.data)
+			offset += uint32(len(s.data))
+		}
+	}
+
+	return append(moof(dataOffsets), mp4Box("mdat", data...)...)
+}
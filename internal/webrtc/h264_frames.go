@@ -0,0 +1,129 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+type (
+	// h264Frame is an access unit, its NAL units are prefixed with their 4 byte length like in MP4 and Matroska
+	h264Frame struct {
+		data     []byte
+		pts      time.Duration
+		keyframe bool
+	}
+
+	// h264FrameAssembler depacketizes the H264 video of an output into frames for outputs that write files, like
+	// recordings and HLS. It follows the highest simulcast layer. Frames that lost a packet are dropped, and every
+	// frame after them until the next keyframe.
+	h264FrameAssembler struct {
+		// Called for every complete frame, its data is reused afterwards
+		onFrame func(h264Frame)
+
+		trackID      string
+		depacketizer *codecs.H264Packet
+		// Latest parameter sets of the publisher, for the decoder configuration of a file
+		sps, pps []byte
+
+		lastSequenceNumber    uint16
+		lastSequenceNumberSet bool
+		needKeyframe          bool
+
+		// The frame being assembled from the packets of one RTP timestamp
+		frame          h264Frame
+		frameTimestamp uint32
+		frameOK        bool
+		frameStarted   bool
+	}
+)
+
+func newH264FrameAssembler(onFrame func(h264Frame)) *h264FrameAssembler {
+	return &h264FrameAssembler{onFrame: onFrame, depacketizer: &codecs.H264Packet{IsAVC: true}, needKeyframe: true}
+}
+
+// found reports whether the output has H264 video
+func (a *h264FrameAssembler) found() bool {
+	return a.trackID != ""
+}
+
+// hasParameterSets reports whether a decoder configuration can be written
+func (a *h264FrameAssembler) hasParameterSets() bool {
+	return len(a.sps) >= 4 && len(a.pps) != 0
+}
+
+// reset drops the frame being assembled and waits for a keyframe, after the publisher reconnected
+func (a *h264FrameAssembler) reset() {
+	a.frameStarted, a.lastSequenceNumberSet, a.needKeyframe = false, false, true
+	a.depacketizer = &codecs.H264Packet{IsAVC: true}
+}
+
+// push assembles a video packet of the output, packets of other codecs and layers are ignored
+func (a *h264FrameAssembler) push(p OutputPacket) {
+	if !strings.EqualFold(p.MimeType, webrtc.MimeTypeH264) {
+		return
+	} else if a.trackID == "" && (p.TrackID == videoTrackLabelDefault || p.TrackID == simulcastLayerHigh) {
+		a.trackID = p.TrackID
+	}
+	if p.TrackID != a.trackID {
+		return
+	}
+
+	if a.frameStarted && p.Packet.Timestamp != a.frameTimestamp {
+		a.finishFrame()
+	}
+
+	if !a.frameStarted {
+		a.frame = h264Frame{data: a.frame.data[:0], pts: p.PTS}
+		a.frameTimestamp, a.frameOK, a.frameStarted = p.Packet.Timestamp, true, true
+	}
+
+	if a.lastSequenceNumberSet && p.Packet.SequenceNumber != a.lastSequenceNumber+1 {
+		a.frameOK, a.needKeyframe = false, true
+		a.depacketizer = &codecs.H264Packet{IsAVC: true}
+	}
+	a.lastSequenceNumber, a.lastSequenceNumberSet = p.Packet.SequenceNumber, true
+
+	nalus, err := a.depacketizer.Unmarshal(p.Packet.Payload)
+	if err != nil {
+		a.frameOK = false
+	}
+
+	for len(nalus) > 4 {
+		size := int(binary.BigEndian.Uint32(nalus))
+		if size == 0 || size > len(nalus)-4 {
+			a.frameOK = false
+			break
+		}
+
+		nalu := nalus[4 : 4+size]
+		switch nalu[0] & naluTypeBitmask {
+		case idrNALUType:
+			a.frame.keyframe = true
+		case spsNALUType:
+			a.sps = append(a.sps[:0], nalu...)
+		case ppsNALUType:
+			a.pps = append(a.pps[:0], nalu...)
+		}
+
+		a.frame.data = append(a.frame.data, nalus[:4+size]...)
+		nalus = nalus[4+size:]
+	}
+
+	if p.Packet.Marker {
+		a.finishFrame()
+	}
+}
+
+func (a *h264FrameAssembler) finishFrame() {
+	a.frameStarted = false
+	if !a.frameOK || len(a.frame.data) == 0 || (a.needKeyframe && !a.frame.keyframe) {
+		return
+	}
+
+	a.needKeyframe = false
+	a.onFrame(a.frame)
+}
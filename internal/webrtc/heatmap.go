@@ -0,0 +1,126 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/scheduler"
+)
+
+const (
+	// Playback positions are counted per heatmapBucket of the recording
+	heatmapBucket = 10 * time.Second
+
+	heatmapFlushInterval = 30 * time.Second
+
+	// Limits of a single report, players report what they played since their last report
+	heatmapMaxPositions = 360
+	heatmapMaxMediaTime = 48 * time.Hour
+)
+
+type (
+	// HeatmapBucket is how often a part of a recording was watched
+	HeatmapBucket struct {
+		// Milliseconds into the recording the bucket starts at
+		MediaTime int64 `json:"mediaTime"`
+		Views     int64 `json:"views"`
+	}
+
+	heatmapKey struct {
+		streamKey       string
+		streamStartedAt uint64
+		bucket          int64
+	}
+)
+
+var (
+	pendingHeatmap     = map[heatmapKey]int64{}
+	pendingHeatmapLock sync.Mutex
+)
+
+// ConfigureRecordingHeatmaps stores the reported playback positions once per heatmapFlushInterval
+func ConfigureRecordingHeatmaps(pool *pgxpool.Pool) {
+	scheduler.Register("recording-heatmap", heatmapFlushInterval, func(context.Context) error {
+		return flushHeatmap(pool)
+	})
+}
+
+// AddPlaybackPositions counts the positions (milliseconds into the recording) a VOD viewer played of the recording of
+// the broadcast of streamKey that started at streamStartedAt. Viewers are not identified.
+func AddPlaybackPositions(streamKey string, streamStartedAt uint64, positions []int64) error {
+	if len(positions) > heatmapMaxPositions {
+		return errors.New("Too many positions")
+	}
+
+	// Every bucket is counted once per report, so seeking back and forth in one segment is a single view
+	buckets := map[int64]bool{}
+	for _, position := range positions {
+		if position < 0 || position > heatmapMaxMediaTime.Milliseconds() {
+			return errors.New("Invalid position")
+		}
+		buckets[position/heatmapBucket.Milliseconds()] = true
+	}
+
+	pendingHeatmapLock.Lock()
+	defer pendingHeatmapLock.Unlock()
+
+	for bucket := range buckets {
+		pendingHeatmap[heatmapKey{streamKey: streamKey, streamStartedAt: streamStartedAt, bucket: bucket}]++
+	}
+
+	return nil
+}
+
+func flushHeatmap(pool *pgxpool.Pool) error {
+	pendingHeatmapLock.Lock()
+	flushed := pendingHeatmap
+	pendingHeatmap = map[heatmapKey]int64{}
+	pendingHeatmapLock.Unlock()
+
+	if len(flushed) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), summarySaveTimeout)
+	defer cancel()
+
+	batch := &pgx.Batch{}
+	for key, views := range flushed {
+		batch.Queue(`INSERT INTO recording_heatmap (stream_key, stream_started_at, bucket, views)
+			 VALUES (@streamKey, to_timestamp(@streamStartedAt), @bucket, @views)
+			 ON CONFLICT (stream_key, stream_started_at, bucket) DO UPDATE SET views = recording_heatmap.views + EXCLUDED.views`, pgx.NamedArgs{
+			"streamKey":       key.streamKey,
+			"streamStartedAt": int64(key.streamStartedAt),
+			"bucket":          key.bucket,
+			"views":           views,
+		})
+	}
+
+	return pool.SendBatch(ctx, batch).Close()
+}
+
+// GetRecordingHeatmap returns how often each part of a recording was watched, ordered by media time. Parts nobody
+// watched are left out.
+func GetRecordingHeatmap(pool *pgxpool.Pool, ctx context.Context, streamKey string, streamStartedAt uint64) ([]HeatmapBucket, error) {
+	query := `SELECT bucket * @bucketLength, views FROM recording_heatmap
+		 WHERE stream_key = @streamKey AND stream_started_at = to_timestamp(@streamStartedAt)
+		 ORDER BY bucket`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
+		"streamKey":       streamKey,
+		"streamStartedAt": int64(streamStartedAt),
+		"bucketLength":    heatmapBucket.Milliseconds(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (HeatmapBucket, error) {
+		var b HeatmapBucket
+		err := row.Scan(&b.MediaTime, &b.Views)
+		return b, err
+	})
+}
@@ -0,0 +1,720 @@
+package webrtc
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/hlskeys"
+	"github.com/patrikrog/broadcast-box/internal/objectstore"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	defaultHLSSegmentDuration = 2 * time.Second
+	defaultHLSWindowSize      = 6
+	defaultHLSUploadPrefix    = "hls/"
+
+	// Segments that left the playlist stay available, for players that were behind
+	hlsRetainedSegments = 3
+
+	// A stream that sent no H264 video this long after its first audio is packaged audio only
+	hlsVideoWait = 5 * time.Second
+
+	hlsVideoTrackID   = 1
+	hlsAudioTrackID   = 2
+	hlsVideoTimescale = 90000
+	hlsAudioTimescale = 48000
+
+	// Duration of an Opus packet of WebRTC, for the last packet of a stream
+	hlsOpusPacketDuration = 20 * time.Millisecond
+)
+
+// ErrHLSNotFound is returned for streams without HLS output and segments that left the playlist
+var ErrHLSNotFound = errors.New("HLS is not available for this stream")
+
+type (
+	hlsSample struct {
+		data     []byte
+		pts      time.Duration
+		keyframe bool
+	}
+
+	hlsSegment struct {
+		sequence        uint64
+		data            []byte
+		duration        time.Duration
+		programDateTime time.Time
+		discontinuity   bool
+		initVersion     int
+		// Zero if the segment isn't encrypted
+		keyID uint64
+		// EXT-X-DATERANGE tags of ad breaks
+		tags []string
+		// The segment was written to object storage and is fetched from there
+		uploaded bool
+	}
+
+	// hlsPackager remuxes the H264 video and Opus audio of a stream into fMP4 segments of a live playlist
+	hlsPackager struct {
+		streamKey string
+		stop      chan struct{}
+		stopOnce  sync.Once
+		done      chan struct{}
+
+		video            *h264FrameAssembler
+		audioTrackID     string
+		firstAudioPTS    time.Duration
+		firstAudioPTSSet bool
+
+		// The segment being assembled
+		started       bool
+		hasVideo      bool
+		startPTS      time.Duration
+		videoSamples  []hlsSample
+		audioSamples  []hlsSample
+		tags          []string
+		discontinuity bool
+		// The segment being assembled follows a discontinuity
+		segmentDiscontinuity bool
+		cutAtKeyframe        bool
+		// Wall clock time of PTS zero, for EXT-X-PROGRAM-DATE-TIME
+		epoch          time.Time
+		initSPS        []byte
+		adBreakStarted map[uint32]time.Time
+
+		// Read by viewers
+		lock                  sync.Mutex
+		inits                 map[int][]byte
+		initVersion           int
+		segments              []*hlsSegment
+		retired               []*hlsSegment
+		nextSequence          uint64
+		discontinuitySequence uint64
+		ended                 bool
+
+		// Segments are published once they were uploaded, if HLS_UPLOAD is set. Every run of a stream has its own
+		// random prefix, so the CDN never serves a segment of an earlier run and the URLs don't reveal the stream key.
+		uploads       chan *hlsSegment
+		uploadsDone   chan struct{}
+		objectPrefix  string
+		uploadedInits map[int]bool
+	}
+)
+
+var (
+	hlsEnabled         bool
+	hlsSegmentDuration = defaultHLSSegmentDuration
+	hlsWindowSize      = defaultHLSWindowSize
+	hlsUpload          bool
+	hlsUploadPrefix    = defaultHLSUploadPrefix
+
+	hlsPackagers     = map[string]*hlsPackager{}
+	hlsPackagersLock sync.Mutex
+)
+
+// configureHLS packages every stream as HLS if HLS_ENABLED is true, with segments of HLS_SEGMENT_DURATION seconds and
+// HLS_WINDOW_SIZE segments in the playlist. With HLS_UPLOAD segments are written to object storage under
+// HLS_UPLOAD_PREFIX and the playlist points at S3_PUBLIC_URL.
+func configureHLS() error {
+	if os.Getenv("HLS_ENABLED") != "true" {
+		return nil
+	}
+	hlsEnabled = true
+
+	if val := os.Getenv("HLS_SEGMENT_DURATION"); val != "" {
+		seconds, err := strconv.ParseFloat(val, 64)
+		if err != nil || seconds < 0.5 || seconds > 60 {
+			return fmt.Errorf("Invalid HLS_SEGMENT_DURATION %q, expected 0.5 to 60 seconds", val)
+		}
+		hlsSegmentDuration = time.Duration(seconds * float64(time.Second))
+	}
+
+	if val := os.Getenv("HLS_WINDOW_SIZE"); val != "" {
+		windowSize, err := strconv.Atoi(val)
+		if err != nil || windowSize < 3 {
+			return fmt.Errorf("Invalid HLS_WINDOW_SIZE %q, expected at least 3 segments", val)
+		}
+		hlsWindowSize = windowSize
+	}
+
+	if os.Getenv("HLS_UPLOAD") == "true" {
+		if !objectstore.Enabled() {
+			return errors.New("HLS_UPLOAD requires S3_BUCKET")
+		}
+		hlsUpload = true
+	}
+	if val, ok := os.LookupEnv("HLS_UPLOAD_PREFIX"); ok {
+		hlsUploadPrefix = val
+	}
+
+	events.Subscribe(func(e events.Event) {
+		switch e.Type {
+		case events.StreamStart:
+			startHLS(e.StreamKey)
+		case events.StreamEnd:
+			stopHLS(e.StreamKey)
+		}
+	})
+
+	return nil
+}
+
+// HLSEnabled reports whether streams are packaged as HLS
+func HLSEnabled() bool {
+	return hlsEnabled
+}
+
+// HLSStreams returns how many streams are packaged as HLS
+func HLSStreams() int {
+	hlsPackagersLock.Lock()
+	defer hlsPackagersLock.Unlock()
+
+	return len(hlsPackagers)
+}
+
+// HLSPlaylist returns the media playlist of streamKey. query is appended to every URI in it, so the playback
+// token of the viewer is passed on.
+func HLSPlaylist(streamKey, query string) ([]byte, error) {
+	p, err := getHLSPackager(streamKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.playlist(query), nil
+}
+
+// HLSFile returns an initialization segment (init-<version>.mp4) or media segment (<sequence>.m4s) of streamKey
+func HLSFile(streamKey, name string) ([]byte, error) {
+	p, err := getHLSPackager(streamKey)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if version, ok := strings.CutPrefix(name, "init-"); ok {
+		v, err := strconv.Atoi(strings.TrimSuffix(version, ".mp4"))
+		if init, ok := p.inits[v]; err == nil && ok && strings.HasSuffix(version, ".mp4") {
+			return init, nil
+		}
+	} else if sequence, ok := strings.CutSuffix(name, ".m4s"); ok {
+		s, err := strconv.ParseUint(sequence, 10, 64)
+		for _, segment := range append(p.retired, p.segments...) {
+			if err == nil && segment.sequence == s {
+				return segment.data, nil
+			}
+		}
+	}
+
+	return nil, ErrHLSNotFound
+}
+
+func getHLSPackager(streamKey string) (*hlsPackager, error) {
+	hlsPackagersLock.Lock()
+	defer hlsPackagersLock.Unlock()
+
+	p, ok := hlsPackagers[streamKey]
+	if !ok {
+		return nil, ErrHLSNotFound
+	}
+
+	return p, nil
+}
+
+func startHLS(streamKey string) {
+	hlsPackagersLock.Lock()
+	defer hlsPackagersLock.Unlock()
+
+	if p, ok := hlsPackagers[streamKey]; ok && !p.isEnded() {
+		return
+	}
+
+	// Streams may not allow HLS, which is not an error
+	packets, detach, err := AttachOutput(streamKey, OutputHLS)
+	if err != nil {
+		return
+	}
+
+	p := &hlsPackager{
+		streamKey:      streamKey,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+		adBreakStarted: map[uint32]time.Time{},
+		inits:          map[int][]byte{},
+	}
+	p.video = newH264FrameAssembler(p.handleVideoFrame)
+	if hlsUpload {
+		p.uploads = make(chan *hlsSegment, hlsWindowSize)
+		p.uploadsDone = make(chan struct{})
+		p.objectPrefix = hlsUploadPrefix + uuid.New().String() + "/"
+		p.uploadedInits = map[int]bool{}
+		go p.upload()
+	}
+	hlsPackagers[streamKey] = p
+
+	go func() {
+		defer close(p.done)
+		defer detach()
+
+		p.run(packets)
+	}()
+}
+
+// stopHLS finishes the playlist of streamKey. It is served until players had the time to play it to its end.
+func stopHLS(streamKey string) {
+	p, err := getHLSPackager(streamKey)
+	if err != nil {
+		return
+	}
+
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+
+	time.AfterFunc(hlsSegmentDuration*time.Duration(hlsWindowSize), func() {
+		hlsPackagersLock.Lock()
+		defer hlsPackagersLock.Unlock()
+
+		if hlsPackagers[streamKey] == p {
+			delete(hlsPackagers, streamKey)
+			hlskeys.Forget(streamKey)
+		}
+		if p.uploads != nil {
+			go p.deleteObjects()
+		}
+	})
+}
+
+func (p *hlsPackager) isEnded() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.ended
+}
+
+func (p *hlsPackager) run(packets <-chan OutputPacket) {
+	for {
+		select {
+		case <-p.stop:
+			p.cut(p.endOfSamples())
+			if p.uploads != nil {
+				close(p.uploads)
+				<-p.uploadsDone
+			}
+
+			p.lock.Lock()
+			p.ended = true
+			p.lock.Unlock()
+			return
+		case packet := <-packets:
+			p.handlePacket(packet)
+		}
+	}
+}
+
+func (p *hlsPackager) handlePacket(packet OutputPacket) {
+	switch {
+	case packet.AdBreak != nil:
+		p.addAdBreak(*packet.AdBreak)
+		return
+	case packet.Packet == nil:
+		return
+	case packet.Discontinuity:
+		// The publisher reconnected, its SPS and timestamps may have changed
+		p.video.reset()
+		p.discontinuity = true
+		if !p.hasVideo {
+			p.cut(p.endOfSamples())
+		}
+	}
+
+	if packet.Video {
+		p.video.push(packet)
+	} else {
+		p.handleAudioPacket(packet)
+	}
+}
+
+func (p *hlsPackager) handleVideoFrame(frame h264Frame) {
+	if frame.keyframe {
+		switch {
+		case !p.started || !p.hasVideo || p.discontinuity || p.cutAtKeyframe:
+			p.startSegment(frame.pts, true)
+		case frame.pts-p.startPTS >= hlsSegmentDuration:
+			p.startSegment(frame.pts, true)
+		}
+	}
+	if !p.started || !p.hasVideo {
+		return
+	}
+
+	p.videoSamples = append(p.videoSamples, hlsSample{data: bytes.Clone(frame.data), pts: frame.pts, keyframe: frame.keyframe})
+}
+
+func (p *hlsPackager) handleAudioPacket(packet OutputPacket) {
+	if !strings.EqualFold(packet.MimeType, webrtc.MimeTypeOpus) {
+		return
+	} else if p.audioTrackID == "" {
+		p.audioTrackID = packet.TrackID
+	}
+	if packet.TrackID != p.audioTrackID || len(packet.Packet.Payload) == 0 {
+		return
+	}
+
+	if !p.firstAudioPTSSet {
+		p.firstAudioPTS, p.firstAudioPTSSet = packet.PTS, true
+	}
+
+	// Streams without H264 video are packaged audio only, segments are cut by time
+	if !p.video.found() && packet.PTS-p.firstAudioPTS >= hlsVideoWait &&
+		(!p.started || p.discontinuity || p.cutAtKeyframe || packet.PTS-p.startPTS >= hlsSegmentDuration) {
+		p.startSegment(packet.PTS, false)
+	}
+	if !p.started || packet.PTS < p.startPTS {
+		return
+	}
+
+	p.audioSamples = append(p.audioSamples, hlsSample{data: bytes.Clone(packet.Packet.Payload), pts: packet.PTS, keyframe: true})
+}
+
+// addAdBreak places the ad break on the segment being assembled, and starts a new segment at the next keyframe so the
+// break starts close to a segment boundary
+func (p *hlsPackager) addAdBreak(adBreak AdBreak) {
+	id := fmt.Sprintf(`ID="ad-%d"`, adBreak.ID)
+	if adBreak.State == AdBreakStart {
+		p.adBreakStarted[adBreak.ID] = adBreak.Time
+		tag := fmt.Sprintf(`#EXT-X-DATERANGE:%s,START-DATE="%s"`, id, adBreak.Time.UTC().Format(time.RFC3339Nano))
+		if adBreak.Duration > 0 {
+			tag += fmt.Sprintf(",PLANNED-DURATION=%.3f", adBreak.Duration)
+		}
+		p.tags = append(p.tags, tag+",SCTE35-OUT=0x"+strings.ToUpper(hex.EncodeToString(adBreak.SCTE35())))
+	} else {
+		startedAt, ok := p.adBreakStarted[adBreak.ID]
+		if !ok {
+			startedAt = adBreak.Time
+		}
+		delete(p.adBreakStarted, adBreak.ID)
+
+		p.tags = append(p.tags, fmt.Sprintf(`#EXT-X-DATERANGE:%s,START-DATE="%s",DURATION=%.3f,SCTE35-IN=0x%s`, id,
+			startedAt.UTC().Format(time.RFC3339Nano), adBreak.Time.Sub(startedAt).Seconds(), strings.ToUpper(hex.EncodeToString(adBreak.SCTE35()))))
+	}
+
+	p.cutAtKeyframe = true
+}
+
+// endOfSamples is where the segment being assembled ends if no further sample arrives
+func (p *hlsPackager) endOfSamples() time.Duration {
+	end := p.startPTS
+	if len(p.videoSamples) != 0 {
+		end = max(end, p.videoSamples[len(p.videoSamples)-1].pts+time.Second/30)
+	}
+	if len(p.audioSamples) != 0 {
+		end = max(end, p.audioSamples[len(p.audioSamples)-1].pts+hlsOpusPacketDuration)
+	}
+
+	return end
+}
+
+// startSegment finishes the segment being assembled at pts and starts the next one with a new initialization
+// segment if the tracks changed
+func (p *hlsPackager) startSegment(pts time.Duration, withVideo bool) {
+	if withVideo && !p.video.hasParameterSets() {
+		return
+	}
+
+	if p.started {
+		p.cut(pts)
+	}
+
+	if !p.started || withVideo != p.hasVideo || (withVideo && !bytes.Equal(p.initSPS, p.video.sps)) {
+		p.writeInit(withVideo)
+	}
+
+	p.started, p.hasVideo, p.startPTS, p.cutAtKeyframe = true, withVideo, pts, false
+	p.segmentDiscontinuity = p.discontinuity && p.nextSequence != 0
+	if p.epoch.IsZero() || p.discontinuity {
+		p.epoch = time.Now().Add(-pts)
+	}
+	p.discontinuity = false
+}
+
+func (p *hlsPackager) writeInit(withVideo bool) {
+	tracks := []fmp4Track{}
+	if withVideo {
+		width, height, err := parseH264SPSResolution(p.video.sps[1:])
+		if err != nil {
+			log.Printf("HLS of %s has no resolution: %v", p.streamKey, err)
+		}
+
+		tracks = append(tracks, fmp4Track{
+			id:        hlsVideoTrackID,
+			video:     true,
+			timescale: hlsVideoTimescale,
+			width:     width,
+			height:    height,
+			sps:       bytes.Clone(p.video.sps),
+			pps:       bytes.Clone(p.video.pps),
+		})
+		p.initSPS = bytes.Clone(p.video.sps)
+	}
+	tracks = append(tracks, fmp4Track{id: hlsAudioTrackID, timescale: hlsAudioTimescale})
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.initVersion++
+	p.inits[p.initVersion] = fmp4Init(tracks)
+
+	// Only the inits of segments that can still be fetched are kept
+	oldest := p.initVersion
+	for _, segment := range append(p.retired, p.segments...) {
+		oldest = min(oldest, segment.initVersion)
+	}
+	for version := range p.inits {
+		if version < oldest {
+			delete(p.inits, version)
+			if p.uploadedInits[version] {
+				delete(p.uploadedInits, version)
+				go p.deleteObject(p.initObjectKey(version))
+			}
+		}
+	}
+}
+
+// cut turns the samples before end into a segment. The last audio sample is kept for the next segment, its
+// duration is only known once the sample after it arrived.
+func (p *hlsPackager) cut(end time.Duration) {
+	if !p.started {
+		return
+	}
+
+	runs := []fmp4Run{}
+	if len(p.videoSamples) != 0 {
+		runs = append(runs, hlsRun(hlsVideoTrackID, hlsVideoTimescale, p.videoSamples, end))
+	}
+
+	audioSamples := p.audioSamples
+	if len(audioSamples) != 0 && audioSamples[len(audioSamples)-1].pts >= end-hlsOpusPacketDuration {
+		audioSamples = audioSamples[:len(audioSamples)-1]
+	}
+	if len(audioSamples) != 0 {
+		audioEnd := end
+		if len(audioSamples) < len(p.audioSamples) {
+			audioEnd = p.audioSamples[len(audioSamples)].pts
+		}
+		runs = append(runs, hlsRun(hlsAudioTrackID, hlsAudioTimescale, audioSamples, audioEnd))
+	}
+
+	p.videoSamples, p.audioSamples = p.videoSamples[:0], p.audioSamples[len(audioSamples):]
+	tags := p.tags
+	p.tags = nil
+	if len(runs) == 0 || end <= p.startPTS {
+		p.tags = tags
+		return
+	}
+
+	segment := &hlsSegment{
+		sequence:        p.nextSequence,
+		duration:        end - p.startPTS,
+		programDateTime: p.epoch.Add(p.startPTS),
+		discontinuity:   p.segmentDiscontinuity,
+		initVersion:     p.initVersion,
+		tags:            tags,
+	}
+	p.segmentDiscontinuity = false
+	p.nextSequence++
+
+	segment.data = fmp4Segment(uint32(segment.sequence+1), runs)
+	if hlskeys.Enabled() {
+		key, err := hlskeys.Current(p.streamKey)
+		if err == nil {
+			segment.data, err = hlskeys.Encrypt(key, segment.sequence, segment.data)
+		}
+		if err != nil {
+			log.Printf("HLS segment of %s could not be encrypted: %v", p.streamKey, err)
+			return
+		}
+		segment.keyID = key.ID
+	}
+
+	if p.uploads != nil {
+		p.uploads <- segment
+	} else {
+		p.publish(segment)
+	}
+}
+
+// publish adds segment to the playlist, the segments that can't be fetched anymore are deleted from object storage
+func (p *hlsPackager) publish(segment *hlsSegment) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.segments = append(p.segments, segment)
+	for len(p.segments) > hlsWindowSize {
+		if p.segments[1].discontinuity {
+			p.discontinuitySequence++
+		}
+		p.retired = append(p.retired, p.segments[0])
+		p.segments = p.segments[1:]
+	}
+	if len(p.retired) > hlsRetainedSegments {
+		for _, segment := range p.retired[:len(p.retired)-hlsRetainedSegments] {
+			if segment.uploaded {
+				go p.deleteObject(p.segmentObjectKey(segment.sequence))
+			}
+		}
+		p.retired = p.retired[len(p.retired)-hlsRetainedSegments:]
+	}
+}
+
+// upload writes segments and their initialization segments to object storage in order, and publishes them once
+// they are there. Segments that could not be uploaded are published anyway and served by Broadcast Box.
+func (p *hlsPackager) upload() {
+	defer close(p.uploadsDone)
+
+	for segment := range p.uploads {
+		p.lock.Lock()
+		init, initUploaded := p.inits[segment.initVersion], p.uploadedInits[segment.initVersion]
+		p.lock.Unlock()
+
+		if !initUploaded {
+			err := objectstore.Put(context.Background(), p.initObjectKey(segment.initVersion), "video/mp4", "public, max-age=3600", init)
+			if err != nil {
+				log.Printf("HLS init segment of %s could not be uploaded: %v", p.streamKey, err)
+			} else {
+				p.lock.Lock()
+				p.uploadedInits[segment.initVersion] = true
+				p.lock.Unlock()
+			}
+		}
+
+		err := objectstore.Put(context.Background(), p.segmentObjectKey(segment.sequence), "video/mp4", "public, max-age=3600", segment.data)
+		if err != nil {
+			log.Printf("HLS segment of %s could not be uploaded: %v", p.streamKey, err)
+		}
+		segment.uploaded = err == nil
+
+		p.publish(segment)
+	}
+}
+
+func (p *hlsPackager) initObjectKey(version int) string {
+	return p.objectPrefix + "init-" + strconv.Itoa(version) + ".mp4"
+}
+
+func (p *hlsPackager) segmentObjectKey(sequence uint64) string {
+	return p.objectPrefix + strconv.FormatUint(sequence, 10) + ".m4s"
+}
+
+func (p *hlsPackager) deleteObject(key string) {
+	if err := objectstore.Delete(context.Background(), key); err != nil {
+		log.Printf("HLS object %s could not be deleted: %v", key, err)
+	}
+}
+
+// deleteObjects deletes what is left of the stream in object storage once its playlist isn't served anymore
+func (p *hlsPackager) deleteObjects() {
+	p.lock.Lock()
+	keys := []string{}
+	for _, segment := range append(p.retired, p.segments...) {
+		if segment.uploaded {
+			keys = append(keys, p.segmentObjectKey(segment.sequence))
+		}
+	}
+	for version := range p.uploadedInits {
+		keys = append(keys, p.initObjectKey(version))
+	}
+	p.lock.Unlock()
+
+	for _, key := range keys {
+		p.deleteObject(key)
+	}
+}
+
+// hlsRun converts samples to the timescale of their track, each lasts until the next one and the last until end
+func hlsRun(trackID, timescale uint32, samples []hlsSample, end time.Duration) fmp4Run {
+	toTimescale := func(pts time.Duration) uint64 {
+		return uint64(pts) * uint64(timescale) / uint64(time.Second)
+	}
+
+	run := fmp4Run{trackID: trackID, baseDecodeTime: toTimescale(samples[0].pts)}
+	for i, s := range samples {
+		next := end
+		if i+1 < len(samples) {
+			next = samples[i+1].pts
+		}
+
+		run.samples = append(run.samples, fmp4Sample{data: s.data, duration: uint32(toTimescale(next) - toTimescale(s.pts)), keyframe: s.keyframe})
+	}
+
+	return run
+}
+
+func (p *hlsPackager) playlist(query string) []byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	targetDuration := math.Ceil(hlsSegmentDuration.Seconds())
+	for _, segment := range p.segments {
+		targetDuration = max(targetDuration, math.Ceil(segment.duration.Seconds()))
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:%d\n", int(targetDuration))
+	if len(p.segments) != 0 {
+		fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.segments[0].sequence)
+	}
+	fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.discontinuitySequence)
+
+	initVersion, keyID := 0, uint64(0)
+	for i, segment := range p.segments {
+		if segment.discontinuity && i != 0 {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+
+		// Initialization segments aren't encrypted, their EXT-X-MAP must not follow an EXT-X-KEY
+		if segment.initVersion != initVersion {
+			if keyID != 0 {
+				b.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+			}
+			uri := fmt.Sprintf("init-%d.mp4%s", segment.initVersion, query)
+			if p.uploadedInits[segment.initVersion] {
+				uri = objectstore.URL(p.initObjectKey(segment.initVersion))
+			}
+			fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s\"\n", uri)
+			initVersion, keyID = segment.initVersion, 0
+		}
+		if segment.keyID != keyID {
+			b.WriteString(hlskeys.Tag("keys/"+strconv.FormatUint(segment.keyID, 10)+query) + "\n")
+			keyID = segment.keyID
+		}
+
+		fmt.Fprintf(b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", segment.programDateTime.UTC().Format("2006-01-02T15:04:05.000Z"))
+		for _, tag := range segment.tags {
+			b.WriteString(tag + "\n")
+		}
+		uri := fmt.Sprintf("%d.m4s%s", segment.sequence, query)
+		if segment.uploaded {
+			uri = objectstore.URL(p.segmentObjectKey(segment.sequence))
+		}
+		fmt.Fprintf(b, "#EXTINF:%.3f,\n%s\n", segment.duration.Seconds(), uri)
+	}
+
+	if p.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	return []byte(b.String())
+}
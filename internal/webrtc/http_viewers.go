@@ -0,0 +1,132 @@
+package webrtc
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// HTTP viewers that didn't send a heartbeat for this long are no longer counted
+const defaultHTTPViewerTimeout = 30 * time.Second
+
+// Outputs viewers may report heartbeats for, they have no connection that could be counted
+var httpViewerOutputs = []string{OutputHLS}
+
+type httpViewer struct {
+	output   string
+	lastSeen time.Time
+}
+
+var (
+	httpViewerTimeout = defaultHTTPViewerTimeout
+
+	ErrHTTPViewerOutput = errors.New("Output must be hls")
+)
+
+func configureHTTPViewers() error {
+	timeout, err := timeoutFromEnv("HTTP_VIEWER_TIMEOUT")
+	if timeout != 0 {
+		httpViewerTimeout = timeout
+	}
+	return err
+}
+
+// HTTPViewerInterval is how often players of HTTP outputs should send a heartbeat
+func HTTPViewerInterval() time.Duration {
+	return httpViewerTimeout / 3
+}
+
+// HTTPViewerHeartbeat counts a viewer of an HTTP output like HLS as watching streamKey. An empty viewerId starts a
+// new viewer, its ID is returned and must be passed with every following heartbeat.
+func HTTPViewerHeartbeat(streamKey, viewerId, output, userAgent string) (string, error) {
+	if !slices.Contains(httpViewerOutputs, output) {
+		return "", ErrHTTPViewerOutput
+	}
+	if err := CheckOutputAllowed(streamKey, output); err != nil {
+		return "", err
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || !stream.online() {
+		return "", errors.New("Stream is not live")
+	}
+
+	if viewer, ok := stream.httpViewers[viewerId]; ok {
+		viewer.lastSeen = time.Now()
+		return viewerId, nil
+	}
+
+	// Viewers that timed out get a new ID, so they are counted again like a reconnecting WHEP viewer
+	viewerId = uuid.New().String()
+	if stream.httpViewers == nil {
+		stream.httpViewers = map[string]*httpViewer{}
+	}
+	stream.httpViewers[viewerId] = &httpViewer{output: output, lastSeen: time.Now()}
+
+	device := viewerDevice{videoCodec: viewerDeviceUnknown}
+	device.browser, device.operatingSystem, device.class = classifyUserAgent(userAgent)
+	if len(stream.videoTracks) != 0 {
+		mimeType, _ := stream.videoTracks[0].mimeType.Load().(string)
+		if name, ok := videoTrackCodecNames[getVideoTrackCodec(mimeType)]; ok {
+			device.videoCodec = name
+		}
+	}
+	stream.viewerDevices.add(device)
+
+	httpViewers := 0
+	for _, count := range stream.countHTTPViewers() {
+		httpViewers += count
+	}
+
+	stream.whepSessionsLock.RLock()
+	stream.peakViewers = max(stream.peakViewers, len(stream.whepSessions)+httpViewers)
+	stream.whepSessionsLock.RUnlock()
+
+	return viewerId, nil
+}
+
+// HTTPViewerLeave stops counting a viewer of an HTTP output before it times out
+func HTTPViewerLeave(streamKey, viewerId string) error {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok {
+		return errors.New("Stream is not live")
+	} else if _, ok := stream.httpViewers[viewerId]; !ok {
+		return errors.New("Viewer does not exist")
+	}
+
+	delete(stream.httpViewers, viewerId)
+	return nil
+}
+
+// countHTTPViewers returns how many viewers of each HTTP output sent a heartbeat recently and forgets the others.
+// streamMapLock must be held.
+func (s *stream) countHTTPViewers() map[string]int {
+	counts := map[string]int{}
+	for viewerId, viewer := range s.httpViewers {
+		if time.Since(viewer.lastSeen) > httpViewerTimeout {
+			delete(s.httpViewers, viewerId)
+		} else {
+			counts[viewer.output]++
+		}
+	}
+
+	return counts
+}
+
+// Viewers counts the WHEP sessions and the viewers of HTTP outputs of a stream
+func (s StreamStatus) Viewers() int {
+	viewers := len(s.WHEPSessions)
+	for _, count := range s.HTTPViewers {
+		viewers += count
+	}
+
+	return viewers
+}
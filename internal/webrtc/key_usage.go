@@ -0,0 +1,82 @@
+package webrtc
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+// StreamKeyUsage is how much a stream key of a streamer has been used, to find stale keys
+type StreamKeyUsage struct {
+	StreamKey string `json:"streamKey"`
+	Streamer  string `json:"streamer"`
+	// Nil if the key was never published to since usage is tracked
+	LastPublishedAt *time.Time `json:"lastPublishedAt"`
+	Sessions        int64      `json:"sessions"`
+	Hours           float64    `json:"hours"`
+}
+
+// ConfigureStreamKeyUsage counts the publish sessions and hours of every stream key
+func ConfigureStreamKeyUsage(pool *pgxpool.Pool) {
+	events.Subscribe(func(e events.Event) {
+		ctx, cancel := context.WithTimeout(context.Background(), summarySaveTimeout)
+		defer cancel()
+
+		var err error
+		switch e.Type {
+		case events.StreamStart:
+			_, err = pool.Exec(ctx, `INSERT INTO stream_key_usage (stream_key, last_published_at, sessions)
+				 VALUES (@streamKey, @time, 1)
+				 ON CONFLICT (stream_key) DO UPDATE SET last_published_at = EXCLUDED.last_published_at,
+				 sessions = stream_key_usage.sessions + 1`, pgx.NamedArgs{
+				"streamKey": e.StreamKey,
+				"time":      e.Time,
+			})
+		case events.StreamEnd:
+			summary, ok := e.Data.(StreamSummary)
+			if !ok {
+				return
+			}
+
+			_, err = pool.Exec(ctx, `UPDATE stream_key_usage SET seconds = seconds + @seconds, last_published_at = @time
+				 WHERE stream_key = @streamKey`, pgx.NamedArgs{
+				"streamKey": e.StreamKey,
+				"seconds":   summary.Duration,
+				"time":      e.Time,
+			})
+		}
+
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// GetStreamKeyUsage returns the usage of every stream key of the streamers of tenant, or of all streamers if tenant is
+// empty. Keys not published to for unusedFor are returned only, if it is not zero. Least recently used keys come first.
+func GetStreamKeyUsage(pool *pgxpool.Pool, ctx context.Context, tenant string, unusedFor time.Duration) ([]StreamKeyUsage, error) {
+	query := `SELECT key, s.name, u.last_published_at, COALESCE(u.sessions, 0), COALESCE(u.seconds, 0) / 3600.0
+		 FROM streamers s CROSS JOIN unnest(s.stream_key) AS key
+		 LEFT JOIN stream_key_usage u ON u.stream_key = key
+		 WHERE (@tenant = '' OR s.tenant = @tenant)
+		 AND (@unusedFor::bigint = 0 OR u.last_published_at IS NULL
+		      OR u.last_published_at < now() - make_interval(secs => @unusedFor::bigint))
+		 ORDER BY u.last_published_at NULLS FIRST, key`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
+		"tenant":    tenant,
+		"unusedFor": int64(unusedFor.Seconds()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (StreamKeyUsage, error) {
+		var u StreamKeyUsage
+		err := row.Scan(&u.StreamKey, &u.Streamer, &u.LastPublishedAt, &u.Sessions, &u.Hours)
+		return u, err
+	})
+}
@@ -2,6 +2,7 @@ package webrtc
 
 import (
 	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 )
 
 const (
@@ -12,6 +13,20 @@ const (
 	ppsNALUType = 8
 )
 
+// newKeyframeDepacketizer returns the depacketizer isKeyframe needs for codec
+func newKeyframeDepacketizer(codec videoTrackCodec) rtp.Depacketizer {
+	switch codec {
+	case videoTrackCodecH264:
+		return &codecs.H264Packet{}
+	case videoTrackCodecVP8:
+		return &codecs.VP8Packet{}
+	case videoTrackCodecVP9:
+		return &codecs.VP9Packet{}
+	}
+
+	return nil
+}
+
 func isKeyframe(pkt *rtp.Packet, codec videoTrackCodec, depacketizer rtp.Depacketizer) bool {
 	if codec == videoTrackCodecH264 {
 		nalu, err := depacketizer.Unmarshal(pkt.Payload)
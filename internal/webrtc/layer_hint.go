@@ -0,0 +1,110 @@
+package webrtc
+
+import (
+	"errors"
+)
+
+// layerHint is the largest layer a viewer wants to receive. Zero values are unbounded.
+type layerHint struct {
+	maxWidth, maxHeight int
+	maxBitrate          uint64
+}
+
+func (h *layerHint) fits(v *videoTrack) bool {
+	width, height, bitrate := int(v.width.Load()), int(v.height.Load()), v.bitrate.Load()
+
+	return (h.maxWidth == 0 || width <= h.maxWidth) &&
+		(h.maxHeight == 0 || height <= h.maxHeight) &&
+		(h.maxBitrate == 0 || bitrate <= h.maxBitrate)
+}
+
+func videoTrackLarger(a, b *videoTrack) bool {
+	aPixels, bPixels := a.width.Load()*a.height.Load(), b.width.Load()*b.height.Load()
+	if aPixels != bPixels {
+		return aPixels > bPixels
+	}
+
+	return a.bitrate.Load() > b.bitrate.Load()
+}
+
+// WHEPSetLayerHint selects the highest simulcast layer that doesn't exceed the given
+// resolution and bitrate. The selection is updated as layers appear or change.
+func WHEPSetLayerHint(whepSessionId string, maxWidth, maxHeight int, maxBitrate uint64) error {
+	if maxWidth < 0 || maxHeight < 0 {
+		return errors.New("Invalid layer hint")
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for streamKey := range streamMap {
+		streamMap[streamKey].whepSessionsLock.RLock()
+		whepSession, ok := streamMap[streamKey].whepSessions[whepSessionId]
+		streamMap[streamKey].whepSessionsLock.RUnlock()
+
+		if !ok {
+			continue
+		}
+
+		if maxWidth == 0 && maxHeight == 0 && maxBitrate == 0 {
+			whepSession.layerHint.Store(nil)
+			return nil
+		}
+
+		whepSession.layerHint.Store(&layerHint{maxWidth: maxWidth, maxHeight: maxHeight, maxBitrate: maxBitrate})
+		streamMap[streamKey].applyLayerHints()
+		return nil
+	}
+
+	return errors.New("WHEP session does not exist")
+}
+
+// hintedLayer returns the largest layer fitting the hint, or the smallest layer if none fit.
+// streamMapLock must be held.
+func (s *stream) hintedLayer(hint *layerHint) string {
+	var best, smallest *videoTrack
+	for _, v := range s.videoTracks {
+		if hint.fits(v) && (best == nil || videoTrackLarger(v, best)) {
+			best = v
+		}
+
+		if smallest == nil || videoTrackLarger(smallest, v) {
+			smallest = v
+		}
+	}
+
+	switch {
+	case best != nil:
+		return best.rid
+	case smallest != nil:
+		return smallest.rid
+	}
+
+	return ""
+}
+
+// applyLayerHints moves every WHEP session with a layer hint to its preferred layer.
+// streamMapLock must be held.
+func (s *stream) applyLayerHints() {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	for _, whepSession := range s.whepSessions {
+		hint := whepSession.layerHint.Load()
+		if hint == nil {
+			continue
+		}
+
+		layer := s.hintedLayer(hint)
+		if layer == "" || layer == whepSession.currentLayer.Load() {
+			continue
+		}
+
+		whepSession.currentLayer.Store(layer)
+		whepSession.waitingForKeyframe.Store(true)
+		select {
+		case s.pliChan <- true:
+		default:
+		}
+	}
+}
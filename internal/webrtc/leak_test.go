@@ -0,0 +1,204 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	leakStreamKey = "leakcheck"
+	leakViewers   = 10
+
+	// How long closed sessions may take to release their resources
+	leakSettle = 10 * time.Second
+)
+
+// TestMain configures the package for sessions over loopback and fails if goroutines or sockets the tests left
+// behind aren't released
+func TestMain(m *testing.M) {
+	os.Setenv("INCLUDE_LOOPBACK_CANDIDATE", "true")
+	if err := Configure(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	baseline := GetResourceUsage()
+
+	code := m.Run()
+	if _, err := waitForRelease(baseline); code == 0 && err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		code = 1
+	}
+
+	os.Exit(code)
+}
+
+// TestSessionTeardown connects a publisher and viewers, sends media and closes every session from the server side.
+// It fails if PeerConnections stay open, or if goroutines and sockets don't return to where they were before.
+func TestSessionTeardown(t *testing.T) {
+	rounds := 5
+	if testing.Short() {
+		rounds = 1
+	}
+
+	baseline := GetResourceUsage()
+	for i := 0; i < rounds; i++ {
+		if err := leakRound(); err != nil {
+			t.Fatalf("Round %d: %s", i+1, err)
+		}
+
+		if _, err := waitForRelease(baseline); err != nil {
+			t.Fatalf("Round %d: %s", i+1, err)
+		}
+	}
+}
+
+// leakRound connects a publisher and viewers, sends media for a second and closes every session. The clients
+// stay connected until Broadcast Box closed its side, so it can not rely on them hanging up.
+func leakRound() error {
+	publisher, videoTrack, err := leakPublish()
+	if err != nil {
+		return err
+	}
+	defer publisher.Close() //nolint
+
+	clients := []*webrtc.PeerConnection{}
+	defer func() {
+		for _, client := range clients {
+			client.Close() //nolint
+		}
+	}()
+
+	for i := 0; i < leakViewers; i++ {
+		client, err := leakWatch()
+		if err != nil {
+			return err
+		}
+		clients = append(clients, client)
+	}
+
+	rtpPkt := &rtp.Packet{Header: rtp.Header{Version: 2, Marker: true}, Payload: []byte{0x09, 0xf0}}
+	for i := 0; i < 30; i++ {
+		rtpPkt.SequenceNumber++
+		rtpPkt.Timestamp += 3000
+		if err = videoTrack.WriteRTP(rtpPkt); err != nil {
+			return err
+		}
+		time.Sleep(time.Second / 30)
+	}
+
+	if usage := GetResourceUsage(); len(usage.Streams) != 1 || usage.Streams[0].PeerConnections != leakViewers+1 {
+		return fmt.Errorf("Expected %d PeerConnections, got %+v", leakViewers+1, usage.Streams)
+	}
+
+	Evacuate(0)
+	SetDraining(false)
+
+	deadline := time.Now().Add(leakSettle)
+	for {
+		usage := GetResourceUsage()
+		if usage.PeerConnections == 0 && usage.ClosingPeerConnections == 0 && len(usage.Streams) == 0 {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("Sessions were not closed: %d PeerConnections open, %d closing, streams %+v",
+				usage.PeerConnections, usage.ClosingPeerConnections, usage.Streams)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func leakPublish() (*webrtc.PeerConnection, *webrtc.TrackLocalStaticRTP, error) {
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", leakStreamKey)
+	if err != nil {
+		return nil, nil, err
+	} else if _, err = client.AddTrack(videoTrack); err != nil {
+		return nil, nil, err
+	}
+
+	err = leakConnect(client, func(offer string) (string, error) {
+		answer, _, err := WHIP(context.Background(), offer, &Streamer{Name: leakStreamKey, StreamKey: leakStreamKey}, false)
+		return answer, err
+	})
+	return client, videoTrack, err
+}
+
+func leakWatch() (*webrtc.PeerConnection, error) {
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err = client.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return nil, err
+		}
+	}
+
+	return client, leakConnect(client, func(offer string) (string, error) {
+		answer, _, err := WHEP(context.Background(), offer, leakStreamKey)
+		return answer, err
+	})
+}
+
+// leakConnect negotiates client with Broadcast Box and waits until it is connected
+func leakConnect(client *webrtc.PeerConnection, answer func(offer string) (string, error)) error {
+	connected := make(chan struct{})
+	client.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(client)
+	if err = client.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gatherComplete
+
+	sdp, err := answer(client.LocalDescription().SDP)
+	if err != nil {
+		return err
+	} else if err = client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}); err != nil {
+		return err
+	}
+
+	select {
+	case <-connected:
+		return nil
+	case <-time.After(10 * time.Second):
+		return errors.New("Timed out connecting")
+	}
+}
+
+// waitForRelease waits until goroutines and sockets are back at baseline
+func waitForRelease(baseline ResourceUsage) (ResourceUsage, error) {
+	deadline := time.Now().Add(leakSettle)
+	for {
+		usage := GetResourceUsage()
+		if usage.Goroutines <= baseline.Goroutines && usage.OpenSockets <= baseline.OpenSockets {
+			return usage, nil
+		} else if time.Now().After(deadline) {
+			return usage, fmt.Errorf("Resources were not released: %d goroutines (baseline %d), %d sockets (baseline %d), streams %+v",
+				usage.Goroutines, baseline.Goroutines, usage.OpenSockets, baseline.OpenSockets, usage.Streams)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
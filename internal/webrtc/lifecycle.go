@@ -0,0 +1,119 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDraining is returned for new sessions while the server is draining
+var ErrDraining = errors.New("Server is draining, try another instance")
+
+var (
+	draining atomic.Bool
+
+	// UDP and TCP muxes of ICE_* settings, closed on shutdown so their ports are released
+	iceMuxes []io.Closer
+)
+
+type evacuateMessage struct {
+	Type string `json:"type"`
+	// Milliseconds until the session is closed
+	ClosingIn int64 `json:"closingIn"`
+}
+
+// SetDraining stops (or resumes) accepting new WHIP and WHEP sessions. Existing sessions are not affected.
+func SetDraining(d bool) {
+	draining.Store(d)
+	Sessions.setDraining(d)
+}
+
+func Draining() bool {
+	return draining.Load()
+}
+
+// SessionCount returns how many publishers and viewers are connected
+func SessionCount() (whipSessions, whepSessions int) {
+	return Sessions.Count(SessionWHIP) + Sessions.Count(SessionRTMP), Sessions.Count(SessionWHEP)
+}
+
+// Evacuate drains the server and ends every session after grace. Viewers with a DataChannel are sent an
+// `evacuate` message first, so players can reconnect to another instance before the session closes.
+func Evacuate(grace time.Duration) {
+	SetDraining(true)
+
+	if err := sendEvacuateMessage(grace); err != nil {
+		log.Println(err)
+		return
+	}
+
+	time.Sleep(grace)
+	closeAllSessions()
+}
+
+// Shutdown ends every session without a grace period and releases the ports of the engine. Viewers are still
+// told to reconnect elsewhere, ctx bounds how long closing the sessions may take.
+func Shutdown(ctx context.Context) error {
+	SetDraining(true)
+
+	if err := sendEvacuateMessage(0); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		closeAllSessions()
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	errs := []error{}
+	for _, mux := range iceMuxes {
+		errs = append(errs, mux.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func sendEvacuateMessage(closingIn time.Duration) error {
+	msg, err := json.Marshal(evacuateMessage{Type: "evacuate", ClosingIn: closingIn.Milliseconds()})
+	if err != nil {
+		return err
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for _, stream := range streamMap {
+		stream.sendDataChannelMessage(msg)
+	}
+	return nil
+}
+
+func closeAllSessions() {
+	sessions := []reapedSession{}
+	streamMapLock.Lock()
+	for streamKey, stream := range streamMap {
+		Sessions.eachViewer(stream, func(whepSessionId string, whepSession *whepSession) {
+			sessions = append(sessions, reapedSession{streamKey: streamKey, whepSessionId: whepSessionId, peerConnection: whepSession.peerConnection, whepSession: whepSession})
+		})
+
+		if stream.whipPeerConnection != nil {
+			sessions = append(sessions, reapedSession{streamKey: streamKey, peerConnection: stream.whipPeerConnection})
+		} else if stream.rtmpConn != nil {
+			// The publisher ends its stream once it noticed the closed connection
+			stream.rtmpConn.Close()
+		}
+	}
+	streamMapLock.Unlock()
+
+	closeSessions(sessions)
+}
@@ -0,0 +1,234 @@
+package webrtc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+)
+
+// Matroska element IDs, see https://www.matroska.org/technical/elements.html
+const (
+	mkvEBML               = 0x1A45DFA3
+	mkvEBMLVersion        = 0x4286
+	mkvEBMLReadVersion    = 0x42F7
+	mkvEBMLMaxIDLength    = 0x42F2
+	mkvEBMLMaxSizeLength  = 0x42F3
+	mkvDocType            = 0x4282
+	mkvDocTypeVersion     = 0x4287
+	mkvDocTypeReadVersion = 0x4285
+	mkvSegment            = 0x18538067
+	mkvInfo               = 0x1549A966
+	mkvTimecodeScale      = 0x2AD7B1
+	mkvMuxingApp          = 0x4D80
+	mkvWritingApp         = 0x5741
+	mkvTracks             = 0x1654AE6B
+	mkvTrackEntry         = 0xAE
+	mkvTrackNumber        = 0xD7
+	mkvTrackUID           = 0x73C5
+	mkvTrackType          = 0x83
+	mkvCodecID            = 0x86
+	mkvCodecPrivate       = 0x63A2
+	mkvVideo              = 0xE0
+	mkvPixelWidth         = 0xB0
+	mkvPixelHeight        = 0xBA
+	mkvAudio              = 0xE1
+	mkvSamplingFrequency  = 0xB5
+	mkvChannels           = 0x9F
+	mkvCluster            = 0x1F43B675
+	mkvTimecode           = 0xE7
+	mkvSimpleBlock        = 0xA3
+
+	mkvTrackTypeVideo = 1
+	mkvTrackTypeAudio = 2
+
+	// Segments and clusters are written before their size is known, players read them until the next element.
+	// A recording cut off by a crash stays playable this way.
+	mkvUnknownSize = 0x01FFFFFFFFFFFFFF
+)
+
+type (
+	mkvTrack struct {
+		number       uint64
+		video        bool
+		codecID      string
+		codecPrivate []byte
+		// Video only
+		width, height int
+	}
+
+	// mkvWriter writes a Matroska file with one video and one audio track at most. Timecodes are milliseconds.
+	mkvWriter struct {
+		w *bufio.Writer
+
+		clusterStarted  bool
+		clusterTimecode int64
+	}
+)
+
+// mkvElement returns an element with its payload
+func mkvElement(id uint32, payload []byte) []byte {
+	return append(append(mkvID(id), mkvSize(uint64(len(payload)))...), payload...)
+}
+
+func mkvID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// mkvSize encodes a size as variable length integer in as few bytes as possible
+func mkvSize(size uint64) []byte {
+	if size == mkvUnknownSize {
+		return []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	}
+
+	length := 1
+	// All ones is reserved for unknown sizes
+	for size >= (1<<(7*length))-1 {
+		length++
+	}
+
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(size)
+		size >>= 8
+	}
+	b[0] |= 0x80 >> (length - 1)
+
+	return b
+}
+
+func mkvUint(id uint32, v uint64) []byte {
+	b := []byte{}
+	for v > 0 || len(b) == 0 {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+	}
+
+	return mkvElement(id, b)
+}
+
+func mkvFloat(id uint32, v float64) []byte {
+	return mkvElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func mkvString(id uint32, v string) []byte {
+	return mkvElement(id, []byte(v))
+}
+
+func mkvMaster(id uint32, children ...[]byte) []byte {
+	payload := []byte{}
+	for _, c := range children {
+		payload = append(payload, c...)
+	}
+
+	return mkvElement(id, payload)
+}
+
+// writeHeader writes everything up to the first cluster
+func (m *mkvWriter) writeHeader(tracks []mkvTrack) error {
+	entries := [][]byte{}
+	for _, t := range tracks {
+		entry := [][]byte{
+			mkvUint(mkvTrackNumber, t.number),
+			mkvUint(mkvTrackUID, t.number),
+			mkvString(mkvCodecID, t.codecID),
+		}
+		if len(t.codecPrivate) != 0 {
+			entry = append(entry, mkvElement(mkvCodecPrivate, t.codecPrivate))
+		}
+
+		if t.video {
+			entry = append(entry, mkvUint(mkvTrackType, mkvTrackTypeVideo), mkvMaster(mkvVideo,
+				mkvUint(mkvPixelWidth, uint64(t.width)),
+				mkvUint(mkvPixelHeight, uint64(t.height)),
+			))
+		} else {
+			entry = append(entry, mkvUint(mkvTrackType, mkvTrackTypeAudio), mkvMaster(mkvAudio,
+				mkvFloat(mkvSamplingFrequency, 48000),
+				mkvUint(mkvChannels, 2),
+			))
+		}
+
+		entries = append(entries, mkvMaster(mkvTrackEntry, entry...))
+	}
+
+	header := mkvMaster(mkvEBML,
+		mkvUint(mkvEBMLVersion, 1),
+		mkvUint(mkvEBMLReadVersion, 1),
+		mkvUint(mkvEBMLMaxIDLength, 4),
+		mkvUint(mkvEBMLMaxSizeLength, 8),
+		mkvString(mkvDocType, "matroska"),
+		mkvUint(mkvDocTypeVersion, 4),
+		mkvUint(mkvDocTypeReadVersion, 2),
+	)
+	header = append(header, mkvID(mkvSegment)...)
+	header = append(header, mkvSize(mkvUnknownSize)...)
+	header = append(header, mkvMaster(mkvInfo,
+		mkvUint(mkvTimecodeScale, 1000000),
+		mkvString(mkvMuxingApp, "Broadcast Box"),
+		mkvString(mkvWritingApp, "Broadcast Box"),
+	)...)
+	header = append(header, mkvMaster(mkvTracks, entries...)...)
+
+	_, err := m.w.Write(header)
+	return err
+}
+
+// writeBlock writes a frame of track at timecode. A cluster is started for every video keyframe (newCluster), and
+// whenever the timecode doesn't fit the 16 bit offset of a block. Clusters are flushed to the file once they are complete.
+func (m *mkvWriter) writeBlock(track uint64, timecode int64, keyframe, newCluster bool, frame []byte) error {
+	offset := timecode - m.clusterTimecode
+	if !m.clusterStarted || (newCluster && offset != 0) || offset < math.MinInt16 || offset > math.MaxInt16 {
+		if err := m.w.Flush(); err != nil {
+			return err
+		}
+
+		cluster := append(mkvID(mkvCluster), mkvSize(mkvUnknownSize)...)
+		cluster = append(cluster, mkvUint(mkvTimecode, uint64(timecode))...)
+		if _, err := m.w.Write(cluster); err != nil {
+			return err
+		}
+		m.clusterStarted, m.clusterTimecode, offset = true, timecode, 0
+	}
+
+	flags := byte(0)
+	if keyframe {
+		flags = 0x80
+	}
+
+	block := append(mkvSize(track), byte(uint16(offset)>>8), byte(uint16(offset)), flags)
+	if _, err := m.w.Write(append(append(mkvID(mkvSimpleBlock), mkvSize(uint64(len(block)+len(frame)))...), block...)); err != nil {
+		return err
+	}
+
+	_, err := m.w.Write(frame)
+	return err
+}
+
+// opusHead is the CodecPrivate of Opus, see RFC 7845
+func opusHead() []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, 2)
+	head = binary.LittleEndian.AppendUint16(head, 0)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = binary.LittleEndian.AppendUint16(head, 0)
+	return append(head, 0)
+}
+
+// avcDecoderConfiguration is the CodecPrivate of H264, see ISO/IEC 14496-15
+func avcDecoderConfiguration(sps, pps []byte) []byte {
+	config := []byte{0x01, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	config = binary.BigEndian.AppendUint16(config, uint16(len(sps)))
+	config = append(config, sps...)
+	config = append(config, 0x01)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(pps)))
+	return append(config, pps...)
+}
@@ -0,0 +1,229 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	defaultKeyframeCacheMB = 8
+
+	// Size of a video packet used to turn RTX_HISTORY_MB into packets
+	rtxHistoryPacketSize     = 1500
+	defaultRTXHistoryPackets = 1024
+	maxRTXHistoryPackets     = 1 << 15
+)
+
+type (
+	// keyframeCache holds the packets since the last keyframe of a layer. Viewers that join get them
+	// replayed, so playback starts without waiting for the publisher to answer a PLI.
+	keyframeCache struct {
+		lock    sync.Mutex
+		stream  *stream
+		packets []cachedPacket
+		size    int64
+		closed  bool
+	}
+
+	cachedPacket struct {
+		buf          []byte
+		timeDiff     int64
+		sequenceDiff int
+		codec        videoTrackCodec
+		isKeyframe   bool
+	}
+)
+
+var (
+	keyframeCacheLimit int64
+	rtxHistorySize     uint16 = defaultRTXHistoryPackets
+)
+
+// configureMediaCaches reads the memory limits of the keyframe cache and the retransmission history
+func configureMediaCaches() (err error) {
+	keyframeCacheMB := float64(defaultKeyframeCacheMB)
+	if v := os.Getenv("KEYFRAME_CACHE_MB"); v != "" {
+		if keyframeCacheMB, err = strconv.ParseFloat(v, 64); err != nil || keyframeCacheMB < 0 {
+			return fmt.Errorf("Invalid KEYFRAME_CACHE_MB %q", v)
+		}
+	}
+	keyframeCacheLimit = int64(keyframeCacheMB * 1024 * 1024)
+
+	if v := os.Getenv("RTX_HISTORY_MB"); v != "" {
+		rtxHistoryMB, err := strconv.ParseFloat(v, 64)
+		if err != nil || rtxHistoryMB <= 0 {
+			return fmt.Errorf("Invalid RTX_HISTORY_MB %q", v)
+		}
+
+		// The NACK responder requires a power of two
+		packets := rtxHistoryMB * 1024 * 1024 / rtxHistoryPacketSize
+		rtxHistorySize = uint16(min(maxRTXHistoryPackets, math.Pow(2, math.Floor(math.Log2(max(packets, 1))))))
+	}
+
+	return nil
+}
+
+// registerInterceptors is webrtc.RegisterDefaultInterceptors with the retransmission history sized by RTX_HISTORY_MB
+// and without sender reports. Every registry gets the same interceptors, the codecs of mediaEngine are only extended once.
+func registerInterceptors(mediaEngine *webrtc.MediaEngine, interceptorRegistries ...*interceptor.Registry) error {
+	responder, err := nack.NewResponderInterceptor(nack.ResponderSize(rtxHistorySize))
+	if err != nil {
+		return err
+	}
+
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return err
+	}
+
+	// Sender reports to viewers are sent by sendSenderReports, mapped to the clock of the publisher
+	receiverReports, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return err
+	}
+
+	twccFeedback, err := twcc.NewSenderInterceptor()
+	if err != nil {
+		return err
+	}
+
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	if err = webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return err
+	}
+
+	// webrtc.ConfigureTWCCSender without the interceptor, it is added to every registry below
+	for _, codecType := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC}, codecType)
+		if err = mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, codecType); err != nil {
+			return err
+		}
+	}
+
+	for _, interceptorRegistry := range interceptorRegistries {
+		interceptorRegistry.Add(responder)
+		interceptorRegistry.Add(generator)
+		interceptorRegistry.Add(receiverReports)
+		interceptorRegistry.Add(twccFeedback)
+	}
+
+	return nil
+}
+
+// push adds a packet the publisher sent. A keyframe starts a new cache, packets before the first keyframe are
+// not kept. If the caches of the stream exceed KEYFRAME_CACHE_MB the cache is dropped until the next keyframe.
+// Must be called with whepSessionsLock held, so the cache always matches what viewers were sent.
+func (c *keyframeCache) push(rtpPkt *rtp.Packet, timeDiff int64, sequenceDiff int, codec videoTrackCodec, isKeyframe bool) {
+	// Keyframe detection has only been implemented for H264
+	if keyframeCacheLimit == 0 || codec != videoTrackCodecH264 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	if isKeyframe && (len(c.packets) == 0 || !c.packets[len(c.packets)-1].isKeyframe) {
+		c.reset()
+	} else if len(c.packets) == 0 {
+		return
+	}
+
+	buf, err := rtpPkt.Marshal()
+	if err != nil {
+		return
+	}
+
+	if c.stream.keyframeCacheBytes.Load()+int64(len(buf)) > keyframeCacheLimit {
+		c.reset()
+		c.stream.keyframeCacheEvictions.Add(1)
+		return
+	}
+
+	c.packets = append(c.packets, cachedPacket{buf: buf, timeDiff: timeDiff, sequenceDiff: sequenceDiff, codec: codec, isKeyframe: isKeyframe})
+	c.size += int64(len(buf))
+	c.stream.keyframeCacheBytes.Add(int64(len(buf)))
+}
+
+// reset must be called with c.lock held
+func (c *keyframeCache) reset() {
+	c.stream.keyframeCacheBytes.Add(-c.size)
+	c.packets, c.size = nil, 0
+}
+
+// drop empties the cache, so viewers are not started with packets of a codec the publisher stopped sending
+func (c *keyframeCache) drop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.reset()
+}
+
+// close frees the cache of a track that was removed from its stream
+func (c *keyframeCache) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.reset()
+	c.closed = true
+}
+
+// replay sends the cached packets to a viewer. Must be called with whepSessionsLock held for writing.
+func (c *keyframeCache) replay(w *whepSession, source *senderReportSource, layer string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.packets) == 0 {
+		return errors.New("Keyframe cache is empty")
+	}
+
+	for _, p := range c.packets {
+		rtpPkt := &rtp.Packet{}
+		if err := rtpPkt.Unmarshal(p.buf); err != nil {
+			return err
+		}
+
+		w.sendVideoPacket(rtpPkt, source, layer, p.timeDiff, p.sequenceDiff, p.codec, p.isKeyframe)
+	}
+
+	return nil
+}
+
+// replayKeyframeCache starts a viewer that just connected at the last keyframe of its layer, false if there is none
+// cached. Must be called with streamMapLock and whepSessionsLock held for writing.
+func (s *stream) replayKeyframeCache(w *whepSession) bool {
+	layer, _ := w.currentLayer.Load().(string)
+	for _, videoTrack := range s.videoTracks {
+		if (layer == "" || layer == videoTrack.rid) && videoTrack.keyframeCache.replay(w, &videoTrack.senderReports, videoTrack.rid) == nil {
+			w.waitingForKeyframe.Store(false)
+			s.keyframeCacheReplays.Add(1)
+			return true
+		}
+	}
+
+	return false
+}
+
+// closeVideoTracks forgets the video tracks of the publisher. Must be called with streamMapLock held.
+func (s *stream) closeVideoTracks() {
+	for _, videoTrack := range s.videoTracks {
+		videoTrack.keyframeCache.close()
+	}
+	s.videoTracks = nil
+}
@@ -0,0 +1,84 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+type (
+	// mediaChange is the data of the stream.media.change event, sent when a publisher switches codec or
+	// resolution without reconnecting
+	mediaChange struct {
+		Layer            string `json:"layer"`
+		MimeType         string `json:"mimeType"`
+		PreviousMimeType string `json:"previousMimeType,omitempty"`
+		Width            int    `json:"width,omitempty"`
+		Height           int    `json:"height,omitempty"`
+		PreviousWidth    int    `json:"previousWidth,omitempty"`
+		PreviousHeight   int    `json:"previousHeight,omitempty"`
+	}
+
+	// renegotiateMessage asks a viewer to reconnect, its answer lacks the codec the publisher switched to
+	renegotiateMessage struct {
+		Type     string `json:"type"`
+		MimeType string `json:"mimeType"`
+	}
+)
+
+// supports reports if the viewer negotiated codec
+func (t *trackMultiCodec) supports(codec videoTrackCodec) bool {
+	switch codec {
+	case videoTrackCodecH264:
+		return t.payloadTypeH264 != 0
+	case videoTrackCodecVP8:
+		return t.payloadTypeVP8 != 0
+	case videoTrackCodecVP9:
+		return t.payloadTypeVP9 != 0
+	case videoTrackCodecAV1:
+		return t.payloadTypeAV1 != 0
+	case videoTrackCodecH265:
+		return t.payloadTypeH265 != 0
+	}
+
+	return false
+}
+
+// onCodecChange restarts the video of every viewer watching layer after the publisher switched codec. The
+// decoders of the viewers can only continue from a keyframe of the new codec, so the cached keyframe of the
+// old codec is dropped and the publisher is asked for a new one. Viewers that did not negotiate the new
+// codec are asked over their DataChannel to reconnect.
+func (s *stream) onCodecChange(streamKey string, videoTrack *videoTrack, codec videoTrackCodec, change mediaChange) {
+	videoTrack.keyframeCache.drop()
+
+	msg, err := json.Marshal(renegotiateMessage{Type: "renegotiate", MimeType: change.MimeType})
+	if err != nil {
+		log.Println(err)
+	}
+
+	s.whepSessionsLock.RLock()
+	for _, whepSession := range s.whepSessions {
+		if whepSession.currentLayer.Load() != change.Layer {
+			continue
+		}
+
+		whepSession.waitingForKeyframe.Store(true)
+		if !whepSession.videoTrack.supports(codec) && msg != nil {
+			whepSession.sendDataChannelMessage(msg)
+		}
+	}
+	s.whepSessionsLock.RUnlock()
+
+	select {
+	case s.pliChan <- true:
+	default:
+	}
+
+	s.publishMediaChange(streamKey, change)
+}
+
+func (s *stream) publishMediaChange(streamKey string, change mediaChange) {
+	log.Printf("Publisher of %s changed %s to %s %dx%d", streamKey, change.Layer, change.MimeType, change.Width, change.Height)
+	events.Publish(events.Event{Type: events.MediaChange, StreamKey: streamKey, Data: change})
+}
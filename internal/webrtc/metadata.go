@@ -0,0 +1,41 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+const maxMetadataLength = 512
+
+// StreamMetadata is set by the publisher and describes a stream to viewers
+type StreamMetadata struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+var (
+	streamMetadata     = map[string]StreamMetadata{}
+	streamMetadataLock sync.RWMutex
+)
+
+func SetStreamMetadata(streamKey string, metadata StreamMetadata) error {
+	if len(metadata.Title) > maxMetadataLength || len(metadata.Description) > maxMetadataLength {
+		return errors.New("Metadata is too long")
+	}
+
+	streamMetadataLock.Lock()
+	streamMetadata[streamKey] = metadata
+	streamMetadataLock.Unlock()
+
+	events.Publish(events.Event{Type: events.Metadata, StreamKey: streamKey, Data: metadata})
+	return nil
+}
+
+func GetStreamMetadata(streamKey string) StreamMetadata {
+	streamMetadataLock.RLock()
+	defer streamMetadataLock.RUnlock()
+
+	return streamMetadata[streamKey]
+}
@@ -0,0 +1,181 @@
+package webrtc
+
+import (
+	"github.com/patrikrog/broadcast-box/internal/metrics"
+)
+
+// PacketLossAlertThreshold is the publisher packet loss ratio above which bitrate guidance considers an uplink congested
+const PacketLossAlertThreshold = guidanceHighLoss
+
+var (
+	// Seconds a viewer waits from the WHEP request until its answer is ready, most of it ICE gathering
+	whepJoinDuration *metrics.Histogram
+	// Seconds from a viewer connecting until it was sent its first frame
+	whepTimeToFirstFrame *metrics.Histogram
+)
+
+func configureMetrics() {
+	whepJoinDuration = metrics.NewHistogram("broadcast_box_whep_join_duration_seconds", "Time from a WHEP request until its answer was ready",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5})
+	whepTimeToFirstFrame = metrics.NewHistogram("broadcast_box_whep_time_to_first_frame_seconds", "Time from a WHEP session connecting until it was sent its first frame",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5})
+	metrics.NewGaugeFunc("broadcast_box_sse_connections", "Open server-sent events connections of WHEP sessions", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(SSEConnections())}}
+	})
+	metrics.NewCounterFunc("broadcast_box_sse_connections_rejected_total", "Server-sent events connections rejected by SSE_MAX_CONNECTIONS or SSE_MAX_CONNECTIONS_PER_SESSION", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(sseRejected.Load())}}
+	})
+	metrics.NewCounterFunc("broadcast_box_sse_connections_reaped_total", "Server-sent events connections ended because their WHEP session closed", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(sseReaped.Load())}}
+	})
+	metrics.NewGaugeFunc("broadcast_box_recordings", "Streams recorded to RECORDING_DIR", func() []metrics.Sample {
+		if diskRecorder == nil {
+			return []metrics.Sample{{Value: 0}}
+		}
+		return []metrics.Sample{{Value: float64(diskRecorder.RecordingCount())}}
+	})
+	metrics.NewCounterFunc("broadcast_box_recording_bytes_total", "Bytes written to recordings in RECORDING_DIR", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(recordingBytesWritten.Load())}}
+	})
+	metrics.NewCounterFunc("broadcast_box_recording_disk_full_total", "Recordings paused because RECORDING_DIR had less than RECORDING_MIN_FREE_MB free", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(recordingDiskFull.Load())}}
+	})
+	metrics.NewGaugeFunc("broadcast_box_hls_streams", "Streams packaged as HLS", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(HLSStreams())}}
+	})
+	metrics.NewCounterFunc("broadcast_box_whep_first_frame_deadlines_missed_total", "Keyframe requests repeated because a viewer got no frame within FIRST_FRAME_DEADLINE_MS", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(firstFrameDeadlinesMissed.Load())}}
+	})
+
+	sessionStateChanges := metrics.NewCounterVec("broadcast_box_session_state_changes_total", "Sessions that entered a lifecycle state", "kind", "state")
+	Sessions.OnStateChange(func(info SessionInfo) {
+		sessionStateChanges.Inc(string(info.Kind), string(info.State))
+	})
+
+	metrics.NewGaugeFunc("broadcast_box_stream_live", "Whether a stream is online according to STREAM_OFFLINE_POLICY", func() []metrics.Sample {
+		return collectStreamMetric(func(s *stream) float64 {
+			if s.online() {
+				return 1
+			}
+			return 0
+		})
+	}, "stream_key")
+
+	metrics.NewGaugeFunc("broadcast_box_stream_viewers", "WHEP sessions of a stream", func() []metrics.Sample {
+		return collectStreamMetric(func(s *stream) float64 {
+			return float64(Sessions.viewers(s))
+		})
+	}, "stream_key")
+
+	metrics.NewGaugeFunc("broadcast_box_stream_http_viewers", "Viewers of HTTP outputs of a stream that sent a heartbeat recently", func() []metrics.Sample {
+		return collectStreamMetric(func(s *stream) float64 {
+			viewers := 0
+			for _, count := range s.countHTTPViewers() {
+				viewers += count
+			}
+			return float64(viewers)
+		})
+	}, "stream_key")
+
+	metrics.NewGaugeFunc("broadcast_box_stream_egress_bitrate", "Bits per second of video sent to the WHEP sessions of a stream", func() []metrics.Sample {
+		return collectStreamMetric(func(s *stream) float64 {
+			return float64(s.egressBitrate())
+		})
+	}, "stream_key")
+
+	metrics.NewCounterFunc("broadcast_box_stream_video_packets_received_total", "Video packets received from the publisher", func() []metrics.Sample {
+		return collectStreamMetric(func(s *stream) float64 {
+			received := uint64(0)
+			for _, videoTrack := range s.videoTracks {
+				received += videoTrack.packetsReceived.Load()
+			}
+			return float64(received)
+		})
+	}, "stream_key")
+
+	metrics.NewCounterFunc("broadcast_box_stream_video_packets_lost_total", "Video packets skipped in the sequence numbers of the publisher, they arrived late or never", func() []metrics.Sample {
+		return collectStreamMetric(func(s *stream) float64 {
+			return float64(s.videoPacketsSkipped.Load())
+		})
+	}, "stream_key")
+
+	metrics.NewGaugeFunc("broadcast_box_keyframe_cache_bytes", "Memory used by the keyframe caches of a stream", func() []metrics.Sample {
+		return collectStreamMetric(func(s *stream) float64 {
+			return float64(s.keyframeCacheBytes.Load())
+		})
+	}, "stream_key")
+
+	metrics.NewCounterFunc("broadcast_box_keyframe_cache_evictions_total", "Keyframe caches dropped because the stream exceeded KEYFRAME_CACHE_MB", func() []metrics.Sample {
+		return collectStreamMetric(func(s *stream) float64 {
+			return float64(s.keyframeCacheEvictions.Load())
+		})
+	}, "stream_key")
+
+	metrics.NewCounterFunc("broadcast_box_keyframe_cache_replays_total", "Viewers that started playback from the keyframe cache", func() []metrics.Sample {
+		return collectStreamMetric(func(s *stream) float64 {
+			return float64(s.keyframeCacheReplays.Load())
+		})
+	}, "stream_key")
+
+	if egressCongestionControl != "" {
+		metrics.NewGaugeFunc("broadcast_box_whep_session_estimated_bitrate", "Bits per second EGRESS_CONGESTION_CONTROL estimates a viewer can receive", func() []metrics.Sample {
+			return collectWHEPSessionMetric(func(e *egressEstimator) float64 {
+				estimated, _ := e.bitrates()
+				return float64(estimated)
+			})
+		}, "stream_key", "session_id")
+
+		metrics.NewGaugeFunc("broadcast_box_whep_session_send_bitrate", "Bits per second a viewer was sent", func() []metrics.Sample {
+			return collectWHEPSessionMetric(func(e *egressEstimator) float64 {
+				_, sent := e.bitrates()
+				return float64(sent)
+			})
+		}, "stream_key", "session_id")
+	}
+
+	if egressPacing {
+		metrics.NewGaugeFunc("broadcast_box_whep_session_pacing_queue_bytes", "Bytes EGRESS_PACING holds back from a viewer", func() []metrics.Sample {
+			return collectWHEPSessionMetric(func(e *egressEstimator) float64 {
+				if e.pacer == nil {
+					return 0
+				}
+				_, bytes := e.pacer.queue()
+				return float64(bytes)
+			})
+		}, "stream_key", "session_id")
+	}
+
+	metrics.NewGaugeFunc("broadcast_box_rtx_history_packets", "Packets kept for retransmission per video track sent to a viewer", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(rtxHistorySize)}}
+	})
+}
+
+func collectStreamMetric(value func(*stream) float64) []metrics.Sample {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	samples := make([]metrics.Sample, 0, len(streamMap))
+	for streamKey, s := range streamMap {
+		samples = append(samples, metrics.Sample{LabelValues: []string{streamKey}, Value: value(s)})
+	}
+
+	return samples
+}
+
+func collectWHEPSessionMetric(value func(*egressEstimator) float64) []metrics.Sample {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	samples := []metrics.Sample{}
+	for streamKey, s := range streamMap {
+		s.whepSessionsLock.RLock()
+		for id, whepSession := range s.whepSessions {
+			if whepSession.egressEstimator != nil {
+				samples = append(samples, metrics.Sample{LabelValues: []string{streamKey, id}, Value: value(whepSession.egressEstimator)})
+			}
+		}
+		s.whepSessionsLock.RUnlock()
+	}
+
+	return samples
+}
@@ -0,0 +1,73 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+// A 20ms Opus frame of silence, replaces the audio of a muted stream so timestamps keep flowing
+var opusSilenceFrame = []byte{0xF8, 0xFF, 0xFE}
+
+// muteMessage is sent to viewers with a DataChannel when the audio or video of a stream is muted
+type muteMessage struct {
+	Type  string `json:"type"`
+	Audio bool   `json:"audio"`
+	Video bool   `json:"video"`
+}
+
+// StreamMute is the data of a stream.mute event
+type StreamMute struct {
+	Audio bool `json:"audio"`
+	Video bool `json:"video"`
+}
+
+// SetStreamMute mutes or unmutes the audio and video of a live stream without renegotiating. Muted audio is
+// replaced with silence, muted video isn't forwarded and viewers are told over their DataChannel, so their
+// sessions stay up. Viewers resume video at the next keyframe after unmuting.
+func SetStreamMute(streamKey string, audio, video bool) error {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() {
+		return errors.New("Stream is not live")
+	}
+
+	stream.audioMuted.Store(audio)
+	if stream.videoMuted.Swap(video) != video {
+		// Viewers joining while muted must not get video from before, or the muted part from the cache
+		for _, videoTrack := range stream.videoTracks {
+			videoTrack.keyframeCache.drop()
+		}
+
+		if !video {
+			stream.whepSessionsLock.RLock()
+			for _, whepSession := range stream.whepSessions {
+				whepSession.waitingForKeyframe.Store(true)
+			}
+			stream.whepSessionsLock.RUnlock()
+
+			select {
+			case stream.pliChan <- true:
+			default:
+			}
+		}
+	}
+
+	if msg, err := json.Marshal(muteMessage{Type: "mute", Audio: audio, Video: video}); err != nil {
+		log.Println(err)
+	} else {
+		stream.sendDataChannelMessage(msg)
+	}
+
+	streamerName := ""
+	if stream.streamer != nil {
+		streamerName = stream.streamer.Name
+	}
+	events.Publish(events.Event{Type: events.StreamMute, StreamKey: streamKey, Streamer: streamerName, Tenant: stream.tenant(), Data: StreamMute{Audio: audio, Video: video}})
+
+	return nil
+}
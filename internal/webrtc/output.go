@@ -0,0 +1,127 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Packets an output may fall behind before new packets are dropped for it
+const outputBufferSize = 512
+
+type (
+	// OutputPacket is a packet of the publisher for outputs that repackage the stream, like recordings or HLS.
+	// Markers like ad breaks are placed on the same timeline, they have no Packet.
+	OutputPacket struct {
+		Video    bool
+		MimeType string
+		// Simulcast layer of a video packet or mid of an audio packet
+		TrackID string
+		Packet  *rtp.Packet
+		// Presentation time on the timeline of the stream. It only grows, also across publisher reconnects,
+		// and audio and video share it.
+		PTS      time.Duration
+		Keyframe bool
+		// First packet after the publisher reconnected or was replaced
+		Discontinuity bool
+		AdBreak       *AdBreak
+	}
+
+	output struct {
+		packets chan OutputPacket
+		dropped atomic.Uint64
+	}
+)
+
+// ErrOutputDetached is returned for outputs of a stream that was deleted
+var ErrOutputDetached = errors.New("Output was detached")
+
+// AttachOutput returns the packets of a stream from now on. The stream is kept while outputs are attached,
+// so the timeline continues when the publisher reconnects. detach must be called when the output is done.
+// name is the kind of output, like OutputHLS, it must be allowed by the streamer.
+func AttachOutput(streamKey, name string) (packets <-chan OutputPacket, detach func(), err error) {
+	if err := CheckOutputAllowed(streamKey, name); err != nil {
+		return nil, nil, err
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, err := getStream(nil, streamKey, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	o := &output{packets: make(chan OutputPacket, outputBufferSize)}
+	stream.outputsLock.Lock()
+	stream.outputs = append(stream.outputs, o)
+	stream.hasOutputs.Store(true)
+	stream.outputsLock.Unlock()
+
+	var once sync.Once
+	return o.packets, func() {
+		once.Do(func() {
+			streamMapLock.Lock()
+			defer streamMapLock.Unlock()
+
+			stream.outputsLock.Lock()
+			for i := range stream.outputs {
+				if stream.outputs[i] == o {
+					stream.outputs = append(stream.outputs[:i], stream.outputs[i+1:]...)
+					break
+				}
+			}
+			stream.hasOutputs.Store(len(stream.outputs) != 0)
+			stream.outputsLock.Unlock()
+
+			stream.whepSessionsLock.Lock()
+			deleteStreamIfUnused(streamKey, stream)
+			stream.whepSessionsLock.Unlock()
+		})
+	}, nil
+}
+
+// sendToOutputs places a packet of the publisher on the timeline and hands a copy to every output
+func (s *stream) sendToOutputs(rtpPkt *rtp.Packet, video bool, mimeType, trackID string, track *trackTimeline, source *senderReportSource, clockRate uint32, keyframe bool) {
+	if !s.hasOutputs.Load() {
+		return
+	}
+
+	pts, discontinuity := s.timeline.pts(track, source, rtpPkt.Timestamp, clockRate, time.Now())
+	packet := OutputPacket{
+		Video:         video,
+		MimeType:      mimeType,
+		TrackID:       trackID,
+		Packet:        rtpPkt.Clone(),
+		PTS:           pts,
+		Keyframe:      keyframe,
+		Discontinuity: discontinuity,
+	}
+
+	s.sendOutputPacket(packet)
+}
+
+// sendMarkerToOutputs places an ad break at the current end of the timeline
+func (s *stream) sendMarkerToOutputs(adBreak *AdBreak) {
+	if !s.hasOutputs.Load() {
+		return
+	}
+
+	s.sendOutputPacket(OutputPacket{PTS: s.timeline.now(), AdBreak: adBreak})
+}
+
+func (s *stream) sendOutputPacket(packet OutputPacket) {
+	s.outputsLock.RLock()
+	defer s.outputsLock.RUnlock()
+
+	for _, o := range s.outputs {
+		select {
+		case o.packets <- packet:
+		default:
+			o.dropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package webrtc
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+const (
+	// Viewers are paced a little above their estimate, so the queue drains after a keyframe
+	egressPacingFactor = 1.5
+
+	// Packets are sent in bursts of at most this much of the pacing rate
+	egressPacingBurst = 5 * time.Millisecond
+
+	// Above this delay the queue is drained faster than the estimate, a late frame freezes playback as well
+	egressPacingMaxQueueDelay = 300 * time.Millisecond
+
+	// The bucket holds at least one full packet, or slow viewers would never be sent one
+	egressPacingMinBurstBytes = 1500
+)
+
+type (
+	// egressPacer smooths the media sent to a viewer to its estimated bandwidth with a token bucket, so keyframes don't
+	// overflow the buffers of consumer routers. Audio is sent before queued video.
+	egressPacer struct {
+		interceptor.NoOp
+
+		estimator atomic.Pointer[egressEstimator]
+
+		mu          sync.Mutex
+		audio       []pacedPacket
+		video       []pacedPacket
+		queuedBytes int
+
+		wake      chan struct{}
+		closed    chan struct{}
+		closeOnce sync.Once
+	}
+
+	pacedPacket struct {
+		header     *rtp.Header
+		payload    []byte
+		attributes interceptor.Attributes
+		writer     interceptor.RTPWriter
+		size       int
+	}
+
+	egressPacerFactory struct{}
+)
+
+var (
+	egressPacing bool
+
+	// Handed to the WHEP session like egressEstimatorCreated
+	egressPacerCreated *egressPacer
+)
+
+// configurePacing paces the media sent to viewers with EGRESS_PACING, it must be added after every other interceptor
+// so packets are numbered for transport-cc when they leave the queue
+func configurePacing(interceptorRegistry *interceptor.Registry) error {
+	if os.Getenv("EGRESS_PACING") != "true" {
+		return nil
+	} else if egressCongestionControl == "" {
+		return errors.New("EGRESS_PACING requires EGRESS_CONGESTION_CONTROL")
+	}
+
+	egressPacing = true
+	interceptorRegistry.Add(egressPacerFactory{})
+	return nil
+}
+
+func (egressPacerFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	p := &egressPacer{wake: make(chan struct{}, 1), closed: make(chan struct{})}
+	egressPacerCreated = p
+
+	go p.run()
+	return p, nil
+}
+
+func (p *egressPacer) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	audio := strings.HasPrefix(strings.ToLower(info.MimeType), "audio/")
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		clone := header.Clone()
+		packet := pacedPacket{
+			header:     &clone,
+			payload:    append([]byte(nil), payload...),
+			attributes: attributes,
+			writer:     writer,
+			size:       header.MarshalSize() + len(payload),
+		}
+
+		p.mu.Lock()
+		if audio {
+			p.audio = append(p.audio, packet)
+		} else {
+			p.video = append(p.video, packet)
+		}
+		p.queuedBytes += packet.size
+		p.mu.Unlock()
+
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+
+		return packet.size, nil
+	})
+}
+
+func (p *egressPacer) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+// queue returns the packets and bytes waiting to be sent
+func (p *egressPacer) queue() (packets, bytes int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.audio) + len(p.video), p.queuedBytes
+}
+
+// rate returns the bytes per second the viewer is paced at
+func (p *egressPacer) rate(queuedBytes int) float64 {
+	bitrate := egressTargetBitrate
+	if e := p.estimator.Load(); e != nil {
+		bitrate = max(e.GetTargetBitrate(), egressMinBitrate)
+	}
+
+	return max(float64(bitrate)*egressPacingFactor/8, float64(queuedBytes)/egressPacingMaxQueueDelay.Seconds())
+}
+
+func (p *egressPacer) run() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	budget, lastRefill := 0.0, time.Now()
+	for {
+		p.mu.Lock()
+		queue := &p.video
+		if len(p.audio) != 0 {
+			queue = &p.audio
+		}
+		empty, queuedBytes := len(*queue) == 0, p.queuedBytes
+		p.mu.Unlock()
+
+		if empty {
+			select {
+			case <-p.wake:
+			case <-p.closed:
+				return
+			}
+			continue
+		}
+
+		now := time.Now()
+		rate := p.rate(queuedBytes)
+		budget = min(budget+now.Sub(lastRefill).Seconds()*rate, max(rate*egressPacingBurst.Seconds(), egressPacingMinBurstBytes))
+		lastRefill = now
+
+		p.mu.Lock()
+		packet := (*queue)[0]
+		if budget >= float64(packet.size) {
+			*queue = (*queue)[1:]
+			p.queuedBytes -= packet.size
+		}
+		p.mu.Unlock()
+
+		if budget < float64(packet.size) {
+			timer.Reset(time.Duration((float64(packet.size) - budget) / rate * float64(time.Second)))
+			select {
+			case <-timer.C:
+			case <-p.closed:
+				return
+			}
+			continue
+		}
+
+		budget -= float64(packet.size)
+		// Errors are those of a closed transport, the session ends on its own
+		_, _ = packet.writer.Write(packet.header, packet.payload, packet.attributes)
+	}
+}
@@ -2,17 +2,32 @@ package webrtc
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Streamer struct {
-	Name string `db:name`
-	AuthToken string `db:auth_token`
+	Name      string `db:"name"`
+	AuthToken string `db:"auth_token"`
 	StreamKey string
+
+	// Quotas of provisioned streamers, zero is unlimited
+	MaxBitrate uint64 `db:"max_bitrate"`
+	MaxViewers int    `db:"max_viewers"`
+
+	// Record the streams of this streamer to RECORDING_DIR
+	Record bool `db:"record"`
+
+	// Tenant the streamer belongs to, nil if none
+	Tenant *Tenant
 }
 
 func GetStreamKeys(pool *pgxpool.Pool, ctx context.Context) ([]string, error) {
@@ -27,22 +42,414 @@ func GetStreamKeys(pool *pgxpool.Pool, ctx context.Context) ([]string, error) {
 	return streamKeys, nil
 }
 
-
-func NewStreamer(pool *pgxpool.Pool, ctx context.Context, token []string) *Streamer{
-	query := `SELECT name,auth_token FROM streamers
-		 WHERE @streamKey = ANY(stream_key)
-		 AND auth_token = @authToken`
-	row := pool.QueryRow(ctx, query, pgx.NamedArgs{
+// NewStreamer authenticates the streamer of token, a stream key and auth token. The stream key may also match a
+// pattern of the streamer, a streamer that lists it exactly is preferred. Auth tokens are only stored hashed, so the
+// streamers of the stream key are fetched and the token is verified against each.
+func NewStreamer(pool *pgxpool.Pool, ctx context.Context, token []string) *Streamer {
+	query := `SELECT s.name, s.auth_token, s.max_bitrate, s.max_viewers, s.record,
+		 t.name, COALESCE(t.max_streams, 0), COALESCE(t.max_viewers, 0) FROM streamers s
+		 LEFT JOIN tenants t ON t.name = s.tenant
+		 WHERE EXISTS (SELECT 1 FROM unnest(s.stream_key) k WHERE k = @streamKey
+		   OR (strpos(k, '*') > 0 AND @streamKey LIKE replace(replace(replace(replace(k, '\', '\\'), '%', '\%'), '_', '\_'), '*', '%')))
+		 AND (s.expires_at IS NULL OR s.expires_at > now())
+		 ORDER BY @streamKey = ANY(s.stream_key) DESC`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
 		"streamKey": token[0],
-		"authToken": token[1],
 	})
-	s := new(Streamer)
-	err := row.Scan(&s.Name, &s.AuthToken)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query failed: %v\n", err)
+		return nil
+	}
+
+	candidates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Streamer, error) {
+		s := new(Streamer)
+		var tenant Tenant
+		var tenantName *string
+		if err := row.Scan(&s.Name, &s.AuthToken, &s.MaxBitrate, &s.MaxViewers, &s.Record, &tenantName, &tenant.MaxStreams, &tenant.MaxViewers); err != nil {
+			return nil, err
+		}
+		if tenantName != nil {
+			tenant.Name = *tenantName
+			s.Tenant = &tenant
+		}
+		return s, nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query failed: %v\n", err)
+		return nil
+	}
+
+	for _, s := range candidates {
+		if verifyAuthToken(token[1], s.AuthToken) {
+			s.AuthToken, s.StreamKey = token[1], token[0]
+			return s
+		}
+	}
+
+	return nil
+}
+
+// ProvisionStreamer creates a streamer that may publish to streamKey with authToken. Expired
+// provisioned streamers of the stream key are removed.
+func ProvisionStreamer(pool *pgxpool.Pool, ctx context.Context, name, streamKey, authToken string, expiresAt *time.Time, maxBitrate uint64, maxViewers int) error {
+	if _, err := pool.Exec(ctx, `DELETE FROM streamers WHERE @streamKey = ANY(stream_key) AND expires_at <= now()`, pgx.NamedArgs{
+		"streamKey": streamKey,
+	}); err != nil {
+		return err
+	}
+
+	hash, err := hashAuthToken(authToken)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO streamers (name, auth_token, auth_token_lookup, stream_key, expires_at, max_bitrate, max_viewers)
+		 VALUES (@name, @authToken, @authTokenLookup, ARRAY[@streamKey], @expiresAt, @maxBitrate, @maxViewers)`
+	_, err = pool.Exec(ctx, query, pgx.NamedArgs{
+		"name":            name,
+		"authToken":       hash,
+		"authTokenLookup": authTokenLookup(authToken),
+		"streamKey":       streamKey,
+		"expiresAt":       expiresAt,
+		"maxBitrate":      maxBitrate,
+		"maxViewers":      maxViewers,
+	})
+	return err
+}
+
+// DeleteExpiredStreamers removes provisioned streamers whose auth token expired and returns how many
+func DeleteExpiredStreamers(pool *pgxpool.Pool, ctx context.Context) (int64, error) {
+	tag, err := pool.Exec(ctx, `DELETE FROM streamers WHERE expires_at <= now()`)
+	return tag.RowsAffected(), err
+}
+
+// StreamerByAuthToken looks up a streamer by their auth token alone. It is used
+// to authenticate requests that aren't tied to publishing a stream key.
+func StreamerByAuthToken(pool *pgxpool.Pool, ctx context.Context, authToken string) *Streamer {
+	name, _, err := streamerByAuthToken(pool, ctx, authToken)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "QueryRow failed: %v\n", err)
 		return nil
 	}
-	s.StreamKey = token[0]
 
-	return s
+	return &Streamer{Name: name, AuthToken: authToken}
+}
+
+// GetStreamerStreamKeys returns the stream keys a streamer may publish to
+func GetStreamerStreamKeys(pool *pgxpool.Pool, ctx context.Context, authToken string) ([]string, error) {
+	name, storedAuthToken, err := streamerByAuthToken(pool, ctx, authToken)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT stream_key FROM streamers
+		 WHERE name = @name AND auth_token = @storedAuthToken`
+	var streamKeys []string
+	if err := pool.QueryRow(ctx, query, pgx.NamedArgs{"name": name, "storedAuthToken": storedAuthToken}).Scan(&streamKeys); err != nil {
+		return nil, err
+	}
+
+	return streamKeys, nil
+}
+
+// RotateAuthToken replaces a streamer's auth token with a new random one
+func RotateAuthToken(pool *pgxpool.Pool, ctx context.Context, authToken string) (string, error) {
+	_, storedAuthToken, err := streamerByAuthToken(pool, ctx, authToken)
+	if err != nil {
+		return "", err
+	}
+
+	newAuthToken, err := generateAuthToken()
+	if err != nil {
+		return "", err
+	}
+	hash, err := hashAuthToken(newAuthToken)
+	if err != nil {
+		return "", err
+	}
+
+	query := `UPDATE streamers SET auth_token = @hash, auth_token_lookup = @lookup
+		 WHERE auth_token = @storedAuthToken`
+	tag, err := pool.Exec(ctx, query, pgx.NamedArgs{
+		"storedAuthToken": storedAuthToken,
+		"hash":            hash,
+		"lookup":          authTokenLookup(newAuthToken),
+	})
+	if err != nil {
+		return "", err
+	} else if tag.RowsAffected() == 0 {
+		return "", pgx.ErrNoRows
+	}
+
+	return newAuthToken, nil
+}
+
+// GetNamedStreamerStreamKeys returns the stream keys of the streamer called name, pgx.ErrNoRows if there is none
+func GetNamedStreamerStreamKeys(pool *pgxpool.Pool, ctx context.Context, name string) ([]string, error) {
+	query := `SELECT DISTINCT(unnest(stream_key)) FROM streamers
+		 WHERE name = @name AND (expires_at IS NULL OR expires_at > now())`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{"name": name})
+	if err != nil {
+		return nil, err
+	}
+
+	streamKeys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	} else if len(streamKeys) == 0 {
+		return nil, pgx.ErrNoRows
+	}
+
+	return streamKeys, nil
+}
+
+// RotateNamedAuthToken replaces the auth token of the streamer called name with a new random one
+func RotateNamedAuthToken(pool *pgxpool.Pool, ctx context.Context, name string) (string, error) {
+	newAuthToken, err := generateAuthToken()
+	if err != nil {
+		return "", err
+	}
+	hash, err := hashAuthToken(newAuthToken)
+	if err != nil {
+		return "", err
+	}
+
+	query := `UPDATE streamers SET auth_token = @hash, auth_token_lookup = @lookup
+		 WHERE name = @name AND expires_at IS NULL`
+	tag, err := pool.Exec(ctx, query, pgx.NamedArgs{
+		"name":   name,
+		"hash":   hash,
+		"lookup": authTokenLookup(newAuthToken),
+	})
+	if err != nil {
+		return "", err
+	} else if tag.RowsAffected() == 0 {
+		return "", pgx.ErrNoRows
+	}
+
+	return newAuthToken, nil
+}
+
+// SetStreamerRecord sets the record flag of the streamer called name, it applies from their next broadcast
+func SetStreamerRecord(pool *pgxpool.Pool, ctx context.Context, name string, record bool) error {
+	tag, err := pool.Exec(ctx, `UPDATE streamers SET record = @record WHERE name = @name`, pgx.NamedArgs{
+		"name":   name,
+		"record": record,
+	})
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
+
+func generateAuthToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// StreamerConfig is the declarative configuration of a streamer, identified by its name. Only a hash of the
+// AuthToken is stored, it is empty when read back.
+type StreamerConfig struct {
+	Name       string     `json:"name"`
+	AuthToken  string     `json:"authToken,omitempty"`
+	StreamKeys []string   `json:"streamKeys"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	MaxBitrate uint64     `json:"maxBitrate"`
+	MaxViewers int        `json:"maxViewers"`
+	Record     bool       `json:"record"`
+	Tenant     string     `json:"tenant,omitempty"`
+}
+
+// GetStreamerConfig returns the streamer called name, pgx.ErrNoRows if there is none
+func GetStreamerConfig(pool *pgxpool.Pool, ctx context.Context, name string) (*StreamerConfig, error) {
+	query := `SELECT name,stream_key,expires_at,max_bitrate,max_viewers,record,tenant FROM streamers
+		 WHERE name = @name
+		 LIMIT 1`
+	c := new(StreamerConfig)
+	if err := pool.QueryRow(ctx, query, pgx.NamedArgs{"name": name}).Scan(
+		&c.Name, &c.StreamKeys, &c.ExpiresAt, &c.MaxBitrate, &c.MaxViewers, &c.Record, &c.Tenant,
+	); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ErrStreamerExists is returned by CreateStreamerConfig if the name is taken
+var ErrStreamerExists = errors.New("Streamer already exists")
+
+// ListStreamerConfigs returns the streamers ordered by name, only those of tenant unless it is empty
+func ListStreamerConfigs(pool *pgxpool.Pool, ctx context.Context, tenant string) ([]StreamerConfig, error) {
+	query := `SELECT name,stream_key,expires_at,max_bitrate,max_viewers,record,tenant FROM streamers
+		 WHERE @tenant = '' OR tenant = @tenant
+		 ORDER BY name`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{"tenant": tenant})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (c StreamerConfig, err error) {
+		err = row.Scan(&c.Name, &c.StreamKeys, &c.ExpiresAt, &c.MaxBitrate, &c.MaxViewers, &c.Record, &c.Tenant)
+		return c, err
+	})
+}
+
+// CreateStreamerConfig creates a streamer, ErrStreamerExists if the name is taken. An auth token is generated if
+// c has none, the auth token is returned.
+func CreateStreamerConfig(pool *pgxpool.Pool, ctx context.Context, c StreamerConfig) (string, error) {
+	if c.AuthToken == "" {
+		authToken, err := generateAuthToken()
+		if err != nil {
+			return "", err
+		}
+		c.AuthToken = authToken
+	}
+
+	hash, err := hashAuthToken(c.AuthToken)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx) //nolint
+
+	args := pgx.NamedArgs{
+		"name":            c.Name,
+		"authToken":       hash,
+		"authTokenLookup": authTokenLookup(c.AuthToken),
+		"streamKeys":      c.StreamKeys,
+		"expiresAt":       c.ExpiresAt,
+		"maxBitrate":      c.MaxBitrate,
+		"maxViewers":      c.MaxViewers,
+		"record":          c.Record,
+		"tenant":          c.Tenant,
+	}
+
+	// Serialized with PutStreamerConfig, the name isn't unique in the schema
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext(@name))`, args); err != nil {
+		return "", err
+	}
+
+	tag, err := tx.Exec(ctx, `INSERT INTO streamers (name, auth_token, auth_token_lookup, stream_key, expires_at, max_bitrate, max_viewers, record, tenant)
+		 SELECT @name, @authToken, @authTokenLookup, @streamKeys, @expiresAt, @maxBitrate, @maxViewers, @record, @tenant
+		 WHERE NOT EXISTS (SELECT 1 FROM streamers WHERE name = @name)`, args)
+	if err != nil {
+		return "", err
+	} else if tag.RowsAffected() == 0 {
+		return "", ErrStreamerExists
+	}
+
+	return c.AuthToken, tx.Commit(ctx)
+}
+
+// RevokeAuthToken replaces the auth token of the streamer called name with a random one and returns it,
+// pgx.ErrNoRows if there is no such streamer
+func RevokeAuthToken(pool *pgxpool.Pool, ctx context.Context, name string) (string, error) {
+	newAuthToken, err := generateAuthToken()
+	if err != nil {
+		return "", err
+	}
+	hash, err := hashAuthToken(newAuthToken)
+	if err != nil {
+		return "", err
+	}
+
+	tag, err := pool.Exec(ctx, `UPDATE streamers SET auth_token = @hash, auth_token_lookup = @lookup WHERE name = @name`, pgx.NamedArgs{
+		"name":   name,
+		"hash":   hash,
+		"lookup": authTokenLookup(newAuthToken),
+	})
+	if err != nil {
+		return "", err
+	} else if tag.RowsAffected() == 0 {
+		return "", pgx.ErrNoRows
+	}
+
+	return newAuthToken, nil
+}
+
+// PutStreamerConfig creates the streamer or replaces all of its settings. Applying the same config
+// twice leaves the streamer unchanged, it returns whether the streamer was created.
+func PutStreamerConfig(pool *pgxpool.Pool, ctx context.Context, c StreamerConfig) (bool, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx) //nolint
+
+	args := pgx.NamedArgs{
+		"name":            c.Name,
+		"authTokenLookup": authTokenLookup(c.AuthToken),
+		"streamKeys":      c.StreamKeys,
+		"expiresAt":       c.ExpiresAt,
+		"maxBitrate":      c.MaxBitrate,
+		"maxViewers":      c.MaxViewers,
+		"record":          c.Record,
+		"tenant":          c.Tenant,
+	}
+
+	// Serialize concurrent PUTs of the same name so they can't both insert
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext(@name))`, args); err != nil {
+		return false, err
+	}
+
+	// Hashes are salted, the stored hash is kept if the token didn't change so the same config changes nothing
+	var storedAuthToken string
+	err = tx.QueryRow(ctx, `SELECT auth_token FROM streamers WHERE name = @name LIMIT 1`, args).Scan(&storedAuthToken)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return false, err
+	} else if err == nil && strings.HasPrefix(storedAuthToken, authTokenHashPrefix) && verifyAuthToken(c.AuthToken, storedAuthToken) {
+		args["authToken"] = storedAuthToken
+	} else if args["authToken"], err = hashAuthToken(c.AuthToken); err != nil {
+		return false, err
+	}
+
+	tag, err := tx.Exec(ctx, `UPDATE streamers
+		 SET auth_token = @authToken, auth_token_lookup = @authTokenLookup, stream_key = @streamKeys, expires_at = @expiresAt,
+		 max_bitrate = @maxBitrate, max_viewers = @maxViewers, record = @record, tenant = @tenant
+		 WHERE name = @name`, args)
+	if err != nil {
+		return false, err
+	}
+
+	created := tag.RowsAffected() == 0
+	if created {
+		if _, err := tx.Exec(ctx, `INSERT INTO streamers (name, auth_token, auth_token_lookup, stream_key, expires_at, max_bitrate, max_viewers, record, tenant)
+			 VALUES (@name, @authToken, @authTokenLookup, @streamKeys, @expiresAt, @maxBitrate, @maxViewers, @record, @tenant)`, args); err != nil {
+			return false, err
+		}
+	}
+
+	return created, tx.Commit(ctx)
+}
+
+// StreamKeysOfOtherTenants returns which of streamKeys streamers outside of tenant may publish to
+func StreamKeysOfOtherTenants(pool *pgxpool.Pool, ctx context.Context, tenant string, streamKeys []string) ([]string, error) {
+	query := `SELECT DISTINCT key FROM streamers, unnest(stream_key) AS key
+		 WHERE tenant <> @tenant AND key = ANY(@streamKeys)`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
+		"tenant":     tenant,
+		"streamKeys": streamKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// DeleteStreamer removes the streamer called name. Deleting a streamer that doesn't exist is not an error.
+func DeleteStreamer(pool *pgxpool.Pool, ctx context.Context, name string) error {
+	_, err := pool.Exec(ctx, `DELETE FROM streamers WHERE name = @name`, pgx.NamedArgs{"name": name})
+	return err
 }
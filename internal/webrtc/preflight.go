@@ -0,0 +1,152 @@
+package webrtc
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// Share of the measured uplink an encoder should use, leaving headroom for audio, RTCP and fluctuations
+	preflightUplinkHeadroom = 0.7
+
+	preflightAudioBitrate = 128_000
+)
+
+type (
+	PreflightCodecs struct {
+		Supported   []string `json:"supported"`
+		Unsupported []string `json:"unsupported"`
+	}
+
+	PreflightUplink struct {
+		Bytes            int64 `json:"bytes"`
+		DurationMs       int64 `json:"durationMs"`
+		EstimatedBitrate int64 `json:"estimatedBitrate"`
+	}
+
+	PreflightEncoderSettings struct {
+		Codec            string `json:"codec"`
+		Width            int    `json:"width"`
+		Height           int    `json:"height"`
+		Framerate        int    `json:"framerate"`
+		VideoBitrate     int64  `json:"videoBitrate"`
+		AudioBitrate     int64  `json:"audioBitrate"`
+		KeyframeInterval int    `json:"keyframeInterval"`
+		X264Tune         string `json:"x264Tune"`
+	}
+
+	PreflightReport struct {
+		Streamer    string                   `json:"streamer"`
+		Live        bool                     `json:"live"`
+		Codecs      PreflightCodecs          `json:"codecs"`
+		Uplink      PreflightUplink          `json:"uplink"`
+		Recommended PreflightEncoderSettings `json:"recommended"`
+		Warnings    []string                 `json:"warnings"`
+	}
+)
+
+// SupportedVideoCodecs returns the names of the video codecs publishers may use, like `H264`
+func SupportedVideoCodecs() []string {
+	codecs := []string{}
+	for _, codec := range codecProfile.VideoCodecs {
+		name := strings.TrimPrefix(codec.MimeType, "video/")
+		if !containsFold(codecs, name) {
+			codecs = append(codecs, name)
+		}
+	}
+
+	return codecs
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Preflight checks if a publisher is ready to go live. encoderCodecs are the codecs the encoder can
+// produce, uplinkBytes were uploaded by the encoder in uplinkDuration.
+func Preflight(streamer *Streamer, encoderCodecs []string, uplinkBytes int64, uplinkDuration time.Duration) PreflightReport {
+	report := PreflightReport{
+		Streamer: streamer.Name,
+		Codecs:   PreflightCodecs{Supported: []string{}, Unsupported: []string{}},
+		Uplink:   PreflightUplink{Bytes: uplinkBytes, DurationMs: uplinkDuration.Milliseconds()},
+		Warnings: []string{},
+	}
+
+	streamMapLock.Lock()
+	if stream, ok := streamMap[streamer.StreamKey]; ok && stream.hasWHIPClient.Load() {
+		report.Live = true
+		report.Warnings = append(report.Warnings, "Stream key is already live")
+	}
+	streamMapLock.Unlock()
+
+	supportedCodecs := SupportedVideoCodecs()
+	if len(encoderCodecs) == 0 {
+		encoderCodecs = supportedCodecs
+	}
+
+	for _, codec := range encoderCodecs {
+		if containsFold(supportedCodecs, codec) {
+			report.Codecs.Supported = append(report.Codecs.Supported, strings.ToUpper(codec))
+		} else {
+			report.Codecs.Unsupported = append(report.Codecs.Unsupported, strings.ToUpper(codec))
+		}
+	}
+
+	// H264 is preferred as every viewer can decode it
+	report.Recommended = PreflightEncoderSettings{
+		Framerate:        30,
+		AudioBitrate:     preflightAudioBitrate,
+		KeyframeInterval: 2,
+		X264Tune:         "zerolatency",
+	}
+	switch {
+	case containsFold(report.Codecs.Supported, "H264"):
+		report.Recommended.Codec = "H264"
+	case len(report.Codecs.Supported) != 0:
+		report.Recommended.Codec = report.Codecs.Supported[0]
+	default:
+		report.Warnings = append(report.Warnings, "Encoder supports none of the codecs accepted by this server")
+	}
+
+	if uplinkDuration <= 0 || uplinkBytes == 0 {
+		report.Warnings = append(report.Warnings, "No uplink probe was sent, bitrate recommendation is a default")
+		report.Recommended.Width, report.Recommended.Height, report.Recommended.VideoBitrate = 1280, 720, 2_500_000
+		return report
+	}
+
+	report.Uplink.EstimatedBitrate = int64(float64(uplinkBytes*8) / uplinkDuration.Seconds())
+	videoBitrate := int64(float64(report.Uplink.EstimatedBitrate)*preflightUplinkHeadroom) - preflightAudioBitrate
+
+	for _, rung := range []struct {
+		width, height int
+		minBitrate    int64
+	}{
+		{1920, 1080, 4_500_000},
+		{1280, 720, 2_500_000},
+		{854, 480, 1_200_000},
+		{640, 360, 600_000},
+	} {
+		if videoBitrate >= rung.minBitrate || rung.height == 360 {
+			report.Recommended.Width, report.Recommended.Height = rung.width, rung.height
+			break
+		}
+	}
+
+	switch {
+	case videoBitrate < 600_000:
+		report.Warnings = append(report.Warnings, "Uplink is too slow for a reliable broadcast")
+		report.Recommended.VideoBitrate = max(videoBitrate, 300_000)
+	case videoBitrate > 6_000_000:
+		report.Recommended.VideoBitrate = 6_000_000
+	default:
+		report.Recommended.VideoBitrate = videoBitrate
+	}
+
+	return report
+}
@@ -0,0 +1,100 @@
+package webrtc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// defaultPublishLinkName is the streamer name of links created without one
+const defaultPublishLinkName = "Guest"
+
+// PublishLink lets a guest publish to a stream key once from a browser, without credentials of their own
+type PublishLink struct {
+	StreamKey string     `json:"streamKey"`
+	Name      string     `json:"name"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+}
+
+// ErrInvalidPublishLink is returned for links that don't exist, expired or were already used
+var ErrInvalidPublishLink = errors.New("Invalid publish link")
+
+// Only a hash of the token is stored, a leaked table doesn't let anyone publish
+func publishLinkHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreatePublishLink returns the token of a new link for streamKey that expires after ttl
+func CreatePublishLink(pool *pgxpool.Pool, ctx context.Context, streamKey, name string, ttl time.Duration) (string, time.Time, error) {
+	if name == "" {
+		name = defaultPublishLinkName
+	}
+
+	token, err := generateAuthToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	_, err = pool.Exec(ctx, `INSERT INTO publish_links (token_hash, stream_key, name, expires_at) VALUES (@tokenHash, @streamKey, @name, @expiresAt)`, pgx.NamedArgs{
+		"tokenHash": publishLinkHash(token),
+		"streamKey": streamKey,
+		"name":      name,
+		"expiresAt": expiresAt,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// DeleteExpiredPublishLinks removes links that expired, used or not, and returns how many
+func DeleteExpiredPublishLinks(pool *pgxpool.Pool, ctx context.Context) (int64, error) {
+	tag, err := pool.Exec(ctx, `DELETE FROM publish_links WHERE expires_at <= now()`)
+	return tag.RowsAffected(), err
+}
+
+// GetPublishLink returns a link that hasn't expired, whether it was used or not
+func GetPublishLink(pool *pgxpool.Pool, ctx context.Context, token string) (*PublishLink, error) {
+	l := &PublishLink{}
+	err := pool.QueryRow(ctx, `SELECT stream_key, name, expires_at, used_at FROM publish_links WHERE token_hash = @tokenHash AND expires_at > now()`, pgx.NamedArgs{
+		"tokenHash": publishLinkHash(token),
+	}).Scan(&l.StreamKey, &l.Name, &l.ExpiresAt, &l.UsedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidPublishLink
+	} else if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// UsePublishLink marks a link as used and returns it. Every link can be used once, on any instance.
+func UsePublishLink(pool *pgxpool.Pool, ctx context.Context, token string) (*PublishLink, error) {
+	l := &PublishLink{}
+	err := pool.QueryRow(ctx, `UPDATE publish_links SET used_at = now()
+		 WHERE token_hash = @tokenHash AND used_at IS NULL AND expires_at > now()
+		 RETURNING stream_key, name, expires_at, used_at`, pgx.NamedArgs{
+		"tokenHash": publishLinkHash(token),
+	}).Scan(&l.StreamKey, &l.Name, &l.ExpiresAt, &l.UsedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidPublishLink
+	} else if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Streamer is who publishes with the link, without quotas
+func (l *PublishLink) Streamer() *Streamer {
+	return &Streamer{Name: l.Name, StreamKey: l.StreamKey}
+}
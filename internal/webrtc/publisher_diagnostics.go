@@ -0,0 +1,82 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// A publisher's connection is degrading once loss or round trip time reach these
+const (
+	degradedPacketLoss    = guidanceHighLoss
+	degradedRoundTripTime = 300 * time.Millisecond
+)
+
+// PublisherDiagnostics describes the connection of a publisher to this server, for the streamer to see
+// while live
+type PublisherDiagnostics struct {
+	SessionID string `json:"sessionId"`
+	// Selected ICE candidate pair, like `udp host 203.0.113.7:51234`
+	LocalCandidate  string `json:"localCandidate"`
+	RemoteCandidate string `json:"remoteCandidate"`
+	// Milliseconds, zero until the first ICE round trip was measured
+	RoundTripTime float64 `json:"roundTripTime"`
+	// Bits per second received from the publisher, and what bitrate guidance estimates the uplink can carry
+	// if it had to lower it
+	UplinkBitrate          uint64 `json:"uplinkBitrate"`
+	EstimatedUplinkBitrate uint64 `json:"estimatedUplinkBitrate,omitempty"`
+	// Percent of packets lost, of the video layer with the most loss
+	PacketLoss float64 `json:"packetLoss"`
+	Degraded   bool    `json:"degraded"`
+}
+
+// GetPublisherDiagnostics returns the diagnostics of the publisher of streamKey
+func GetPublisherDiagnostics(streamKey string) (PublisherDiagnostics, error) {
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() || stream.whipPeerConnection == nil {
+		streamMapLock.Unlock()
+		return PublisherDiagnostics{}, errors.New("Stream is not live")
+	}
+
+	diagnostics := PublisherDiagnostics{SessionID: stream.whipSessionId}
+	peerConnection := stream.whipPeerConnection
+	for _, videoTrack := range stream.videoTracks {
+		diagnostics.UplinkBitrate += videoTrack.bitrate.Load()
+
+		if guidance := videoTrack.guidance.Load(); guidance != nil {
+			diagnostics.PacketLoss = max(diagnostics.PacketLoss, float64(guidance.lastLossRate.Load())/100)
+			diagnostics.EstimatedUplinkBitrate += guidance.lastTarget.Load()
+		}
+	}
+	streamMapLock.Unlock()
+
+	// GetStats locks the PeerConnection, it isn't called with streamMapLock held
+	report := peerConnection.GetStats()
+	for _, stats := range report {
+		pair, ok := stats.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+
+		diagnostics.RoundTripTime = pair.CurrentRoundTripTime * 1000
+		if local, ok := report[pair.LocalCandidateID].(webrtc.ICECandidateStats); ok {
+			diagnostics.LocalCandidate = describeCandidate(local)
+		}
+		if remote, ok := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats); ok {
+			diagnostics.RemoteCandidate = describeCandidate(remote)
+		}
+		break
+	}
+
+	diagnostics.Degraded = diagnostics.PacketLoss >= degradedPacketLoss*100 ||
+		diagnostics.RoundTripTime >= float64(degradedRoundTripTime.Milliseconds())
+
+	return diagnostics, nil
+}
+
+func describeCandidate(candidate webrtc.ICECandidateStats) string {
+	return fmt.Sprintf("%s %s %s:%d", candidate.Protocol, candidate.CandidateType, candidate.IP, candidate.Port)
+}
@@ -0,0 +1,132 @@
+package webrtc
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/patrikrog/broadcast-box/internal/metrics"
+)
+
+const (
+	midExtensionURI = "urn:ietf:params:rtp-hdrext:sdes:mid"
+	ridExtensionURI = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+
+	quirkMissingContentType    = "missing-content-type"
+	quirkMissingSimulcastExt   = "missing-simulcast-extmap"
+	quirkAscendingSimulcastRid = "ascending-simulcast-order"
+)
+
+var encoderQuirks = metrics.NewCounterVec(
+	"broadcast_box_encoder_quirks_total",
+	"WHIP offers that needed a compatibility workaround",
+	"quirk", "client",
+)
+
+// encoderClient guesses the publishing software from its User-Agent, used to label quirk metrics
+func encoderClient(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	for _, client := range []string{"obs", "gstreamer", "larix", "ffmpeg"} {
+		if strings.Contains(userAgent, client) {
+			return client
+		}
+	}
+
+	return "other"
+}
+
+// ApplyEncoderQuirks detects known deviations of publishers from what Broadcast Box expects and
+// rewrites the offer to work around them. Every applied workaround is counted per client.
+func ApplyEncoderQuirks(offer, userAgent, contentType string) string {
+	client := encoderClient(userAgent)
+
+	// The offer is accepted anyway, but is counted so clients can be fixed upstream
+	if !strings.HasPrefix(contentType, "application/sdp") {
+		encoderQuirks.Inc(quirkMissingContentType, client)
+	}
+
+	lines := strings.Split(strings.ReplaceAll(offer, "\r\n", "\n"), "\n")
+	sessionEnd := len(lines)
+	for i, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			sessionEnd = i
+			break
+		}
+	}
+
+	out := slices.Clone(lines[:sessionEnd])
+	for start := sessionEnd; start < len(lines); {
+		end := start + 1
+		for end < len(lines) && !strings.HasPrefix(lines[end], "m=") {
+			end++
+		}
+
+		out = append(out, fixMediaSection(lines[:sessionEnd], lines[start:end], client)...)
+		start = end
+	}
+
+	return strings.Join(out, "\r\n")
+}
+
+func fixMediaSection(session, media []string, client string) []string {
+	simulcastIndex := slices.IndexFunc(media, func(l string) bool { return strings.HasPrefix(l, "a=simulcast:") })
+	if simulcastIndex == -1 {
+		return media
+	}
+
+	// Without the mid and rid header extensions layers can't be told apart. Dropping simulcast
+	// lets the publisher fall back to sending one layer instead of failing.
+	hasExtension := func(uri string) bool {
+		return slices.ContainsFunc(append(slices.Clone(session), media...), func(l string) bool {
+			return strings.HasPrefix(l, "a=extmap:") && strings.Contains(l, uri)
+		})
+	}
+	if !hasExtension(midExtensionURI) || !hasExtension(ridExtensionURI) {
+		encoderQuirks.Inc(quirkMissingSimulcastExt, client)
+		return slices.DeleteFunc(slices.Clone(media), func(l string) bool {
+			return strings.HasPrefix(l, "a=simulcast:") || strings.HasPrefix(l, "a=rid:")
+		})
+	}
+
+	// Layers are expected from highest to lowest quality, some publishers list them the other way around
+	direction, rids, ok := strings.Cut(strings.TrimPrefix(media[simulcastIndex], "a=simulcast:"), " ")
+	if !ok || strings.ContainsAny(rids, ",~ ") {
+		return media
+	}
+
+	layers := strings.Split(rids, ";")
+	widths := make([]int, len(layers))
+	for i, rid := range layers {
+		if widths[i] = ridMaxWidth(media, rid); widths[i] == 0 {
+			return media
+		}
+	}
+
+	if len(layers) > 1 && slices.IsSorted(widths) && widths[0] != widths[len(widths)-1] {
+		encoderQuirks.Inc(quirkAscendingSimulcastRid, client)
+		slices.Reverse(layers)
+
+		media = slices.Clone(media)
+		media[simulcastIndex] = "a=simulcast:" + direction + " " + strings.Join(layers, ";")
+	}
+
+	return media
+}
+
+// ridMaxWidth returns the max-width restriction of a rid, or zero if it has none
+func ridMaxWidth(media []string, rid string) int {
+	for _, l := range media {
+		if !strings.HasPrefix(l, "a=rid:"+rid+" ") {
+			continue
+		}
+
+		for _, restriction := range strings.FieldsFunc(l, func(r rune) bool { return r == ' ' || r == ';' }) {
+			if val, ok := strings.CutPrefix(restriction, "max-width="); ok {
+				width, _ := strconv.Atoi(val)
+				return width
+			}
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,158 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reactionFlushInterval = time.Second
+
+	defaultReactionsPerViewer = 5
+)
+
+type reactionsMessage struct {
+	Type      string            `json:"type"`
+	Reactions map[string]uint64 `json:"reactions"`
+}
+
+var (
+	reactionEmotes = []string{"clap", "heart", "laugh", "fire", "wow"}
+
+	// How many reactions one viewer may send per reactionFlushInterval
+	reactionsPerViewer = defaultReactionsPerViewer
+
+	ErrReactionRateLimited = errors.New("Too many reactions")
+
+	reactionsLock       sync.Mutex
+	pendingReactions    = map[string]map[string]uint64{}
+	reactionSubscribers = map[string]map[chan []byte]struct{}{}
+
+	// Reactions each viewer sent since the last flush
+	viewerReactions = map[string]int{}
+)
+
+// configureReactions reads REACTION_EMOTES and REACTION_RATE_LIMIT
+func configureReactions() error {
+	if emotes := os.Getenv("REACTION_EMOTES"); emotes != "" {
+		reactionEmotes = strings.Split(emotes, "|")
+	}
+
+	if val := os.Getenv("REACTION_RATE_LIMIT"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 {
+			return fmt.Errorf("Invalid REACTION_RATE_LIMIT %q", val)
+		}
+		reactionsPerViewer = limit
+	}
+
+	go func() {
+		for range time.Tick(reactionFlushInterval) {
+			flushReactions()
+		}
+	}()
+
+	return nil
+}
+
+// AddReaction counts a reaction of viewer for a live stream. Reactions are aggregated and
+// relayed to viewers once per reactionFlushInterval, a viewer sending more than
+// reactionsPerViewer in that time gets ErrReactionRateLimited.
+func AddReaction(streamKey, viewer, emote string) error {
+	if !slices.Contains(reactionEmotes, emote) {
+		return errors.New("Unknown reaction")
+	}
+
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	live := ok && stream.hasWHIPClient.Load()
+	streamMapLock.Unlock()
+
+	if !live {
+		return errors.New("Stream is not live")
+	}
+
+	reactionsLock.Lock()
+	defer reactionsLock.Unlock()
+
+	if viewerReactions[viewer] >= reactionsPerViewer {
+		return ErrReactionRateLimited
+	}
+	viewerReactions[viewer]++
+
+	if _, ok := pendingReactions[streamKey]; !ok {
+		pendingReactions[streamKey] = map[string]uint64{}
+	}
+	pendingReactions[streamKey][emote]++
+
+	return nil
+}
+
+// SubscribeReactions returns a channel that receives the aggregated reactions of a stream
+// as JSON. The returned function must be called to stop the subscription.
+func SubscribeReactions(streamKey string) (<-chan []byte, func()) {
+	reactionsLock.Lock()
+	defer reactionsLock.Unlock()
+
+	reactions := make(chan []byte, 10)
+	if _, ok := reactionSubscribers[streamKey]; !ok {
+		reactionSubscribers[streamKey] = map[chan []byte]struct{}{}
+	}
+	reactionSubscribers[streamKey][reactions] = struct{}{}
+
+	return reactions, func() {
+		reactionsLock.Lock()
+		defer reactionsLock.Unlock()
+
+		delete(reactionSubscribers[streamKey], reactions)
+		if len(reactionSubscribers[streamKey]) == 0 {
+			delete(reactionSubscribers, streamKey)
+		}
+	}
+}
+
+func flushReactions() {
+	messages := map[string][]byte{}
+
+	reactionsLock.Lock()
+	for streamKey, reactions := range pendingReactions {
+		msg, err := json.Marshal(reactionsMessage{Type: "reactions", Reactions: reactions})
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		messages[streamKey] = msg
+
+		for subscriber := range reactionSubscribers[streamKey] {
+			select {
+			case subscriber <- msg:
+			default:
+			}
+		}
+	}
+	flushed := pendingReactions
+	pendingReactions = map[string]map[string]uint64{}
+	clear(viewerReactions)
+	reactionsLock.Unlock()
+
+	for streamKey, reactions := range flushed {
+		logRecordingEvent(streamKey, "reactions", time.Now(), reactions)
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for streamKey, msg := range messages {
+		if stream, ok := streamMap[streamKey]; ok {
+			stream.sendDataChannelMessage(msg)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package webrtc
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// How often sessions are checked for inactivity
+const reapInterval = 5 * time.Second
+
+var (
+	// Close WHIP sessions that have not sent any media for this long, zero disables
+	whipIdleTimeout time.Duration
+
+	// Close WHEP sessions whose ICE connection has been disconnected for this long, zero disables
+	whepDisconnectedTimeout time.Duration
+)
+
+type reapedSession struct {
+	streamKey      string
+	whepSessionId  string
+	peerConnection *webrtc.PeerConnection
+
+	// Set if the viewer is still connected and should be told its tracks end
+	whepSession *whepSession
+}
+
+func timeoutFromEnv(name string) (time.Duration, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.Atoi(val)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("%s must be a number of seconds", name)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func configureReaper() (err error) {
+	if whipIdleTimeout, err = timeoutFromEnv("WHIP_IDLE_TIMEOUT"); err != nil {
+		return err
+	} else if whepDisconnectedTimeout, err = timeoutFromEnv("WHEP_DISCONNECTED_TIMEOUT"); err != nil {
+		return err
+	}
+
+	if whipIdleTimeout == 0 && whepDisconnectedTimeout == 0 {
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(reapInterval)
+		for range ticker.C {
+			reapSessions()
+		}
+	}()
+
+	return nil
+}
+
+// reapSessions closes abandoned sessions. Their tracks are freed the same way as if the
+// remote had disconnected.
+func reapSessions() {
+	now := time.Now()
+	reaped := []reapedSession{}
+
+	streamMapLock.Lock()
+	for streamKey, stream := range streamMap {
+		lastMediaReceived := time.Unix(0, stream.lastMediaReceived.Load())
+		if whipIdleTimeout != 0 && stream.whipPeerConnection != nil && now.Sub(lastMediaReceived) > whipIdleTimeout {
+			reaped = append(reaped, reapedSession{streamKey: streamKey, peerConnection: stream.whipPeerConnection})
+		}
+
+		if whepDisconnectedTimeout == 0 {
+			continue
+		}
+
+		Sessions.eachViewer(stream, func(whepSessionId string, whepSession *whepSession) {
+			disconnectedSince := whepSession.disconnectedSince.Load()
+			if disconnectedSince != 0 && now.Sub(time.Unix(0, disconnectedSince)) > whepDisconnectedTimeout {
+				reaped = append(reaped, reapedSession{streamKey: streamKey, whepSessionId: whepSessionId, peerConnection: whepSession.peerConnection})
+			}
+		})
+	}
+	streamMapLock.Unlock()
+
+	for _, r := range reaped {
+		if r.whepSessionId == "" {
+			log.Printf("Closing WHIP session of %s, no media received for %s\n", r.streamKey, whipIdleTimeout)
+		} else {
+			log.Printf("Closing WHEP session %s, disconnected for %s\n", r.whepSessionId, whepDisconnectedTimeout)
+		}
+	}
+
+	closeSessions(reaped)
+}
+
+// closeSessions closes the PeerConnections and frees their tracks the same way as if the remote had disconnected
+func closeSessions(sessions []reapedSession) {
+	for _, r := range sessions {
+		if r.whepSession != nil {
+			r.whepSession.sendGoodbye(false, "Session closed")
+		}
+		closePeerConnection(r.peerConnection)
+
+		if r.whepSessionId == "" {
+			whipDisconnected(r.streamKey, r.peerConnection)
+		} else {
+			peerConnectionDisconnected(r.streamKey, r.whepSessionId)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/autostart"
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+const recordingEventSaveTimeout = 10 * time.Second
+
+// RecordingEvent happened during a recorded broadcast. Players replaying the recording show it at MediaTime.
+type RecordingEvent struct {
+	Type string `json:"type"`
+	// Milliseconds since the start of the broadcast, the same offset into the recording bookmarks use
+	MediaTime int64           `json:"mediaTime"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+var (
+	recordingEventsPool *pgxpool.Pool
+
+	// Stream keys a record autostart rule started a recording for
+	recordedStreams     = map[string]bool{}
+	recordedStreamsLock sync.Mutex
+
+	// Events kept next to the media of a recording, reactions are added once per reactionFlushInterval
+	recordedEventTypes = []string{events.Metadata, events.CohostJoin, events.CohostLeave, events.MediaChange}
+)
+
+// ConfigureRecordingEvents stores the reactions and events of every stream that is recorded, so a replay can show them
+// in sync with the media
+func ConfigureRecordingEvents(pool *pgxpool.Pool) {
+	recordingEventsPool = pool
+
+	events.Subscribe(func(e events.Event) {
+		switch {
+		case e.Type == events.Autostart:
+			if rule, ok := e.Data.(autostart.Rule); ok && rule.Action == autostart.ActionRecord {
+				recordedStreamsLock.Lock()
+				recordedStreams[e.StreamKey] = true
+				recordedStreamsLock.Unlock()
+			}
+		case e.Type == events.StreamEnd:
+			recordedStreamsLock.Lock()
+			delete(recordedStreams, e.StreamKey)
+			recordedStreamsLock.Unlock()
+		case slices.Contains(recordedEventTypes, e.Type):
+			logRecordingEvent(e.StreamKey, e.Type, e.Time, e.Data)
+		}
+	})
+}
+
+// logRecordingEvent stores an event of a stream if it is recorded. Must not be called with streamMapLock held.
+func logRecordingEvent(streamKey, eventType string, at time.Time, data any) {
+	recordedStreamsLock.Lock()
+	recorded := recordedStreams[streamKey]
+	recordedStreamsLock.Unlock()
+	if !recorded || recordingEventsPool == nil {
+		return
+	}
+
+	streamStartedAt, mediaTime, err := CurrentMediaTime(streamKey)
+	if err != nil {
+		return
+	}
+	mediaTime = max(0, mediaTime-time.Since(at).Milliseconds())
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), recordingEventSaveTimeout)
+		defer cancel()
+
+		query := `INSERT INTO recording_events (stream_key, stream_started_at, media_time, type, data)
+			 VALUES (@streamKey, to_timestamp(@streamStartedAt), @mediaTime, @type, @data)`
+		if _, err := recordingEventsPool.Exec(ctx, query, pgx.NamedArgs{
+			"streamKey":       streamKey,
+			"streamStartedAt": streamStartedAt,
+			"mediaTime":       mediaTime,
+			"type":            eventType,
+			"data":            encoded,
+		}); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// GetRecordingEvents returns the events of the broadcast of streamKey that started at streamStartedAt (Unix seconds),
+// ordered by media time. If streamStartedAt is zero the latest recorded broadcast is used.
+func GetRecordingEvents(pool *pgxpool.Pool, ctx context.Context, streamKey string, streamStartedAt uint64) ([]RecordingEvent, error) {
+	query := `SELECT type, media_time, data, created_at FROM recording_events
+		 WHERE stream_key = @streamKey
+		 AND stream_started_at = COALESCE(to_timestamp(NULLIF(@streamStartedAt, 0)),
+		     (SELECT max(stream_started_at) FROM recording_events WHERE stream_key = @streamKey))
+		 ORDER BY media_time, id`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
+		"streamKey":       streamKey,
+		"streamStartedAt": int64(streamStartedAt),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (RecordingEvent, error) {
+		var e RecordingEvent
+		err := row.Scan(&e.Type, &e.MediaTime, &e.Data, &e.CreatedAt)
+		return e, err
+	})
+}
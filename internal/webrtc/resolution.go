@@ -0,0 +1,314 @@
+package webrtc
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+var errSPSTruncated = errors.New("SPS is truncated")
+
+// newResolutionDepacketizer returns a depacketizer used only for reading the
+// resolution out of keyframes. It is separate from the keyframe detector so
+// partial FU-A state isn't shared.
+func newResolutionDepacketizer(codec videoTrackCodec) rtp.Depacketizer {
+	switch codec {
+	case videoTrackCodecH264:
+		return &codecs.H264Packet{}
+	case videoTrackCodecVP8:
+		return &codecs.VP8Packet{}
+	}
+
+	return nil
+}
+
+// keyframeResolution returns the width and height announced by a keyframe.
+// This is only implemented for H264 (via the SPS) and VP8.
+func keyframeResolution(pkt *rtp.Packet, codec videoTrackCodec, depacketizer rtp.Depacketizer) (int, int, bool) {
+	if depacketizer == nil {
+		return 0, 0, false
+	}
+
+	payload, err := depacketizer.Unmarshal(pkt.Payload)
+	if err != nil || len(payload) == 0 {
+		return 0, 0, false
+	}
+
+	switch codec {
+	case videoTrackCodecH264:
+		for _, nalu := range bytes.Split(payload, []byte{0x00, 0x00, 0x01}) {
+			nalu = bytes.TrimRight(nalu, "\x00")
+			if len(nalu) == 0 || nalu[0]&naluTypeBitmask != spsNALUType {
+				continue
+			}
+
+			if width, height, err := parseH264SPSResolution(nalu[1:]); err == nil {
+				return width, height, true
+			}
+		}
+	case videoTrackCodecVP8:
+		vp8Packet, ok := depacketizer.(*codecs.VP8Packet)
+		if !ok || vp8Packet.S != 1 || vp8Packet.PID != 0 {
+			return 0, 0, false
+		}
+
+		// Keyframes have the inverse key frame bit set, followed by the 3 byte start code
+		if len(payload) < 10 || payload[0]&0x01 != 0 || !bytes.Equal(payload[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, false
+		}
+
+		width := int(payload[6]) | int(payload[7]&0x3f)<<8
+		height := int(payload[8]) | int(payload[9]&0x3f)<<8
+		return width, height, true
+	}
+
+	return 0, 0, false
+}
+
+type bitReader struct {
+	data   []byte
+	offset int
+}
+
+func (b *bitReader) readBit() (uint, error) {
+	if b.offset/8 >= len(b.data) {
+		return 0, errSPSTruncated
+	}
+
+	bit := uint(b.data[b.offset/8]>>(7-b.offset%8)) & 0x01
+	b.offset++
+	return bit, nil
+}
+
+func (b *bitReader) readBits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		bit, err := b.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | bit
+	}
+
+	return v, nil
+}
+
+// readUE reads an unsigned Exp-Golomb code
+func (b *bitReader) readUE() (uint, error) {
+	leadingZeros := 0
+	for {
+		bit, err := b.readBit()
+		if err != nil {
+			return 0, err
+		}
+
+		if bit == 1 {
+			break
+		}
+
+		leadingZeros++
+		if leadingZeros > 31 {
+			return 0, errSPSTruncated
+		}
+	}
+
+	v, err := b.readBits(leadingZeros)
+	return (1 << leadingZeros) - 1 + v, err
+}
+
+func (b *bitReader) skipUE(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := b.readUE(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseH264SPSResolution reads the frame size from a H264 SPS without the NALU header.
+// See ITU-T H.264 7.3.2.1.1
+func parseH264SPSResolution(sps []byte) (int, int, error) {
+	// Remove emulation prevention bytes
+	sps = bytes.ReplaceAll(sps, []byte{0x00, 0x00, 0x03}, []byte{0x00, 0x00})
+	if len(sps) < 3 {
+		return 0, 0, errSPSTruncated
+	}
+
+	profileIDC := sps[0]
+	b := &bitReader{data: sps[3:]}
+
+	if err := b.skipUE(1); err != nil { // seq_parameter_set_id
+		return 0, 0, err
+	}
+
+	chromaFormatIDC := uint(1)
+	switch profileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		var err error
+		if chromaFormatIDC, err = b.readUE(); err != nil {
+			return 0, 0, err
+		}
+
+		if chromaFormatIDC == 3 {
+			if _, err = b.readBit(); err != nil { // separate_colour_plane_flag
+				return 0, 0, err
+			}
+		}
+
+		if err = b.skipUE(2); err != nil { // bit_depth_luma_minus8, bit_depth_chroma_minus8
+			return 0, 0, err
+		}
+
+		if _, err = b.readBit(); err != nil { // qpprime_y_zero_transform_bypass_flag
+			return 0, 0, err
+		}
+
+		scalingMatrixPresent, err := b.readBit()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if scalingMatrixPresent == 1 {
+			scalingLists := 8
+			if chromaFormatIDC == 3 {
+				scalingLists = 12
+			}
+
+			for i := 0; i < scalingLists; i++ {
+				present, err := b.readBit()
+				if err != nil {
+					return 0, 0, err
+				}
+
+				if present == 0 {
+					continue
+				}
+
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+
+				lastScale, nextScale := 8, 8
+				for j := 0; j < size; j++ {
+					if nextScale != 0 {
+						v, err := b.readUE()
+						if err != nil {
+							return 0, 0, err
+						}
+
+						// se(v) mapping of the delta_scale
+						deltaScale := int(v+1) / 2
+						if v%2 == 0 {
+							deltaScale = -deltaScale
+						}
+						nextScale = (lastScale + deltaScale + 256) % 256
+					}
+
+					if nextScale != 0 {
+						lastScale = nextScale
+					}
+				}
+			}
+		}
+	}
+
+	if err := b.skipUE(1); err != nil { // log2_max_frame_num_minus4
+		return 0, 0, err
+	}
+
+	picOrderCntType, err := b.readUE()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch picOrderCntType {
+	case 0:
+		if err = b.skipUE(1); err != nil { // log2_max_pic_order_cnt_lsb_minus4
+			return 0, 0, err
+		}
+	case 1:
+		if _, err = b.readBit(); err != nil { // delta_pic_order_always_zero_flag
+			return 0, 0, err
+		}
+
+		if err = b.skipUE(2); err != nil { // offset_for_non_ref_pic, offset_for_top_to_bottom_field
+			return 0, 0, err
+		}
+
+		cycleLength, err := b.readUE()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if err = b.skipUE(int(cycleLength)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err = b.skipUE(1); err != nil { // max_num_ref_frames
+		return 0, 0, err
+	}
+
+	if _, err = b.readBit(); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return 0, 0, err
+	}
+
+	widthInMbsMinus1, err := b.readUE()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	heightInMapUnitsMinus1, err := b.readUE()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	frameMbsOnly, err := b.readBit()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if frameMbsOnly == 0 {
+		if _, err = b.readBit(); err != nil { // mb_adaptive_frame_field_flag
+			return 0, 0, err
+		}
+	}
+
+	if _, err = b.readBit(); err != nil { // direct_8x8_inference_flag
+		return 0, 0, err
+	}
+
+	width := int(widthInMbsMinus1+1) * 16
+	height := int(2-frameMbsOnly) * int(heightInMapUnitsMinus1+1) * 16
+
+	frameCropping, err := b.readBit()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if frameCropping == 1 {
+		var crop [4]uint
+		for i := range crop {
+			if crop[i], err = b.readUE(); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		cropUnitX, cropUnitY := 1, int(2-frameMbsOnly)
+		if chromaFormatIDC == 1 || chromaFormatIDC == 2 {
+			cropUnitX = 2
+		}
+		if chromaFormatIDC == 1 {
+			cropUnitY *= 2
+		}
+
+		width -= int(crop[0]+crop[1]) * cropUnitX
+		height -= int(crop[2]+crop[3]) * cropUnitY
+	}
+
+	return width, height, nil
+}
@@ -0,0 +1,148 @@
+package webrtc
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v4"
+)
+
+type (
+	// StreamResourceUsage is what the sessions of a stream hold on to
+	StreamResourceUsage struct {
+		StreamKey       string `json:"streamKey"`
+		PeerConnections int    `json:"peerConnections"`
+		// Host candidates of all PeerConnections. Each holds its own socket unless UDP_MUX_PORT or
+		// TCP_MUX_ADDRESS share one between sessions.
+		Sockets int `json:"sockets"`
+		// Goroutines of Broadcast Box forwarding media or RTCP for the stream, pion's own are not included
+		Goroutines int64 `json:"goroutines"`
+	}
+
+	// ResourceUsage of this instance, used to find sessions that were not cleaned up
+	ResourceUsage struct {
+		// PeerConnections that were created and not closed yet
+		PeerConnections int `json:"peerConnections"`
+		Goroutines      int `json:"goroutines"`
+		// Open sockets of the process, -1 where /proc is not available
+		OpenSockets int `json:"openSockets"`
+		// PeerConnections that were closed but whose goroutines have not ended yet
+		ClosingPeerConnections int64                 `json:"closingPeerConnections"`
+		Streams                []StreamResourceUsage `json:"streams"`
+	}
+)
+
+var (
+	openPeerConnections    sync.Map
+	closingPeerConnections atomic.Int64
+)
+
+// closePeerConnection closes peerConnection in the background. Safe to call from PeerConnection callbacks.
+func closePeerConnection(peerConnection *webrtc.PeerConnection) {
+	go func() {
+		if err := closePeerConnectionAndWait(peerConnection); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// closePeerConnectionAndWait closes peerConnection and waits until every goroutine pion started for it
+// has ended, which is when its sockets are released
+func closePeerConnectionAndWait(peerConnection *webrtc.PeerConnection) error {
+	if _, open := openPeerConnections.LoadAndDelete(peerConnection); open {
+		closingPeerConnections.Add(1)
+		defer closingPeerConnections.Add(-1)
+	}
+
+	return peerConnection.GracefulClose()
+}
+
+// trackGoroutine counts a goroutine working for the stream. Call the returned func when it ends.
+func (s *stream) trackGoroutine() func() {
+	s.goroutines.Add(1)
+	return func() {
+		s.goroutines.Add(-1)
+	}
+}
+
+// GetResourceUsage returns the goroutines and sockets of this instance and of each stream
+func GetResourceUsage() ResourceUsage {
+	type streamPeerConnections struct {
+		usage           StreamResourceUsage
+		peerConnections []*webrtc.PeerConnection
+	}
+
+	streamMapLock.Lock()
+	streams := make([]streamPeerConnections, 0, len(streamMap))
+	for streamKey, s := range streamMap {
+		peerConnections := []*webrtc.PeerConnection{}
+		if s.whipPeerConnection != nil {
+			peerConnections = append(peerConnections, s.whipPeerConnection)
+		}
+		if s.guest != nil {
+			peerConnections = append(peerConnections, s.guest.peerConnection)
+		}
+
+		Sessions.eachViewer(s, func(_ string, whepSession *whepSession) {
+			peerConnections = append(peerConnections, whepSession.peerConnection)
+		})
+
+		streams = append(streams, streamPeerConnections{
+			usage:           StreamResourceUsage{StreamKey: streamKey, PeerConnections: len(peerConnections), Goroutines: s.goroutines.Load()},
+			peerConnections: peerConnections,
+		})
+	}
+	streamMapLock.Unlock()
+
+	// Stats are collected without holding streamMapLock, pion takes its own locks
+	usage := ResourceUsage{
+		Goroutines:             runtime.NumGoroutine(),
+		OpenSockets:            openSockets(),
+		ClosingPeerConnections: closingPeerConnections.Load(),
+		Streams:                make([]StreamResourceUsage, 0, len(streams)),
+	}
+	openPeerConnections.Range(func(_, _ any) bool {
+		usage.PeerConnections++
+		return true
+	})
+	for _, s := range streams {
+		for _, peerConnection := range s.peerConnections {
+			s.usage.Sockets += hostCandidates(peerConnection)
+		}
+		usage.Streams = append(usage.Streams, s.usage)
+	}
+
+	return usage
+}
+
+func hostCandidates(peerConnection *webrtc.PeerConnection) (count int) {
+	for _, stats := range peerConnection.GetStats() {
+		if candidate, ok := stats.(webrtc.ICECandidateStats); ok &&
+			candidate.Type == webrtc.StatsTypeLocalCandidate && candidate.CandidateType == webrtc.ICECandidateTypeHost {
+			count++
+		}
+	}
+
+	return count
+}
+
+func openSockets() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+
+	count := 0
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); err == nil && strings.HasPrefix(target, "socket:") {
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,147 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Viewers can resume a WHEP session this long after it ended
+const defaultResumeWindow = 30 * time.Second
+
+var ErrResumeTokenInvalid = errors.New("Resume token is invalid or expired")
+
+// resumableSession is what a viewer reconnecting with a resume token continues from
+type resumableSession struct {
+	streamKey     string
+	whepSessionId string
+	session       *whepSession
+	createdAt     time.Time
+
+	// Zero while the session is still connected
+	expiresAt time.Time
+}
+
+var (
+	resumeWindow = defaultResumeWindow
+
+	resumableSessions     = map[string]*resumableSession{}
+	resumableSessionsLock sync.Mutex
+)
+
+func configureResume() (err error) {
+	if os.Getenv("WHEP_RESUME_WINDOW") != "" {
+		resumeWindow, err = timeoutFromEnv("WHEP_RESUME_WINDOW")
+	}
+	return err
+}
+
+// IssueResumeToken returns a token the viewer of a WHEP session can reconnect with after a network switch.
+// An empty token is returned if resuming is disabled or the session does not exist.
+func IssueResumeToken(whepSessionId string) string {
+	if resumeWindow == 0 {
+		return ""
+	}
+
+	streamMapLock.Lock()
+	streamKey, session, ok := getWHEPSession(whepSessionId)
+	streamMapLock.Unlock()
+	if !ok {
+		return ""
+	}
+
+	createdAt := time.Now()
+	if info, ok := Sessions.get(whepSessionId); ok {
+		createdAt = info.CreatedAt
+	}
+
+	resumeToken := uuid.New().String()
+	now := time.Now()
+
+	resumableSessionsLock.Lock()
+	defer resumableSessionsLock.Unlock()
+
+	for token, r := range resumableSessions {
+		if !r.expiresAt.IsZero() && now.After(r.expiresAt) {
+			delete(resumableSessions, token)
+		}
+	}
+
+	resumableSessions[resumeToken] = &resumableSession{
+		streamKey:     streamKey,
+		whepSessionId: whepSessionId,
+		session:       session,
+		createdAt:     createdAt,
+	}
+	return resumeToken
+}
+
+// CanResumeWHEP reports if resumeToken can still resume a session of streamKey. Viewers that can resume
+// were already authorized for the stream.
+func CanResumeWHEP(resumeToken, streamKey string) bool {
+	resumableSessionsLock.Lock()
+	defer resumableSessionsLock.Unlock()
+
+	r, ok := resumableSessions[resumeToken]
+	return ok && r.streamKey == streamKey && (r.expiresAt.IsZero() || time.Now().Before(r.expiresAt))
+}
+
+// WHEPResume starts playback for a viewer that reconnects with a resume token. The layer selection and
+// playout delay of the previous session are restored and its stats continue. If the previous session is
+// still connected, it is closed first so it doesn't count against the viewer limit.
+func WHEPResume(ctx context.Context, offer, resumeToken string) (answer string, whepSessionId string, err error) {
+	resumableSessionsLock.Lock()
+	r, ok := resumableSessions[resumeToken]
+	delete(resumableSessions, resumeToken)
+	resumableSessionsLock.Unlock()
+
+	if !ok || (!r.expiresAt.IsZero() && time.Now().After(r.expiresAt)) {
+		return "", "", ErrResumeTokenInvalid
+	}
+
+	streamMapLock.Lock()
+	streamKey, previous, ok := getWHEPSession(r.whepSessionId)
+	streamMapLock.Unlock()
+
+	// The previous PeerConnection is usually stuck in disconnected, the viewer left it behind
+	if ok {
+		closePeerConnection(previous.peerConnection)
+		peerConnectionDisconnected(streamKey, r.whepSessionId)
+	}
+
+	return whep(ctx, offer, r.streamKey, r)
+}
+
+// expireResumeTokens starts the resume window of a WHEP session that ended
+func expireResumeTokens(whepSessionId string) {
+	resumableSessionsLock.Lock()
+	defer resumableSessionsLock.Unlock()
+
+	for _, r := range resumableSessions {
+		if r.whepSessionId == whepSessionId && r.expiresAt.IsZero() {
+			r.expiresAt = time.Now().Add(resumeWindow)
+		}
+	}
+}
+
+// resumeFrom restores what the viewer had selected in the previous session. Must be called before the
+// session receives media.
+func (w *whepSession) resumeFrom(previous *whepSession) {
+	if layer, _ := previous.currentLayer.Load().(string); layer != "" {
+		w.currentLayer.Store(layer)
+		w.waitingForKeyframe.Store(true)
+	}
+	if layer, _ := previous.audioLayer.Load().(string); layer != "" {
+		w.audioLayer.Store(layer)
+	}
+
+	w.layerHint.Store(previous.layerHint.Load())
+	w.playoutDelay.Store(previous.playoutDelay.Load())
+	w.playoutDelayExt.Store(previous.playoutDelayExt.Load())
+	w.receiverReport.Store(previous.receiverReport.Load())
+	w.packetsWritten = previous.packetsWritten
+}
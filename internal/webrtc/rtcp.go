@@ -0,0 +1,206 @@
+package webrtc
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const senderReportInterval = time.Second
+
+type (
+	// senderReportSource maps the RTP timestamps of a publisher track to the publisher's NTP clock. Tracks of
+	// the same publisher share that clock, which is what lets viewers synchronize audio and video.
+	senderReportSource struct {
+		mu         sync.Mutex
+		clockRate  uint32
+		ntpTime    uint64
+		rtpTime    uint32
+		receivedAt time.Time
+	}
+
+	// outgoingTrackStats is what a viewer needs in its sender reports for one outgoing track
+	outgoingTrackStats struct {
+		mu              sync.Mutex
+		packets, octets uint32
+		source          *senderReportSource
+		sourceTimestamp uint32
+		timestamp       uint32
+	}
+
+	// viewerReceiverReport is the latest receiver report a viewer sent for its video
+	viewerReceiverReport struct {
+		// Percent of packets lost since the previous report
+		FractionLost float64
+		TotalLost    uint32
+		// Interarrival jitter in milliseconds
+		Jitter float64
+	}
+)
+
+// update records a sender report of the publisher
+func (s *senderReportSource) update(sr *rtcp.SenderReport, clockRate uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clockRate, s.ntpTime, s.rtpTime, s.receivedAt = clockRate, sr.NTPTime, sr.RTPTime, time.Now()
+}
+
+// onPacket records a packet forwarded from source, sourceTimestamp is its timestamp as the publisher sent it
+func (o *outgoingTrackStats) onPacket(source *senderReportSource, sourceTimestamp, timestamp uint32, payloadSize int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.packets++
+	o.octets += uint32(payloadSize)
+	o.source, o.sourceTimestamp, o.timestamp = source, sourceTimestamp, timestamp
+}
+
+// senderReport maps the latest sender report of the publisher onto the timestamps of this outgoing
+// track, extrapolated to now. It returns nil until the publisher sent a sender report.
+func (o *outgoingTrackStats) senderReport(ssrc uint32, now time.Time) *rtcp.SenderReport {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.source == nil || ssrc == 0 {
+		return nil
+	}
+
+	o.source.mu.Lock()
+	defer o.source.mu.Unlock()
+
+	if o.source.receivedAt.IsZero() {
+		return nil
+	}
+
+	elapsed := now.Sub(o.source.receivedAt)
+	return &rtcp.SenderReport{
+		SSRC:        ssrc,
+		NTPTime:     o.source.ntpTime + durationToNTP(elapsed),
+		RTPTime:     o.source.rtpTime + (o.timestamp - o.sourceTimestamp) + uint32(elapsed.Seconds()*float64(o.source.clockRate)),
+		PacketCount: o.packets,
+		OctetCount:  o.octets,
+	}
+}
+
+func durationToNTP(d time.Duration) uint64 {
+	seconds := uint64(d / time.Second)
+	fraction := uint64(d%time.Second) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// readSenderReports reads the RTCP the publisher sends for a track until the track ends. rid is empty
+// for tracks without simulcast.
+func (s *stream) readSenderReports(rtpReceiver *webrtc.RTPReceiver, remoteTrack *webrtc.TrackRemote, source *senderReportSource) {
+	defer s.trackGoroutine()()
+
+	for {
+		var (
+			packets []rtcp.Packet
+			err     error
+		)
+		if rid := remoteTrack.RID(); rid != "" {
+			packets, _, err = rtpReceiver.ReadSimulcastRTCP(rid)
+		} else {
+			packets, _, err = rtpReceiver.ReadRTCP()
+		}
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			if sr, ok := packet.(*rtcp.SenderReport); ok && sr.SSRC == uint32(remoteTrack.SSRC()) {
+				source.update(sr, remoteTrack.Codec().ClockRate)
+			}
+		}
+	}
+}
+
+// sendSenderReports sends sender reports for the tracks of a viewer until its PeerConnection is closed
+func (w *whepSession) sendSenderReports(s *stream) {
+	defer s.trackGoroutine()()
+
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if w.peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+
+		packets := []rtcp.Packet{}
+		for _, sr := range []*rtcp.SenderReport{
+			w.videoStats.senderReport(uint32(w.videoTrack.ssrc), now),
+			w.audioStats.senderReport(w.audioSSRC, now),
+			w.guestVideoStats.senderReport(uint32(w.guestVideoTrack.ssrc), now),
+			w.guestAudioStats.senderReport(w.guestAudioSSRC, now),
+		} {
+			if sr != nil {
+				packets = append(packets, sr)
+			}
+		}
+
+		if len(packets) == 0 {
+			continue
+		}
+
+		if err := w.peerConnection.WriteRTCP(packets); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				log.Println(err)
+			}
+			return
+		}
+	}
+}
+
+// onReceiverReport keeps the report the viewer sent about its video
+func (w *whepSession) onReceiverReport(rr *rtcp.ReceiverReport) {
+	for _, report := range rr.Reports {
+		if report.SSRC != uint32(w.videoTrack.ssrc) {
+			continue
+		}
+
+		w.receiverReport.Store(&viewerReceiverReport{
+			FractionLost: float64(report.FractionLost) * 100 / 256,
+			TotalLost:    report.TotalLost,
+			Jitter:       float64(report.Jitter) * 1000 / 90000,
+		})
+	}
+}
+
+// sendGoodbye tells the viewer that the given tracks end, so players stop waiting for their media
+func (w *whepSession) sendGoodbye(guest bool, reason string) {
+	ssrcs := []uint32{uint32(w.videoTrack.ssrc), w.audioSSRC}
+	if guest {
+		ssrcs = []uint32{uint32(w.guestVideoTrack.ssrc), w.guestAudioSSRC}
+	}
+
+	// Tracks the viewer did not negotiate have no SSRC
+	sources := []uint32{}
+	for _, ssrc := range ssrcs {
+		if ssrc != 0 {
+			sources = append(sources, ssrc)
+		}
+	}
+	if len(sources) == 0 {
+		return
+	}
+
+	if err := w.peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.Goodbye{Sources: sources, Reason: reason}}); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		log.Println(err)
+	}
+}
+
+// sendGoodbye tells every viewer the publisher's tracks ended. Must be called with whepSessionsLock held.
+func (s *stream) sendGoodbye(guest bool, reason string) {
+	for _, whepSession := range s.whepSessions {
+		if whepSession.peerConnection != nil {
+			go whepSession.sendGoodbye(guest, reason)
+		}
+	}
+}
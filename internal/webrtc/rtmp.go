@@ -0,0 +1,249 @@
+package webrtc
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	rtmpClockRate = 90000
+	rtmpMTU       = 1200
+)
+
+// RTMPPublisher feeds the H264 of a publisher using RTMP into its stream. Viewers, outputs and the keyframe cache get
+// it the same way as the video of a WHIP publisher.
+type RTMPPublisher struct {
+	stream    *stream
+	streamKey string
+	sessionId string
+	conn      io.Closer
+
+	ctx    context.Context
+	cancel func()
+
+	track                                *videoTrack
+	payloader                            codecs.H264Payloader
+	depacketizer, resolutionDepacketizer rtp.Depacketizer
+	sequenceNumber                       uint16
+
+	lastTimestamp    uint32
+	lastTimestampSet bool
+
+	// While muted frames are skipped, viewers continue where they left off with timestamps that advanced
+	muted         bool
+	mutedTimeDiff int64
+
+	bitrateWindowStart time.Time
+	bitrateWindowBytes int
+	quota              uint64
+	quotaEvent         events.Event
+}
+
+// RTMP starts publishing the stream of streamer from an RTMP connection. Like WHIP it is rejected if the stream is
+// already live, RTMP publishers can't take over. conn is closed when the publisher is ended by WHIPDelete, a WHIP
+// takeover or an evacuation, and Close must be called once the connection is gone.
+func RTMP(streamer *Streamer, conn io.Closer) (*RTMPPublisher, error) {
+	p, err := startRTMP(streamer, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.track, err = addTrack(p.stream, videoTrackLabelDefault); err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.track.mimeType.Store(webrtc.MimeTypeH264)
+
+	// RTMP can't ask the encoder for a keyframe, viewers that need one wait for the next
+	go func() {
+		defer p.stream.trackGoroutine()()
+
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-p.stream.pliChan:
+			case <-p.track.pliChan:
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+func startRTMP(streamer *Streamer, conn io.Closer) (*RTMPPublisher, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	if Draining() {
+		return nil, ErrDraining
+	} else if bandwidthTestStreamKey != "" && streamer.StreamKey == bandwidthTestStreamKey {
+		return nil, ErrReservedStreamKey
+	}
+
+	if existing, ok := streamMap[streamer.StreamKey]; ok && existing.hasWHIPClient.Load() {
+		return nil, ErrStreamAlreadyLive
+	}
+
+	if err := checkTenantStreamLimit(streamer); err != nil {
+		return nil, err
+	}
+
+	stream, err := getStream(streamer, streamer.StreamKey, true)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionId := Sessions.begin("", SessionRTMP, streamer.StreamKey)
+	stream.publishStartedAt = time.Now()
+	stream.bytesReceived.Store(0)
+	stream.videoPacketsSkipped.Store(0)
+	stream.whepSessionsLock.RLock()
+	stream.peakViewers = len(stream.whepSessions)
+	stream.whepSessionsLock.RUnlock()
+	stream.viewerDevices = ViewerDevices{}
+	stream.rtmpConn = conn
+	stream.whipSessionId = sessionId
+	stream.timeline.newSession()
+	stream.lastMediaReceived.Store(time.Now().UnixNano())
+	stream.reportedState = StreamStateOnline
+	Sessions.setLive(sessionId)
+
+	events.Publish(events.Event{Type: events.StreamStart, StreamKey: streamer.StreamKey, Streamer: streamer.Name, Tenant: stream.tenant()})
+	checkTenantStreamQuotaWarning(streamer)
+
+	ctx, cancel := context.WithCancel(stream.whipActiveContext)
+	return &RTMPPublisher{
+		stream:                 stream,
+		streamKey:              streamer.StreamKey,
+		sessionId:              sessionId,
+		conn:                   conn,
+		ctx:                    ctx,
+		cancel:                 cancel,
+		depacketizer:           newKeyframeDepacketizer(videoTrackCodecH264),
+		resolutionDepacketizer: newResolutionDepacketizer(videoTrackCodecH264),
+		bitrateWindowStart:     time.Now(),
+		quota:                  streamer.MaxBitrate,
+		quotaEvent:             events.Event{StreamKey: streamer.StreamKey, Streamer: streamer.Name, Tenant: stream.tenant()},
+	}, nil
+}
+
+// WriteH264 forwards an access unit, its NALUs without start codes, that is presented at pts. An error means the
+// publisher was ended and the connection should be closed.
+func (p *RTMPPublisher) WriteH264(nalus [][]byte, pts time.Duration) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+
+	accessUnit := []byte{}
+	for _, nalu := range nalus {
+		accessUnit = append(accessUnit, 0x00, 0x00, 0x00, 0x01)
+		accessUnit = append(accessUnit, nalu...)
+	}
+
+	p.stream.bytesReceived.Add(uint64(len(accessUnit)))
+	p.stream.lastMediaReceived.Store(time.Now().UnixNano())
+
+	layerChanged := false
+	p.bitrateWindowBytes += len(accessUnit)
+	if elapsed := time.Since(p.bitrateWindowStart); elapsed >= time.Second {
+		layerChanged = p.track.bitrate.Load() == 0
+		p.track.bitrate.Store(uint64(float64(p.bitrateWindowBytes*8) / elapsed.Seconds()))
+		p.bitrateWindowStart, p.bitrateWindowBytes = time.Now(), 0
+
+		checkQuotaWarning(p.quotaEvent, p.streamKey+"/"+videoTrackLabelDefault, QuotaWarning{Quota: QuotaBitrate, Layer: videoTrackLabelDefault, Usage: p.track.bitrate.Load(), Limit: p.quota})
+	}
+
+	timestamp := uint32(pts.Milliseconds() * rtmpClockRate / 1000)
+	timeDiff := int64(int32(timestamp - p.lastTimestamp))
+	if !p.lastTimestampSet {
+		timeDiff, p.lastTimestampSet = 0, true
+	}
+	p.lastTimestamp = timestamp
+	p.track.clock.update(timestamp, timeDiff, rtmpClockRate)
+
+	if p.stream.videoMuted.Load() {
+		p.muted, p.mutedTimeDiff = true, p.mutedTimeDiff+timeDiff
+		return nil
+	} else if p.muted {
+		p.muted, timeDiff, p.mutedTimeDiff = false, timeDiff+p.mutedTimeDiff, 0
+	}
+
+	payloads := p.payloader.Payload(rtmpMTU, accessUnit)
+	for i, payload := range payloads {
+		p.sequenceNumber++
+		rtpPkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: p.sequenceNumber,
+				Timestamp:      timestamp,
+			},
+			Payload: payload,
+		}
+		p.track.packetsReceived.Add(1)
+
+		isKeyframe := isKeyframe(rtpPkt, videoTrackCodecH264, p.depacketizer)
+		if isKeyframe {
+			p.track.lastKeyFrameSeen.Store(time.Now())
+
+			if width, height, ok := keyframeResolution(rtpPkt, videoTrackCodecH264, p.resolutionDepacketizer); ok &&
+				(uint32(width) != p.track.width.Load() || uint32(height) != p.track.height.Load()) {
+				previousWidth, previousHeight := int(p.track.width.Load()), int(p.track.height.Load())
+				p.track.width.Store(uint32(width))
+				p.track.height.Store(uint32(height))
+				layerChanged = true
+
+				if previousWidth != 0 {
+					p.stream.publishMediaChange(p.streamKey, mediaChange{
+						Layer: videoTrackLabelDefault, MimeType: webrtc.MimeTypeH264, Width: width, Height: height,
+						PreviousWidth: previousWidth, PreviousHeight: previousHeight,
+					})
+				}
+			}
+		}
+
+		if layerChanged {
+			streamMapLock.Lock()
+			p.stream.onLayersChanged()
+			streamMapLock.Unlock()
+			layerChanged = false
+		}
+
+		// Only the first packet of the access unit advances the timestamp
+		packetTimeDiff := int64(0)
+		if i == 0 {
+			packetTimeDiff = timeDiff
+		}
+
+		p.stream.sendToOutputs(rtpPkt, true, webrtc.MimeTypeH264, videoTrackLabelDefault, &p.track.timeline, &p.track.senderReports, rtmpClockRate, isKeyframe)
+
+		p.stream.whepSessionsLock.RLock()
+		p.track.keyframeCache.push(rtpPkt, packetTimeDiff, 1, videoTrackCodecH264, isKeyframe)
+		for _, whepSession := range p.stream.whepSessions {
+			whepSession.sendVideoPacket(rtpPkt, &p.track.senderReports, videoTrackLabelDefault, packetTimeDiff, 1, videoTrackCodecH264, isKeyframe)
+		}
+		p.stream.whepSessionsLock.RUnlock()
+	}
+
+	return nil
+}
+
+// Close ends the stream once the RTMP connection is gone, unless the publisher was replaced by then
+func (p *RTMPPublisher) Close() {
+	p.cancel()
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	if stream, ok := streamMap[p.streamKey]; ok && stream.rtmpConn == p.conn {
+		removeSession(p.streamKey, "")
+	}
+	Sessions.setState(p.sessionId, SessionClosed)
+}
@@ -0,0 +1,40 @@
+package webrtc
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// rtpRewriter keeps sequence numbers and timestamps of a outgoing track continuous while
+// the source it forwards changes (like switching audio layers or a guest reconnecting)
+type rtpRewriter struct {
+	mu sync.Mutex
+
+	source                             string
+	sequenceNumber, lastSequenceNumber uint16
+	timestamp, lastTimestamp           uint32
+}
+
+// rewrite updates rtpPkt in place. sequenceNumber and timestamp are the values as received from
+// source, switchGap is how far the timestamp advances when the source changes.
+func (r *rtpRewriter) rewrite(rtpPkt *rtp.Packet, source string, sequenceNumber uint16, timestamp, switchGap uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case r.source == "":
+		r.sequenceNumber, r.timestamp = sequenceNumber, timestamp
+	case r.source != source:
+		r.sequenceNumber++
+		r.timestamp += switchGap
+	default:
+		r.sequenceNumber += sequenceNumber - r.lastSequenceNumber
+		r.timestamp += timestamp - r.lastTimestamp
+	}
+	r.source = source
+	r.lastSequenceNumber, r.lastTimestamp = sequenceNumber, timestamp
+
+	rtpPkt.SequenceNumber = r.sequenceNumber
+	rtpPkt.Timestamp = r.timestamp
+}
@@ -0,0 +1,225 @@
+package webrtc
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SessionState is where a session is in its lifecycle. Sessions move from negotiating to live, may be
+// draining while the server drains, and end up closed.
+type SessionState string
+
+const (
+	SessionNegotiating SessionState = "negotiating"
+	SessionLive        SessionState = "live"
+	SessionDraining    SessionState = "draining"
+	SessionClosed      SessionState = "closed"
+)
+
+// SessionKind tells publishers, co-hosts and viewers apart
+type SessionKind string
+
+const (
+	SessionWHIP   SessionKind = "whip"
+	SessionRTMP   SessionKind = "rtmp"
+	SessionCohost SessionKind = "cohost"
+	SessionWHEP   SessionKind = "whep"
+)
+
+// SessionInfo describes a session for introspection and state change hooks
+type SessionInfo struct {
+	ID             string       `json:"id"`
+	Kind           SessionKind  `json:"kind"`
+	StreamKey      string       `json:"streamKey"`
+	State          SessionState `json:"state"`
+	CreatedAt      time.Time    `json:"createdAt"`
+	StateChangedAt time.Time    `json:"stateChangedAt"`
+	// Session a viewer resumed with a resume token, CreatedAt is carried over from it
+	ResumedFrom string `json:"resumedFrom,omitempty"`
+}
+
+// SessionManager owns the lifecycle state of every WHIP, co-host and WHEP session of this instance. WHEP sessions
+// join and leave the viewers of their stream through it, and viewers are counted and visited through it. Only the
+// media fan-out of a publisher reads the viewers of a stream directly, it runs for every packet.
+type SessionManager struct {
+	lock     sync.Mutex
+	sessions map[string]*SessionInfo
+	hooks    []func(SessionInfo)
+}
+
+// Sessions is the SessionManager of this instance
+var Sessions = &SessionManager{sessions: map[string]*SessionInfo{}}
+
+// OnStateChange registers hook to be called whenever a session changes state. Hooks are called in order
+// of the changes and must not block or call back into the webrtc package.
+func (m *SessionManager) OnStateChange(hook func(SessionInfo)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.hooks = append(m.hooks, hook)
+}
+
+// List returns every session that isn't closed yet, oldest first
+func (m *SessionManager) List() []SessionInfo {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+
+	return sessions
+}
+
+// get returns the session with id if it isn't closed yet
+func (m *SessionManager) get(id string) (SessionInfo, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return SessionInfo{}, false
+	}
+
+	return *session, true
+}
+
+// Count returns how many sessions of kind are live or draining
+func (m *SessionManager) Count(kind SessionKind) (count int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, session := range m.sessions {
+		if session.Kind == kind && (session.State == SessionLive || session.State == SessionDraining) {
+			count++
+		}
+	}
+
+	return
+}
+
+// begin tracks a new session that is negotiating. An ID is generated if id is empty.
+func (m *SessionManager) begin(id string, kind SessionKind, streamKey string) string {
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	now := time.Now()
+	m.lock.Lock()
+	m.sessions[id] = &SessionInfo{ID: id, Kind: kind, StreamKey: streamKey, CreatedAt: now}
+	m.lock.Unlock()
+
+	m.setState(id, SessionNegotiating)
+	return id
+}
+
+// resumed marks a negotiating session as continuing previousId, which was created at createdAt
+func (m *SessionManager) resumed(id, previousId string, createdAt time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if session, ok := m.sessions[id]; ok {
+		session.ResumedFrom, session.CreatedAt = previousId, createdAt
+	}
+}
+
+// setLive marks a session whose negotiation succeeded, sessions that finish negotiating while the server
+// drains are draining right away
+func (m *SessionManager) setLive(id string) {
+	if Draining() {
+		m.setState(id, SessionDraining)
+	} else {
+		m.setState(id, SessionLive)
+	}
+}
+
+// setState moves a session to state. Closed sessions are forgotten, closing twice is a no-op.
+func (m *SessionManager) setState(id string, state SessionState) {
+	m.lock.Lock()
+	session, ok := m.sessions[id]
+	if !ok || session.State == state {
+		m.lock.Unlock()
+		return
+	}
+
+	session.State, session.StateChangedAt = state, time.Now()
+	if state == SessionClosed {
+		delete(m.sessions, id)
+	}
+
+	info, hooks := *session, m.hooks
+	m.lock.Unlock()
+
+	for _, hook := range hooks {
+		hook(info)
+	}
+}
+
+// setDraining moves every live session to draining, or back if d is false
+func (m *SessionManager) setDraining(d bool) {
+	from, to := SessionLive, SessionDraining
+	if !d {
+		from, to = to, from
+	}
+
+	for _, session := range m.List() {
+		if session.State == from {
+			m.setState(session.ID, to)
+		}
+	}
+}
+
+// attachWHEP adds a WHEP session whose negotiation succeeded to the viewers of s and marks it live.
+// streamMapLock must be held.
+func (m *SessionManager) attachWHEP(s *stream, id string, w *whepSession) {
+	s.whepSessionsLock.Lock()
+	s.whepSessions[id] = w
+	s.peakViewers = max(s.peakViewers, len(s.whepSessions))
+	s.whepSessionsLock.Unlock()
+
+	m.setLive(id)
+}
+
+// detachWHEP removes a WHEP session from the viewers of s and closes it. Its resume tokens stop working.
+// streamMapLock and whepSessionsLock must be held.
+func (m *SessionManager) detachWHEP(s *stream, id string) {
+	delete(s.whepSessions, id)
+	m.setState(id, SessionClosed)
+	expireResumeTokens(id)
+}
+
+// viewers returns how many WHEP sessions watch s. whepSessionsLock must not be held.
+func (m *SessionManager) viewers(s *stream) int {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	return len(s.whepSessions)
+}
+
+// eachViewer calls fn with every WHEP session watching s. whepSessionsLock must not be held, fn must not
+// attach or detach sessions.
+func (m *SessionManager) eachViewer(s *stream, fn func(id string, w *whepSession)) {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	for id, w := range s.whepSessions {
+		fn(id, w)
+	}
+}
+
+// streamKeyOf returns the stream key of the session with id if it is of kind and not closed yet
+func (m *SessionManager) streamKeyOf(id string, kind SessionKind) (string, bool) {
+	session, ok := m.get(id)
+	if !ok || session.Kind != kind {
+		return "", false
+	}
+
+	return session.StreamKey, true
+}
@@ -0,0 +1,126 @@
+package webrtc
+
+import (
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// Captures of the most recent sessions that are kept, older ones are dropped
+	maxSignalingCaptures = 100
+	// Events kept per session, a misbehaving client trickling candidates forever can't grow a capture further
+	maxSignalingCaptureEvents = 500
+
+	SignalingOffer           = "offer"
+	SignalingAnswer          = "answer"
+	SignalingRemoteCandidate = "remoteCandidate"
+	SignalingICEState        = "iceConnectionState"
+	SignalingSessionState    = "sessionState"
+	SignalingError           = "error"
+)
+
+type (
+	// SignalingEvent is one step of the negotiation of a session
+	SignalingEvent struct {
+		Time time.Time `json:"time"`
+		Type string    `json:"type"`
+		Data string    `json:"data"`
+	}
+
+	// SignalingCapture is the negotiation timeline of a session, with secrets redacted
+	SignalingCapture struct {
+		SessionID string           `json:"sessionId"`
+		Kind      SessionKind      `json:"kind"`
+		StreamKey string           `json:"streamKey"`
+		CreatedAt time.Time        `json:"createdAt"`
+		Events    []SignalingEvent `json:"events"`
+	}
+)
+
+var (
+	signalingDebugEnabled bool
+
+	signalingCaptures     = map[string]*SignalingCapture{}
+	signalingCaptureOrder []string
+	signalingCapturesLock sync.Mutex
+
+	// ICE credentials and SDES keys would let anyone with the bundle hijack or decrypt the session
+	signalingSecretPattern = regexp.MustCompile(`(a=ice-pwd:|a=ice-ufrag:|a=crypto:\d+ \S+ inline:|ufrag )\S+`)
+)
+
+func configureSignalingDebug() {
+	if signalingDebugEnabled = os.Getenv("SIGNALING_DEBUG") == "true"; !signalingDebugEnabled {
+		return
+	}
+
+	Sessions.OnStateChange(func(info SessionInfo) {
+		captureSignaling(info.ID, info.Kind, info.StreamKey, SignalingSessionState, string(info.State))
+	})
+}
+
+// captureSignaling adds an event to the capture of a session, starting the capture on the first event
+func captureSignaling(sessionId string, kind SessionKind, streamKey, eventType, data string) {
+	if !signalingDebugEnabled {
+		return
+	}
+
+	signalingCapturesLock.Lock()
+	defer signalingCapturesLock.Unlock()
+
+	capture, ok := signalingCaptures[sessionId]
+	if !ok {
+		capture = &SignalingCapture{SessionID: sessionId, Kind: kind, StreamKey: streamKey, CreatedAt: time.Now()}
+		signalingCaptures[sessionId] = capture
+
+		signalingCaptureOrder = append(signalingCaptureOrder, sessionId)
+		if len(signalingCaptureOrder) > maxSignalingCaptures {
+			delete(signalingCaptures, signalingCaptureOrder[0])
+			signalingCaptureOrder = signalingCaptureOrder[1:]
+		}
+	}
+
+	if len(capture.Events) < maxSignalingCaptureEvents {
+		capture.Events = append(capture.Events, SignalingEvent{
+			Time: time.Now(),
+			Type: eventType,
+			Data: signalingSecretPattern.ReplaceAllString(data, "${1}<redacted>"),
+		})
+	}
+}
+
+// SignalingDebugEnabled reports if SIGNALING_DEBUG captures the negotiation of sessions
+func SignalingDebugEnabled() bool {
+	return signalingDebugEnabled
+}
+
+// SignalingCaptures returns the captured sessions without their events, newest first
+func SignalingCaptures() []SignalingCapture {
+	signalingCapturesLock.Lock()
+	defer signalingCapturesLock.Unlock()
+
+	captures := make([]SignalingCapture, 0, len(signalingCaptureOrder))
+	for i := len(signalingCaptureOrder) - 1; i >= 0; i-- {
+		capture := *signalingCaptures[signalingCaptureOrder[i]]
+		capture.Events = nil
+		captures = append(captures, capture)
+	}
+
+	return captures
+}
+
+// GetSignalingCapture returns the capture of a session, false if there is none
+func GetSignalingCapture(sessionId string) (SignalingCapture, bool) {
+	signalingCapturesLock.Lock()
+	defer signalingCapturesLock.Unlock()
+
+	capture, ok := signalingCaptures[sessionId]
+	if !ok {
+		return SignalingCapture{}, false
+	}
+
+	copied := *capture
+	copied.Events = append([]SignalingEvent{}, capture.Events...)
+	return copied, true
+}
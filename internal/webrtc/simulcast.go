@@ -0,0 +1,177 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	simulcastLayerHigh = "high"
+	simulcastLayerMid  = "mid"
+	simulcastLayerLow  = "low"
+)
+
+// rid-id of RFC 8851, limited to the 16 bytes most encoders and browsers accept
+var ridPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+
+// simulcastLayerNames validates the simulcast layers a publisher offers and maps each rid to a canonical name,
+// high, mid and low, so players see the same layers whatever the encoder calls them. Layers are ordered by their
+// max-width if every layer has one, otherwise the order of `a=simulcast` is used, which lists the highest first.
+// Layers between mid and low are named mid2, mid3 and so on.
+func simulcastLayerNames(offer string) (map[string]string, error) {
+	names := map[string]string{}
+
+	lines := strings.Split(strings.ReplaceAll(offer, "\r\n", "\n"), "\n")
+	for start := 0; start < len(lines); {
+		end := start + 1
+		for end < len(lines) && !strings.HasPrefix(lines[end], "m=") {
+			end++
+		}
+		media := lines[start:end]
+		start = end
+
+		if !strings.HasPrefix(media[0], "m=video") {
+			continue
+		}
+
+		layers, err := simulcastSendLayers(media)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, layer := range layers {
+			name := simulcastLayerHigh
+			switch {
+			case i == 0:
+			case i == len(layers)-1:
+				name = simulcastLayerLow
+			case i == 1:
+				name = simulcastLayerMid
+			default:
+				name = simulcastLayerMid + strconv.Itoa(i)
+			}
+
+			for _, rid := range layer {
+				if _, ok := names[rid]; ok {
+					return nil, fmt.Errorf("Simulcast rid %s is used more than once", rid)
+				}
+				names[rid] = name
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// simulcastSendLayers returns the rids of every layer of a video section, highest quality first. A layer has more
+// than one rid if the publisher offered alternatives for it.
+func simulcastSendLayers(media []string) ([][]string, error) {
+	simulcastIndex := slices.IndexFunc(media, func(l string) bool { return strings.HasPrefix(l, "a=simulcast:") })
+	if simulcastIndex == -1 {
+		return nil, nil
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(media[simulcastIndex], "a=simulcast:"))
+	sendIndex := slices.Index(fields, "send")
+	if sendIndex == -1 || sendIndex == len(fields)-1 {
+		return nil, nil
+	}
+
+	layers := [][]string{}
+	for _, layer := range strings.Split(fields[sendIndex+1], ";") {
+		alternatives := []string{}
+		for _, rid := range strings.Split(layer, ",") {
+			rid = strings.TrimPrefix(rid, "~")
+			if !ridPattern.MatchString(rid) {
+				return nil, fmt.Errorf("Simulcast rid `%s` is invalid, rids are up to 16 letters, digits, - or _", rid)
+			} else if !slices.ContainsFunc(media, func(l string) bool { return strings.HasPrefix(l, "a=rid:"+rid+" send") }) {
+				return nil, fmt.Errorf("Simulcast rid %s has no a=rid line", rid)
+			}
+
+			alternatives = append(alternatives, rid)
+		}
+		layers = append(layers, alternatives)
+	}
+
+	for _, layer := range layers {
+		if ridMaxWidth(media, layer[0]) == 0 {
+			return layers, nil
+		}
+	}
+
+	slices.SortStableFunc(layers, func(a, b []string) int {
+		return ridMaxWidth(media, b[0]) - ridMaxWidth(media, a[0])
+	})
+
+	return layers, nil
+}
+
+// canonicalLayer returns the name of the video layer the publisher calls rid, so viewers can keep selecting layers by
+// the rids of the encoder. streamMapLock must be held.
+func (s *stream) canonicalLayer(rid string) string {
+	if slices.ContainsFunc(s.videoTracks, func(v *videoTrack) bool { return v.rid == rid }) {
+		return rid
+	}
+
+	for _, videoTrack := range s.videoTracks {
+		if videoTrack.publisherRID == rid {
+			return videoTrack.rid
+		}
+	}
+
+	return rid
+}
+
+// layersMessage is sent to viewers with a DataChannel when the layers of the stream changed
+type layersMessage struct {
+	Type   string          `json:"type"`
+	Layers json.RawMessage `json:"layers"`
+}
+
+// onLayersChanged is called when a video layer started sending or changed its resolution. Some encoders enable
+// simulcast only seconds after they connected, viewers that joined before are told about the new layers and their
+// layer hints are applied again. streamMapLock must be held.
+func (s *stream) onLayersChanged() {
+	s.applyLayerHints()
+
+	if s.layersChanged != nil {
+		close(s.layersChanged)
+		s.layersChanged = nil
+	}
+
+	layers, err := s.layers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if msg, err := json.Marshal(layersMessage{Type: "layers", Layers: layers}); err != nil {
+		log.Println(err)
+	} else {
+		s.sendDataChannelMessage(msg)
+	}
+}
+
+// WHEPLayersChanged returns a channel that is closed the next time the layers of the stream of a WHEP session change
+func WHEPLayersChanged(whepSessionId string) (<-chan struct{}, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	streamKey, _, ok := getWHEPSession(whepSessionId)
+	if !ok {
+		return nil, errors.New("WHEP session does not exist")
+	}
+
+	s := streamMap[streamKey]
+	if s.layersChanged == nil {
+		s.layersChanged = make(chan struct{})
+	}
+
+	return s.layersChanged, nil
+}
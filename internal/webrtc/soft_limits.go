@@ -0,0 +1,124 @@
+package webrtc
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+// Quotas warn once usage reaches this percent of their limit
+const defaultQuotaWarningPercent = 80
+
+// Quotas that warn before they are enforced
+const (
+	QuotaViewers       = "viewers"
+	QuotaBitrate       = "bitrate"
+	QuotaTenantStreams = "tenantStreams"
+	QuotaTenantViewers = "tenantViewers"
+)
+
+// QuotaWarning is the data of a quota.warning event
+type QuotaWarning struct {
+	Quota string `json:"quota"`
+	// Video layer for QuotaBitrate
+	Layer string `json:"layer,omitempty"`
+	Usage uint64 `json:"usage"`
+	Limit uint64 `json:"limit"`
+}
+
+var (
+	quotaWarningPercent uint64 = defaultQuotaWarningPercent
+
+	// Quotas that are above their warning threshold, so each crossing is only reported once
+	quotaWarned     = map[string]bool{}
+	quotaWarnedLock sync.Mutex
+)
+
+func configureQuotaWarnings() error {
+	val := os.Getenv("QUOTA_WARNING_PERCENT")
+	if val == "" {
+		return nil
+	}
+
+	percent, err := strconv.ParseUint(val, 10, 64)
+	if err != nil || percent > 100 {
+		return errors.New("QUOTA_WARNING_PERCENT must be a number between 0 and 100")
+	}
+	quotaWarningPercent = percent
+	return nil
+}
+
+// checkQuotaWarning publishes a quota.warning event when usage reaches the warning threshold of limit. The
+// quota warns again after usage was below the threshold. scope tells apart what the quota applies to, like
+// a stream key or tenant.
+func checkQuotaWarning(e events.Event, scope string, warning QuotaWarning) {
+	if quotaWarningPercent == 0 || warning.Limit == 0 {
+		return
+	}
+
+	key := warning.Quota + "/" + scope
+	above := warning.Usage*100 >= warning.Limit*quotaWarningPercent
+
+	quotaWarnedLock.Lock()
+	warned := quotaWarned[key]
+	if above {
+		quotaWarned[key] = true
+	} else {
+		delete(quotaWarned, key)
+	}
+	quotaWarnedLock.Unlock()
+
+	if above && !warned {
+		e.Type, e.Data = events.QuotaWarning, warning
+		events.Publish(e)
+	}
+}
+
+// forgetQuotaWarnings clears the warnings of a stream that ended
+func forgetQuotaWarnings(streamKey string) {
+	quotaWarnedLock.Lock()
+	defer quotaWarnedLock.Unlock()
+
+	for key := range quotaWarned {
+		_, scope, _ := strings.Cut(key, "/")
+		if scope == streamKey || strings.HasPrefix(scope, streamKey+"/") {
+			delete(quotaWarned, key)
+		}
+	}
+}
+
+// checkViewerQuotaWarnings warns when the viewers of s or of its tenant near their limits. Must be called
+// with streamMapLock held.
+func (s *stream) checkViewerQuotaWarnings(streamKey string) {
+	if s.streamer == nil {
+		return
+	}
+
+	e := events.Event{StreamKey: streamKey, Streamer: s.streamer.Name, Tenant: s.tenant()}
+
+	viewers := Sessions.viewers(s) + s.pendingWHEPSessions
+	checkQuotaWarning(e, streamKey, QuotaWarning{Quota: QuotaViewers, Usage: uint64(viewers), Limit: uint64(s.streamer.MaxViewers)})
+
+	if tenant := s.streamer.Tenant; tenant != nil && tenant.MaxViewers != 0 {
+		checkQuotaWarning(e, tenant.Name, QuotaWarning{Quota: QuotaTenantViewers, Usage: uint64(tenantViewers(tenant.Name)), Limit: uint64(tenant.MaxViewers)})
+	}
+}
+
+// checkTenantStreamQuotaWarning warns when the live streams of the tenant of streamer near their limit.
+// Must be called with streamMapLock held, after the stream of streamer went live.
+func checkTenantStreamQuotaWarning(streamer *Streamer) {
+	if streamer.Tenant == nil || streamer.Tenant.MaxStreams == 0 {
+		return
+	}
+
+	e := events.Event{StreamKey: streamer.StreamKey, Streamer: streamer.Name, Tenant: streamer.Tenant.Name}
+	checkQuotaWarning(e, streamer.Tenant.Name, QuotaWarning{
+		Quota: QuotaTenantStreams,
+		Usage: uint64(tenantLiveStreams(streamer.Tenant.Name, "")),
+		Limit: uint64(streamer.Tenant.MaxStreams),
+	})
+}
@@ -0,0 +1,115 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	defaultBandwidthTestBitrate = 8_000_000
+	bandwidthTestFrameRate      = 30
+	bandwidthTestKeyframeEvery  = 2 * bandwidthTestFrameRate
+	bandwidthTestPayloadSize    = 1200
+	bandwidthTestClockRate      = 90000
+
+	// H264 filler data NALU, decoders skip it
+	fillerNALUType = 12
+)
+
+var (
+	// Viewers of this stream key receive generated video instead of a publisher, empty disables
+	bandwidthTestStreamKey string
+	bandwidthTestBitrate   = uint64(defaultBandwidthTestBitrate)
+
+	ErrReservedStreamKey = errors.New("Stream key is reserved for the bandwidth test")
+)
+
+func configureBandwidthTest() error {
+	bandwidthTestStreamKey = os.Getenv("BANDWIDTH_TEST_STREAM_KEY")
+
+	if val := os.Getenv("BANDWIDTH_TEST_BITRATE"); val != "" {
+		bitrate, err := strconv.ParseUint(val, 10, 64)
+		if err != nil || bitrate == 0 {
+			return errors.New("BANDWIDTH_TEST_BITRATE must be a number of bits per second")
+		}
+		bandwidthTestBitrate = bitrate
+	}
+	return nil
+}
+
+// startBandwidthTest sends generated H264 at BANDWIDTH_TEST_BITRATE to the viewers of the bandwidth test stream,
+// until the last one left. The frames only contain filler data, players measure the received bitrate and loss
+// with their WebRTC stats.
+func (s *stream) startBandwidthTest() {
+	if !s.bandwidthTestRunning.CompareAndSwap(false, true) {
+		return
+	}
+
+	videoTrack, err := addTrack(s, videoTrackLabelDefault)
+	if err != nil {
+		s.bandwidthTestRunning.Store(false)
+		log.Println(err)
+		return
+	}
+	videoTrack.mimeType.Store(webrtc.MimeTypeH264)
+	videoTrack.bitrate.Store(bandwidthTestBitrate)
+
+	go func() {
+		defer s.trackGoroutine()()
+		defer s.bandwidthTestRunning.Store(false)
+
+		frameSize := int(bandwidthTestBitrate / 8 / bandwidthTestFrameRate)
+		payload := make([]byte, bandwidthTestPayloadSize)
+		payload[0] = fillerNALUType
+		for i := 1; i < len(payload)-1; i++ {
+			payload[i] = 0xFF
+		}
+		payload[len(payload)-1] = 0x80
+
+		ticker := time.NewTicker(time.Second / bandwidthTestFrameRate)
+		defer ticker.Stop()
+
+		rtpPkt := &rtp.Packet{Header: rtp.Header{Version: 2}}
+		timeDiff := int64(bandwidthTestClockRate / bandwidthTestFrameRate)
+		for frame := 0; ; frame++ {
+			select {
+			case <-s.whipActiveContext.Done():
+				return
+			case <-ticker.C:
+			}
+
+			isKeyframe := frame%bandwidthTestKeyframeEvery == 0
+			s.whepSessionsLock.RLock()
+			if len(s.whepSessions) == 0 {
+				s.whepSessionsLock.RUnlock()
+				return
+			}
+
+			for sent := 0; sent < frameSize; sent += len(payload) {
+				rtpPkt.Payload = payload
+				rtpPkt.Marker = sent+len(payload) >= frameSize
+
+				frameTimeDiff := int64(0)
+				if sent == 0 {
+					frameTimeDiff = timeDiff
+				}
+
+				videoTrack.packetsReceived.Add(1)
+				for _, whepSession := range s.whepSessions {
+					whepSession.sendVideoPacket(rtpPkt, &videoTrack.senderReports, videoTrackLabelDefault, frameTimeDiff, 1, videoTrackCodecH264, isKeyframe)
+				}
+			}
+			s.whepSessionsLock.RUnlock()
+
+			if isKeyframe {
+				videoTrack.lastKeyFrameSeen.Store(time.Now())
+			}
+		}
+	}()
+}
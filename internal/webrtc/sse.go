@@ -0,0 +1,220 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+const (
+	defaultSSEMaxConnections = 10000
+	// A player only needs one, the others cover reconnects that overlap with the connection they replace
+	defaultSSEMaxSessionConnections = 3
+)
+
+// States of the stream a WHEP session watches, sent as the state Server-Sent Event
+const (
+	// The publisher is connected and sending media
+	SSEStreamActive = "active"
+	// The publisher is connected but stopped sending media, see STREAM_OFFLINE_POLICY
+	SSEStreamInactive = "inactive"
+	// The publisher disconnected, the session stays open in case it reconnects
+	SSEStreamEnded = "ended"
+)
+
+// SSESubscription is a server-sent events connection of a WHEP session
+type SSESubscription struct {
+	whepSessionId, streamKey string
+	done                     chan struct{}
+	closeOnce                sync.Once
+
+	// Only the latest state matters to a viewer, a slow connection skips the ones in between
+	streamState        atomic.Value
+	streamStateChanged chan struct{}
+}
+
+var (
+	// Limits of SSE_MAX_CONNECTIONS and SSE_MAX_CONNECTIONS_PER_SESSION, zero is unlimited
+	sseMaxConnections        = defaultSSEMaxConnections
+	sseMaxSessionConnections = defaultSSEMaxSessionConnections
+
+	sseSubscriptions     = map[string]map[*SSESubscription]struct{}{}
+	sseSubscriptionCount int
+	sseSubscriptionsLock sync.Mutex
+
+	sseRejected atomic.Uint64
+	sseReaped   atomic.Uint64
+
+	ErrSSELimit = errors.New("Too many event streams")
+)
+
+func configureSSE() error {
+	parseLimit := func(name string, limit *int) error {
+		if val := os.Getenv(name); val != "" {
+			parsed, err := strconv.Atoi(val)
+			if err != nil || parsed < 0 {
+				return fmt.Errorf("%s must be a number of connections", name)
+			}
+			*limit = parsed
+		}
+		return nil
+	}
+	if err := parseLimit("SSE_MAX_CONNECTIONS", &sseMaxConnections); err != nil {
+		return err
+	} else if err = parseLimit("SSE_MAX_CONNECTIONS_PER_SESSION", &sseMaxSessionConnections); err != nil {
+		return err
+	}
+
+	// Connections of a closed session would otherwise wait for layer changes that never come
+	Sessions.OnStateChange(func(info SessionInfo) {
+		if info.Kind == SessionWHEP && info.State == SessionClosed {
+			reapSSESubscriptions(info.ID)
+		}
+	})
+
+	events.Subscribe(func(e events.Event) {
+		state := ""
+		switch e.Type {
+		case events.StreamStart, events.StreamOnline:
+			state = SSEStreamActive
+		case events.StreamOffline:
+			state = SSEStreamInactive
+		case events.StreamEnd:
+			state = SSEStreamEnded
+		default:
+			return
+		}
+
+		sseSubscriptionsLock.Lock()
+		defer sseSubscriptionsLock.Unlock()
+
+		for _, subscriptions := range sseSubscriptions {
+			for s := range subscriptions {
+				if s.streamKey == e.StreamKey {
+					s.setStreamState(state)
+				}
+			}
+		}
+	})
+
+	return nil
+}
+
+// SubscribeSSE counts a server-sent events connection of whepSessionId, ErrSSELimit if it would exceed
+// SSE_MAX_CONNECTIONS or SSE_MAX_CONNECTIONS_PER_SESSION. Close must be called once the connection ended.
+func SubscribeSSE(whepSessionId string) (*SSESubscription, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	sseSubscriptionsLock.Lock()
+	defer sseSubscriptionsLock.Unlock()
+
+	if (sseMaxConnections != 0 && sseSubscriptionCount >= sseMaxConnections) ||
+		(sseMaxSessionConnections != 0 && len(sseSubscriptions[whepSessionId]) >= sseMaxSessionConnections) {
+		sseRejected.Add(1)
+		return nil, ErrSSELimit
+	}
+
+	s := &SSESubscription{whepSessionId: whepSessionId, done: make(chan struct{}), streamStateChanged: make(chan struct{}, 1)}
+	if streamKey, _, ok := getWHEPSession(whepSessionId); ok {
+		s.streamKey = streamKey
+		s.setStreamState(streamMap[streamKey].sseState())
+	}
+	if sseSubscriptions[whepSessionId] == nil {
+		sseSubscriptions[whepSessionId] = map[*SSESubscription]struct{}{}
+	}
+	sseSubscriptions[whepSessionId][s] = struct{}{}
+	sseSubscriptionCount++
+
+	return s, nil
+}
+
+// Done is closed once the WHEP session of the subscription closed, the connection should end then
+func (s *SSESubscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// StreamStateChanged receives once the state of the stream changed, StreamState returns the new one
+func (s *SSESubscription) StreamStateChanged() <-chan struct{} {
+	return s.streamStateChanged
+}
+
+// StreamState returns SSEStreamActive, SSEStreamInactive or SSEStreamEnded. It is empty if the session isn't
+// connected to this instance.
+func (s *SSESubscription) StreamState() string {
+	state, _ := s.streamState.Load().(string)
+	return state
+}
+
+func (s *SSESubscription) setStreamState(state string) {
+	if s.streamState.Swap(state) == state {
+		return
+	}
+
+	select {
+	case s.streamStateChanged <- struct{}{}:
+	default:
+	}
+}
+
+// sseState maps the state of a stream to its state Server-Sent Event. Must be called with streamMapLock held.
+func (s *stream) sseState() string {
+	switch {
+	case !s.hasWHIPClient.Load():
+		return SSEStreamEnded
+	case s.online():
+		return SSEStreamActive
+	default:
+		return SSEStreamInactive
+	}
+}
+
+// Close stops counting the subscription
+func (s *SSESubscription) Close() {
+	sseSubscriptionsLock.Lock()
+	defer sseSubscriptionsLock.Unlock()
+
+	s.remove()
+}
+
+// remove must be called with sseSubscriptionsLock held
+func (s *SSESubscription) remove() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+
+	subscriptions, ok := sseSubscriptions[s.whepSessionId]
+	if _, subscribed := subscriptions[s]; !ok || !subscribed {
+		return
+	}
+
+	delete(subscriptions, s)
+	if len(subscriptions) == 0 {
+		delete(sseSubscriptions, s.whepSessionId)
+	}
+	sseSubscriptionCount--
+}
+
+// reapSSESubscriptions ends the connections of a WHEP session that closed
+func reapSSESubscriptions(whepSessionId string) {
+	sseSubscriptionsLock.Lock()
+	defer sseSubscriptionsLock.Unlock()
+
+	for s := range sseSubscriptions[whepSessionId] {
+		s.remove()
+		sseReaped.Add(1)
+	}
+}
+
+// SSEConnections returns how many server-sent events connections are open
+func SSEConnections() int {
+	sseSubscriptionsLock.Lock()
+	defer sseSubscriptionsLock.Unlock()
+
+	return sseSubscriptionCount
+}
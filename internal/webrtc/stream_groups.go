@@ -0,0 +1,241 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+const (
+	// Groups of a stream key are cached for this long, so every event doesn't query Postgres
+	streamGroupCacheTTL = 10 * time.Second
+
+	streamGroupWebhookTimeout = 10 * time.Second
+)
+
+type (
+	// StreamGroup manages the stream keys of an event, like the stages of a conference, as a unit
+	StreamGroup struct {
+		Name       string   `json:"name"`
+		StreamKeys []string `json:"streamKeys"`
+		// Receives the events of every stream key of the group
+		WebhookURL string `json:"webhookUrl,omitempty"`
+	}
+
+	// StreamGroupStatus is the live status of every stream key of a group
+	StreamGroupStatus struct {
+		Name        string                  `json:"name"`
+		LiveStreams int                     `json:"liveStreams"`
+		Viewers     int                     `json:"viewers"`
+		Streams     map[string]StreamStatus `json:"streams"`
+	}
+
+	// groupEvent is sent to the webhook of a group
+	groupEvent struct {
+		events.Event
+		Group string `json:"group"`
+	}
+
+	streamGroupCacheEntry struct {
+		groups    []StreamGroup
+		expiresAt time.Time
+	}
+)
+
+// ErrStreamGroupTaken is returned when another streamer owns the group
+var ErrStreamGroupTaken = errors.New("Group is taken")
+
+var (
+	streamGroupCache     = map[string]streamGroupCacheEntry{}
+	streamGroupCacheLock sync.Mutex
+)
+
+// GetStreamGroup returns a group by name, pgx.ErrNoRows if there is none
+func GetStreamGroup(pool *pgxpool.Pool, ctx context.Context, name string) (*StreamGroup, error) {
+	g := &StreamGroup{}
+	err := pool.QueryRow(ctx, `SELECT name, stream_keys, webhook_url FROM stream_groups WHERE name = @name`, pgx.NamedArgs{
+		"name": name,
+	}).Scan(&g.Name, &g.StreamKeys, &g.WebhookURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// GetStreamGroups returns the groups of a streamer
+func GetStreamGroups(pool *pgxpool.Pool, ctx context.Context, owner string) ([]StreamGroup, error) {
+	rows, err := pool.Query(ctx, `SELECT name, stream_keys, webhook_url FROM stream_groups WHERE owner = @owner ORDER BY name`, pgx.NamedArgs{
+		"owner": owner,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, scanStreamGroup)
+}
+
+// PutStreamGroup creates or replaces a group of owner
+func PutStreamGroup(pool *pgxpool.Pool, ctx context.Context, owner string, g StreamGroup) error {
+	query := `INSERT INTO stream_groups (name, owner, stream_keys, webhook_url)
+		 VALUES (@name, @owner, @streamKeys, @webhookUrl)
+		 ON CONFLICT (name) DO UPDATE SET stream_keys = EXCLUDED.stream_keys, webhook_url = EXCLUDED.webhook_url
+		 WHERE stream_groups.owner = EXCLUDED.owner`
+	tag, err := pool.Exec(ctx, query, pgx.NamedArgs{
+		"name":       g.Name,
+		"owner":      owner,
+		"streamKeys": g.StreamKeys,
+		"webhookUrl": g.WebhookURL,
+	})
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return ErrStreamGroupTaken
+	}
+
+	forgetStreamGroups()
+	return nil
+}
+
+// DeleteStreamGroup removes a group of owner
+func DeleteStreamGroup(pool *pgxpool.Pool, ctx context.Context, owner, name string) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM stream_groups WHERE name = @name AND owner = @owner`, pgx.NamedArgs{
+		"name":  name,
+		"owner": owner,
+	})
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	forgetStreamGroups()
+	return nil
+}
+
+func scanStreamGroup(row pgx.CollectableRow) (StreamGroup, error) {
+	var g StreamGroup
+	err := row.Scan(&g.Name, &g.StreamKeys, &g.WebhookURL)
+	return g, err
+}
+
+// GetStreamGroupStatus returns the status of every stream key of g
+func GetStreamGroupStatus(g *StreamGroup) StreamGroupStatus {
+	status := StreamGroupStatus{Name: g.Name, Streams: map[string]StreamStatus{}}
+	for _, streamKey := range g.StreamKeys {
+		streamStatus := GetStreamStatus(streamKey)
+		if streamStatus.State == StreamStateOnline {
+			status.LiveStreams++
+		}
+
+		status.Viewers += streamStatus.Viewers()
+		status.Streams[streamKey] = streamStatus
+	}
+
+	return status
+}
+
+// GetStreamGroupAnalytics combines the summaries of the most recent broadcasts of every stream key of g
+func GetStreamGroupAnalytics(pool *pgxpool.Pool, ctx context.Context, g *StreamGroup) (*StreamAnalytics, error) {
+	summaries := []StreamSummary{}
+	for _, streamKey := range g.StreamKeys {
+		streamKeySummaries, err := GetStreamKeySummaries(pool, ctx, streamKey)
+		if err != nil {
+			return nil, err
+		}
+
+		summaries = append(summaries, streamKeySummaries...)
+	}
+
+	slices.SortFunc(summaries, func(a, b StreamSummary) int {
+		return b.EndedAt.Compare(a.EndedAt)
+	})
+	if len(summaries) > streamSummaryLimit {
+		summaries = summaries[:streamSummaryLimit]
+	}
+
+	return analyzeStreamSummaries(summaries), nil
+}
+
+// ConfigureStreamGroupWebhooks sends the events of every stream to the webhooks of the groups it is in
+func ConfigureStreamGroupWebhooks(pool *pgxpool.Pool) {
+	events.Subscribe(func(e events.Event) {
+		if e.StreamKey == "" {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), streamGroupWebhookTimeout)
+		defer cancel()
+
+		groups, err := streamKeyGroups(pool, ctx, e.StreamKey)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, g := range groups {
+			if g.WebhookURL == "" {
+				continue
+			}
+
+			body, err := json.Marshal(groupEvent{Event: e, Group: g.Name})
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			if err := events.PostJSON(g.WebhookURL, body); err != nil {
+				log.Printf("Webhook of group %s failed: %v", g.Name, err)
+			}
+		}
+	})
+}
+
+// streamKeyGroups returns the groups streamKey is in
+func streamKeyGroups(pool *pgxpool.Pool, ctx context.Context, streamKey string) ([]StreamGroup, error) {
+	streamGroupCacheLock.Lock()
+	entry, ok := streamGroupCache[streamKey]
+	streamGroupCacheLock.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.groups, nil
+	}
+
+	rows, err := pool.Query(ctx, `SELECT name, stream_keys, webhook_url FROM stream_groups WHERE @streamKey = ANY(stream_keys)`, pgx.NamedArgs{
+		"streamKey": streamKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := pgx.CollectRows(rows, scanStreamGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	streamGroupCacheLock.Lock()
+	streamGroupCache[streamKey] = streamGroupCacheEntry{groups: groups, expiresAt: time.Now().Add(streamGroupCacheTTL)}
+	for cached, entry := range streamGroupCache {
+		if time.Now().After(entry.expiresAt) {
+			delete(streamGroupCache, cached)
+		}
+	}
+	streamGroupCacheLock.Unlock()
+
+	return groups, nil
+}
+
+// forgetStreamGroups empties the cache of this instance, other instances see changes after streamGroupCacheTTL
+func forgetStreamGroups() {
+	streamGroupCacheLock.Lock()
+	defer streamGroupCacheLock.Unlock()
+
+	clear(streamGroupCache)
+}
@@ -0,0 +1,72 @@
+package webrtc
+
+import (
+	"slices"
+	"strings"
+)
+
+// Stream keys of a streamer may contain * to match any characters, e.g. team-* lets one credential publish to team-a
+// and team-b. A session always carries the concrete stream key it published to, never the pattern.
+const streamKeyWildcard = "*"
+
+// IsStreamKeyPattern reports whether a stream key of a streamer is a pattern instead of a single stream key
+func IsStreamKeyPattern(streamKey string) bool {
+	return strings.Contains(streamKey, streamKeyWildcard)
+}
+
+// MatchStreamKey reports whether streamKey is one of streamKeys, or matches one of their patterns
+func MatchStreamKey(streamKeys []string, streamKey string) bool {
+	for _, k := range streamKeys {
+		if k == streamKey || (IsStreamKeyPattern(k) && matchStreamKeyPattern(k, streamKey)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchStreamKeyPattern(pattern, streamKey string) bool {
+	parts := strings.Split(pattern, streamKeyWildcard)
+	if !strings.HasPrefix(streamKey, parts[0]) {
+		return false
+	}
+	streamKey = streamKey[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(streamKey, part)
+		if i == -1 {
+			return false
+		}
+		streamKey = streamKey[i+len(part):]
+	}
+
+	return len(streamKey) >= len(last) && strings.HasSuffix(streamKey, last)
+}
+
+// ExpandStreamKeys replaces the patterns of streamKeys with the stream keys matching them that are live on this
+// instance, for listings that can't show a pattern
+func ExpandStreamKeys(streamKeys []string) []string {
+	expanded := []string{}
+	patterns := []string{}
+	for _, k := range streamKeys {
+		if IsStreamKeyPattern(k) {
+			patterns = append(patterns, k)
+		} else {
+			expanded = append(expanded, k)
+		}
+	}
+	if len(patterns) == 0 {
+		return streamKeys
+	}
+
+	streamMapLock.Lock()
+	for streamKey, stream := range streamMap {
+		if stream.hasWHIPClient.Load() && MatchStreamKey(patterns, streamKey) && !slices.Contains(expanded, streamKey) {
+			expanded = append(expanded, streamKey)
+		}
+	}
+	streamMapLock.Unlock()
+
+	return expanded
+}
@@ -0,0 +1,240 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// Settings are cached for this long, so viewers joining at once don't each query Postgres
+	streamSettingsCacheTTL = 10 * time.Second
+
+	outputAllowedTimeout = 5 * time.Second
+
+	// Outputs a streamer may allow in StreamSettings.AllowedOutputs
+	OutputWebRTC    = "webrtc"
+	OutputHLS       = "hls"
+	OutputRecording = "recording"
+)
+
+// StreamSettings are advanced settings of a stream key, set by its streamer
+type StreamSettings struct {
+	// Header extensions removed from offers of the publisher and viewers, by URI or short name like transport-cc
+	DisabledExtensions []string `json:"disabledExtensions"`
+	// RTCP feedback removed from offers, like `transport-cc`, `nack`, `nack pli` or `goog-remb`
+	DisabledRTCPFeedback []string `json:"disabledRtcpFeedback"`
+	// Outputs the stream may be redistributed as, for publishers with licensing constraints. Empty allows every output.
+	AllowedOutputs []string `json:"allowedOutputs,omitempty"`
+	// Sites the stream may be played on, like `https://example.com` or `https://*.example.com` for its subdomains.
+	// Checked against the Origin or Referer of viewers. Empty allows every site.
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+}
+
+type streamSettingsCacheEntry struct {
+	settings  StreamSettings
+	expiresAt time.Time
+}
+
+var (
+	streamSettingsPool *pgxpool.Pool
+
+	outputs = []string{OutputWebRTC, OutputHLS, OutputRecording}
+
+	ErrOutputNotAllowed = errors.New("The streamer does not allow this output")
+	ErrOriginNotAllowed = errors.New("The streamer does not allow playback on this site")
+
+	streamSettingsCache     = map[string]streamSettingsCacheEntry{}
+	streamSettingsCacheLock sync.Mutex
+
+	// Short names of header extensions for DisabledExtensions
+	extensionShortNames = map[string]string{
+		"transport-cc":  "http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01",
+		"abs-send-time": "http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time",
+		"playout-delay": playoutDelayExtensionURI,
+		"mid":           midExtensionURI,
+		"rid":           ridExtensionURI,
+	}
+)
+
+// GetStreamSettings returns the settings of a stream key, the zero value if none were set
+func GetStreamSettings(pool *pgxpool.Pool, ctx context.Context, streamKey string) (StreamSettings, error) {
+	streamSettingsCacheLock.Lock()
+	entry, ok := streamSettingsCache[streamKey]
+	streamSettingsCacheLock.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.settings, nil
+	}
+
+	settings := StreamSettings{}
+	err := pool.QueryRow(ctx, `SELECT settings FROM stream_settings WHERE stream_key = @streamKey`, pgx.NamedArgs{
+		"streamKey": streamKey,
+	}).Scan(&settings)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return StreamSettings{}, err
+	}
+
+	streamSettingsCacheLock.Lock()
+	streamSettingsCache[streamKey] = streamSettingsCacheEntry{settings: settings, expiresAt: time.Now().Add(streamSettingsCacheTTL)}
+	for cached, entry := range streamSettingsCache {
+		if time.Now().After(entry.expiresAt) {
+			delete(streamSettingsCache, cached)
+		}
+	}
+	streamSettingsCacheLock.Unlock()
+
+	return settings, nil
+}
+
+// PutStreamSettings replaces the settings of a stream key
+func PutStreamSettings(pool *pgxpool.Pool, ctx context.Context, streamKey string, settings StreamSettings) error {
+	query := `INSERT INTO stream_settings (stream_key, settings) VALUES (@streamKey, @settings)
+		 ON CONFLICT (stream_key) DO UPDATE SET settings = EXCLUDED.settings`
+	if _, err := pool.Exec(ctx, query, pgx.NamedArgs{
+		"streamKey": streamKey,
+		"settings":  settings,
+	}); err != nil {
+		return err
+	}
+
+	streamSettingsCacheLock.Lock()
+	delete(streamSettingsCache, streamKey)
+	streamSettingsCacheLock.Unlock()
+
+	return nil
+}
+
+// ConfigureOutputAllowlist enforces the AllowedOutputs of every stream key
+func ConfigureOutputAllowlist(pool *pgxpool.Pool) {
+	streamSettingsPool = pool
+}
+
+// Validate returns an error if settings contain an unknown output
+func (settings StreamSettings) Validate() error {
+	for _, output := range settings.AllowedOutputs {
+		if !slices.Contains(outputs, output) {
+			return fmt.Errorf("Unknown output %s, allowed are %v", output, outputs)
+		}
+	}
+
+	for _, origin := range settings.AllowedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("Invalid origin %q, expected a scheme and host like https://example.com", origin)
+		}
+	}
+
+	return nil
+}
+
+// CheckOutputAllowed returns ErrOutputNotAllowed if the streamer of streamKey doesn't allow output. Settings that
+// can't be read allow nothing, the streamer may have licensing constraints.
+func CheckOutputAllowed(streamKey, output string) error {
+	if streamSettingsPool == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), outputAllowedTimeout)
+	defer cancel()
+
+	settings, err := GetStreamSettings(streamSettingsPool, ctx, streamKey)
+	if err != nil {
+		return err
+	} else if len(settings.AllowedOutputs) != 0 && !slices.Contains(settings.AllowedOutputs, output) {
+		return ErrOutputNotAllowed
+	}
+
+	return nil
+}
+
+// CheckOriginAllowed returns ErrOriginNotAllowed if the streamer of streamKey restricts the sites the stream may be
+// played on and origin, or the Referer if there is no Origin, isn't one of them. Broadcast Box itself at host, like
+// its frontend and embedded player, is always allowed. Viewers that send neither are rejected, sites could hide
+// where they embed the stream otherwise.
+func CheckOriginAllowed(streamKey, host, origin, referer string) error {
+	if streamSettingsPool == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), outputAllowedTimeout)
+	defer cancel()
+
+	settings, err := GetStreamSettings(streamSettingsPool, ctx, streamKey)
+	if err != nil {
+		return err
+	} else if len(settings.AllowedOrigins) == 0 {
+		return nil
+	}
+
+	if origin == "" || origin == "null" {
+		u, err := url.Parse(referer)
+		if err != nil || u.Host == "" {
+			return ErrOriginNotAllowed
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, host) {
+		return nil
+	}
+
+	for _, allowed := range settings.AllowedOrigins {
+		if originMatches(allowed, origin) {
+			return nil
+		}
+	}
+
+	return ErrOriginNotAllowed
+}
+
+// originMatches reports if origin is allowed, or one of its subdomains if allowed is like `https://*.example.com`
+func originMatches(allowed, origin string) bool {
+	allowed, origin = strings.ToLower(allowed), strings.ToLower(origin)
+	if allowed == origin {
+		return true
+	}
+
+	prefix, domain, ok := strings.Cut(allowed, "://*.")
+	return ok && strings.HasPrefix(origin, prefix+"://") && strings.HasSuffix(origin, "."+domain)
+}
+
+// ApplyNegotiationOverrides removes the disabled header extensions and RTCP feedback from an offer. Answers only
+// contain what was offered, so neither side uses them.
+func (settings StreamSettings) ApplyNegotiationOverrides(offer string) string {
+	if len(settings.DisabledExtensions) == 0 && len(settings.DisabledRTCPFeedback) == 0 {
+		return offer
+	}
+
+	disabledExtensions := []string{}
+	for _, extension := range settings.DisabledExtensions {
+		if uri, ok := extensionShortNames[extension]; ok {
+			extension = uri
+		}
+		disabledExtensions = append(disabledExtensions, extension)
+	}
+
+	lines := strings.Split(strings.ReplaceAll(offer, "\r\n", "\n"), "\n")
+	lines = slices.DeleteFunc(lines, func(line string) bool {
+		switch {
+		case strings.HasPrefix(line, "a=extmap:"):
+			// a=extmap:<id>[/<direction>] <uri> [<attributes>]
+			fields := strings.Fields(line)
+			return len(fields) >= 2 && slices.Contains(disabledExtensions, fields[1])
+		case strings.HasPrefix(line, "a=rtcp-fb:"):
+			// a=rtcp-fb:<payload type> <type> [<parameter>]
+			_, feedback, ok := strings.Cut(line, " ")
+			return ok && slices.Contains(settings.DisabledRTCPFeedback, feedback)
+		}
+		return false
+	})
+
+	return strings.Join(lines, "\r\n")
+}
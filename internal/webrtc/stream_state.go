@@ -0,0 +1,134 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+const (
+	// A stream is online while its publisher is connected
+	OfflinePolicyConnection = "connection"
+	// A stream is online while its publisher sends media
+	OfflinePolicyMedia = "media"
+
+	defaultOfflineAfter = 10 * time.Second
+	stateCheckInterval  = time.Second
+)
+
+type (
+	StreamState string
+
+	stateMessage struct {
+		Type  string      `json:"type"`
+		State StreamState `json:"state"`
+	}
+)
+
+const (
+	StreamStateOnline  StreamState = "online"
+	StreamStateOffline StreamState = "offline"
+)
+
+var (
+	offlinePolicy = OfflinePolicyConnection
+
+	// With OfflinePolicyMedia, a stream is offline once no media arrived for this long
+	offlineAfter = defaultOfflineAfter
+)
+
+func configureStreamStates() error {
+	switch policy := os.Getenv("STREAM_OFFLINE_POLICY"); policy {
+	case "", OfflinePolicyConnection:
+	case OfflinePolicyMedia:
+		offlinePolicy = OfflinePolicyMedia
+	default:
+		return fmt.Errorf("STREAM_OFFLINE_POLICY must be %s or %s", OfflinePolicyConnection, OfflinePolicyMedia)
+	}
+
+	after, err := timeoutFromEnv("STREAM_OFFLINE_AFTER")
+	if err != nil {
+		return err
+	} else if after != 0 {
+		offlineAfter = after
+	}
+
+	if offlinePolicy != OfflinePolicyMedia {
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(stateCheckInterval)
+		for range ticker.C {
+			updateStreamStates()
+		}
+	}()
+
+	return nil
+}
+
+// online reports whether a stream is live according to STREAM_OFFLINE_POLICY. Status, directory, metrics and
+// events all use it, so they agree on when a stream is offline.
+func (s *stream) online() bool {
+	if !s.hasWHIPClient.Load() {
+		return false
+	} else if offlinePolicy == OfflinePolicyConnection {
+		return true
+	}
+
+	return time.Since(time.Unix(0, s.lastMediaReceived.Load())) <= offlineAfter
+}
+
+func (s *stream) state() StreamState {
+	if s.online() {
+		return StreamStateOnline
+	}
+
+	return StreamStateOffline
+}
+
+// updateStreamStates publishes stream.offline and stream.online events when the publisher of a connected stream stops
+// or resumes sending media. Viewers with a DataChannel are sent the new state.
+func updateStreamStates() {
+	type transition struct {
+		streamKey, streamer, tenant string
+		state                       StreamState
+	}
+	transitions := []transition{}
+
+	streamMapLock.Lock()
+	for streamKey, stream := range streamMap {
+		if !stream.hasWHIPClient.Load() {
+			continue
+		}
+
+		state := stream.state()
+		if state == stream.reportedState {
+			continue
+		}
+		stream.reportedState = state
+
+		if msg, err := json.Marshal(stateMessage{Type: "state", State: state}); err == nil {
+			stream.sendDataChannelMessage(msg)
+		}
+
+		streamer := ""
+		if stream.streamer != nil {
+			streamer = stream.streamer.Name
+		}
+		transitions = append(transitions, transition{streamKey: streamKey, streamer: streamer, tenant: stream.tenant(), state: state})
+	}
+	streamMapLock.Unlock()
+
+	for _, t := range transitions {
+		eventType := events.StreamOnline
+		if t.state == StreamStateOffline {
+			eventType = events.StreamOffline
+		}
+
+		events.Publish(events.Event{Type: eventType, StreamKey: t.streamKey, Streamer: t.streamer, Tenant: t.tenant})
+	}
+}
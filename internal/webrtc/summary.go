@@ -0,0 +1,257 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/objectstore"
+)
+
+const (
+	// How many summaries GetStreamSummaries returns
+	streamSummaryLimit = 50
+
+	summarySaveTimeout = 10 * time.Second
+)
+
+// StreamSummary describes how a broadcast went. It is sent as data of the stream.end event
+// and stored for the streamer to look up later.
+type StreamSummary struct {
+	StreamKey string    `json:"streamKey"`
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	// Length of the broadcast in seconds
+	Duration    int64 `json:"duration"`
+	PeakViewers int   `json:"peakViewers"`
+	// Average bitrate of all tracks in bits per second
+	AverageBitrate uint64 `json:"averageBitrate"`
+	// Video packets skipped in the sequence numbers of the publisher. Retransmissions that filled a gap later aren't
+	// subtracted, so it counts packets that arrived late or never.
+	VideoPacketsSkipped uint64        `json:"videoPacketsSkipped"`
+	ViewerDevices       ViewerDevices `json:"viewerDevices"`
+	// Recordings of the broadcast uploaded with RECORDING_UPLOAD. Uploads finish after the broadcast ended, so the
+	// summary of the stream.end event has none.
+	Recordings []SummaryRecording `json:"recordings,omitempty"`
+}
+
+// SummaryRecording is a recording of a broadcast uploaded to object storage
+type SummaryRecording struct {
+	Key string `json:"key"`
+	URL string `json:"url"`
+}
+
+// StreamAnalytics combines the summaries of recent broadcasts, of a streamer or of the stream keys of a group
+type StreamAnalytics struct {
+	Broadcasts int `json:"broadcasts"`
+	// Length of all broadcasts in seconds
+	Duration int64 `json:"duration"`
+	// Highest peak of a single broadcast
+	PeakViewers int `json:"peakViewers"`
+	// Average of the average bitrates of the broadcasts in bits per second
+	AverageBitrate uint64          `json:"averageBitrate"`
+	ViewerDevices  ViewerDevices   `json:"viewerDevices"`
+	Summaries      []StreamSummary `json:"summaries"`
+}
+
+// summary must be called with streamMapLock held
+func (s *stream) summary(streamKey string) StreamSummary {
+	endedAt := time.Now()
+	duration := endedAt.Sub(s.publishStartedAt)
+
+	averageBitrate := uint64(0)
+	if duration > 0 {
+		averageBitrate = uint64(float64(s.bytesReceived.Load()*8) / duration.Seconds())
+	}
+
+	return StreamSummary{
+		StreamKey:           streamKey,
+		StartedAt:           s.publishStartedAt,
+		EndedAt:             endedAt,
+		Duration:            int64(duration.Seconds()),
+		PeakViewers:         s.peakViewers,
+		AverageBitrate:      averageBitrate,
+		VideoPacketsSkipped: s.videoPacketsSkipped.Load(),
+		ViewerDevices:       s.viewerDevices.clone(),
+	}
+}
+
+// ConfigureStreamSummaries stores the summary of every stream that ends
+func ConfigureStreamSummaries(pool *pgxpool.Pool) {
+	events.Subscribe(func(e events.Event) {
+		summary, ok := e.Data.(StreamSummary)
+		if e.Type != events.StreamEnd || e.Streamer == "" || !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), summarySaveTimeout)
+		defer cancel()
+
+		if err := SaveStreamSummary(pool, ctx, e.Streamer, summary); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+func SaveStreamSummary(pool *pgxpool.Pool, ctx context.Context, streamer string, summary StreamSummary) error {
+	query := `INSERT INTO stream_summaries (streamer, stream_key, started_at, ended_at, peak_viewers, average_bitrate, video_packets_skipped, viewer_devices)
+		 VALUES (@streamer, @streamKey, @startedAt, @endedAt, @peakViewers, @averageBitrate, @videoPacketsSkipped, @viewerDevices)`
+	if _, err := pool.Exec(ctx, query, pgx.NamedArgs{
+		"streamer":            streamer,
+		"streamKey":           summary.StreamKey,
+		"startedAt":           summary.StartedAt,
+		"endedAt":             summary.EndedAt,
+		"peakViewers":         summary.PeakViewers,
+		"averageBitrate":      summary.AverageBitrate,
+		"videoPacketsSkipped": summary.VideoPacketsSkipped,
+		"viewerDevices":       summary.ViewerDevices,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Exec failed: %v\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetStreamSummaries returns the summaries of the most recent broadcasts of streamer
+func GetStreamSummaries(pool *pgxpool.Pool, ctx context.Context, streamer string) ([]StreamSummary, error) {
+	query := `SELECT stream_key, started_at, ended_at, peak_viewers, average_bitrate, video_packets_skipped, COALESCE(viewer_devices, '{}')
+		 FROM stream_summaries
+		 WHERE streamer = @streamer
+		 ORDER BY ended_at DESC
+		 LIMIT @limit`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
+		"streamer": streamer,
+		"limit":    streamSummaryLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summaries, err := pgx.CollectRows(rows, scanStreamSummary)
+	if err != nil {
+		return nil, err
+	}
+
+	return summaries, addSummaryRecordings(pool, ctx, summaries)
+}
+
+// GetStreamKeySummaries returns the summaries of the most recent broadcasts on streamKey
+func GetStreamKeySummaries(pool *pgxpool.Pool, ctx context.Context, streamKey string) ([]StreamSummary, error) {
+	query := `SELECT stream_key, started_at, ended_at, peak_viewers, average_bitrate, video_packets_skipped, COALESCE(viewer_devices, '{}')
+		 FROM stream_summaries
+		 WHERE stream_key = @streamKey
+		 ORDER BY ended_at DESC
+		 LIMIT @limit`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
+		"streamKey": streamKey,
+		"limit":     streamSummaryLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summaries, err := pgx.CollectRows(rows, scanStreamSummary)
+	if err != nil {
+		return nil, err
+	}
+
+	return summaries, addSummaryRecordings(pool, ctx, summaries)
+}
+
+// addSummaryRecordings adds the uploaded recordings to summaries. A recording belongs to the last broadcast on its
+// stream key that started before it was uploaded.
+func addSummaryRecordings(pool *pgxpool.Pool, ctx context.Context, summaries []StreamSummary) error {
+	if len(summaries) == 0 {
+		return nil
+	}
+
+	streamKeys, startedAt := []string{}, summaries[0].StartedAt
+	for _, summary := range summaries {
+		if !slices.Contains(streamKeys, summary.StreamKey) {
+			streamKeys = append(streamKeys, summary.StreamKey)
+		}
+		if summary.StartedAt.Before(startedAt) {
+			startedAt = summary.StartedAt
+		}
+	}
+
+	query := `SELECT stream_key, object_key, created_at FROM recording_objects
+		 WHERE stream_key = ANY(@streamKeys) AND created_at >= @startedAt
+		 ORDER BY created_at, id`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
+		"streamKeys": streamKeys,
+		"startedAt":  startedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var streamKey, key string
+		var createdAt time.Time
+		if err := rows.Scan(&streamKey, &key, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+
+		broadcast := -1
+		for i, summary := range summaries {
+			if summary.StreamKey == streamKey && !summary.StartedAt.After(createdAt) &&
+				(broadcast == -1 || summary.StartedAt.After(summaries[broadcast].StartedAt)) {
+				broadcast = i
+			}
+		}
+
+		if broadcast != -1 {
+			summaries[broadcast].Recordings = append(summaries[broadcast].Recordings, SummaryRecording{Key: key, URL: objectstore.URL(key)})
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetStreamerAnalytics combines the summaries of the most recent broadcasts of streamer
+func GetStreamerAnalytics(pool *pgxpool.Pool, ctx context.Context, streamer string) (*StreamAnalytics, error) {
+	summaries, err := GetStreamSummaries(pool, ctx, streamer)
+	if err != nil {
+		return nil, err
+	}
+
+	return analyzeStreamSummaries(summaries), nil
+}
+
+// analyzeStreamSummaries combines summaries, ordered newest first
+func analyzeStreamSummaries(summaries []StreamSummary) *StreamAnalytics {
+	analytics := &StreamAnalytics{Summaries: summaries}
+	if analytics.Summaries == nil {
+		analytics.Summaries = []StreamSummary{}
+	}
+
+	bitrates := uint64(0)
+	for _, summary := range analytics.Summaries {
+		analytics.Broadcasts++
+		analytics.Duration += summary.Duration
+		analytics.PeakViewers = max(analytics.PeakViewers, summary.PeakViewers)
+		analytics.ViewerDevices.merge(summary.ViewerDevices)
+		bitrates += summary.AverageBitrate
+	}
+
+	if analytics.Broadcasts > 0 {
+		analytics.AverageBitrate = bitrates / uint64(analytics.Broadcasts)
+	}
+	return analytics
+}
+
+func scanStreamSummary(row pgx.CollectableRow) (StreamSummary, error) {
+	var s StreamSummary
+	err := row.Scan(&s.StreamKey, &s.StartedAt, &s.EndedAt, &s.PeakViewers, &s.AverageBitrate, &s.VideoPacketsSkipped, &s.ViewerDevices)
+	s.Duration = int64(s.EndedAt.Sub(s.StartedAt).Seconds())
+	return s, err
+}
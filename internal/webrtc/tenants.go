@@ -0,0 +1,227 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/events"
+)
+
+const tenantWebhookTimeout = 10 * time.Second
+
+// Tenant is an organization sharing this deployment. Its admins manage only its streamers, and its
+// quotas apply to all of its streams together.
+type Tenant struct {
+	Name string `json:"name"`
+	// Only set when a tenant is saved, the token is stored hashed like auth tokens
+	AdminToken string `json:"adminToken,omitempty"`
+	// Concurrently live streams and viewers of all streams of the tenant, zero is unlimited
+	MaxStreams int `json:"maxStreams"`
+	MaxViewers int `json:"maxViewers"`
+	// Receives the events of the tenant's streams, in addition to EVENT_WEBHOOK_URL
+	WebhookURL string `json:"webhookUrl,omitempty"`
+}
+
+var (
+	ErrTenantStreamLimit = errors.New("Tenant reached its stream limit")
+	ErrTenantViewerLimit = errors.New("Tenant reached its viewer limit")
+
+	ErrAdminTokenInUse = errors.New("Admin token is used by another tenant")
+)
+
+// TenantByAdminToken returns the tenant administered with adminToken, nil if there is none. Admin tokens are
+// stored hashed, the tenants with the lookup of adminToken are fetched and the token is verified against each.
+func TenantByAdminToken(pool *pgxpool.Pool, ctx context.Context, adminToken string) *Tenant {
+	query := `SELECT name, admin_token, max_streams, max_viewers, webhook_url FROM tenants
+		 WHERE admin_token_lookup = @lookup OR (admin_token_lookup = '' AND admin_token = @adminToken)`
+	rows, err := pool.Query(ctx, query, pgx.NamedArgs{
+		"lookup":     authTokenLookup(adminToken),
+		"adminToken": adminToken,
+	})
+	if err != nil {
+		return nil
+	}
+
+	candidates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (t Tenant, err error) {
+		err = row.Scan(&t.Name, &t.AdminToken, &t.MaxStreams, &t.MaxViewers, &t.WebhookURL)
+		return t, err
+	})
+	if err != nil {
+		return nil
+	}
+
+	for _, t := range candidates {
+		if verifyAuthToken(adminToken, t.AdminToken) {
+			t.AdminToken = ""
+			return &t
+		}
+	}
+
+	return nil
+}
+
+// GetTenant returns the tenant called name, pgx.ErrNoRows if there is none
+func GetTenant(pool *pgxpool.Pool, ctx context.Context, name string) (*Tenant, error) {
+	query := `SELECT name, max_streams, max_viewers, webhook_url FROM tenants
+		 WHERE name = @name`
+	t := new(Tenant)
+	if err := pool.QueryRow(ctx, query, pgx.NamedArgs{"name": name}).Scan(
+		&t.Name, &t.MaxStreams, &t.MaxViewers, &t.WebhookURL,
+	); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// PutTenant creates the tenant or replaces its settings, it returns whether the tenant was created. The admin token
+// is stored as its hash, ErrAdminTokenInUse if another tenant already has it.
+func PutTenant(pool *pgxpool.Pool, ctx context.Context, t Tenant) (bool, error) {
+	if other := TenantByAdminToken(pool, ctx, t.AdminToken); other != nil && other.Name != t.Name {
+		return false, ErrAdminTokenInUse
+	}
+
+	args := pgx.NamedArgs{
+		"name":             t.Name,
+		"adminTokenLookup": authTokenLookup(t.AdminToken),
+		"maxStreams":       t.MaxStreams,
+		"maxViewers":       t.MaxViewers,
+		"webhookUrl":       t.WebhookURL,
+	}
+
+	// Hashes are salted, the stored hash is kept if the token didn't change so the same tenant changes nothing
+	var storedAdminToken string
+	err := pool.QueryRow(ctx, `SELECT admin_token FROM tenants WHERE name = @name`, args).Scan(&storedAdminToken)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return false, err
+	} else if err == nil && strings.HasPrefix(storedAdminToken, authTokenHashPrefix) && verifyAuthToken(t.AdminToken, storedAdminToken) {
+		args["adminToken"] = storedAdminToken
+	} else if args["adminToken"], err = hashAuthToken(t.AdminToken); err != nil {
+		return false, err
+	}
+
+	query := `INSERT INTO tenants (name, admin_token, admin_token_lookup, max_streams, max_viewers, webhook_url)
+		 VALUES (@name, @adminToken, @adminTokenLookup, @maxStreams, @maxViewers, @webhookUrl)
+		 ON CONFLICT (name) DO UPDATE SET admin_token = EXCLUDED.admin_token, admin_token_lookup = EXCLUDED.admin_token_lookup,
+		 max_streams = EXCLUDED.max_streams, max_viewers = EXCLUDED.max_viewers, webhook_url = EXCLUDED.webhook_url
+		 RETURNING xmax = 0`
+	created := false
+	err = pool.QueryRow(ctx, query, args).Scan(&created)
+
+	return created, err
+}
+
+// DeleteTenant removes the tenant called name. Its streamers are kept and fall back to no tenant.
+func DeleteTenant(pool *pgxpool.Pool, ctx context.Context, name string) error {
+	_, err := pool.Exec(ctx, `DELETE FROM tenants WHERE name = @name`, pgx.NamedArgs{"name": name})
+	return err
+}
+
+// StreamTenant returns the tenant of a live stream, empty if it has none or is not live
+func StreamTenant(streamKey string) string {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	if stream, ok := streamMap[streamKey]; ok {
+		return stream.tenant()
+	}
+
+	return ""
+}
+
+// tenant must be called with streamMapLock held
+func (s *stream) tenant() string {
+	if s.streamer == nil || s.streamer.Tenant == nil {
+		return ""
+	}
+
+	return s.streamer.Tenant.Name
+}
+
+// checkTenantStreamLimit returns ErrTenantStreamLimit if streamer may not start another stream. Must be called
+// with streamMapLock held.
+func checkTenantStreamLimit(streamer *Streamer) error {
+	if streamer.Tenant == nil || streamer.Tenant.MaxStreams == 0 {
+		return nil
+	}
+
+	if tenantLiveStreams(streamer.Tenant.Name, streamer.StreamKey) >= streamer.Tenant.MaxStreams {
+		return ErrTenantStreamLimit
+	}
+	return nil
+}
+
+// checkTenantViewerLimit returns ErrTenantViewerLimit if s may not get another viewer. Must be called with
+// streamMapLock held.
+func (s *stream) checkTenantViewerLimit() error {
+	if s.streamer == nil || s.streamer.Tenant == nil || s.streamer.Tenant.MaxViewers == 0 {
+		return nil
+	}
+
+	if tenantViewers(s.streamer.Tenant.Name) >= s.streamer.Tenant.MaxViewers {
+		return ErrTenantViewerLimit
+	}
+	return nil
+}
+
+// tenantLiveStreams counts the live streams of tenant other than exceptStreamKey. Must be called with
+// streamMapLock held.
+func tenantLiveStreams(tenant, exceptStreamKey string) (live int) {
+	for _, stream := range streamMap {
+		if stream.hasWHIPClient.Load() && stream.tenant() == tenant && stream.streamer.StreamKey != exceptStreamKey {
+			live++
+		}
+	}
+
+	return
+}
+
+// tenantViewers counts the viewers of every stream of tenant, including those still negotiating. Must be
+// called with streamMapLock held.
+func tenantViewers(tenant string) (viewers int) {
+	for _, stream := range streamMap {
+		if stream.tenant() != tenant {
+			continue
+		}
+
+		viewers += Sessions.viewers(stream) + stream.pendingWHEPSessions
+	}
+
+	return
+}
+
+// ConfigureTenantWebhooks sends the events of every stream to the webhook of its tenant
+func ConfigureTenantWebhooks(pool *pgxpool.Pool) {
+	events.Subscribe(func(e events.Event) {
+		if e.Tenant == "" {
+			e.Tenant = StreamTenant(e.StreamKey)
+		}
+		if e.Tenant == "" {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), tenantWebhookTimeout)
+		defer cancel()
+
+		tenant, err := GetTenant(pool, ctx, e.Tenant)
+		if err != nil || tenant.WebhookURL == "" {
+			return
+		}
+
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if err := events.PostJSON(tenant.WebhookURL, body); err != nil {
+			log.Printf("Webhook of tenant %s failed: %v", tenant.Name, err)
+		}
+	})
+}
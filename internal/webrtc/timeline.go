@@ -0,0 +1,148 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Seconds between the NTP epoch (1900) and the Unix epoch
+	ntpUnixOffset = 2208988800
+
+	// Gap between the last packet before and the first packet after a publisher reconnected
+	timelineReconnectGap = 33 * time.Millisecond
+
+	// The timeline follows the server clock by moving 1/timelineSlew of the drift per packet. A drift
+	// above timelineResyncDrift is a jump of the publisher clock and corrected at once.
+	timelineSlew        = 1000
+	timelineResyncDrift = 5 * time.Second
+)
+
+type (
+	// outputTimeline gives the packets of a stream presentation times for outputs that repackage it. Audio
+	// and video are placed on the publisher's NTP clock (from its sender reports), which keeps them in sync.
+	// That clock is slowly pulled to the server clock so long recordings don't drift, and a publisher that
+	// reconnects continues where the previous one ended.
+	outputTimeline struct {
+		mu      sync.Mutex
+		session *timelineSession
+		lastPTS time.Duration
+	}
+
+	// timelineSession is the part of the timeline of one publisher
+	timelineSession struct {
+		started       bool
+		offset        time.Duration
+		startPTS      time.Duration
+		startArrival  time.Time
+		discontinuity bool
+
+		// Moves the publisher's NTP clock onto the arrival estimate tracks use until the first sender
+		// report, so the first report does not make the timeline jump. Shared by all tracks to keep them in sync.
+		reportCorrection    time.Duration
+		reportCorrectionSet bool
+	}
+
+	// trackTimeline unwraps the RTP timestamps of one publisher track
+	trackTimeline struct {
+		session      *timelineSession
+		lastRTP      uint32
+		extended     int64
+		firstArrival time.Time
+		lastPTS      time.Duration
+	}
+)
+
+// newSession starts the timeline of a new publisher. Must be called before its first packet.
+func (t *outputTimeline) newSession() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.session = &timelineSession{discontinuity: t.session != nil && t.session.started}
+}
+
+// now returns the presentation time of the latest packet
+func (t *outputTimeline) now() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.lastPTS
+}
+
+// pts returns the presentation time of a packet and if it is the first after a reconnect
+func (t *outputTimeline) pts(track *trackTimeline, source *senderReportSource, rtpTimestamp, clockRate uint32, arrival time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.session == nil {
+		t.session = &timelineSession{}
+	}
+	session := t.session
+
+	if track.session != session {
+		*track = trackTimeline{session: session, lastRTP: rtpTimestamp, firstArrival: arrival}
+	}
+	track.extended += int64(int32(rtpTimestamp - track.lastRTP))
+	track.lastRTP = rtpTimestamp
+
+	publisherTime, reportTime, hasReport := track.publisherTime(source, rtpTimestamp, clockRate)
+	if hasReport {
+		if !session.reportCorrectionSet {
+			session.reportCorrection, session.reportCorrectionSet = publisherTime-reportTime, true
+		}
+		publisherTime = reportTime + session.reportCorrection
+	}
+
+	discontinuity := false
+	if !session.started {
+		startPTS := time.Duration(0)
+		if session.discontinuity {
+			startPTS = t.lastPTS + timelineReconnectGap
+		}
+
+		session.started, session.startPTS, session.startArrival = true, startPTS, arrival
+		session.offset = startPTS - publisherTime
+		discontinuity, session.discontinuity = session.discontinuity, false
+	}
+
+	pts := publisherTime + session.offset
+	drift := session.startPTS + arrival.Sub(session.startArrival) - pts
+	if drift > timelineResyncDrift || drift < -timelineResyncDrift {
+		session.offset += drift
+	} else {
+		session.offset += drift / timelineSlew
+	}
+	pts = publisherTime + session.offset
+
+	// Presentation times of a track never go backwards
+	pts = max(pts, track.lastPTS)
+	track.lastPTS = pts
+	t.lastPTS = max(t.lastPTS, pts)
+
+	return pts, discontinuity
+}
+
+// publisherTime estimates when a packet was captured from when the track's first packet arrived, as duration
+// since the Unix epoch. If the publisher sent a sender report, reportTime is the capture time on its NTP clock.
+func (track *trackTimeline) publisherTime(source *senderReportSource, rtpTimestamp, clockRate uint32) (estimate, reportTime time.Duration, hasReport bool) {
+	estimate = time.Duration(track.firstArrival.UnixNano())
+	if clockRate == 0 {
+		return estimate, 0, false
+	}
+	estimate += ticksToDuration(track.extended, clockRate)
+
+	source.mu.Lock()
+	ntpTime, rtpTime, hasReport := source.ntpTime, source.rtpTime, !source.receivedAt.IsZero()
+	source.mu.Unlock()
+
+	if !hasReport {
+		return estimate, 0, false
+	}
+
+	reportTime = time.Duration(ntpTime>>32-ntpUnixOffset)*time.Second + time.Duration((ntpTime&0xFFFFFFFF)*uint64(time.Second)>>32)
+	return estimate, reportTime + ticksToDuration(int64(int32(rtpTimestamp-rtpTime)), clockRate), true
+}
+
+func ticksToDuration(ticks int64, clockRate uint32) time.Duration {
+	return time.Duration(ticks * int64(time.Second) / int64(clockRate))
+}
@@ -11,6 +11,8 @@ type trackMultiCodec struct {
 
 	payloadTypeH264, payloadTypeH265, payloadTypeVP8, payloadTypeVP9, payloadTypeAV1 uint8
 
+	playoutDelayExtensionID uint8
+
 	id, rid, streamID string
 }
 
@@ -34,6 +36,12 @@ func (t *trackMultiCodec) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecPar
 		}
 	}
 
+	for _, headerExtension := range ctx.HeaderExtensions() {
+		if headerExtension.URI == playoutDelayExtensionURI {
+			t.playoutDelayExtensionID = uint8(headerExtension.ID)
+		}
+	}
+
 	return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, RTCPFeedback: videoRTCPFeedback}}, nil
 }
 
@@ -42,6 +50,11 @@ func (t *trackMultiCodec) Unbind(webrtc.TrackLocalContext) error {
 }
 
 func (t *trackMultiCodec) WriteRTP(p *rtp.Packet, codec videoTrackCodec) error {
+	// Track was added but not negotiated by the remote
+	if t.writeStream == nil {
+		return nil
+	}
+
 	p.Header.SSRC = uint32(t.ssrc)
 
 	switch codec {
@@ -0,0 +1,214 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// ErrInvalidSDPFragment is returned for PATCH bodies that are no application/trickle-ice-sdpfrag
+var ErrInvalidSDPFragment = errors.New("Invalid trickle-ice-sdpfrag")
+
+// sdpFragment is a parsed application/trickle-ice-sdpfrag body, see RFC 8840
+type sdpFragment struct {
+	ufrag, pwd string
+	candidates []webrtc.ICECandidateInit
+}
+
+func parseSDPFragment(body string) (sdpFragment, error) {
+	fragment := sdpFragment{}
+	mid, mLineIndex := "", -1
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "m="):
+			mid, mLineIndex = "", mLineIndex+1
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			fragment.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			fragment.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			if mLineIndex == -1 {
+				return sdpFragment{}, ErrInvalidSDPFragment
+			}
+
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				candidateMid := mid
+				candidate.SDPMid = &candidateMid
+			}
+			index := uint16(mLineIndex)
+			candidate.SDPMLineIndex = &index
+			fragment.candidates = append(fragment.candidates, candidate)
+		case strings.HasPrefix(line, "a="):
+			// a=end-of-candidates, a=ice-options and others carry nothing that pion needs
+		default:
+			return sdpFragment{}, ErrInvalidSDPFragment
+		}
+	}
+
+	if (fragment.ufrag == "") != (fragment.pwd == "") {
+		return sdpFragment{}, ErrInvalidSDPFragment
+	}
+
+	return fragment, nil
+}
+
+// WHIPPatch applies an application/trickle-ice-sdpfrag of a publisher. Candidates are added to its PeerConnection.
+// New ICE credentials restart ICE, the returned fragment then carries the credentials and candidates of Broadcast
+// Box. It is empty if ICE wasn't restarted.
+func WHIPPatch(ctx context.Context, streamKey, whipSessionId, body string) (string, error) {
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() || stream.whipSessionId != whipSessionId || stream.whipPeerConnection == nil {
+		streamMapLock.Unlock()
+		return "", ErrUnknownWHIPSession
+	}
+	peerConnection := stream.whipPeerConnection
+	streamMapLock.Unlock()
+
+	return patchPeerConnection(ctx, peerConnection, whipSessionId, SessionWHIP, streamKey, body, ErrUnknownWHIPSession)
+}
+
+// WHEPPatch applies an application/trickle-ice-sdpfrag of a viewer, like WHIPPatch does for publishers
+func WHEPPatch(ctx context.Context, whepSessionId, body string) (string, error) {
+	streamMapLock.Lock()
+	streamKey, whepSession, ok := getWHEPSession(whepSessionId)
+	streamMapLock.Unlock()
+	if !ok {
+		return "", ErrUnknownWHEPSession
+	}
+
+	return patchPeerConnection(ctx, whepSession.peerConnection, whepSessionId, SessionWHEP, streamKey, body, ErrUnknownWHEPSession)
+}
+
+// patchPeerConnection adds the candidates of a fragment to peerConnection and restarts ICE for new credentials.
+// errUnknown is returned if the session ended before it was negotiated.
+func patchPeerConnection(ctx context.Context, peerConnection *webrtc.PeerConnection, sessionId string, kind SessionKind, streamKey, body string, errUnknown error) (string, error) {
+	captureSignaling(sessionId, kind, streamKey, SignalingRemoteCandidate, body)
+
+	fragment, err := parseSDPFragment(body)
+	if err != nil {
+		return "", err
+	}
+
+	remoteDescription := peerConnection.RemoteDescription()
+	if remoteDescription == nil {
+		return "", errUnknown
+	}
+
+	restart := fragment.ufrag != "" && fragment.ufrag != iceUfrag(remoteDescription.SDP)
+	if restart {
+		offer, err := replaceICECredentials(remoteDescription.SDP, fragment.ufrag, fragment.pwd)
+		if err != nil {
+			return "", err
+		}
+
+		if err = negotiate(ctx, peerConnection, offer); err != nil {
+			return "", err
+		}
+	}
+
+	for _, candidate := range fragment.candidates {
+		if err := peerConnection.AddICECandidate(candidate); err != nil {
+			return "", err
+		}
+	}
+
+	if !restart {
+		return "", nil
+	}
+
+	answer := appendAnswer(peerConnection.LocalDescription().SDP)
+	captureSignaling(sessionId, kind, streamKey, SignalingAnswer, answer)
+	return localSDPFragment(answer)
+}
+
+// iceUfrag returns the ICE username fragment of a session description, empty if it can't be parsed
+func iceUfrag(description string) string {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(description)); err != nil {
+		return ""
+	}
+
+	if ufrag, ok := parsed.Attribute("ice-ufrag"); ok {
+		return ufrag
+	}
+	for _, media := range parsed.MediaDescriptions {
+		if ufrag, ok := media.Attribute("ice-ufrag"); ok {
+			return ufrag
+		}
+	}
+
+	return ""
+}
+
+// replaceICECredentials turns the offer of a publisher into the offer of an ICE restart with new credentials
+func replaceICECredentials(offer, ufrag, pwd string) (string, error) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer)); err != nil {
+		return "", err
+	}
+
+	withoutICE := func(attributes []sdp.Attribute) []sdp.Attribute {
+		kept := []sdp.Attribute{}
+		for _, a := range attributes {
+			switch a.Key {
+			case "ice-ufrag", "ice-pwd", "candidate", "end-of-candidates":
+			default:
+				kept = append(kept, a)
+			}
+		}
+		return kept
+	}
+
+	parsed.Attributes = withoutICE(parsed.Attributes)
+	for _, media := range parsed.MediaDescriptions {
+		media.Attributes = append(withoutICE(media.Attributes),
+			sdp.NewAttribute("ice-ufrag", ufrag),
+			sdp.NewAttribute("ice-pwd", pwd),
+		)
+	}
+
+	marshaled, err := parsed.Marshal()
+	if err != nil {
+		return "", err
+	}
+
+	return string(marshaled), nil
+}
+
+// localSDPFragment returns the ICE credentials and candidates of an answer as an application/trickle-ice-sdpfrag
+func localSDPFragment(answer string) (string, error) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(answer)); err != nil {
+		return "", err
+	}
+
+	fragment := strings.Builder{}
+	for i, media := range parsed.MediaDescriptions {
+		if i == 0 {
+			ufrag, _ := media.Attribute("ice-ufrag")
+			pwd, _ := media.Attribute("ice-pwd")
+			fragment.WriteString("a=ice-ufrag:" + ufrag + "\r\n")
+			fragment.WriteString("a=ice-pwd:" + pwd + "\r\n")
+		}
+
+		fragment.WriteString("m=" + media.MediaName.String() + "\r\n")
+		if mid, ok := media.Attribute("mid"); ok {
+			fragment.WriteString("a=mid:" + mid + "\r\n")
+		}
+		for _, a := range media.Attributes {
+			if a.Key == "candidate" || a.Key == "end-of-candidates" {
+				fragment.WriteString("a=" + a.String() + "\r\n")
+			}
+		}
+	}
+
+	return fragment.String(), nil
+}
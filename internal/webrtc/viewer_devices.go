@@ -0,0 +1,193 @@
+package webrtc
+
+import (
+	"errors"
+	"maps"
+	"strings"
+)
+
+const viewerDeviceUnknown = "unknown"
+
+// ViewerDevices counts the viewers of a broadcast by what they watched on. It is part of the StreamSummary so
+// streamers can see if publishing H.265 or AV1 would reach enough of their audience.
+type ViewerDevices struct {
+	Browsers         map[string]int `json:"browsers"`
+	OperatingSystems map[string]int `json:"operatingSystems"`
+	// mobile, tablet, desktop or unknown
+	Classes map[string]int `json:"classes"`
+	// Codec each viewer was sent, `none` if their offer didn't support the codec of the publisher
+	VideoCodecs map[string]int `json:"videoCodecs"`
+	// How many viewers could have received each codec, from their offer
+	SupportedVideoCodecs map[string]int `json:"supportedVideoCodecs"`
+}
+
+type viewerDevice struct {
+	browser, operatingSystem, class, videoCodec string
+	supportedVideoCodecs                        []string
+}
+
+var (
+	// Checked in order, Chromium based browsers also claim to be Chrome and Safari
+	viewerBrowsers = []struct{ token, name string }{
+		{"edg/", "edge"}, {"opr/", "opera"}, {"samsungbrowser/", "samsung"}, {"firefox/", "firefox"}, {"fxios/", "firefox"},
+		{"crios/", "chrome"}, {"chrome/", "chrome"}, {"safari/", "safari"},
+	}
+	viewerOperatingSystems = []struct{ token, name string }{
+		{"android", "android"}, {"iphone", "ios"}, {"ipad", "ios"}, {"ipod", "ios"}, {"windows", "windows"},
+		{"cros", "chromeos"}, {"mac os x", "macos"}, {"macintosh", "macos"}, {"linux", "linux"},
+	}
+
+	videoTrackCodecNames = map[videoTrackCodec]string{
+		videoTrackCodecH264: "h264",
+		videoTrackCodecVP8:  "vp8",
+		videoTrackCodecVP9:  "vp9",
+		videoTrackCodecAV1:  "av1",
+		videoTrackCodecH265: "h265",
+	}
+)
+
+func classifyUserAgent(userAgent string) (browser, operatingSystem, class string) {
+	userAgent = strings.ToLower(userAgent)
+	browser, operatingSystem, class = viewerDeviceUnknown, viewerDeviceUnknown, viewerDeviceUnknown
+	if userAgent == "" {
+		return
+	}
+
+	for _, b := range viewerBrowsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, o := range viewerOperatingSystems {
+		if strings.Contains(userAgent, o.token) {
+			operatingSystem = o.name
+			break
+		}
+	}
+
+	switch {
+	case strings.Contains(userAgent, "ipad") || strings.Contains(userAgent, "tablet"):
+		class = "tablet"
+	case strings.Contains(userAgent, "mobi") || strings.Contains(userAgent, "iphone"):
+		class = "mobile"
+	// Android tablets leave out Mobile
+	case operatingSystem == "android":
+		class = "tablet"
+	case operatingSystem != viewerDeviceUnknown:
+		class = "desktop"
+	}
+
+	return
+}
+
+// supportedVideoCodecs returns the codecs negotiated for the video track of a viewer
+func (t *trackMultiCodec) supportedVideoCodecs() []videoTrackCodec {
+	codecs := []videoTrackCodec{}
+	for codec, payloadType := range map[videoTrackCodec]uint8{
+		videoTrackCodecH264: t.payloadTypeH264,
+		videoTrackCodecVP8:  t.payloadTypeVP8,
+		videoTrackCodecVP9:  t.payloadTypeVP9,
+		videoTrackCodecAV1:  t.payloadTypeAV1,
+		videoTrackCodecH265: t.payloadTypeH265,
+	} {
+		if payloadType != 0 {
+			codecs = append(codecs, codec)
+		}
+	}
+
+	return codecs
+}
+
+// RecordViewerDevice classifies a WHEP session by the User-Agent of its request and what its offer negotiated, and
+// counts it for the summary of the broadcast. Resumed sessions were counted when they first joined.
+func RecordViewerDevice(whepSessionId, userAgent string) error {
+	if info, ok := Sessions.get(whepSessionId); ok && info.ResumedFrom != "" {
+		return nil
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	streamKey, session, ok := getWHEPSession(whepSessionId)
+	if !ok {
+		return errors.New("WHEP session does not exist")
+	}
+	stream := streamMap[streamKey]
+
+	device := viewerDevice{videoCodec: "none"}
+	device.browser, device.operatingSystem, device.class = classifyUserAgent(userAgent)
+
+	publisherCodec := videoTrackCodec(0)
+	if len(stream.videoTracks) != 0 {
+		mimeType, _ := stream.videoTracks[0].mimeType.Load().(string)
+		publisherCodec = getVideoTrackCodec(mimeType)
+	}
+
+	for _, codec := range session.videoTrack.supportedVideoCodecs() {
+		device.supportedVideoCodecs = append(device.supportedVideoCodecs, videoTrackCodecNames[codec])
+		if codec == publisherCodec {
+			device.videoCodec = videoTrackCodecNames[codec]
+		}
+	}
+
+	// Viewers that joined before the publisher are sent whatever it publishes later
+	if publisherCodec == 0 {
+		device.videoCodec = viewerDeviceUnknown
+	}
+
+	stream.viewerDevices.add(device)
+	return nil
+}
+
+func (v *ViewerDevices) init() {
+	if v.Browsers == nil {
+		*v = ViewerDevices{
+			Browsers:             map[string]int{},
+			OperatingSystems:     map[string]int{},
+			Classes:              map[string]int{},
+			VideoCodecs:          map[string]int{},
+			SupportedVideoCodecs: map[string]int{},
+		}
+	}
+}
+
+func (v *ViewerDevices) add(device viewerDevice) {
+	v.init()
+
+	v.Browsers[device.browser]++
+	v.OperatingSystems[device.operatingSystem]++
+	v.Classes[device.class]++
+	v.VideoCodecs[device.videoCodec]++
+	for _, codec := range device.supportedVideoCodecs {
+		v.SupportedVideoCodecs[codec]++
+	}
+}
+
+// clone copies the counts, so a summary isn't changed by viewers that join later
+func (v ViewerDevices) clone() ViewerDevices {
+	return ViewerDevices{
+		Browsers:             maps.Clone(v.Browsers),
+		OperatingSystems:     maps.Clone(v.OperatingSystems),
+		Classes:              maps.Clone(v.Classes),
+		VideoCodecs:          maps.Clone(v.VideoCodecs),
+		SupportedVideoCodecs: maps.Clone(v.SupportedVideoCodecs),
+	}
+}
+
+// merge adds the counts of other, e.g. to combine the broadcasts of a stream group
+func (v *ViewerDevices) merge(other ViewerDevices) {
+	v.init()
+
+	addCounts := func(counts, other map[string]int) {
+		for name, count := range other {
+			counts[name] += count
+		}
+	}
+	addCounts(v.Browsers, other.Browsers)
+	addCounts(v.OperatingSystems, other.OperatingSystems)
+	addCounts(v.Classes, other.Classes)
+	addCounts(v.VideoCodecs, other.VideoCodecs)
+	addCounts(v.SupportedVideoCodecs, other.SupportedVideoCodecs)
+}
@@ -2,10 +2,12 @@ package webrtc
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"os"
@@ -15,6 +17,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/patrikrog/broadcast-box/internal/events"
 	"github.com/pion/dtls/v3/pkg/crypto/elliptic"
 	"github.com/pion/ice/v3"
 	"github.com/pion/interceptor"
@@ -24,6 +27,8 @@ import (
 const (
 	videoTrackLabelDefault = "default"
 
+	playoutDelayExtensionURI = "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay"
+
 	videoTrackCodecH264 videoTrackCodec = iota + 1
 	videoTrackCodecVP8
 	videoTrackCodecVP9
@@ -40,8 +45,10 @@ type (
 		firstSeenEpoch uint64
 
 		videoTracks []*videoTrack
+		// Closed when a video layer starts sending or changes, see WHEPLayersChanged
+		layersChanged chan struct{}
 
-		audioTrack           *webrtc.TrackLocalStaticRTP
+		audioTracks          []*audioTrack
 		audioPacketsReceived atomic.Uint64
 
 		pliChan chan any
@@ -49,15 +56,93 @@ type (
 		whipActiveContext       context.Context
 		whipActiveContextCancel func()
 
+		// PeerConnection and session ID of the current publisher, replaced on takeover
+		whipPeerConnection *webrtc.PeerConnection
+		whipSessionId      string
+
+		// Connection of the publisher instead of whipPeerConnection if it uses RTMP, closing it ends the publisher
+		rtmpConn io.Closer
+
+		// Unix time in nanoseconds of the last media packet of the publisher
+		lastMediaReceived atomic.Int64
+
+		// Used for the summary sent when the stream ends
+		publishStartedAt    time.Time
+		peakViewers         int
+		viewerDevices       ViewerDevices
+		bytesReceived       atomic.Uint64
+		videoPacketsSkipped atomic.Uint64
+
+		// Set with SetStreamMute
+		audioMuted, videoMuted atomic.Bool
+
+		keyframeCacheBytes     atomic.Int64
+		keyframeCacheEvictions atomic.Uint64
+		keyframeCacheReplays   atomic.Uint64
+
 		whepSessionsLock sync.RWMutex
 		whepSessions     map[string]*whepSession
-		streamer		*Streamer
+		streamer         *Streamer
+
+		// WHEP sessions that are negotiating, guarded by streamMapLock
+		pendingWHEPSessions int
+
+		// Generated video is sent to the viewers, see startBandwidthTest
+		bandwidthTestRunning atomic.Bool
+
+		// State last published as event, guarded by streamMapLock
+		reportedState StreamState
+
+		// Goroutines forwarding media or RTCP for this stream
+		goroutines atomic.Int64
+
+		// Co-host publishing into this stream, guarded by streamMapLock
+		guest *guestPublisher
+
+		// Viewers of HTTP outputs by ID, guarded by streamMapLock
+		httpViewers map[string]*httpViewer
+
+		// Ad break that was started and not ended yet, guarded by streamMapLock
+		adBreak       *activeAdBreak
+		nextAdBreakID uint32
+
+		// Recordings and other outputs that repackage the stream, see AttachOutput
+		timeline    outputTimeline
+		outputsLock sync.RWMutex
+		outputs     []*output
+		hasOutputs  atomic.Bool
 	}
 
 	videoTrack struct {
+		// Canonical name of the layer, the rid the publisher sent it with is publisherRID
 		rid              string
+		publisherRID     string
 		packetsReceived  atomic.Uint64
 		lastKeyFrameSeen atomic.Value
+		clock            mediaClock
+		mimeType         atomic.Value
+
+		// Resolution (if it could be parsed from keyframes) and bitrate in bits per second
+		width, height atomic.Uint32
+		bitrate       atomic.Uint64
+
+		guidance atomic.Pointer[bitrateGuidance]
+
+		// Keyframe requests for this layer alone, see requestKeyframe
+		pliChan chan any
+
+		keyframeCache keyframeCache
+		senderReports senderReportSource
+		timeline      trackTimeline
+	}
+
+	audioTrack struct {
+		// mid of the publisher's audio transceiver
+		id              string
+		language        string
+		packetsReceived atomic.Uint64
+		senderReports   senderReportSource
+		timeline        trackTimeline
 	}
 
 	videoTrackCodec int
@@ -68,8 +153,7 @@ var (
 	streamMapLock    sync.Mutex
 	apiWhip, apiWhep *webrtc.API
 
-	// nolint
-	videoRTCPFeedback = []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}}
+	videoRTCPFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
 )
 
 func getVideoTrackCodec(in string) videoTrackCodec {
@@ -93,21 +177,15 @@ func getVideoTrackCodec(in string) videoTrackCodec {
 func getStream(streamer *Streamer, streamKey string, forWHIP bool) (*stream, error) {
 	foundStream, ok := streamMap[streamKey]
 	if !ok {
-		audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
-		if err != nil {
-			return nil, err
-		}
-
 		whipActiveContext, whipActiveContextCancel := context.WithCancel(context.Background())
 
 		foundStream = &stream{
-			audioTrack:              audioTrack,
 			pliChan:                 make(chan any, 50),
 			whepSessions:            map[string]*whepSession{},
 			whipActiveContext:       whipActiveContext,
 			whipActiveContextCancel: whipActiveContextCancel,
 			firstSeenEpoch:          uint64(time.Now().Unix()),
-			streamer:				 streamer,
+			streamer:                streamer,
 		}
 		streamMap[streamKey] = foundStream
 	}
@@ -120,10 +198,35 @@ func getStream(streamer *Streamer, streamKey string, forWHIP bool) (*stream, err
 	return foundStream, nil
 }
 
+func (s *stream) sendDataChannelMessage(msg []byte) {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	for _, whepSession := range s.whepSessions {
+		whepSession.sendDataChannelMessage(msg)
+	}
+}
+
 func peerConnectionDisconnected(streamKey string, whepSessionId string) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 
+	removeSession(streamKey, whepSessionId)
+}
+
+// whipDisconnected ends the stream if peerConnection is still its publisher. A publisher that was
+// replaced by a takeover disconnects without affecting the stream.
+func whipDisconnected(streamKey string, peerConnection *webrtc.PeerConnection) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	if stream, ok := streamMap[streamKey]; ok && stream.whipPeerConnection == peerConnection {
+		removeSession(streamKey, "")
+	}
+}
+
+// removeSession must be called with streamMapLock held
+func removeSession(streamKey string, whepSessionId string) {
 	stream, ok := streamMap[streamKey]
 	if !ok {
 		return
@@ -133,15 +236,42 @@ func peerConnectionDisconnected(streamKey string, whepSessionId string) {
 	defer stream.whepSessionsLock.Unlock()
 
 	if whepSessionId != "" {
-		delete(stream.whepSessions, whepSessionId)
+		Sessions.detachWHEP(stream, whepSessionId)
 	} else {
+		if stream.hasWHIPClient.Load() {
+			stream.sendGoodbye(false, "Stream ended")
+		}
+
+		forgetQuotaWarnings(streamKey)
+		if stream.hasWHIPClient.Load() && stream.streamer != nil {
+			events.Publish(events.Event{Type: events.StreamEnd, StreamKey: streamKey, Streamer: stream.streamer.Name, Tenant: stream.tenant(), Data: stream.summary(streamKey)})
+		}
+
+		if stream.guest != nil {
+			closePeerConnection(stream.guest.peerConnection)
+		}
+
+		if stream.rtmpConn != nil {
+			stream.rtmpConn.Close()
+			stream.rtmpConn = nil
+		}
+
+		Sessions.setState(stream.whipSessionId, SessionClosed)
 		stream.hasWHIPClient.Store(false)
-		stream.videoTracks = nil
+		stream.whipPeerConnection = nil
+		stream.whipSessionId = ""
+		stream.closeVideoTracks()
+		stream.audioTracks = nil
 		stream.streamer = nil
 	}
 
-	// Only delete stream if all WHEP Sessions are gone and have no WHIP Client
-	if len(stream.whepSessions) != 0 || stream.hasWHIPClient.Load() {
+	deleteStreamIfUnused(streamKey, stream)
+}
+
+// deleteStreamIfUnused deletes the stream if all WHEP Sessions are gone, none are negotiating and it has no WHIP Client.
+// Cancelling its context stops every goroutine still working for it. Must be called with streamMapLock and whepSessionsLock held.
+func deleteStreamIfUnused(streamKey string, stream *stream) {
+	if len(stream.whepSessions) != 0 || stream.pendingWHEPSessions != 0 || stream.hasWHIPClient.Load() || stream.hasOutputs.Load() {
 		return
 	}
 
@@ -149,6 +279,45 @@ func peerConnectionDisconnected(streamKey string, whepSessionId string) {
 	delete(streamMap, streamKey)
 }
 
+// negotiate answers offer and waits for ICE gathering to complete. If the client goes away while
+// gathering, ctx is done and its error returned.
+func negotiate(ctx context.Context, peerConnection *webrtc.PeerConnection, offer string) error {
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		SDP:  offer,
+		Type: webrtc.SDPTypeOffer,
+	}); err != nil {
+		return err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	answer, err := peerConnection.CreateAnswer(nil)
+
+	if err != nil {
+		return err
+	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	select {
+	case <-gatherComplete:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// abandonNegotiation cleans up after a session failed before it was added to its stream. Closing
+// peerConnection ends the goroutines started for it. Must be called with streamMapLock held.
+func abandonNegotiation(streamKey string, peerConnection *webrtc.PeerConnection) {
+	closePeerConnection(peerConnection)
+
+	if stream, ok := streamMap[streamKey]; ok {
+		stream.whepSessionsLock.Lock()
+		deleteStreamIfUnused(streamKey, stream)
+		stream.whepSessionsLock.Unlock()
+	}
+}
+
 func addTrack(stream *stream, rid string) (*videoTrack, error) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
@@ -159,52 +328,66 @@ func addTrack(stream *stream, rid string) (*videoTrack, error) {
 		}
 	}
 
-	t := &videoTrack{rid: rid}
+	t := &videoTrack{rid: rid, keyframeCache: keyframeCache{stream: stream}, pliChan: make(chan any, 1)}
 	t.lastKeyFrameSeen.Store(time.Time{})
 	stream.videoTracks = append(stream.videoTracks, t)
 	return t, nil
 }
 
-func getPublicIP() string {
+func addAudioTrack(stream *stream, id, language string) *audioTrack {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for i := range stream.audioTracks {
+		if id == stream.audioTracks[i].id {
+			return stream.audioTracks[i]
+		}
+	}
+
+	t := &audioTrack{id: id, language: language}
+	stream.audioTracks = append(stream.audioTracks, t)
+	return t
+}
+
+func getPublicIP() (string, error) {
 	req, err := http.Get("http://ip-api.com/json/")
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	defer req.Body.Close()
 
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	ip := struct {
 		Query string
 	}{}
 	if err = json.Unmarshal(body, &ip); err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	if ip.Query == "" {
-		log.Fatal("Query entry was not populated")
+		return "", errors.New("Query entry was not populated")
 	}
 
-	return ip.Query
+	return ip.Query, nil
 }
 
-func createSettingEngine(isWHIP bool, udpMuxCache map[int]*ice.MultiUDPMuxDefault, tcpMuxCache map[string]ice.TCPMux) (settingEngine webrtc.SettingEngine) {
+func createSettingEngine(isWHIP bool, udpMuxCache map[int]*ice.MultiUDPMuxDefault, tcpMuxCache map[string]ice.TCPMux) (settingEngine webrtc.SettingEngine, err error) {
 	var (
 		NAT1To1IPs   []string
 		networkTypes []webrtc.NetworkType
 		udpMuxPort   int
 		udpMuxOpts   []ice.UDPMuxFromPortOption
-		err          error
 	)
 
 	if os.Getenv("NETWORK_TYPES") != "" {
 		for _, networkTypeStr := range strings.Split(os.Getenv("NETWORK_TYPES"), "|") {
 			networkType, err := webrtc.NewNetworkType(networkTypeStr)
 			if err != nil {
-				log.Fatal(err)
+				return settingEngine, err
 			}
 			networkTypes = append(networkTypes, networkType)
 		}
@@ -213,7 +396,11 @@ func createSettingEngine(isWHIP bool, udpMuxCache map[int]*ice.MultiUDPMuxDefaul
 	}
 
 	if os.Getenv("INCLUDE_PUBLIC_IP_IN_NAT_1_TO_1_IP") != "" {
-		NAT1To1IPs = append(NAT1To1IPs, getPublicIP())
+		publicIP, err := getPublicIP()
+		if err != nil {
+			return settingEngine, err
+		}
+		NAT1To1IPs = append(NAT1To1IPs, publicIP)
 	}
 
 	if os.Getenv("NAT_1_TO_1_IP") != "" {
@@ -240,15 +427,15 @@ func createSettingEngine(isWHIP bool, udpMuxCache map[int]*ice.MultiUDPMuxDefaul
 
 	if isWHIP && os.Getenv("UDP_MUX_PORT_WHIP") != "" {
 		if udpMuxPort, err = strconv.Atoi(os.Getenv("UDP_MUX_PORT_WHIP")); err != nil {
-			log.Fatal(err)
+			return settingEngine, err
 		}
 	} else if !isWHIP && os.Getenv("UDP_MUX_PORT_WHEP") != "" {
 		if udpMuxPort, err = strconv.Atoi(os.Getenv("UDP_MUX_PORT_WHEP")); err != nil {
-			log.Fatal(err)
+			return settingEngine, err
 		}
 	} else if os.Getenv("UDP_MUX_PORT") != "" {
 		if udpMuxPort, err = strconv.Atoi(os.Getenv("UDP_MUX_PORT")); err != nil {
-			log.Fatal(err)
+			return settingEngine, err
 		}
 	}
 
@@ -256,7 +443,7 @@ func createSettingEngine(isWHIP bool, udpMuxCache map[int]*ice.MultiUDPMuxDefaul
 		udpMux, ok := udpMuxCache[udpMuxPort]
 		if !ok {
 			if udpMux, err = ice.NewMultiUDPMuxFromPort(udpMuxPort, udpMuxOpts...); err != nil {
-				log.Fatal(err)
+				return settingEngine, err
 			}
 			udpMuxCache[udpMuxPort] = udpMux
 		}
@@ -269,12 +456,12 @@ func createSettingEngine(isWHIP bool, udpMuxCache map[int]*ice.MultiUDPMuxDefaul
 		if !ok {
 			tcpAddr, err := net.ResolveTCPAddr("tcp", os.Getenv("TCP_MUX_ADDRESS"))
 			if err != nil {
-				log.Fatal(err)
+				return settingEngine, err
 			}
 
 			tcpListener, err := net.ListenTCP("tcp", tcpAddr)
 			if err != nil {
-				log.Fatal(err)
+				return settingEngine, err
 			}
 
 			tcpMux = webrtc.NewICETCPMux(nil, tcpListener, 8)
@@ -298,61 +485,60 @@ func createSettingEngine(isWHIP bool, udpMuxCache map[int]*ice.MultiUDPMuxDefaul
 	return
 }
 
+// PopulateMediaEngine registers the codecs and header extensions of the active codec profile
 func PopulateMediaEngine(m *webrtc.MediaEngine) error {
-	for _, codec := range []webrtc.RTPCodecParameters{
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeOpus, 48000, 2, "minptime=10;useinbandfec=1", nil},
-			PayloadType:        111,
-		},
-	} {
-		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+	for _, codec := range codecProfile.AudioCodecs {
+		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    codec.MimeType,
+				ClockRate:   codec.ClockRate,
+				Channels:    codec.Channels,
+				SDPFmtpLine: codec.SDPFmtpLine,
+			},
+			PayloadType: webrtc.PayloadType(codec.PayloadType),
+		}, webrtc.RTPCodecTypeAudio); err != nil {
 			return err
 		}
 	}
 
-	for _, codecDetails := range []struct {
-		payloadType uint8
-		mimeType    string
-		sdpFmtpLine string
-	}{
-		{102, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"},
-		{104, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f"},
-		{106, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
-		{108, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f"},
-		{39, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=4d001f"},
-		{45, webrtc.MimeTypeAV1, ""},
-		{98, webrtc.MimeTypeVP9, "profile-id=0"},
-		{100, webrtc.MimeTypeVP9, "profile-id=2"},
-		{113, webrtc.MimeTypeH265, "level-id=93;profile-id=1;tier-flag=0;tx-mode=SRST"},
-	} {
+	for _, codec := range codecProfile.VideoCodecs {
 		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
 			RTPCodecCapability: webrtc.RTPCodecCapability{
-				MimeType:     codecDetails.mimeType,
-				ClockRate:    90000,
+				MimeType:     codec.MimeType,
+				ClockRate:    codec.ClockRate,
 				Channels:     0,
-				SDPFmtpLine:  codecDetails.sdpFmtpLine,
+				SDPFmtpLine:  codec.SDPFmtpLine,
 				RTCPFeedback: videoRTCPFeedback,
 			},
-			PayloadType: webrtc.PayloadType(codecDetails.payloadType),
+			PayloadType: webrtc.PayloadType(codec.PayloadType),
 		}, webrtc.RTPCodecTypeVideo); err != nil {
 			return err
 		}
 
+		if !codecProfile.RTX {
+			continue
+		}
+
 		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
 			RTPCodecCapability: webrtc.RTPCodecCapability{
 				MimeType:     "video/rtx",
-				ClockRate:    90000,
+				ClockRate:    codec.ClockRate,
 				Channels:     0,
-				SDPFmtpLine:  fmt.Sprintf("apt=%d", codecDetails.payloadType),
+				SDPFmtpLine:  fmt.Sprintf("apt=%d", codec.PayloadType),
 				RTCPFeedback: nil,
 			},
-			PayloadType: webrtc.PayloadType(codecDetails.payloadType + 1),
+			PayloadType: webrtc.PayloadType(codec.PayloadType + 1),
 		}, webrtc.RTPCodecTypeVideo); err != nil {
 			return err
 		}
 	}
 
+	for _, uri := range codecProfile.HeaderExtensions {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -367,7 +553,13 @@ func newPeerConnection(api *webrtc.API) (*webrtc.PeerConnection, error) {
 		}
 	}
 
-	return api.NewPeerConnection(cfg)
+	peerConnection, err := api.NewPeerConnection(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	openPeerConnections.Store(peerConnection, struct{}{})
+	return peerConnection, nil
 }
 
 func appendAnswer(in string) string {
@@ -391,55 +583,173 @@ func maybePrintOfferAnswer(sdp string, isOffer bool) string {
 	return sdp
 }
 
-func Configure() {
+// Configure reads the configuration of the WebRTC engine and starts its background work
+func Configure() error {
 	streamMap = map[string]*stream{}
 
+	if err := configureCodecProfile(); err != nil {
+		return err
+	} else if err = configureAuthTokens(); err != nil {
+		return err
+	} else if err = configureMediaCaches(); err != nil {
+		return err
+	} else if err = configureFirstFrame(); err != nil {
+		return err
+	} else if err = configureDiskRecording(); err != nil {
+		return err
+	} else if err = configureHLS(); err != nil {
+		return err
+	}
+
 	mediaEngine := &webrtc.MediaEngine{}
 	if err := PopulateMediaEngine(mediaEngine); err != nil {
-		panic(err)
+		return err
 	}
 
-	interceptorRegistry := &interceptor.Registry{}
-	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
-		log.Fatal(err)
+	// Viewers get their own registry, the bandwidth to them is estimated with EGRESS_CONGESTION_CONTROL
+	interceptorRegistry, whepInterceptorRegistry := &interceptor.Registry{}, &interceptor.Registry{}
+	if err := registerInterceptors(mediaEngine, interceptorRegistry, whepInterceptorRegistry); err != nil {
+		return err
+	} else if err = configureCongestionControl(whepInterceptorRegistry); err != nil {
+		return err
+	} else if err = configurePacing(whepInterceptorRegistry); err != nil {
+		return err
 	}
 
 	udpMuxCache := map[int]*ice.MultiUDPMuxDefault{}
 	tcpMuxCache := map[string]ice.TCPMux{}
+	// Closed by Shutdown, also those of a setting engine that failed
+	defer func() {
+		for _, udpMux := range udpMuxCache {
+			iceMuxes = append(iceMuxes, udpMux)
+		}
+		for _, tcpMux := range tcpMuxCache {
+			iceMuxes = append(iceMuxes, tcpMux)
+		}
+	}()
+
+	whipSettingEngine, err := createSettingEngine(true, udpMuxCache, tcpMuxCache)
+	if err != nil {
+		return err
+	}
+	whepSettingEngine, err := createSettingEngine(false, udpMuxCache, tcpMuxCache)
+	if err != nil {
+		return err
+	}
 
 	apiWhip = webrtc.NewAPI(
 		webrtc.WithMediaEngine(mediaEngine),
 		webrtc.WithInterceptorRegistry(interceptorRegistry),
-		webrtc.WithSettingEngine(createSettingEngine(true, udpMuxCache, tcpMuxCache)),
+		webrtc.WithSettingEngine(whipSettingEngine),
 	)
 
 	apiWhep = webrtc.NewAPI(
 		webrtc.WithMediaEngine(mediaEngine),
-		webrtc.WithInterceptorRegistry(interceptorRegistry),
-		webrtc.WithSettingEngine(createSettingEngine(false, udpMuxCache, tcpMuxCache)),
+		webrtc.WithInterceptorRegistry(whepInterceptorRegistry),
+		webrtc.WithSettingEngine(whepSettingEngine),
 	)
+
+	if err = configureReactions(); err != nil {
+		return err
+	} else if err = configureReaper(); err != nil {
+		return err
+	} else if err = configureResume(); err != nil {
+		return err
+	} else if err = configureHTTPViewers(); err != nil {
+		return err
+	} else if err = configureEgressCap(); err != nil {
+		return err
+	} else if err = configureCapacity(); err != nil {
+		return err
+	}
+	configureSignalingDebug()
+	if err = configureSSE(); err != nil {
+		return err
+	} else if err = configureQuotaWarnings(); err != nil {
+		return err
+	} else if err = configureStreamStates(); err != nil {
+		return err
+	} else if err = configureBandwidthTest(); err != nil {
+		return err
+	}
+	configureMetrics()
+
+	return nil
 }
 
 type StreamStatusVideo struct {
 	RID              string    `json:"rid"`
+	PublisherRID     string    `json:"publisherRid,omitempty"`
+	MimeType         string    `json:"mimeType"`
 	PacketsReceived  uint64    `json:"packetsReceived"`
 	LastKeyFrameSeen time.Time `json:"lastKeyFrameSeen"`
+	Width            uint32    `json:"width"`
+	Height           uint32    `json:"height"`
+	Bitrate          uint64    `json:"bitrate"`
+	// Packet loss of the publisher's uplink in percent
+	PacketLoss float64 `json:"packetLoss"`
+	// Bitrate the publisher was asked to send via REMB, zero if no guidance was sent
+	TargetBitrate uint64 `json:"targetBitrate"`
+}
+
+type StreamStatusAudio struct {
+	ID              string `json:"id"`
+	Language        string `json:"language,omitempty"`
+	PacketsReceived uint64 `json:"packetsReceived"`
 }
 
 type StreamStatus struct {
-	Streamer			 string				 `json:"streamer"`
+	Streamer             string              `json:"streamer"`
+	State                StreamState         `json:"state"`
 	FirstSeenEpoch       uint64              `json:"firstSeenEpoch"`
 	AudioPacketsReceived uint64              `json:"audioPacketsReceived"`
 	VideoStreams         []StreamStatusVideo `json:"videoStreams"`
+	AudioStreams         []StreamStatusAudio `json:"audioStreams"`
 	WHEPSessions         []whepSessionStatus `json:"whepSessions"`
+	// Viewers of HTTP outputs like HLS per output, counted from their heartbeats
+	HTTPViewers map[string]int `json:"httpViewers"`
+	// Bits per second of video sent to the WHEP sessions, estimated from the layer each receives
+	EgressBitrate uint64 `json:"egressBitrate"`
+	Cohost        string `json:"cohost,omitempty"`
+	AudioMuted    bool   `json:"audioMuted"`
+	VideoMuted    bool   `json:"videoMuted"`
+	// Aggregated from the receiver reports viewers sent for the video
+	ViewerReports StreamStatusViewerReports `json:"viewerReports"`
+}
+
+type StreamStatusViewerReports struct {
+	// Viewers that sent a receiver report
+	Reporting int `json:"reporting"`
+	// Percent of packets lost, averaged over and highest of all reporting viewers
+	AverageFractionLost float64 `json:"averageFractionLost"`
+	MaxFractionLost     float64 `json:"maxFractionLost"`
+	// Interarrival jitter in milliseconds, averaged over all reporting viewers
+	AverageJitter float64 `json:"averageJitter"`
 }
 
 type whepSessionStatus struct {
+	// An opaque handle of the session, not its ID. The status is public and the ID authorizes ending the session.
 	ID             string `json:"id"`
 	CurrentLayer   string `json:"currentLayer"`
 	SequenceNumber uint16 `json:"sequenceNumber"`
 	Timestamp      uint32 `json:"timestamp"`
 	PacketsWritten uint64 `json:"packetsWritten"`
+	PlayoutDelay   uint32 `json:"playoutDelay"`
+	// From the latest receiver report of the viewer, zero until it sent one
+	FractionLost float64 `json:"fractionLost"`
+	Jitter       float64 `json:"jitter"`
+	// Bits per second EGRESS_CONGESTION_CONTROL estimates the viewer can receive and it was actually sent
+	EstimatedBitrate uint64 `json:"estimatedBitrate,omitempty"`
+	SendBitrate      uint64 `json:"sendBitrate,omitempty"`
+	// Packets and bytes EGRESS_PACING holds back
+	PacingQueuePackets int `json:"pacingQueuePackets,omitempty"`
+	PacingQueueBytes   int `json:"pacingQueueBytes,omitempty"`
+}
+
+// sessionHandle identifies a session in public listings without revealing its ID
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
 }
 
 func GetStreamStatus(streamKey string) StreamStatus {
@@ -450,51 +760,130 @@ func GetStreamStatus(streamKey string) StreamStatus {
 		return StreamStatus{}
 	}
 
-	stream := streamMap[streamKey]
+	return streamMap[streamKey].status()
+}
+
+// LiveStreamStatuses returns the status of every stream that has a publisher
+func LiveStreamStatuses() map[string]StreamStatus {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	statuses := map[string]StreamStatus{}
+	for streamKey, stream := range streamMap {
+		if stream.online() {
+			statuses[streamKey] = stream.status()
+		}
+	}
+
+	return statuses
+}
 
+// status must be called with streamMapLock held
+func (s *stream) status() StreamStatus {
 	streamerName := ""
-	if stream.streamer != nil {
-		streamerName = stream.streamer.Name
+	if s.streamer != nil {
+		streamerName = s.streamer.Name
 	}
 
 	whepSessions := []whepSessionStatus{}
-	stream.whepSessionsLock.Lock()
-	for id, whepSession := range stream.whepSessions {
+	viewerReports := StreamStatusViewerReports{}
+	s.whepSessionsLock.Lock()
+	for id, whepSession := range s.whepSessions {
 		currentLayer, ok := whepSession.currentLayer.Load().(string)
 		if !ok {
 			continue
 		}
 
-		whepSessions = append(whepSessions, whepSessionStatus{
-			ID:             id,
+		status := whepSessionStatus{
+			ID:             sessionHandle(id),
 			CurrentLayer:   currentLayer,
 			SequenceNumber: whepSession.sequenceNumber,
 			Timestamp:      whepSession.timestamp,
 			PacketsWritten: whepSession.packetsWritten,
-		})
+			PlayoutDelay:   whepSession.effectivePlayoutDelay(),
+		}
+		if whepSession.egressEstimator != nil {
+			status.EstimatedBitrate, status.SendBitrate = whepSession.egressEstimator.bitrates()
+			if pacer := whepSession.egressEstimator.pacer; pacer != nil {
+				status.PacingQueuePackets, status.PacingQueueBytes = pacer.queue()
+			}
+		}
+
+		if report := whepSession.receiverReport.Load(); report != nil {
+			status.FractionLost, status.Jitter = report.FractionLost, report.Jitter
+
+			viewerReports.Reporting++
+			viewerReports.AverageFractionLost += report.FractionLost
+			viewerReports.MaxFractionLost = max(viewerReports.MaxFractionLost, report.FractionLost)
+			viewerReports.AverageJitter += report.Jitter
+		}
+
+		whepSessions = append(whepSessions, status)
+	}
+	s.whepSessionsLock.Unlock()
+
+	if viewerReports.Reporting != 0 {
+		viewerReports.AverageFractionLost /= float64(viewerReports.Reporting)
+		viewerReports.AverageJitter /= float64(viewerReports.Reporting)
 	}
-	stream.whepSessionsLock.Unlock()
 
 	streamStatusVideo := []StreamStatusVideo{}
-	for _, videoTrack := range stream.videoTracks {
+	for _, videoTrack := range s.videoTracks {
 		var lastKeyFrameSeen time.Time
 		if v, ok := videoTrack.lastKeyFrameSeen.Load().(time.Time); ok {
 			lastKeyFrameSeen = v
 		}
 
+		var packetLoss float64
+		var targetBitrate uint64
+		if guidance := videoTrack.guidance.Load(); guidance != nil {
+			packetLoss = float64(guidance.lastLossRate.Load()) / 100
+			targetBitrate = guidance.lastTarget.Load()
+		}
+
+		mimeType, _ := videoTrack.mimeType.Load().(string)
 		streamStatusVideo = append(streamStatusVideo, StreamStatusVideo{
 			RID:              videoTrack.rid,
+			PublisherRID:     videoTrack.publisherRID,
+			MimeType:         mimeType,
 			PacketsReceived:  videoTrack.packetsReceived.Load(),
 			LastKeyFrameSeen: lastKeyFrameSeen,
+			Width:            videoTrack.width.Load(),
+			Height:           videoTrack.height.Load(),
+			Bitrate:          videoTrack.bitrate.Load(),
+			PacketLoss:       packetLoss,
+			TargetBitrate:    targetBitrate,
+		})
+	}
+
+	cohost := ""
+	if s.guest != nil {
+		cohost = s.guest.name
+	}
+
+	streamStatusAudio := []StreamStatusAudio{}
+	for _, audioTrack := range s.audioTracks {
+		streamStatusAudio = append(streamStatusAudio, StreamStatusAudio{
+			ID:              audioTrack.id,
+			Language:        audioTrack.language,
+			PacketsReceived: audioTrack.packetsReceived.Load(),
 		})
 	}
 
 	return StreamStatus{
-		Streamer:			  streamerName,
-		FirstSeenEpoch:       stream.firstSeenEpoch,
-		AudioPacketsReceived: stream.audioPacketsReceived.Load(),
+		Streamer:             streamerName,
+		State:                s.state(),
+		FirstSeenEpoch:       s.firstSeenEpoch,
+		AudioPacketsReceived: s.audioPacketsReceived.Load(),
 		VideoStreams:         streamStatusVideo,
+		AudioStreams:         streamStatusAudio,
+		Cohost:               cohost,
+		AudioMuted:           s.audioMuted.Load(),
+		VideoMuted:           s.videoMuted.Load(),
 		WHEPSessions:         whepSessions,
+		HTTPViewers:          s.countHTTPViewers(),
+		EgressBitrate:        s.egressBitrate(),
+		ViewerReports:        viewerReports,
 	}
 
 }
@@ -1,11 +1,14 @@
 package webrtc
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pion/rtcp"
@@ -13,49 +16,112 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+const (
+	// Largest delay that can be signaled with the playout-delay header extension
+	maxPlayoutDelay = 40950 * time.Millisecond
+
+	// Media IDs used by the WHEP layer extension
+	whepAudioMediaId = "0"
+	whepVideoMediaId = "1"
+
+	// Duration of a Opus frame in RTP timestamp units
+	opusFrameDuration = 960
+)
+
 type (
 	whepSession struct {
+		audioTrack    *webrtc.TrackLocalStaticRTP
+		audioLayer    atomic.Value
+		audioRewriter rtpRewriter
+
+		// Tracks of a co-host, only negotiated if the viewer offered a second audio and video section
+		guestAudioTrack    *webrtc.TrackLocalStaticRTP
+		guestVideoTrack    *trackMultiCodec
+		guestAudioRewriter rtpRewriter
+		guestVideoRewriter rtpRewriter
+
+		peerConnection    *webrtc.PeerConnection
+		disconnectedSince atomic.Int64
+		// Set if EGRESS_CONGESTION_CONTROL estimates the bandwidth to the viewer
+		egressEstimator *egressEstimator
+
+		// Sender reports are generated from these, receiver reports of the viewer kept for stats
+		videoStats, audioStats, guestVideoStats, guestAudioStats outgoingTrackStats
+		audioSSRC, guestAudioSSRC                                uint32
+		receiverReport                                           atomic.Pointer[viewerReceiverReport]
+
 		videoTrack         *trackMultiCodec
+		dataChannel        atomic.Pointer[webrtc.DataChannel]
 		currentLayer       atomic.Value
 		waitingForKeyframe atomic.Bool
-		sequenceNumber     uint16
-		timestamp          uint32
-		packetsWritten     uint64
+		// When the viewer connected in Unix nanoseconds, until it was sent its first frame
+		connectedAt     atomic.Int64
+		playoutDelay    atomic.Uint32
+		playoutDelayExt atomic.Pointer[[]byte]
+		layerHint       atomic.Pointer[layerHint]
+		sequenceNumber  uint16
+		timestamp       uint32
+		packetsWritten  uint64
 	}
 
 	simulcastLayerResponse struct {
 		EncodingId string `json:"encodingId"`
+		Width      uint32 `json:"width,omitempty"`
+		Height     uint32 `json:"height,omitempty"`
+		Bitrate    uint64 `json:"bitrate,omitempty"`
+		Language   string `json:"language,omitempty"`
 	}
 )
 
+// ErrUnknownWHEPSession is returned for sessions this instance doesn't have
+var ErrUnknownWHEPSession = errors.New("WHEP session does not exist")
+
 func WHEPLayers(whepSessionId string) ([]byte, error) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 
-	layers := []simulcastLayerResponse{}
-	for streamKey := range streamMap {
-		streamMap[streamKey].whepSessionsLock.Lock()
-		defer streamMap[streamKey].whepSessionsLock.Unlock()
+	if streamKey, _, ok := getWHEPSession(whepSessionId); ok {
+		return streamMap[streamKey].layers()
+	}
 
-		if _, ok := streamMap[streamKey].whepSessions[whepSessionId]; ok {
-			for i := range streamMap[streamKey].videoTracks {
-				layers = append(layers, simulcastLayerResponse{EncodingId: streamMap[streamKey].videoTracks[i].rid})
-			}
+	return (&stream{}).layers()
+}
 
-			break
-		}
+// layers returns the layers event of the viewers of s. streamMapLock must be held.
+func (s *stream) layers() ([]byte, error) {
+	layers, audioLayers := []simulcastLayerResponse{}, []simulcastLayerResponse{}
+	for _, videoTrack := range s.videoTracks {
+		layers = append(layers, simulcastLayerResponse{
+			EncodingId: videoTrack.rid,
+			Width:      videoTrack.width.Load(),
+			Height:     videoTrack.height.Load(),
+			Bitrate:    videoTrack.bitrate.Load(),
+		})
+	}
+
+	for _, audioTrack := range s.audioTracks {
+		audioLayers = append(audioLayers, simulcastLayerResponse{
+			EncodingId: audioTrack.id,
+			Language:   audioTrack.language,
+		})
 	}
 
 	resp := map[string]map[string][]simulcastLayerResponse{
-		"1": map[string][]simulcastLayerResponse{
+		whepVideoMediaId: {
 			"layers": layers,
 		},
 	}
 
+	if len(audioLayers) != 0 {
+		resp[whepAudioMediaId] = map[string][]simulcastLayerResponse{
+			"layers": audioLayers,
+		}
+	}
+
 	return json.Marshal(resp)
 }
 
-func WHEPChangeLayer(whepSessionId, layer string) error {
+func WHEPChangeLayer(whepSessionId, mediaId, layer string) error {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 
@@ -64,6 +130,13 @@ func WHEPChangeLayer(whepSessionId, layer string) error {
 		defer streamMap[streamKey].whepSessionsLock.Unlock()
 
 		if _, ok := streamMap[streamKey].whepSessions[whepSessionId]; ok {
+			if mediaId == whepAudioMediaId {
+				streamMap[streamKey].whepSessions[whepSessionId].audioLayer.Store(layer)
+				continue
+			}
+
+			layer = streamMap[streamKey].canonicalLayer(layer)
+			streamMap[streamKey].whepSessions[whepSessionId].layerHint.Store(nil)
 			streamMap[streamKey].whepSessions[whepSessionId].currentLayer.Store(layer)
 			streamMap[streamKey].whepSessions[whepSessionId].waitingForKeyframe.Store(true)
 			streamMap[streamKey].pliChan <- true
@@ -73,38 +146,230 @@ func WHEPChangeLayer(whepSessionId, layer string) error {
 	return nil
 }
 
-func WHEP(offer, streamKey string) (string, string, error) {
-	maybePrintOfferAnswer(offer, true)
+// WHEPSetPlayoutDelay asks the viewer to buffer the given amount of media before playback.
+// Viewers on poor networks trade latency for smoothness. A delay of zero restores the default.
+func WHEPSetPlayoutDelay(whepSessionId string, delay time.Duration) error {
+	if delay < 0 || delay > maxPlayoutDelay {
+		return fmt.Errorf("Playout delay must be between 0 and %s", maxPlayoutDelay)
+	}
 
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
-	stream, err := getStream(nil, streamKey, false)
+
+	for streamKey := range streamMap {
+		streamMap[streamKey].whepSessionsLock.RLock()
+		whepSession, ok := streamMap[streamKey].whepSessions[whepSessionId]
+		streamMap[streamKey].whepSessionsLock.RUnlock()
+
+		if !ok {
+			continue
+		}
+
+		if delay == 0 {
+			whepSession.playoutDelay.Store(0)
+			whepSession.playoutDelayExt.Store(nil)
+			return nil
+		}
+
+		// Playout delay is signaled in units of 10ms
+		units := uint16(delay / (10 * time.Millisecond))
+		ext, err := rtp.PlayoutDelayExtension{MinDelay: units, MaxDelay: units}.Marshal()
+		if err != nil {
+			return err
+		}
+
+		whepSession.playoutDelay.Store(uint32(delay.Milliseconds()))
+		whepSession.playoutDelayExt.Store(&ext)
+		return nil
+	}
+
+	return ErrUnknownWHEPSession
+}
+
+// WHEPDelete ends a WHEP session on request of its viewer, instead of waiting until ICE times out. The session
+// can't be resumed.
+func WHEPDelete(whepSessionId string) error {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	streamKey, whepSession, ok := getWHEPSession(whepSessionId)
+	if !ok {
+		return ErrUnknownWHEPSession
+	}
+
+	removeSession(streamKey, whepSessionId)
+	closePeerConnection(whepSession.peerConnection)
+	return nil
+}
+
+// getWHEPSession must be called with streamMapLock held
+func getWHEPSession(whepSessionId string) (string, *whepSession, bool) {
+	for streamKey, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		whepSession, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+
+		if ok {
+			return streamKey, whepSession, true
+		}
+	}
+
+	return "", nil, false
+}
+
+// HasWHEPSession reports if a WHEP session is connected to this instance
+func HasWHEPSession(whepSessionId string) bool {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	_, _, ok := getWHEPSession(whepSessionId)
+	return ok
+}
+
+// WHEPAddICECandidate adds a remote candidate that was gathered after the offer was sent
+func WHEPAddICECandidate(whepSessionId, candidate string) error {
+	streamMapLock.Lock()
+	streamKey, whepSession, ok := getWHEPSession(whepSessionId)
+	streamMapLock.Unlock()
+
+	if !ok {
+		return ErrUnknownWHEPSession
+	}
+
+	captureSignaling(whepSessionId, SessionWHEP, streamKey, SignalingRemoteCandidate, candidate)
+	return whepSession.peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate})
+}
+
+// WHEPClose ends a WHEP session
+func WHEPClose(whepSessionId string) error {
+	streamMapLock.Lock()
+	streamKey, whepSession, ok := getWHEPSession(whepSessionId)
+	streamMapLock.Unlock()
+
+	if !ok {
+		return ErrUnknownWHEPSession
+	}
+
+	whepSession.sendGoodbye(false, "Session closed")
+	err := closePeerConnectionAndWait(whepSession.peerConnection)
+	peerConnectionDisconnected(streamKey, whepSessionId)
+	return err
+}
+
+// WHEP starts playback of a stream. Negotiation is abandoned when ctx is done.
+//
+// streamMapLock is only held to reserve a seat and to add the finished session, so viewers joining
+// at the same time create their PeerConnections and answers in parallel.
+func WHEP(ctx context.Context, offer, streamKey string) (answer string, whepSessionId string, err error) {
+	return whep(ctx, offer, streamKey, nil)
+}
+
+// whep negotiates a WHEP session, continuing from resumed if the viewer reconnected with a resume token
+func whep(ctx context.Context, offer, streamKey string, resumed *resumableSession) (answer string, whepSessionId string, err error) {
+	maybePrintOfferAnswer(offer, true)
+	joinStarted := time.Now()
+
+	if err := CheckOutputAllowed(streamKey, OutputWebRTC); err != nil {
+		return "", "", err
+	}
+
+	stream, err := reserveWHEPSession(streamKey)
 	if err != nil {
 		return "", "", err
 	}
 
-	whepSessionId := uuid.New().String()
+	whepSessionId = uuid.New().String()
+	session := &whepSession{timestamp: 50000}
 
-	videoTrack := &trackMultiCodec{id: "video", streamID: "pion"}
+	peerConnection, egressEstimator, err := newWHEPPeerConnection()
+	if err != nil {
+		releaseWHEPSession(streamKey, stream)
+		return "", "", err
+	}
+	session.egressEstimator = egressEstimator
+	Sessions.begin(whepSessionId, SessionWHEP, streamKey)
+	if resumed != nil {
+		Sessions.resumed(whepSessionId, resumed.whepSessionId, resumed.createdAt)
+	}
+	captureSignaling(whepSessionId, SessionWHEP, streamKey, SignalingOffer, offer)
+	defer func() {
+		streamMapLock.Lock()
+		defer streamMapLock.Unlock()
+
+		stream.pendingWHEPSessions--
+		if err != nil {
+			captureSignaling(whepSessionId, SessionWHEP, streamKey, SignalingError, err.Error())
+			abandonNegotiation(streamKey, peerConnection)
+			Sessions.setState(whepSessionId, SessionClosed)
+			return
+		}
 
-	peerConnection, err := newPeerConnection(apiWhep)
+		Sessions.attachWHEP(stream, whepSessionId, session)
+		stream.checkViewerQuotaWarnings(streamKey)
+
+		whepJoinDuration.Observe(time.Since(joinStarted).Seconds())
+	}()
+
+	audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
 	if err != nil {
 		return "", "", err
 	}
 
-	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
-		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
-			if err := peerConnection.Close(); err != nil {
-				log.Println(err)
-			}
+	guestAudioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "guest-audio", "guest")
+	if err != nil {
+		return "", "", err
+	}
+
+	videoTrack := &trackMultiCodec{id: "video", streamID: "pion"}
+	guestVideoTrack := &trackMultiCodec{id: "guest-video", streamID: "guest"}
+	session.audioTrack, session.videoTrack = audioTrack, videoTrack
+	session.guestAudioTrack, session.guestVideoTrack = guestAudioTrack, guestVideoTrack
+	session.audioLayer.Store("")
+	session.currentLayer.Store("")
+	session.waitingForKeyframe.Store(false)
+	if resumed != nil {
+		session.resumeFrom(resumed.session)
+	}
+
+	// Viewers that open a DataChannel receive stream events (like reactions) on it
+	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
+		d.OnOpen(func() {
+			session.dataChannel.Store(d)
+		})
+	})
 
+	session.peerConnection = peerConnection
+
+	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		captureSignaling(whepSessionId, SessionWHEP, streamKey, SignalingICEState, i.String())
+
+		switch i {
+		case webrtc.ICEConnectionStateDisconnected:
+			session.disconnectedSince.Store(time.Now().UnixNano())
+		case webrtc.ICEConnectionStateConnected:
+			session.disconnectedSince.Store(0)
+		case webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+			closePeerConnection(peerConnection)
 			peerConnectionDisconnected(streamKey, whepSessionId)
 		}
 	})
 
-	if _, err = peerConnection.AddTrack(stream.audioTrack); err != nil {
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			stream.startViewer(whepSessionId)
+			go session.sendSenderReports(stream)
+
+			if bandwidthTestStreamKey != "" && streamKey == bandwidthTestStreamKey {
+				stream.startBandwidthTest()
+			}
+		}
+	})
+
+	audioSender, err := peerConnection.AddTrack(audioTrack)
+	if err != nil {
 		return "", "", err
 	}
+	session.audioSSRC = uint32(audioSender.GetParameters().Encodings[0].SSRC)
 
 	rtpSender, err := peerConnection.AddTrack(videoTrack)
 	if err != nil {
@@ -112,6 +377,8 @@ func WHEP(offer, streamKey string) (string, string, error) {
 	}
 
 	go func() {
+		defer stream.trackGoroutine()()
+
 		for {
 			rtcpPackets, _, rtcpErr := rtpSender.ReadRTCP()
 			if rtcpErr != nil {
@@ -119,68 +386,184 @@ func WHEP(offer, streamKey string) (string, string, error) {
 			}
 
 			for _, r := range rtcpPackets {
-				if _, isPLI := r.(*rtcp.PictureLossIndication); isPLI {
+				switch r := r.(type) {
+				case *rtcp.PictureLossIndication:
 					select {
 					case stream.pliChan <- true:
 					default:
 					}
+				case *rtcp.ReceiverReport:
+					session.onReceiverReport(r)
 				}
 			}
 		}
 	}()
 
-	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
-		SDP:  offer,
-		Type: webrtc.SDPTypeOffer,
-	}); err != nil {
+	guestAudioSender, err := peerConnection.AddTrack(guestAudioTrack)
+	if err != nil {
 		return "", "", err
 	}
+	session.guestAudioSSRC = uint32(guestAudioSender.GetParameters().Encodings[0].SSRC)
 
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	answer, err := peerConnection.CreateAnswer(nil)
-
+	guestRTPSender, err := peerConnection.AddTrack(guestVideoTrack)
 	if err != nil {
 		return "", "", err
-	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
+	}
+
+	go func() {
+		defer stream.trackGoroutine()()
+
+		for {
+			rtcpPackets, _, rtcpErr := guestRTPSender.ReadRTCP()
+			if rtcpErr != nil {
+				return
+			}
+
+			for _, r := range rtcpPackets {
+				if _, isPLI := r.(*rtcp.PictureLossIndication); isPLI {
+					stream.requestGuestKeyframe()
+				}
+			}
+		}
+	}()
+
+	if err = negotiate(ctx, peerConnection, offer); err != nil {
 		return "", "", err
 	}
 
-	<-gatherComplete
+	answer = maybePrintOfferAnswer(appendAnswer(peerConnection.LocalDescription().SDP), false)
+	captureSignaling(whepSessionId, SessionWHEP, streamKey, SignalingAnswer, answer)
+	return answer, whepSessionId, nil
+}
+
+// reserveWHEPSession counts a viewer that is negotiating against the viewer limit. The stream is
+// not deleted until the viewer was added or released again.
+func reserveWHEPSession(streamKey string) (*stream, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	if Draining() {
+		return nil, ErrDraining
+	}
+
+	stream, err := getStream(nil, streamKey, false)
+	if err != nil {
+		return nil, err
+	}
+
+	viewers := Sessions.viewers(stream) + stream.pendingWHEPSessions
+
+	if stream.streamer != nil && stream.streamer.MaxViewers != 0 && viewers >= stream.streamer.MaxViewers {
+		stream.whepSessionsLock.Lock()
+		deleteStreamIfUnused(streamKey, stream)
+		stream.whepSessionsLock.Unlock()
+		return nil, errors.New("Stream reached its viewer limit")
+	}
+
+	if err := stream.checkTenantViewerLimit(); err != nil {
+		stream.whepSessionsLock.Lock()
+		deleteStreamIfUnused(streamKey, stream)
+		stream.whepSessionsLock.Unlock()
+		return nil, err
+	}
+
+	if err := stream.checkEgressCap(); err != nil {
+		stream.whepSessionsLock.Lock()
+		deleteStreamIfUnused(streamKey, stream)
+		stream.whepSessionsLock.Unlock()
+		return nil, err
+	}
+
+	stream.pendingWHEPSessions++
+	return stream, nil
+}
+
+// releaseWHEPSession gives up a reservation before a PeerConnection was created
+func releaseWHEPSession(streamKey string, stream *stream) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream.pendingWHEPSessions--
 
 	stream.whepSessionsLock.Lock()
-	defer stream.whepSessionsLock.Unlock()
+	deleteStreamIfUnused(streamKey, stream)
+	stream.whepSessionsLock.Unlock()
+}
 
-	stream.whepSessions[whepSessionId] = &whepSession{
-		videoTrack: videoTrack,
-		timestamp:  50000,
+// sendAudioPacket forwards audio of the selected audio layer. Sequence numbers and timestamps
+// are rewritten so they stay continuous when the viewer switches between audio layers.
+func (w *whepSession) sendAudioPacket(rtpPkt *rtp.Packet, source *senderReportSource, layer string, sequenceNumber uint16, timestamp uint32) {
+	if w.audioLayer.Load() == "" {
+		w.audioLayer.Store(layer)
+	} else if layer != w.audioLayer.Load() {
+		return
+	}
+
+	w.audioRewriter.rewrite(rtpPkt, layer, sequenceNumber, timestamp, opusFrameDuration)
+	w.audioStats.onPacket(source, timestamp, rtpPkt.Timestamp, len(rtpPkt.Payload))
+
+	if err := w.audioTrack.WriteRTP(rtpPkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		log.Println(err)
 	}
-	stream.whepSessions[whepSessionId].currentLayer.Store("")
-	stream.whepSessions[whepSessionId].waitingForKeyframe.Store(false)
+}
 
-	return maybePrintOfferAnswer(appendAnswer(peerConnection.LocalDescription().SDP), false), whepSessionId, nil
+func (w *whepSession) sendDataChannelMessage(msg []byte) {
+	d := w.dataChannel.Load()
+	if d == nil || d.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+
+	if err := d.Send(msg); err != nil {
+		log.Println(err)
+	}
 }
 
-func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, layer string, timeDiff int64, sequenceDiff int, codec videoTrackCodec, isKeyframe bool) {
+func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, source *senderReportSource, layer string, timeDiff int64, sequenceDiff int, codec videoTrackCodec, isKeyframe bool) {
 	if w.currentLayer.Load() == "" {
 		w.currentLayer.Store(layer)
 	} else if layer != w.currentLayer.Load() {
 		return
-	} else if w.waitingForKeyframe.Load() {
+	}
+
+	if w.waitingForKeyframe.Load() {
 		if !isKeyframe {
 			return
 		}
 
 		w.waitingForKeyframe.Store(false)
 	}
+	w.onFirstFrame()
 
 	w.packetsWritten += 1
 	w.sequenceNumber = uint16(int(w.sequenceNumber) + sequenceDiff)
 	w.timestamp = uint32(int64(w.timestamp) + timeDiff)
+	w.videoStats.onPacket(source, rtpPkt.Timestamp, w.timestamp, len(rtpPkt.Payload))
 
 	rtpPkt.SequenceNumber = w.sequenceNumber
 	rtpPkt.Timestamp = w.timestamp
 
+	// rtpPkt is shared between all WHEP sessions, so extensions are removed again after writing
+	if ext := w.playoutDelayExt.Load(); ext != nil && w.videoTrack.playoutDelayExtensionID != 0 {
+		if err := rtpPkt.SetExtension(w.videoTrack.playoutDelayExtensionID, *ext); err != nil {
+			log.Println(err)
+		}
+		defer func() {
+			rtpPkt.Extension = false
+			rtpPkt.Extensions = nil
+		}()
+	}
+
 	if err := w.videoTrack.WriteRTP(rtpPkt, codec); err != nil && !errors.Is(err, io.ErrClosedPipe) {
 		log.Println(err)
 	}
 }
+
+// effectivePlayoutDelay is the requested playout delay in milliseconds, or zero if the viewer
+// did not negotiate the playout-delay header extension
+func (w *whepSession) effectivePlayoutDelay() uint32 {
+	if w.videoTrack.playoutDelayExtensionID == 0 {
+		return 0
+	}
+
+	return w.playoutDelay.Load()
+}
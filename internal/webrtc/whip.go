@@ -1,6 +1,7 @@
 package webrtc
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log"
@@ -8,14 +9,21 @@ import (
 	"strings"
 	"time"
 
+	"github.com/patrikrog/broadcast-box/internal/events"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
-	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
 )
 
-func audioWriter(remoteTrack *webrtc.TrackRemote, stream *stream) {
+func audioWriter(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver, stream *stream, id, language string) {
+	defer stream.trackGoroutine()()
+
+	audioTrack := addAudioTrack(stream, id, language)
+	go stream.readSenderReports(rtpReceiver, remoteTrack, &audioTrack.senderReports)
+
 	rtpBuf := make([]byte, 1500)
+	rtpPkt := &rtp.Packet{}
 	for {
 		rtpRead, _, err := remoteTrack.Read(rtpBuf)
 		switch {
@@ -26,16 +34,61 @@ func audioWriter(remoteTrack *webrtc.TrackRemote, stream *stream) {
 			return
 		}
 
-		stream.audioPacketsReceived.Add(1)
-		if _, writeErr := stream.audioTrack.Write(rtpBuf[:rtpRead]); writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
-			log.Println(writeErr)
+		if err = rtpPkt.Unmarshal(rtpBuf[:rtpRead]); err != nil {
+			log.Println(err)
 			return
 		}
+
+		stream.audioPacketsReceived.Add(1)
+		stream.bytesReceived.Add(uint64(rtpRead))
+		stream.lastMediaReceived.Store(time.Now().UnixNano())
+		audioTrack.packetsReceived.Add(1)
+		if stream.audioMuted.Load() {
+			rtpPkt.Payload = opusSilenceFrame
+		}
+		stream.sendToOutputs(rtpPkt, false, remoteTrack.Codec().MimeType, id, &audioTrack.timeline, &audioTrack.senderReports, remoteTrack.Codec().ClockRate, false)
+
+		sequenceNumber, timestamp := rtpPkt.SequenceNumber, rtpPkt.Timestamp
+
+		stream.whepSessionsLock.RLock()
+		for i := range stream.whepSessions {
+			stream.whepSessions[i].sendAudioPacket(rtpPkt, &audioTrack.senderReports, id, sequenceNumber, timestamp)
+		}
+		stream.whepSessionsLock.RUnlock()
 	}
 }
 
-func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection *webrtc.PeerConnection, s *stream) {
-	id := remoteTrack.RID()
+// audioLanguages maps the mid of every audio section in a SDP to its `a=lang` attribute
+func audioLanguages(offer string) map[string]string {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer)); err != nil {
+		return nil
+	}
+
+	sessionLanguage, _ := parsed.Attribute("lang")
+	languages := map[string]string{}
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "audio" {
+			continue
+		}
+
+		mid, _ := media.Attribute("mid")
+		if language, ok := media.Attribute("lang"); ok {
+			languages[mid] = language
+		} else {
+			languages[mid] = sessionLanguage
+		}
+	}
+
+	return languages
+}
+
+// videoWriter forwards a video track of the publisher. ctx is done once the publisher disconnected.
+// layer is the canonical name of the simulcast layer, see simulcastLayerNames.
+func videoWriter(ctx context.Context, remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver, stream *stream, peerConnection *webrtc.PeerConnection, s *stream, layer string) {
+	defer s.trackGoroutine()()
+
+	id := layer
 	if id == "" {
 		id = videoTrackLabelDefault
 	}
@@ -45,37 +98,54 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 		log.Println(err)
 		return
 	}
+	go s.readSenderReports(rtpReceiver, remoteTrack, &videoTrack.senderReports)
 
 	go func() {
+		defer s.trackGoroutine()()
+
 		for {
 			select {
-			case <-stream.whipActiveContext.Done():
+			case <-ctx.Done():
 				return
 			case <-stream.pliChan:
-				if sendErr := peerConnection.WriteRTCP([]rtcp.Packet{
-					&rtcp.PictureLossIndication{
-						MediaSSRC: uint32(remoteTrack.SSRC()),
-					},
-				}); sendErr != nil {
-					return
-				}
+			case <-videoTrack.pliChan:
+			}
+
+			if sendErr := peerConnection.WriteRTCP([]rtcp.Packet{
+				&rtcp.PictureLossIndication{
+					MediaSSRC: uint32(remoteTrack.SSRC()),
+				},
+			}); sendErr != nil {
+				return
 			}
 		}
 	}()
 
 	rtpBuf := make([]byte, 1500)
 	rtpPkt := &rtp.Packet{}
-	codec := getVideoTrackCodec(remoteTrack.Codec().RTPCodecCapability.MimeType)
+	mimeType := remoteTrack.Codec().RTPCodecCapability.MimeType
+	codec := getVideoTrackCodec(mimeType)
+	clockRate := remoteTrack.Codec().ClockRate
+	payloadType := remoteTrack.PayloadType()
+	videoTrack.mimeType.Store(mimeType)
 
-	var depacketizer rtp.Depacketizer
-	switch codec {
-	case videoTrackCodecH264:
-		depacketizer = &codecs.H264Packet{}
-	case videoTrackCodecVP8:
-		depacketizer = &codecs.VP8Packet{}
-	case videoTrackCodecVP9:
-		depacketizer = &codecs.VP9Packet{}
+	depacketizer := newKeyframeDepacketizer(codec)
+	resolutionDepacketizer := newResolutionDepacketizer(codec)
+	bitrateWindowStart, bitrateWindowBytes := time.Now(), 0
+	quota := uint64(0)
+	streamKey := ""
+	quotaEvent := events.Event{}
+	streamMapLock.Lock()
+	videoTrack.publisherRID = remoteTrack.RID()
+	if stream.streamer != nil {
+		quota = stream.streamer.MaxBitrate
+		streamKey = stream.streamer.StreamKey
+		quotaEvent = events.Event{StreamKey: streamKey, Streamer: stream.streamer.Name, Tenant: stream.tenant()}
 	}
+	streamMapLock.Unlock()
+
+	guidance := newBitrateGuidance(quota)
+	videoTrack.guidance.Store(guidance)
 
 	lastTimestamp := uint32(0)
 	lastTimestampSet := false
@@ -83,6 +153,9 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 	lastSequenceNumber := uint16(0)
 	lastSequenceNumberSet := false
 
+	// While muted packets are skipped, viewers continue where they left off with timestamps that advanced
+	muted, mutedTimeDiff := false, int64(0)
+
 	for {
 		rtpRead, _, err := remoteTrack.Read(rtpBuf)
 		switch {
@@ -99,6 +172,35 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 		}
 
 		videoTrack.packetsReceived.Add(1)
+		stream.bytesReceived.Add(uint64(rtpRead))
+		stream.lastMediaReceived.Store(time.Now().UnixNano())
+
+		// The publisher switched codec without reconnecting, remoteTrack already follows the new payload type
+		if webrtc.PayloadType(rtpPkt.PayloadType) != payloadType {
+			payloadType = webrtc.PayloadType(rtpPkt.PayloadType)
+			if newMimeType := remoteTrack.Codec().RTPCodecCapability.MimeType; getVideoTrackCodec(newMimeType) != codec {
+				change := mediaChange{Layer: id, MimeType: newMimeType, PreviousMimeType: mimeType}
+				mimeType, codec, clockRate = newMimeType, getVideoTrackCodec(newMimeType), remoteTrack.Codec().ClockRate
+				depacketizer, resolutionDepacketizer = newKeyframeDepacketizer(codec), newResolutionDepacketizer(codec)
+				videoTrack.mimeType.Store(mimeType)
+				videoTrack.width.Store(0)
+				videoTrack.height.Store(0)
+				s.onCodecChange(streamKey, videoTrack, codec, change)
+			}
+		}
+
+		layerChanged := false
+		bitrateWindowBytes += rtpRead
+		if elapsed := time.Since(bitrateWindowStart); elapsed >= time.Second {
+			layerChanged = videoTrack.bitrate.Load() == 0
+			videoTrack.bitrate.Store(uint64(float64(bitrateWindowBytes*8) / elapsed.Seconds()))
+			bitrateWindowStart, bitrateWindowBytes = time.Now(), 0
+
+			if err := guidance.update(peerConnection, remoteTrack.SSRC(), videoTrack.bitrate.Load()); err != nil {
+				log.Println(err)
+			}
+			checkQuotaWarning(quotaEvent, streamKey+"/"+id, QuotaWarning{Quota: QuotaBitrate, Layer: id, Usage: videoTrack.bitrate.Load(), Limit: quota})
+		}
 
 		// Keyframe detection has only been implemented for H264
 		isKeyframe := isKeyframe(rtpPkt, codec, depacketizer)
@@ -106,6 +208,31 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 			videoTrack.lastKeyFrameSeen.Store(time.Now())
 		}
 
+		if isKeyframe {
+			if width, height, ok := keyframeResolution(rtpPkt, codec, resolutionDepacketizer); ok &&
+				(uint32(width) != videoTrack.width.Load() || uint32(height) != videoTrack.height.Load()) {
+				previousWidth, previousHeight := int(videoTrack.width.Load()), int(videoTrack.height.Load())
+				videoTrack.width.Store(uint32(width))
+				videoTrack.height.Store(uint32(height))
+				layerChanged = true
+
+				// The first resolution of a track, or of a new codec, is no change. Viewers get the new resolution
+				// with this keyframe and need no restart.
+				if previousWidth != 0 {
+					s.publishMediaChange(streamKey, mediaChange{
+						Layer: id, MimeType: mimeType, Width: width, Height: height,
+						PreviousWidth: previousWidth, PreviousHeight: previousHeight,
+					})
+				}
+			}
+		}
+
+		if layerChanged {
+			streamMapLock.Lock()
+			s.onLayersChanged()
+			streamMapLock.Unlock()
+		}
+
 		rtpPkt.Extension = false
 		rtpPkt.Extensions = nil
 
@@ -127,67 +254,219 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 			sequenceDiff += (math.MaxUint16 + 1)
 		}
 
+		guidance.onPacket(sequenceDiff)
+		if sequenceDiff > 1 {
+			stream.videoPacketsSkipped.Add(uint64(sequenceDiff - 1))
+		}
 		lastTimestamp = rtpPkt.Timestamp
 		lastSequenceNumber = rtpPkt.SequenceNumber
+		videoTrack.clock.update(rtpPkt.Timestamp, timeDiff, clockRate)
+
+		if s.videoMuted.Load() {
+			muted, mutedTimeDiff = true, mutedTimeDiff+timeDiff
+			continue
+		} else if muted {
+			muted, timeDiff, sequenceDiff = false, timeDiff+mutedTimeDiff, 1
+			mutedTimeDiff = 0
+		}
+
+		s.sendToOutputs(rtpPkt, true, remoteTrack.Codec().MimeType, id, &videoTrack.timeline, &videoTrack.senderReports, clockRate, isKeyframe)
 
 		s.whepSessionsLock.RLock()
+		videoTrack.keyframeCache.push(rtpPkt, timeDiff, sequenceDiff, codec, isKeyframe)
 		for i := range s.whepSessions {
-			s.whepSessions[i].sendVideoPacket(rtpPkt, id, timeDiff, sequenceDiff, codec, isKeyframe)
+			s.whepSessions[i].sendVideoPacket(rtpPkt, &videoTrack.senderReports, id, timeDiff, sequenceDiff, codec, isKeyframe)
 		}
 		s.whepSessionsLock.RUnlock()
 
 	}
 }
 
-func WHIP(offer string, streamer *Streamer) (string, error) {
+var (
+	// ErrStreamAlreadyLive is returned when a stream key is published to while it already has a publisher
+	ErrStreamAlreadyLive = errors.New("Stream is already live")
+	// ErrUnknownWHIPSession is returned by WHIPDelete when the session isn't publishing to the stream
+	ErrUnknownWHIPSession = errors.New("WHIP session does not exist")
+)
+
+// WHIP starts publishing a stream. A second publisher for a live stream is rejected unless takeover
+// is set, in which case the current publisher is disconnected and replaced. Negotiation is abandoned
+// when ctx is done. The returned session ID identifies the publisher for WHIPDelete.
+func WHIP(ctx context.Context, offer string, streamer *Streamer, takeover bool) (answer string, whipSessionId string, err error) {
 	maybePrintOfferAnswer(offer, true)
 
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	if Draining() {
+		return "", "", ErrDraining
+	} else if bandwidthTestStreamKey != "" && streamer.StreamKey == bandwidthTestStreamKey {
+		return "", "", ErrReservedStreamKey
+	}
+
+	if existing, ok := streamMap[streamer.StreamKey]; ok && existing.hasWHIPClient.Load() && !takeover {
+		return "", "", ErrStreamAlreadyLive
+	}
+
+	if err = checkTenantStreamLimit(streamer); err != nil {
+		return "", "", err
+	}
+
 	peerConnection, err := newPeerConnection(apiWhip)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
-	stream, err := getStream(streamer, streamer.StreamKey, true)
+	// The stream only becomes live once negotiation succeeded
+	stream, err := getStream(streamer, streamer.StreamKey, false)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	sessionId := Sessions.begin("", SessionWHIP, streamer.StreamKey)
+	captureSignaling(sessionId, SessionWHIP, streamer.StreamKey, SignalingOffer, offer)
+	publisherContext, publisherContextCancel := context.WithCancel(stream.whipActiveContext)
+	defer func() {
+		if err != nil {
+			captureSignaling(sessionId, SessionWHIP, streamer.StreamKey, SignalingError, err.Error())
+			publisherContextCancel()
+			abandonNegotiation(streamer.StreamKey, peerConnection)
+			Sessions.setState(sessionId, SessionClosed)
+		}
+	}()
+
+	languages := audioLanguages(offer)
+	layerNames, err := simulcastLayerNames(offer)
+	if err != nil {
+		return "", "", err
 	}
 
 	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver) {
 		if strings.HasPrefix(remoteTrack.Codec().RTPCodecCapability.MimeType, "audio") {
-			audioWriter(remoteTrack, stream)
+			mid := remoteTrack.ID()
+			for _, transceiver := range peerConnection.GetTransceivers() {
+				if transceiver.Receiver() == rtpReceiver {
+					mid = transceiver.Mid()
+				}
+			}
+
+			audioWriter(remoteTrack, rtpReceiver, stream, mid, languages[mid])
 		} else {
-			videoWriter(remoteTrack, stream, peerConnection, stream)
+			layer, ok := layerNames[remoteTrack.RID()]
+			if !ok {
+				layer = remoteTrack.RID()
+			}
+
+			videoWriter(publisherContext, remoteTrack, rtpReceiver, stream, peerConnection, stream, layer)
 
 		}
 	})
 
 	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		captureSignaling(sessionId, SessionWHIP, streamer.StreamKey, SignalingICEState, i.String())
+
 		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
-			if err := peerConnection.Close(); err != nil {
-				log.Println(err)
-			}
-			peerConnectionDisconnected(streamer.StreamKey, "")
+			publisherContextCancel()
+			Sessions.setState(sessionId, SessionClosed)
+			closePeerConnection(peerConnection)
+			whipDisconnected(streamer.StreamKey, peerConnection)
 		}
 	})
 
-	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
-		SDP:  string(offer),
-		Type: webrtc.SDPTypeOffer,
-	}); err != nil {
-		return "", err
+	if err = negotiate(ctx, peerConnection, offer); err != nil {
+		return "", "", err
 	}
 
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	answer, err := peerConnection.CreateAnswer(nil)
+	if _, err = getStream(streamer, streamer.StreamKey, true); err != nil {
+		return "", "", err
+	}
 
-	if err != nil {
-		return "", err
-	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-		return "", err
+	if previous, previousRTMP := stream.whipPeerConnection, stream.rtmpConn; previous != nil || previousRTMP != nil {
+		Sessions.setState(stream.whipSessionId, SessionClosed)
+		stream.takeover()
+		if previous != nil {
+			closePeerConnection(previous)
+		} else {
+			stream.rtmpConn = nil
+			previousRTMP.Close()
+		}
+	} else {
+		stream.publishStartedAt = time.Now()
+		stream.bytesReceived.Store(0)
+		stream.videoPacketsSkipped.Store(0)
+		stream.whepSessionsLock.RLock()
+		stream.peakViewers = len(stream.whepSessions)
+		stream.whepSessionsLock.RUnlock()
+		stream.viewerDevices = ViewerDevices{}
+	}
+	stream.whipPeerConnection = peerConnection
+	stream.whipSessionId = sessionId
+	stream.timeline.newSession()
+	stream.lastMediaReceived.Store(time.Now().UnixNano())
+	stream.reportedState = StreamStateOnline
+	Sessions.setLive(sessionId)
+
+	events.Publish(events.Event{Type: events.StreamStart, StreamKey: streamer.StreamKey, Streamer: streamer.Name, Tenant: stream.tenant()})
+	checkTenantStreamQuotaWarning(streamer)
+
+	answer = maybePrintOfferAnswer(appendAnswer(peerConnection.LocalDescription().SDP), false)
+	captureSignaling(sessionId, SessionWHIP, streamer.StreamKey, SignalingAnswer, answer)
+	return answer, sessionId, nil
+}
+
+// WHIPDelete ends the publisher of streamKey, like when OBS stops streaming. Viewers are told the stream ended
+// right away instead of waiting for ICE to time out. An empty whipSessionId ends whichever publisher is live.
+func WHIPDelete(streamKey, whipSessionId string) error {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() || (whipSessionId != "" && stream.whipSessionId != whipSessionId) {
+		return ErrUnknownWHIPSession
+	}
+
+	peerConnection := stream.whipPeerConnection
+	removeSession(streamKey, "")
+	if peerConnection != nil {
+		closePeerConnection(peerConnection)
+	}
+
+	return nil
+}
+
+// EndStreamsOfStreamer ends every stream the streamer called name publishes to on this instance, like WHIPDelete
+func EndStreamsOfStreamer(name string) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for streamKey, stream := range streamMap {
+		if !stream.hasWHIPClient.Load() || stream.streamer == nil || stream.streamer.Name != name {
+			continue
+		}
+
+		peerConnection := stream.whipPeerConnection
+		removeSession(streamKey, "")
+		if peerConnection != nil {
+			closePeerConnection(peerConnection)
+		}
+	}
+}
+
+// takeover forgets the tracks of the replaced publisher. Viewers wait for a keyframe of the new publisher
+// before they receive video again.
+func (s *stream) takeover() {
+	s.closeVideoTracks()
+	s.audioTracks = nil
+
+	s.whepSessionsLock.RLock()
+	for _, whepSession := range s.whepSessions {
+		whepSession.audioLayer.Store("")
+		whepSession.waitingForKeyframe.Store(true)
 	}
+	s.whepSessionsLock.RUnlock()
 
-	<-gatherComplete
-	return maybePrintOfferAnswer(appendAnswer(peerConnection.LocalDescription().SDP), false), nil
+	select {
+	case s.pliChan <- true:
+	default:
+	}
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	defaultEvacuateGrace = 10 * time.Second
+	maxEvacuateGrace     = 5 * time.Minute
+	maxDrainWait         = time.Hour
+	drainPollInterval    = time.Second
+)
+
+type sessionCountJSON struct {
+	Draining     bool `json:"draining"`
+	WHIPSessions int  `json:"whipSessions"`
+	WHEPSessions int  `json:"whepSessions"`
+}
+
+func currentSessionCount() sessionCountJSON {
+	whipSessions, whepSessions := webrtc.SessionCount()
+	return sessionCountJSON{Draining: webrtc.Draining(), WHIPSessions: whipSessions, WHEPSessions: whepSessions}
+}
+
+// secondsFromQuery returns the query parameter name as a duration of at most limit, or fallback if it is not set or invalid
+func secondsFromQuery(req *http.Request, name string, fallback, limit time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(req.URL.Query().Get(name)); err == nil && seconds >= 0 {
+		return time.Duration(min(seconds, int(limit/time.Second))) * time.Second
+	}
+
+	return fallback
+}
+
+// healthHandler is the liveness probe, it fails only if the process can't serve HTTP
+func healthHandler(res http.ResponseWriter, req *http.Request) {
+	res.WriteHeader(http.StatusOK)
+}
+
+// readinessHandler is the readiness probe. The instance is not ready while draining or once it serves
+// READINESS_MAX_SESSIONS sessions, so new sessions are routed to other instances.
+func readinessHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	count := currentSessionCount()
+	maxSessions, _ := strconv.Atoi(os.Getenv("READINESS_MAX_SESSIONS"))
+
+	switch {
+	case count.Draining:
+		res.WriteHeader(http.StatusServiceUnavailable)
+	case maxSessions > 0 && count.WHIPSessions+count.WHEPSessions >= maxSessions:
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(res).Encode(count); err != nil {
+		log.Println(err)
+	}
+}
+
+// drainHandler stops accepting new sessions on `POST`, meant as preStop hook. With `?wait=<seconds>` the
+// response is delayed until all sessions ended or the time passed, at most maxDrainWait. `DELETE` stops draining,
+// `GET` only reports.
+func drainHandler(res http.ResponseWriter, req *http.Request) {
+	if !adminFromRequest(res, req) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		webrtc.SetDraining(false)
+	case http.MethodPost:
+		webrtc.SetDraining(true)
+
+		deadline := time.Now().Add(secondsFromQuery(req, "wait", 0, maxDrainWait))
+		for count := currentSessionCount(); count.WHIPSessions+count.WHEPSessions != 0 && time.Now().Before(deadline); count = currentSessionCount() {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(drainPollInterval):
+			}
+		}
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(currentSessionCount()); err != nil {
+		log.Println(err)
+	}
+}
+
+// evacuateHandler drains the instance and ends all sessions after `?grace=<seconds>`, at most maxEvacuateGrace. Viewers
+// are told to reconnect elsewhere during the grace period, publishers are expected to reconnect by themselves.
+func evacuateHandler(res http.ResponseWriter, req *http.Request) {
+	if !adminFromRequest(res, req) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	webrtc.Evacuate(secondsFromQuery(req, "grace", defaultEvacuateGrace, maxEvacuateGrace))
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(currentSessionCount()); err != nil {
+		log.Println(err)
+	}
+}
+
+// sessionsHandler lists every session of this instance with its lifecycle state. Filter with `?streamKey=`
+// and `?state=` (negotiating, live or draining).
+func sessionsHandler(res http.ResponseWriter, req *http.Request) {
+	tenant, ok := adminScopeFromRequest(res, req)
+	if !ok {
+		return
+	}
+
+	streamKey, state := req.URL.Query().Get("streamKey"), webrtc.SessionState(req.URL.Query().Get("state"))
+	sessions := []webrtc.SessionInfo{}
+	for _, session := range webrtc.Sessions.List() {
+		if tenant != "" && webrtc.StreamTenant(session.StreamKey) != tenant {
+			continue
+		}
+
+		if (streamKey == "" || session.StreamKey == streamKey) && (state == "" || session.State == state) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(sessions); err != nil {
+		log.Println(err)
+	}
+}
+
+// signalingDebugHandler lists the sessions SIGNALING_DEBUG captured the negotiation of, and downloads the capture of
+// one as a JSON bundle that can be attached to a bug report. Secrets are redacted when the capture is taken.
+func signalingDebugHandler(res http.ResponseWriter, req *http.Request) {
+	tenant, ok := adminScopeFromRequest(res, req)
+	if !ok {
+		return
+	} else if !webrtc.SignalingDebugEnabled() {
+		logHTTPError(res, "Signaling debug is disabled, set SIGNALING_DEBUG=true", http.StatusNotFound)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	sessionId := req.PathValue("sessionid")
+	if sessionId == "" {
+		captures := []webrtc.SignalingCapture{}
+		for _, capture := range webrtc.SignalingCaptures() {
+			if tenant == "" || webrtc.StreamTenant(capture.StreamKey) == tenant {
+				captures = append(captures, capture)
+			}
+		}
+
+		if err := json.NewEncoder(res).Encode(captures); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	capture, ok := webrtc.GetSignalingCapture(sessionId)
+	if !ok || (tenant != "" && webrtc.StreamTenant(capture.StreamKey) != tenant) {
+		logHTTPError(res, "Session was not captured", http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Disposition", `attachment; filename="signaling-`+capture.SessionID+`.json"`)
+	encoder := json.NewEncoder(res)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(capture); err != nil {
+		log.Println(err)
+	}
+}
+
+// capacityHandler reports what every stream consumes and how many more viewers fit, so operators know when to scale
+func capacityHandler(res http.ResponseWriter, req *http.Request) {
+	if !adminFromRequest(res, req) {
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(webrtc.GetCapacity()); err != nil {
+		log.Println(err)
+	}
+}
+
+// resourceUsageHandler shows the goroutines and sockets of this instance and of each stream, to spot
+// sessions that were closed without releasing them
+func resourceUsageHandler(res http.ResponseWriter, req *http.Request) {
+	if !adminFromRequest(res, req) {
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(webrtc.GetResourceUsage()); err != nil {
+		log.Println(err)
+	}
+}
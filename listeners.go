@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/subsystem"
+)
+
+// Routes a listener exposes. Health and readiness probes are served by every listener.
+const (
+	// Everything that isn't admin or metrics, like WHIP, WHEP, the portal and embeds
+	exposurePublic = "public"
+	// /api/admin/...
+	exposureAdmin = "admin"
+	// /api/metrics
+	exposureMetrics = "metrics"
+)
+
+var allExposures = []string{exposurePublic, exposureAdmin, exposureMetrics}
+
+type httpListener struct {
+	address         string
+	exposures       []string
+	tlsCert, tlsKey string
+
+	// Reloaded by the certificates job, renewed certificates are served without a restart
+	certificate *atomic.Pointer[tls.Certificate]
+}
+
+// httpListenersFromEnv reads HTTP_LISTENERS as `address;exposures;cert;key` delineated by '|', with exposures delineated
+// by ','. Cert and key are optional. Without HTTP_LISTENERS there is a single listener on HTTP_ADDRESS that exposes
+// everything, with TLS if SSL_CERT and SSL_KEY are set.
+func httpListenersFromEnv() ([]httpListener, error) {
+	val := os.Getenv("HTTP_LISTENERS")
+	if val == "" {
+		return []httpListener{{
+			address:   os.Getenv("HTTP_ADDRESS"),
+			exposures: allExposures,
+			tlsCert:   os.Getenv("SSL_CERT"),
+			tlsKey:    os.Getenv("SSL_KEY"),
+
+			certificate: &atomic.Pointer[tls.Certificate]{},
+		}}, nil
+	}
+
+	listeners := []httpListener{}
+	for _, listener := range strings.Split(val, "|") {
+		fields := strings.Split(listener, ";")
+		if len(fields) != 2 && len(fields) != 4 {
+			return nil, fmt.Errorf("HTTP_LISTENERS has an invalid listener `%s`, expected `address;exposures` or `address;exposures;cert;key`", listener)
+		}
+
+		l := httpListener{address: strings.TrimSpace(fields[0]), certificate: &atomic.Pointer[tls.Certificate]{}}
+		for _, exposure := range strings.Split(fields[1], ",") {
+			exposure = strings.TrimSpace(exposure)
+			if !slices.Contains(allExposures, exposure) {
+				return nil, fmt.Errorf("HTTP_LISTENERS has an invalid exposure `%s`, expected %s", exposure, strings.Join(allExposures, ", "))
+			}
+			l.exposures = append(l.exposures, exposure)
+		}
+
+		if len(fields) == 4 {
+			l.tlsCert, l.tlsKey = strings.TrimSpace(fields[2]), strings.TrimSpace(fields[3])
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// exposureOf returns which exposure a path belongs to, empty for probes
+func exposureOf(path string) string {
+	switch {
+	case path == "/api/healthz" || path == "/api/readyz":
+		return ""
+	case path == "/api/metrics":
+		return exposureMetrics
+	case strings.HasPrefix(path, "/api/admin/"):
+		return exposureAdmin
+	default:
+		return exposurePublic
+	}
+}
+
+// exposureHandler answers requests for routes the listener doesn't expose with 404, as if they didn't exist
+func exposureHandler(exposures []string, next http.Handler) http.Handler {
+	if len(exposures) == len(allExposures) {
+		return next
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if exposure := exposureOf(req.URL.Path); exposure != "" && !slices.Contains(exposures, exposure) {
+			logHTTPError(res, "Not found", http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
+
+// start binds the address of the listener and serves handler on it until the returned server is shut down. A
+// listener that stops serving fails the http subsystem.
+func (l httpListener) start(handler http.Handler) (*http.Server, error) {
+	server := &http.Server{
+		Handler: handler,
+		Addr:    l.address,
+	}
+
+	scheme, address := "HTTP", l.address
+	if l.usesTLS() {
+		if _, err := l.loadCertificate(); err != nil {
+			return nil, err
+		}
+		server.TLSConfig = &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return l.certificate.Load(), nil
+			},
+		}
+		scheme = "HTTPS"
+	}
+
+	// Like ListenAndServe, an empty address is the default port of the scheme
+	if address == "" {
+		address = ":" + strings.ToLower(scheme)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		log.Println("Running " + scheme + " Server at `" + l.address + "` for " + strings.Join(l.exposures, ", "))
+
+		if l.usesTLS() {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			subsystem.Fail("http", err)
+		}
+	}()
+
+	return server, nil
+}
+
+// usesTLS reports whether the listener serves HTTPS
+func (l httpListener) usesTLS() bool {
+	return l.tlsCert != "" && l.tlsKey != ""
+}
+
+// loadCertificate reads the certificate and key of the listener from disk and returns when the certificate expires
+func (l httpListener) loadCertificate() (time.Time, error) {
+	cert, err := tls.LoadX509KeyPair(l.tlsCert, l.tlsKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	l.certificate.Store(&cert)
+	return leaf.NotAfter, nil
+}
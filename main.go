@@ -2,22 +2,37 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
-	"github.com/patrikrog/broadcast-box/internal/networktest"
+	"github.com/patrikrog/broadcast-box/internal/edge"
+	"github.com/patrikrog/broadcast-box/internal/hlskeys"
+	"github.com/patrikrog/broadcast-box/internal/metrics"
+	"github.com/patrikrog/broadcast-box/internal/playbacktoken"
+	"github.com/patrikrog/broadcast-box/internal/plugin"
+	"github.com/patrikrog/broadcast-box/internal/postprocess"
+	"github.com/patrikrog/broadcast-box/internal/provisioning"
+	"github.com/patrikrog/broadcast-box/internal/sessionstore"
+	"github.com/patrikrog/broadcast-box/internal/subsystem"
+	"github.com/patrikrog/broadcast-box/internal/tokenexchange"
 	"github.com/patrikrog/broadcast-box/internal/webrtc"
 )
 
@@ -28,140 +43,1274 @@ const (
 	networkTestIntroMessage   = "\033[0;33mNETWORK_TEST_ON_START is enabled. If the test fails Broadcast Box will exit.\nSee the README for how to debug or disable NETWORK_TEST_ON_START\033[0m"
 	networkTestSuccessMessage = "\033[0;32mNetwork Test passed.\nHave fun using Broadcast Box.\033[0m"
 	networkTestFailedMessage  = "\033[0;31mNetwork Test failed.\n%s\nPlease see the README and join Discord for help\033[0m"
+
+	defaultPlaybackTokenLifetime   = 60 * 60
+	defaultPlaybackTokenMaxTTL     = 24 * 60 * 60
+	exchangedPlaybackTokenLifetime = 5 * time.Minute
+
+	maxPreflightProbeSize = 16 << 20
+
+	databasePingTimeout = 2 * time.Second
+
+	// Stream keys a single /api/status-batch request may ask for
+	maxBatchStatusKeys = 100
+
+	// Proxies close idle connections, Server-Sent Events get a comment at least this often
+	sseKeepaliveInterval = 15 * time.Second
+)
+
+var (
+	dbPool *pgxpool.Pool
+	store  plugin.Store
+
+	// Longest lifetime in seconds a publisher may give a playback token
+	playbackTokenMaxTTL int64 = defaultPlaybackTokenMaxTTL
 )
 
-var dbPool *pgxpool.Pool
+type (
+	capabilitiesJSON struct {
+		CodecProfile webrtc.CodecProfile `json:"codecProfile"`
+		Available    []string            `json:"available"`
+	}
+
+	whepLayerRequestJSON struct {
+		MediaId    string `json:"mediaId"`
+		EncodingId string `json:"encodingId"`
+
+		// Requested playout delay in milliseconds
+		PlayoutDelay *int64 `json:"playoutDelay"`
+
+		// Largest layer the viewer wants to receive, the bitrate is in bits per second
+		MaxWidth   *int    `json:"maxWidth"`
+		MaxHeight  *int    `json:"maxHeight"`
+		MaxBitrate *uint64 `json:"maxBitrate"`
+	}
+
+	batchStatusRequestJSON struct {
+		StreamKeys []string `json:"streamKeys"`
+	}
+
+	reactionRequestJSON struct {
+		Emote string `json:"emote"`
+	}
+
+	bookmarkRequestJSON struct {
+		Label string `json:"label"`
+		// Optional, viewers that are behind live (e.g. because of a playout delay) pass their own media time
+		MediaTime *int64 `json:"mediaTime"`
+	}
+
+	heatmapRequestJSON struct {
+		StreamStartedAt uint64 `json:"streamStartedAt"`
+		// Milliseconds into the recording the viewer played since its last report
+		Positions []int64 `json:"positions"`
+	}
+
+	playbackTokenRequestJSON struct {
+		// Lifetime of the token in seconds
+		ExpiresIn int64 `json:"expiresIn"`
+	}
+
+	playbackTokenResponseJSON struct {
+		Token     string `json:"token"`
+		ExpiresAt int64  `json:"expiresAt"`
+	}
+
+	clockResponseJSON struct {
+		ClientTime   int64               `json:"clientTime,omitempty"`
+		ReceiveTime  int64               `json:"receiveTime"`
+		TransmitTime int64               `json:"transmitTime"`
+		Stream       *webrtc.StreamClock `json:"stream,omitempty"`
+	}
+)
+
+func validateStreamKey(streamKey string) bool {
+	return regexp.MustCompile(`^[a-zA-Z0-9_\-\.~]+$`).MatchString(streamKey)
+}
+
+// resolveStreamKey returns the stream key an alias points to. Names that are no alias are returned as they are.
+func resolveStreamKey(ctx context.Context, name string) string {
+	streamKey, err := webrtc.ResolveStreamAlias(dbPool, ctx, name)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Println(err)
+		}
+		return name
+	}
+
+	return streamKey
+}
+
+// publicStreamKeys replaces the stream keys that have an alias with their alias, so listings don't reveal them
+func publicStreamKeys(ctx context.Context, streamKeys []string) ([]string, error) {
+	aliasOf, err := webrtc.GetAliasesOfStreamKeys(dbPool, ctx, streamKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	public := make([]string, len(streamKeys))
+	for i, streamKey := range streamKeys {
+		if alias, ok := aliasOf[streamKey]; ok {
+			public[i] = alias
+		} else {
+			public[i] = streamKey
+		}
+	}
+	return public, nil
+}
+
+// publicDirectory lists the given stream keys like webrtc.GetDirectory, with aliases in place of the stream keys that have one
+func publicDirectory(ctx context.Context, streamKeys []string, liveOnly bool) ([]webrtc.DirectoryEntry, error) {
+	entries := webrtc.GetDirectory(streamKeys, liveOnly)
+
+	entryKeys := make([]string, len(entries))
+	for i, entry := range entries {
+		entryKeys[i] = entry.StreamKey
+	}
+
+	publicKeys, err := publicStreamKeys(ctx, entryKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		entries[i].StreamKey = publicKeys[i]
+		if entries[i].ThumbnailURL != "" {
+			entries[i].ThumbnailURL = webrtc.ThumbnailURL(publicKeys[i])
+		}
+	}
+	return entries, nil
+}
+
+// applyNegotiationOverrides removes what the streamer disabled in the stream settings from an offer
+func applyNegotiationOverrides(ctx context.Context, streamKey, offer string) string {
+	settings, err := webrtc.GetStreamSettings(dbPool, ctx, streamKey)
+	if err != nil {
+		log.Println(err)
+		return offer
+	}
+
+	return settings.ApplyNegotiationOverrides(offer)
+}
+
+func extractBearerToken(authHeader string) ([]string, bool) {
+	const bearerPrefix = "Bearer "
+	if strings.HasPrefix(authHeader, bearerPrefix) {
+		s := strings.Split(strings.TrimPrefix(authHeader, bearerPrefix), ";")
+		return s, true
+	}
+	return nil, false
+}
+
+// streamerFromRequest authenticates a publisher by the `Bearer <streamKey>;<authToken>` Authorization header.
+// On failure the error is written to res and nil is returned.
+func streamerFromRequest(res http.ResponseWriter, req *http.Request) *webrtc.Streamer {
+	streamKeyHeader := req.Header.Get("Authorization")
+	if streamKeyHeader == "" {
+		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
+		return nil
+	}
+
+	token, ok := extractBearerToken(streamKeyHeader)
+	if !ok || len(token) != 2 || !validateStreamKey(token[0]) {
+		logHTTPError(res, "Not a valid token", http.StatusBadRequest)
+		return nil
+	}
+
+	streamer := authenticateStreamer(req.Context(), token[0], token[1])
+	if streamer == nil {
+		logHTTPError(res, "Not an authorized streamer", http.StatusForbidden)
+		return nil
+	}
+
+	return streamer
+}
+
+// authenticateStreamer returns the streamer of streamKey if authToken is theirs. Unknown stream keys are provisioned
+// if provisioning is enabled.
+func authenticateStreamer(ctx context.Context, streamKey, authToken string) *webrtc.Streamer {
+	streamer := store.Streamer(ctx, streamKey, authToken)
+	if streamer == nil && provisioning.Enabled() {
+		streamer = provisionStreamer(ctx, []string{streamKey, authToken})
+	}
+
+	return streamer
+}
+
+// provisionStreamer asks the provisioning webhook about an unknown stream key and creates the streamer if it is allowed
+func provisionStreamer(ctx context.Context, token []string) *webrtc.Streamer {
+	result, err := provisioning.Provision(ctx, token[0], token[1])
+	if err != nil {
+		log.Printf("Provisioning %s failed: %v", token[0], err)
+		return nil
+	} else if !result.Allow {
+		return nil
+	}
+
+	var expiresAt *time.Time
+	if result.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+
+	if err := store.ProvisionStreamer(ctx, result.Name, token[0], token[1], expiresAt, result.Quotas.MaxBitrate, result.Quotas.MaxViewers); err != nil {
+		log.Printf("Provisioning %s failed: %v", token[0], err)
+		return nil
+	}
+
+	return store.Streamer(ctx, token[0], token[1])
+}
+
+// accountFromRequest authenticates a user by the `Bearer <authToken>` Authorization header
+func accountFromRequest(res http.ResponseWriter, req *http.Request) *webrtc.Streamer {
+	token, ok := extractBearerToken(req.Header.Get("Authorization"))
+	if !ok || len(token) != 1 || token[0] == "" {
+		logHTTPError(res, "Authorization was not set", http.StatusUnauthorized)
+		return nil
+	}
+
+	account := store.StreamerByAuthToken(req.Context(), token[0])
+	if account == nil {
+		logHTTPError(res, "Not an authorized user", http.StatusForbidden)
+		return nil
+	}
+
+	return account
+}
+
+func whipHandler(res http.ResponseWriter, r *http.Request) {
+	streamer := publisherFromRequest(res, r, r.Method == http.MethodPost)
+	if streamer == nil {
+		return
+	}
+
+	// Clients that were given the old Location end whichever publisher of their stream key is live
+	if r.Method == http.MethodDelete {
+		whipDeleteHandler(res, streamer, "")
+		return
+	}
+
+	offer, err := io.ReadAll(r.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offerWithQuirks := webrtc.ApplyEncoderQuirks(string(offer), r.UserAgent(), r.Header.Get("Content-Type"))
+	offerWithQuirks = applyNegotiationOverrides(r.Context(), streamer.StreamKey, offerWithQuirks)
+	answer, whipSessionId, err := webrtc.WHIP(r.Context(), offerWithQuirks, streamer, r.URL.Query().Get("takeover") == "true")
+	if errors.Is(err, webrtc.ErrStreamAlreadyLive) {
+		logHTTPError(res, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, webrtc.ErrReservedStreamKey) {
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
+	} else if errors.Is(err, webrtc.ErrTenantStreamLimit) {
+		logHTTPError(res, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if errors.Is(err, webrtc.ErrDraining) {
+		logHTTPError(res, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res.Header().Add("Location", "/api/whip/"+whipSessionId)
+	res.Header().Add("Content-Type", "application/sdp")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusCreated)
+	fmt.Fprint(res, answer)
+}
+
+// whipSessionHandler is the resource of a publisher. PATCH trickles ICE candidates or restarts ICE, DELETE ends the stream.
+func whipSessionHandler(res http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPatch {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamer := publisherFromRequest(res, r, false)
+	if streamer == nil {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		whipDeleteHandler(res, streamer, r.PathValue("whipSessionId"))
+		return
+	}
+
+	sdpFragmentHandler(res, r, func(body string) (string, error) {
+		return webrtc.WHIPPatch(r.Context(), streamer.StreamKey, r.PathValue("whipSessionId"), body)
+	})
+}
+
+// sdpFragmentHandler answers the PATCH of a WHIP or WHEP session with what patch returns for its trickle-ice-sdpfrag
+func sdpFragmentHandler(res http.ResponseWriter, r *http.Request, patch func(body string) (string, error)) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/trickle-ice-sdpfrag") {
+		logHTTPError(res, "Content-Type must be application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fragment, err := patch(string(body))
+	if errors.Is(err, webrtc.ErrUnknownWHIPSession) || errors.Is(err, webrtc.ErrUnknownWHEPSession) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only an ICE restart has an answer
+	if fragment == "" {
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/trickle-ice-sdpfrag")
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprint(res, fragment)
+}
+
+func whipDeleteHandler(res http.ResponseWriter, streamer *webrtc.Streamer, whipSessionId string) {
+	if err := webrtc.WHIPDelete(streamer.StreamKey, whipSessionId); errors.Is(err, webrtc.ErrUnknownWHIPSession) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+func whepHandler(res http.ResponseWriter, req *http.Request) {
+	streamKeyHeader := req.Header.Get("Authorization")
+	if streamKeyHeader == "" {
+		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
+		return
+	}
+
+	token, ok := extractBearerToken(streamKeyHeader)
+	if !ok || !validateStreamKey(token[0]) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+
+	if redirectURL, ok := edge.RedirectURL(req); ok {
+		http.Redirect(res, req, redirectURL, http.StatusTemporaryRedirect)
+		return
+	}
+
+	// Viewers resuming a session were already authorized
+	streamKey := resolveStreamKey(req.Context(), token[0])
+	resumeToken := req.Header.Get("X-Resume-Token")
+	resuming := resumeToken != "" && webrtc.CanResumeWHEP(resumeToken, streamKey)
+
+	if playbacktoken.Enabled() && !resuming {
+		if len(token) != 2 {
+			logHTTPError(res, "Playback token was not set", http.StatusUnauthorized)
+			return
+		} else if err := playbacktoken.Verify(token[1], streamKey); err != nil {
+			logHTTPError(res, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if !resuming {
+		if err := webrtc.CheckOriginAllowed(streamKey, req.Host, req.Header.Get("Origin"), req.Header.Get("Referer")); err != nil {
+			logHTTPError(res, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	offer, err := io.ReadAll(req.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offerWithOverrides := applyNegotiationOverrides(req.Context(), streamKey, string(offer))
+
+	var answer, whepSessionId string
+	if resuming {
+		answer, whepSessionId, err = webrtc.WHEPResume(req.Context(), offerWithOverrides, resumeToken)
+	} else {
+		answer, whepSessionId, err = webrtc.WHEP(req.Context(), offerWithOverrides, streamKey)
+	}
+	if errors.Is(err, webrtc.ErrDraining) {
+		logHTTPError(res, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, webrtc.ErrOutputNotAllowed) {
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
+	} else if errors.Is(err, webrtc.ErrStreamEgressLimit) {
+		// Players fall back to another output, like HLS, instead of failing
+		if fallbackURL := webrtc.EgressFallbackURL(streamKey); fallbackURL != "" {
+			res.Header().Set("Link", fmt.Sprintf(`<%s>; rel="alternate"`, fallbackURL))
+		}
+		logHTTPError(res, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sessionstore.Register(whepSessionId, streamKey)
+	if err := webrtc.RecordViewerDevice(whepSessionId, req.UserAgent()); err != nil {
+		log.Println(err)
+	}
+
+	apiPath := req.Host + strings.TrimSuffix(req.URL.RequestURI(), "whep")
+	res.Header().Add("Link", `<`+apiPath+"sse/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:server-sent-events"; events="layers"`)
+	res.Header().Add("Link", `<`+apiPath+"layer/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:layer"`)
+	if resumeToken := webrtc.IssueResumeToken(whepSessionId); resumeToken != "" {
+		res.Header().Add("X-Resume-Token", resumeToken)
+	}
+	res.Header().Add("Location", "/api/whep/"+whepSessionId)
+	res.Header().Add("Content-Type", "application/sdp")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusCreated)
+	fmt.Fprint(res, answer)
+}
+
+// whepSessionHandler is the resource of a viewer. PATCH trickles ICE candidates or restarts ICE, DELETE ends the
+// session. Like the layer and SSE endpoints the session ID authorizes it. Any instance can answer a DELETE, a PATCH
+// has to reach the instance that owns the session.
+func whepSessionHandler(res http.ResponseWriter, req *http.Request) {
+	whepSessionId := req.PathValue("whepSessionId")
+	if req.Method == http.MethodPatch {
+		sdpFragmentHandler(res, req, func(body string) (string, error) {
+			return webrtc.WHEPPatch(req.Context(), whepSessionId, body)
+		})
+		return
+	} else if req.Method != http.MethodDelete {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := webrtc.WHEPDelete(whepSessionId)
+	if errors.Is(err, webrtc.ErrUnknownWHEPSession) && sessionstore.Enabled() {
+		err = sessionstore.ForwardDelete(req.Context(), whepSessionId)
+	}
+
+	if errors.Is(err, webrtc.ErrUnknownWHEPSession) || errors.Is(err, sessionstore.ErrUnknownSession) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+func whepServerSentEventsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+
+	vals := strings.Split(req.URL.RequestURI(), "/")
+	whepSessionId := vals[len(vals)-1]
+
+	subscription, err := webrtc.SubscribeSSE(whepSessionId)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer subscription.Close()
+
+	// Sessions of this instance push their layers again whenever they change, like simulcast layers that
+	// the encoder enabled late. Sessions of other instances get the layers the owning instance stored once,
+	// their connection is still kept open so EventSource doesn't reconnect over and over.
+	writeLayers := true
+	layersChanged, err := webrtc.WHEPLayersChanged(whepSessionId)
+	if err != nil && sessionstore.Enabled() {
+		layers, err := sessionstore.Layers(req.Context(), whepSessionId)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeLayersEvent(res, layers)
+		writeLayers = false
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, _ := res.(http.Flusher)
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	// Layers and the state of the stream are sent right away, and again whenever they change
+	sentState := ""
+	for {
+		if writeLayers {
+			layers, err := whepSessionLayers(whepSessionId)
+			if err != nil {
+				return
+			}
+
+			writeLayersEvent(res, layers)
+			writeLayers = false
+		}
+		if state := subscription.StreamState(); state != sentState {
+			writeStateEvent(res, state)
+			sentState = state
+		}
+
+		if flusher == nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-subscription.Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(res, ": keepalive\n\n")
+		case <-subscription.StreamStateChanged():
+		case <-layersChanged:
+			if layersChanged, err = webrtc.WHEPLayersChanged(whepSessionId); err != nil {
+				return
+			}
+			writeLayers = true
+		}
+	}
+}
+
+func writeLayersEvent(res http.ResponseWriter, layers []byte) {
+	fmt.Fprint(res, "event: layers\n")
+	fmt.Fprintf(res, "data: %s\n", string(layers))
+	fmt.Fprint(res, "\n\n")
+}
+
+func writeStateEvent(res http.ResponseWriter, state string) {
+	fmt.Fprint(res, "event: state\n")
+	fmt.Fprintf(res, "data: %s\n", state)
+	fmt.Fprint(res, "\n\n")
+}
+
+func whepLayerHandler(res http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vals := strings.Split(req.URL.RequestURI(), "/")
+	whepSessionId := vals[len(vals)-1]
+
+	// The session is connected to another instance
+	if !webrtc.HasWHEPSession(whepSessionId) && sessionstore.Enabled() {
+		if err := sessionstore.Forward(req.Context(), whepSessionId, body); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	if err := applyWHEPLayerRequest(whepSessionId, body); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// whepSessionLayers returns the layers of a local WHEP session
+func whepSessionLayers(whepSessionId string) ([]byte, error) {
+	if !webrtc.HasWHEPSession(whepSessionId) {
+		return nil, errors.New("WHEP session does not exist")
+	}
+
+	return webrtc.WHEPLayers(whepSessionId)
+}
+
+func applyWHEPLayerRequest(whepSessionId string, body []byte) error {
+	var r whepLayerRequestJSON
+	if err := json.Unmarshal(body, &r); err != nil {
+		return err
+	}
+
+	if r.PlayoutDelay != nil {
+		if err := webrtc.WHEPSetPlayoutDelay(whepSessionId, time.Duration(*r.PlayoutDelay)*time.Millisecond); err != nil {
+			return err
+		}
+	}
+
+	if r.MaxWidth != nil || r.MaxHeight != nil || r.MaxBitrate != nil {
+		var maxWidth, maxHeight int
+		var maxBitrate uint64
+		if r.MaxWidth != nil {
+			maxWidth = *r.MaxWidth
+		}
+		if r.MaxHeight != nil {
+			maxHeight = *r.MaxHeight
+		}
+		if r.MaxBitrate != nil {
+			maxBitrate = *r.MaxBitrate
+		}
+
+		return webrtc.WHEPSetLayerHint(whepSessionId, maxWidth, maxHeight, maxBitrate)
+	}
+
+	if r.EncodingId == "" && r.PlayoutDelay != nil {
+		return nil
+	}
+
+	return webrtc.WHEPChangeLayer(whepSessionId, r.MediaId, r.EncodingId)
+}
+
+func playbackTokenHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	streamer := streamerFromRequest(res, req)
+	if streamer == nil {
+		return
+	} else if streamer.StreamKey != req.PathValue("streamkey") {
+		logHTTPError(res, "Not an authorized streamer", http.StatusForbidden)
+		return
+	}
+
+	r := playbackTokenRequestJSON{ExpiresIn: defaultPlaybackTokenLifetime}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.ExpiresIn <= 0 {
+		logHTTPError(res, "Invalid token lifetime", http.StatusBadRequest)
+		return
+	}
+
+	expiresAt := time.Now().Add(time.Duration(min(r.ExpiresIn, playbackTokenMaxTTL)) * time.Second)
+	token, err := playbacktoken.Sign(streamer.StreamKey, expiresAt)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(playbackTokenResponseJSON{Token: token, ExpiresAt: expiresAt.Unix()}); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// configurePlaybackTokenMaxTTL reads PLAYBACK_TOKEN_MAX_TTL, the longest lifetime of playback tokens in seconds
+func configurePlaybackTokenMaxTTL() error {
+	val := os.Getenv("PLAYBACK_TOKEN_MAX_TTL")
+	if val == "" {
+		return nil
+	}
+
+	ttl, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("Invalid PLAYBACK_TOKEN_MAX_TTL %q, expected a positive number of seconds", val)
+	}
+	playbackTokenMaxTTL = ttl
+
+	return nil
+}
+
+// playbackTokenExchangeHandler exchanges the viewer's session on the operator's site for a short-lived playback
+// token. The session is a cookie or bearer token, so CORS is only allowed for SSO_ALLOWED_ORIGINS with credentials.
+func playbackTokenExchangeHandler(res http.ResponseWriter, req *http.Request) {
+	if origin := req.Header.Get("Origin"); origin != "" && slices.Contains(strings.Split(os.Getenv("SSO_ALLOWED_ORIGINS"), "|"), origin) {
+		res.Header().Set("Access-Control-Allow-Origin", origin)
+		res.Header().Set("Access-Control-Allow-Credentials", "true")
+		res.Header().Set("Access-Control-Allow-Methods", "POST")
+		res.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		res.Header().Set("Vary", "Origin")
+	}
+
+	if req.Method == http.MethodOptions {
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	} else if !tokenexchange.Enabled() || !playbacktoken.Enabled() {
+		logHTTPError(res, "Token exchange is disabled", http.StatusNotFound)
+		return
+	}
+
+	streamKey := req.PathValue("streamkey")
+	sessionExpiresAt, err := tokenexchange.Authorize(req, streamKey)
+	switch {
+	case errors.Is(err, tokenexchange.ErrNoSession), errors.Is(err, tokenexchange.ErrDenied):
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// Tokens never outlive the session they were exchanged for
+	expiresAt := time.Now().Add(exchangedPlaybackTokenLifetime)
+	if !sessionExpiresAt.IsZero() && sessionExpiresAt.Before(expiresAt) {
+		expiresAt = sessionExpiresAt
+	}
+
+	// The site authorizes the name the viewer knows, tokens are verified against the stream key it resolves to
+	token, err := playbacktoken.Sign(resolveStreamKey(req.Context(), streamKey), expiresAt)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(playbackTokenResponseJSON{Token: token, ExpiresAt: expiresAt.Unix()}); err != nil {
+		log.Println(err)
+	}
+}
+
+// preflightHandler lets encoders check their setup before going live. The request is authenticated like WHIP,
+// `?codecs=H264,AV1` lists the codecs the encoder supports and the body is an uplink probe of arbitrary bytes.
+func preflightHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamer := streamerFromRequest(res, req)
+	if streamer == nil {
+		return
+	} else if streamer.StreamKey != req.PathValue("streamkey") {
+		logHTTPError(res, "Not an authorized streamer", http.StatusForbidden)
+		return
+	}
+
+	var codecs []string
+	if val := req.URL.Query().Get("codecs"); val != "" {
+		codecs = strings.Split(val, ",")
+	}
+
+	probeStart := time.Now()
+	probeBytes, err := io.Copy(io.Discard, io.LimitReader(req.Body, maxPreflightProbeSize))
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := webrtc.Preflight(streamer, codecs, probeBytes, time.Since(probeStart))
+	if err := json.NewEncoder(res).Encode(report); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+func metadataHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+	streamKey := req.PathValue("streamkey")
+
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+
+	if req.Method == http.MethodPost || req.Method == http.MethodPut {
+		streamer := streamerFromRequest(res, req)
+		if streamer == nil {
+			return
+		} else if streamer.StreamKey != streamKey {
+			logHTTPError(res, "Not an authorized streamer", http.StatusForbidden)
+			return
+		}
+
+		var metadata webrtc.StreamMetadata
+		if err := json.NewDecoder(req.Body).Decode(&metadata); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := webrtc.SetStreamMetadata(streamKey, metadata); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := json.NewEncoder(res).Encode(webrtc.GetStreamMetadata(streamKey)); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// edgeSelectHandler returns the edge node closest to the viewer, see edge.Select
+func edgeSelectHandler(res http.ResponseWriter, req *http.Request) {
+	if !edge.Enabled() {
+		logHTTPError(res, "Edge selection is disabled", http.StatusNotFound)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(edge.Select(req)); err != nil {
+		log.Println(err)
+	}
+}
+
+// hlsKeyHandler serves the AES-128 keys HLS segments are encrypted with, to viewers with a playback token
+func hlsKeyHandler(res http.ResponseWriter, req *http.Request) {
+	if !hlskeys.Enabled() {
+		logHTTPError(res, "HLS encryption is disabled", http.StatusNotFound)
+		return
+	}
+
+	streamKey := resolveStreamKey(req.Context(), req.PathValue("streamkey"))
+	if playbacktoken.Enabled() {
+		if err := playbacktoken.Verify(req.URL.Query().Get("token"), streamKey); err != nil {
+			logHTTPError(res, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := webrtc.CheckOutputAllowed(streamKey, webrtc.OutputHLS); err != nil {
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
+	} else if err = webrtc.CheckOriginAllowed(streamKey, req.Host, req.Header.Get("Origin"), req.Header.Get("Referer")); err != nil {
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if err != nil {
+		logHTTPError(res, "Invalid key id", http.StatusBadRequest)
+		return
+	}
+
+	key, err := hlskeys.Get(streamKey, id)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/octet-stream")
+	res.Header().Set("Cache-Control", "no-store")
+	if _, err := res.Write(key.Bytes); err != nil {
+		log.Println(err)
+	}
+}
 
+// hlsHandler serves the playlist and segments of a stream packaged as HLS, the playback token of the viewer is
+// added to every URI of the playlist
+func hlsHandler(res http.ResponseWriter, req *http.Request) {
+	streamKey, file := req.PathValue("streamkey"), req.PathValue("file")
+	if !webrtc.HLSEnabled() {
+		logHTTPError(res, "HLS is disabled", http.StatusNotFound)
+		return
+	} else if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-type (
-	whepLayerRequestJSON struct {
-		MediaId    string `json:"mediaId"`
-		EncodingId string `json:"encodingId"`
+	// Players keep using the alias in the URLs of the playlist, the stream is looked up by the key it resolves to
+	streamKey = resolveStreamKey(req.Context(), streamKey)
+	token := req.URL.Query().Get("token")
+	if playbacktoken.Enabled() {
+		if err := playbacktoken.Verify(token, streamKey); err != nil {
+			logHTTPError(res, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := webrtc.CheckOutputAllowed(streamKey, webrtc.OutputHLS); err != nil {
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
+	} else if err = webrtc.CheckOriginAllowed(streamKey, req.Host, req.Header.Get("Origin"), req.Header.Get("Referer")); err != nil {
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
 	}
-)
 
-func logHTTPError(w http.ResponseWriter, err string, code int) {
-	log.Println(err)
-	http.Error(w, err, code)
+	// Segments never change, the playlist changes with every segment
+	contentType, cacheControl := "video/mp4", "public, max-age=3600"
+	var body []byte
+	var err error
+	if file == "index.m3u8" {
+		query := ""
+		if token != "" {
+			query = "?token=" + url.QueryEscape(token)
+		}
+
+		contentType, cacheControl = "application/vnd.apple.mpegurl", "no-cache"
+		body, err = webrtc.HLSPlaylist(streamKey, query)
+	} else {
+		body, err = webrtc.HLSFile(streamKey, file)
+	}
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Cache-Control", cacheControl)
+	res.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if req.Method == http.MethodHead {
+		return
+	}
+	if _, err := res.Write(body); err != nil {
+		log.Println(err)
+	}
 }
 
-func validateStreamKey(streamKey string) bool {
-	return regexp.MustCompile(`^[a-zA-Z0-9_\-\.~]+$`).MatchString(streamKey)
+// capabilitiesHandler describes the codec profile this server negotiates with, and which profiles CODEC_PROFILE can select
+func capabilitiesHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	capabilities := capabilitiesJSON{CodecProfile: webrtc.ActiveCodecProfile(), Available: []string{}}
+	for _, profile := range webrtc.CodecProfiles() {
+		capabilities.Available = append(capabilities.Available, profile.Name)
+	}
+
+	if err := json.NewEncoder(res).Encode(capabilities); err != nil {
+		log.Println(err)
+	}
 }
 
-func extractBearerToken(authHeader string) ([]string, bool) {
-	const bearerPrefix = "Bearer "
-	if strings.HasPrefix(authHeader, bearerPrefix) {
-		s := strings.Split(strings.TrimPrefix(authHeader, bearerPrefix), ";")
-		return s, true
+func directoryHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	streamKeys, err := store.GetStreamKeys(req.Context())
+	if err != nil {
+		logHTTPError(res, "Could not get stream keys", http.StatusBadRequest)
+		return
 	}
-	return nil, false
+
+	entries, err := publicDirectory(req.Context(), webrtc.ExpandStreamKeys(streamKeys), req.URL.Query().Get("live") == "true")
+	if err != nil {
+		log.Println(err)
+		logHTTPError(res, "Could not get stream aliases", http.StatusInternalServerError)
+		return
+	}
+
+	writeCacheableJSON(res, req, cacheControlFor(cacheRouteDirectory), entries, time.Time{})
 }
 
-func whipHandler(res http.ResponseWriter, r *http.Request) {
-	if r.Method == "DELETE" {
+// viewerFromRequest returns the subject of the platform session of a viewer of streamKey, the session must allow
+// playback of it. On failure the error is written to res and "" is returned.
+func viewerFromRequest(res http.ResponseWriter, req *http.Request, streamKey string) string {
+	if !tokenexchange.Enabled() {
+		logHTTPError(res, "Viewer sessions are disabled", http.StatusNotFound)
+		return ""
+	}
+
+	viewer, err := tokenexchange.Viewer(req, streamKey)
+	switch {
+	case errors.Is(err, tokenexchange.ErrNoSession):
+		logHTTPError(res, err.Error(), http.StatusUnauthorized)
+		return ""
+	case errors.Is(err, tokenexchange.ErrDenied):
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return ""
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadGateway)
+		return ""
+	}
+
+	return viewer
+}
+
+func bookmarksHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+	streamKey := req.PathValue("streamkey")
+
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
 		return
 	}
 
-	streamKeyHeader := r.Header.Get("Authorization")
-	if streamKeyHeader == "" {
-		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
+	viewer := viewerFromRequest(res, req, streamKey)
+	if viewer == "" {
 		return
 	}
 
-	token, ok := extractBearerToken(streamKeyHeader)
-	if !ok || token == nil || !validateStreamKey(token[0]) {
-		logHTTPError(res, "Not a valid token", http.StatusBadRequest)
+	// Bookmarks are kept for the stream key but listed with the name the viewer knows, which may be an alias
+	name := streamKey
+	streamKey = resolveStreamKey(req.Context(), streamKey)
+
+	switch req.Method {
+	case http.MethodPost:
+		var r bookmarkRequestJSON
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		streamStartedAt, mediaTime, err := webrtc.CurrentMediaTime(streamKey)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.MediaTime != nil {
+			if *r.MediaTime < 0 || *r.MediaTime > mediaTime {
+				logHTTPError(res, "Invalid media time", http.StatusBadRequest)
+				return
+			}
+			mediaTime = *r.MediaTime
+		}
+
+		bookmark, err := webrtc.AddBookmark(dbPool, req.Context(), viewer, webrtc.Bookmark{
+			StreamKey:       streamKey,
+			Label:           r.Label,
+			StreamStartedAt: streamStartedAt,
+			MediaTime:       mediaTime,
+		})
+		if err != nil {
+			logHTTPError(res, "Could not add bookmark", http.StatusInternalServerError)
+			return
+		}
+		bookmark.StreamKey = name
+
+		res.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(res).Encode(bookmark); err != nil {
+			log.Println(err)
+		}
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(req.PathValue("id"), 10, 64)
+		if err != nil {
+			logHTTPError(res, "Invalid bookmark id", http.StatusBadRequest)
+			return
+		}
+
+		if err := webrtc.DeleteBookmark(dbPool, req.Context(), viewer, id); err != nil {
+			logHTTPError(res, "Bookmark does not exist", http.StatusNotFound)
+			return
+		}
+	default:
+		bookmarks, err := webrtc.GetBookmarks(dbPool, req.Context(), viewer, streamKey)
+		if err != nil {
+			logHTTPError(res, "Could not get bookmarks", http.StatusInternalServerError)
+			return
+		}
+
+		for i := range bookmarks {
+			bookmarks[i].StreamKey = name
+		}
+
+		if err := json.NewEncoder(res).Encode(bookmarks); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
+}
 
-	streamer := webrtc.NewStreamer(dbPool, r.Context(), token)
-	if streamer == nil {
-		logHTTPError(res, "Not an authorized streamer", http.StatusForbidden)
+// recordingEventsHandler returns the reactions and events of a recorded broadcast, so replays can show them in sync
+func recordingEventsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+	streamKey := req.PathValue("streamkey")
+
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
 		return
 	}
+	streamKey = resolveStreamKey(req.Context(), streamKey)
 
-	offer, err := io.ReadAll(r.Body)
+	streamStartedAt := uint64(0)
+	if v := req.URL.Query().Get("streamStartedAt"); v != "" {
+		var err error
+		if streamStartedAt, err = strconv.ParseUint(v, 10, 64); err != nil {
+			logHTTPError(res, "Invalid streamStartedAt", http.StatusBadRequest)
+			return
+		}
+	}
+
+	recordingEvents, err := webrtc.GetRecordingEvents(dbPool, req.Context(), streamKey, streamStartedAt)
 	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		logHTTPError(res, "Could not get recording events", http.StatusInternalServerError)
+		return
+	}
+
+	lastModified := time.Time{}
+	for _, e := range recordingEvents {
+		if e.CreatedAt.After(lastModified) {
+			lastModified = e.CreatedAt
+		}
+	}
+	writeCacheableJSON(res, req, cacheControlFor(cacheRouteRecordings), recordingEvents, lastModified)
+}
+
+// recordingsHandler lists the recordings of a stream key uploaded to object storage, newest first
+func recordingsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+	streamKey := req.PathValue("streamkey")
+
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
 		return
 	}
+	streamKey = resolveStreamKey(req.Context(), streamKey)
 
-	answer, err := webrtc.WHIP(string(offer), streamer)
+	objects, err := postprocess.GetObjects(dbPool, req.Context(), streamKey)
 	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		logHTTPError(res, "Could not get recordings", http.StatusInternalServerError)
 		return
 	}
 
-	res.Header().Add("Location", "/api/whip")
-	res.Header().Add("Content-Type", "application/sdp")
-	res.WriteHeader(http.StatusCreated)
-	fmt.Fprint(res, answer)
+	lastModified := time.Time{}
+	if len(objects) != 0 {
+		lastModified = objects[0].CreatedAt
+	}
+	writeCacheableJSON(res, req, cacheControlFor(cacheRouteRecordings), objects, lastModified)
 }
 
-func whepHandler(res http.ResponseWriter, req *http.Request) {
-	streamKeyHeader := req.Header.Get("Authorization")
-	if streamKeyHeader == "" {
-		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
+// recordingHeatmapHandler collects anonymous playback positions of VOD viewers with POST. The streamer gets how often
+// each part of a recording was watched with GET.
+func recordingHeatmapHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+	streamKey := req.PathValue("streamkey")
+
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
 		return
 	}
+	streamKey = resolveStreamKey(req.Context(), streamKey)
 
-	token, ok := extractBearerToken(streamKeyHeader)
-	if !ok || !validateStreamKey(token[0]) {
-		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+	if req.Method == http.MethodPost {
+		var r heatmapRequestJSON
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := webrtc.AddPlaybackPositions(streamKey, r.StreamStartedAt, r.Positions); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	offer, err := io.ReadAll(req.Body)
+	account := accountFromRequest(res, req)
+	if account == nil || !ownsStreamKey(res, req, account, streamKey) {
+		return
+	}
+
+	streamStartedAt, err := strconv.ParseUint(req.URL.Query().Get("streamStartedAt"), 10, 64)
 	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		logHTTPError(res, "Invalid streamStartedAt", http.StatusBadRequest)
 		return
 	}
 
-	answer, whepSessionId, err := webrtc.WHEP(string(offer), token[0])
+	heatmap, err := webrtc.GetRecordingHeatmap(dbPool, req.Context(), streamKey, streamStartedAt)
 	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		logHTTPError(res, "Could not get heatmap", http.StatusInternalServerError)
 		return
 	}
 
-	apiPath := req.Host + strings.TrimSuffix(req.URL.RequestURI(), "whep")
-	res.Header().Add("Link", `<`+apiPath+"sse/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:server-sent-events"; events="layers"`)
-	res.Header().Add("Link", `<`+apiPath+"layer/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:layer"`)
-	res.Header().Add("Location", "/api/whep")
-	res.Header().Add("Content-Type", "application/sdp")
-	res.WriteHeader(http.StatusCreated)
-	fmt.Fprint(res, answer)
+	// Only the streamer may see the heatmap, shared caches must not store it
+	writeCacheableJSON(res, req, "private, no-cache", heatmap, time.Time{})
 }
 
-func whepServerSentEventsHandler(res http.ResponseWriter, req *http.Request) {
-	res.Header().Set("Content-Type", "text/event-stream")
-	res.Header().Set("Cache-Control", "no-cache")
-	res.Header().Set("Connection", "keep-alive")
+func reactHandler(res http.ResponseWriter, req *http.Request) {
+	streamKey := req.PathValue("streamkey")
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
 
-	vals := strings.Split(req.URL.RequestURI(), "/")
-	whepSessionId := vals[len(vals)-1]
+	if req.Method == http.MethodGet {
+		reactionsServerSentEventsHandler(res, req, streamKey)
+		return
+	}
 
-	layers, err := webrtc.WHEPLayers(whepSessionId)
-	if err != nil {
+	var r reactionRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	fmt.Fprint(res, "event: layers\n")
-	fmt.Fprintf(res, "data: %s\n", string(layers))
-	fmt.Fprint(res, "\n\n")
+	if err := webrtc.AddReaction(streamKey, remoteHost(req), r.Emote); errors.Is(err, webrtc.ErrReactionRateLimited) {
+		logHTTPError(res, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
 }
 
-func whepLayerHandler(res http.ResponseWriter, req *http.Request) {
-	var r whepLayerRequestJSON
-	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
+// remoteHost is the address of the client without its port
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+func reactionsServerSentEventsHandler(res http.ResponseWriter, req *http.Request, streamKey string) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		logHTTPError(res, "Streaming is not supported", http.StatusInternalServerError)
 		return
 	}
 
-	vals := strings.Split(req.URL.RequestURI(), "/")
-	whepSessionId := vals[len(vals)-1]
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+
+	reactions, unsubscribe := webrtc.SubscribeReactions(streamKey)
+	defer unsubscribe()
+
+	flusher.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case r := <-reactions:
+			fmt.Fprint(res, "event: reactions\n")
+			fmt.Fprintf(res, "data: %s\n\n", string(r))
+			flusher.Flush()
+		}
+	}
+}
+
+// clockHandler behaves like a NTP request over HTTP. Clients pass their send time as `t` (unix milliseconds)
+// and estimate their offset from the server clock with the returned receive and transmit times.
+func clockHandler(res http.ResponseWriter, req *http.Request) {
+	r := clockResponseJSON{ReceiveTime: time.Now().UnixMilli()}
+	res.Header().Add("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
 
-	if err := webrtc.WHEPChangeLayer(whepSessionId, r.EncodingId); err != nil {
+	if t := req.URL.Query().Get("t"); t != "" {
+		clientTime, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			logHTTPError(res, "Invalid client time", http.StatusBadRequest)
+			return
+		}
+		r.ClientTime = clientTime
+	}
+
+	if streamKey := req.PathValue("streamkey"); streamKey != "" {
+		if !validateStreamKey(streamKey) {
+			logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+			return
+		}
+
+		streamClock, err := webrtc.GetStreamClock(streamKey)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+			return
+		}
+		r.Stream = &streamClock
+	}
+
+	r.TransmitTime = time.Now().UnixMilli()
+	if err := json.NewEncoder(res).Encode(r); err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -170,16 +1319,20 @@ func whepLayerHandler(res http.ResponseWriter, req *http.Request) {
 func streamsHandler(res http.ResponseWriter, req *http.Request) {
 	res.Header().Add("Content-Type", "application/json")
 
-	streamKeys, err := webrtc.GetStreamKeys(dbPool, req.Context())
+	streamKeys, err := store.GetStreamKeys(req.Context())
 	if err != nil {
 		logHTTPError(res, "Could not get stream keys", http.StatusBadRequest)
 		return
 	}
 
-	if err := json.NewEncoder(res).Encode(streamKeys); err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	publicKeys, err := publicStreamKeys(req.Context(), webrtc.ExpandStreamKeys(streamKeys))
+	if err != nil {
+		log.Println(err)
+		logHTTPError(res, "Could not get stream aliases", http.StatusInternalServerError)
 		return
 	}
+
+	writeCacheableJSON(res, req, cacheControlFor(cacheRouteStreams), publicKeys, time.Time{})
 }
 
 func statusHandler(res http.ResponseWriter, req *http.Request) {
@@ -191,18 +1344,57 @@ func statusHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	streamKeys, err := webrtc.GetStreamKeys(dbPool, req.Context())
+	streamKey = resolveStreamKey(req.Context(), streamKey)
+	streamKeys, err := store.GetStreamKeys(req.Context())
 	if err != nil {
 		logHTTPError(res, "Could not get stream keys", http.StatusBadRequest)
 		return
 	}
 
-
-	if !slices.Contains(streamKeys, streamKey) {
+	if !webrtc.MatchStreamKey(streamKeys, streamKey) {
 		logHTTPError(res, "Stream does not exist", http.StatusNotFound)
 		return
 	}
-	if err := json.NewEncoder(res).Encode(webrtc.GetStreamStatus(streamKey)); err != nil {
+	writeCacheableJSON(res, req, cacheControlFor(cacheRouteStatus), webrtc.GetStreamStatus(streamKey), time.Time{})
+}
+
+// batchStatusHandler returns the status of many streams at once, keyed by the stream keys or aliases they were requested
+// with. Stream keys that don't exist are left out.
+func batchStatusHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var r batchStatusRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(r.StreamKeys) > maxBatchStatusKeys {
+		logHTTPErrorDetails(res, fmt.Sprintf("At most %d stream keys can be requested at once", maxBatchStatusKeys), http.StatusBadRequest, map[string]int{"maxStreamKeys": maxBatchStatusKeys})
+		return
+	}
+
+	streamKeys, err := store.GetStreamKeys(req.Context())
+	if err != nil {
+		logHTTPError(res, "Could not get stream keys", http.StatusBadRequest)
+		return
+	}
+
+	statuses := map[string]webrtc.StreamStatus{}
+	for _, requested := range r.StreamKeys {
+		if !validateStreamKey(requested) {
+			logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+			return
+		}
+
+		if streamKey := resolveStreamKey(req.Context(), requested); webrtc.MatchStreamKey(streamKeys, streamKey) {
+			statuses[requested] = webrtc.GetStreamStatus(streamKey)
+		}
+	}
+
+	if err := json.NewEncoder(res).Encode(statuses); err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -252,81 +1444,123 @@ func main() {
 			log.Fatal(err)
 		}
 	}
-	var err error
-	dbPool, err = pgxpool.New(context.Background(), os.Getenv("POSTGRES_URL"))
+
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck())
+	} else if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate())
+	} else if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		os.Exit(runBundle(os.Args[1], os.Args[2:]))
+	}
+
+	// Configuration of the HTTP server is checked before anything is started
+	responseHeaders, err := responseHeadersFromEnv()
 	if err != nil {
 		log.Fatal(err)
+	} else if err = configureCacheControl(); err != nil {
+		log.Fatal(err)
+	} else if err = configurePlaybackTokenMaxTTL(); err != nil {
+		log.Fatal(err)
 	}
-	defer dbPool.Close()
-
-	webrtc.Configure()
-
-	if os.Getenv("NETWORK_TEST_ON_START") == "true" {
-		fmt.Println(networkTestIntroMessage) //nolint
 
-		go func() {
-			time.Sleep(time.Second * 5)
-
-			if networkTestErr := networktest.Run(whepHandler); networkTestErr != nil {
-				fmt.Printf(networkTestFailedMessage, networkTestErr.Error())
-				os.Exit(1)
-			} else {
-				fmt.Println(networkTestSuccessMessage) //nolint
-			}
-		}()
+	listeners, err := httpListenersFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	httpsRedirectPort := "80"
-	if val := os.Getenv("HTTPS_REDIRECT_PORT"); val != "" {
-		httpsRedirectPort = val
-	}
+	registerSubsystems(listeners, responseHeaders)
 
-	if os.Getenv("HTTPS_REDIRECT_PORT") != "" || os.Getenv("ENABLE_HTTP_REDIRECT") != "" {
-		go func() {
-			redirectServer := &http.Server{
-				Addr: ":" + httpsRedirectPort,
-				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					http.Redirect(w, r, "https://"+r.Host+r.URL.String(), http.StatusMovedPermanently)
-				}),
-			}
+	// Subsystems are stopped in order on SIGINT and SIGTERM, or when one of them fails
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = subsystem.Run(ctx)
+	stop()
 
-			log.Println("Running HTTP->HTTPS redirect Server at :" + httpsRedirectPort)
-			log.Fatal(redirectServer.ListenAndServe())
-		}()
+	if err != nil {
+		os.Exit(1)
 	}
+}
 
+// newServeMux returns the routes of every listener, exposureHandler hides those a listener doesn't expose
+func newServeMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/streams", corsHandler(streamsHandler))
 	mux.HandleFunc("/api/status/{streamkey}", corsHandler(statusHandler))
+	mux.HandleFunc("/api/status-batch", corsHandler(batchStatusHandler))
+	mux.HandleFunc("/api/groups/{name}/status", corsHandler(groupStatusHandler))
+	mux.HandleFunc("/api/metrics", metrics.Handler)
+	mux.HandleFunc("/api/admin/alert-rules", corsHandler(alertRulesHandler))
+	mux.HandleFunc("/api/admin/graphql", corsHandler(graphqlHandler))
+	mux.HandleFunc("/api/admin/drain", corsHandler(drainHandler))
+	mux.HandleFunc("/api/admin/evacuate", corsHandler(evacuateHandler))
+	mux.HandleFunc("/api/admin/sessions", corsHandler(sessionsHandler))
+	mux.HandleFunc("/api/admin/signaling-debug", corsHandler(signalingDebugHandler))
+	mux.HandleFunc("/api/admin/signaling-debug/{sessionid}", corsHandler(signalingDebugHandler))
+	mux.HandleFunc("/api/admin/resource-usage", corsHandler(resourceUsageHandler))
+	mux.HandleFunc("/api/admin/capacity", corsHandler(capacityHandler))
+	mux.HandleFunc("/api/admin/bundle", corsHandler(adminBundleHandler))
+	mux.HandleFunc("/api/admin/jobs", corsHandler(jobsHandler))
+	mux.HandleFunc("/api/admin/publish-links", corsHandler(adminPublishLinkHandler))
+	mux.HandleFunc("/api/admin/streamers", corsHandler(adminStreamersHandler))
+	mux.HandleFunc("/api/admin/streamers/{name}", corsHandler(adminStreamerHandler))
+	mux.HandleFunc("/api/admin/streamers/{name}/revoke", corsHandler(adminStreamerRevokeHandler))
+	mux.HandleFunc("/api/admin/tenants/{name}", corsHandler(adminTenantHandler))
+	mux.HandleFunc("/api/admin/stream-keys", corsHandler(adminStreamKeyUsageHandler))
+	mux.HandleFunc("/api/admin/mute/{streamkey}", corsHandler(adminMuteHandler))
+	mux.HandleFunc("/api/healthz", healthHandler)
+	mux.HandleFunc("/api/readyz", readinessHandler)
 	mux.HandleFunc("/api/whip", corsHandler(whipHandler))
+	mux.HandleFunc("/api/whip/{whipSessionId}", corsHandler(whipSessionHandler))
+	mux.HandleFunc("/api/whip/cohost", corsHandler(cohostWHIPHandler))
+	mux.HandleFunc("/api/whip/cohost/{guestSessionId}", corsHandler(cohostSessionHandler))
 	mux.HandleFunc("/api/whep", corsHandler(whepHandler))
+	mux.HandleFunc("/api/whep/{whepSessionId}", corsHandler(whepSessionHandler))
+	mux.HandleFunc("/api/ice-config", corsHandler(iceConfigHandler))
+	mux.Handle("/api/ws/play", wsPlayServer)
 	mux.HandleFunc("/api/sse/", corsHandler(whepServerSentEventsHandler))
 	mux.HandleFunc("/api/layer/", corsHandler(whepLayerHandler))
+	mux.HandleFunc("/api/react/{streamkey}", corsHandler(reactHandler))
+	mux.HandleFunc("/api/heartbeat/{streamkey}", corsHandler(heartbeatHandler))
+	mux.HandleFunc("/api/heartbeat/{streamkey}/{viewerid}", corsHandler(heartbeatHandler))
+	mux.HandleFunc("/api/clock", corsHandler(clockHandler))
+	mux.HandleFunc("/api/metadata/{streamkey}", corsHandler(metadataHandler))
+	mux.HandleFunc("/api/panic/{streamkey}", corsHandler(panicHandler))
+	mux.HandleFunc("/api/directory", corsHandler(directoryHandler))
+	mux.HandleFunc("/api/capabilities", corsHandler(capabilitiesHandler))
+	mux.HandleFunc("/api/edge-select", corsHandler(edgeSelectHandler))
+	mux.HandleFunc("/api/hls/{streamkey}/{file}", corsHandler(hlsHandler))
+	mux.HandleFunc("/api/hls/{streamkey}/keys/{id}", corsHandler(hlsKeyHandler))
+	mux.HandleFunc("/api/playback-token/{streamkey}", corsHandler(playbackTokenHandler))
+	mux.HandleFunc("/api/playback-token/{streamkey}/exchange", playbackTokenExchangeHandler)
+	mux.HandleFunc("/embed/{streamkey}", embedHandler)
+	mux.HandleFunc("/publish/{token}", publishHandler)
+	mux.HandleFunc("/api/preflight/{streamkey}", corsHandler(preflightHandler))
+	mux.HandleFunc("/api/portal", corsHandler(portalHandler))
+	mux.HandleFunc("/api/portal/rotate-token", corsHandler(portalRotateTokenHandler))
+	mux.HandleFunc("/api/portal/notifications", corsHandler(portalNotificationsHandler))
+	mux.HandleFunc("/api/portal/notifications/{id}", corsHandler(portalNotificationsHandler))
+	mux.HandleFunc("/api/portal/summaries", corsHandler(portalSummariesHandler))
+	mux.HandleFunc("/api/portal/analytics", corsHandler(portalAnalyticsHandler))
+	mux.HandleFunc("/api/portal/recording", corsHandler(portalRecordingHandler))
+	mux.HandleFunc("/api/portal/autostart", corsHandler(portalAutostartHandler))
+	mux.HandleFunc("/api/portal/autostart/{id}", corsHandler(portalAutostartHandler))
+	mux.HandleFunc("/api/portal/aliases", corsHandler(portalAliasesHandler))
+	mux.HandleFunc("/api/portal/aliases/{alias}", corsHandler(portalAliasesHandler))
+	mux.HandleFunc("/api/portal/settings/{streamkey}", corsHandler(portalStreamSettingsHandler))
+	mux.HandleFunc("/api/portal/diagnostics/{streamkey}", corsHandler(portalDiagnosticsHandler))
+	mux.HandleFunc("/api/portal/mute/{streamkey}", corsHandler(portalMuteHandler))
+	mux.HandleFunc("/api/portal/ad-breaks/{streamkey}", corsHandler(portalAdBreaksHandler))
+	mux.HandleFunc("/api/portal/recording-jobs/{streamkey}", corsHandler(portalRecordingJobsHandler))
+	mux.HandleFunc("/api/portal/groups", corsHandler(portalGroupsHandler))
+	mux.HandleFunc("/api/portal/groups/{name}", corsHandler(portalGroupsHandler))
+	mux.HandleFunc("/api/portal/groups/{name}/analytics", corsHandler(portalGroupAnalyticsHandler))
+	mux.HandleFunc("/api/integrations/events", corsHandler(integrationEventsHandler))
+	mux.HandleFunc("/api/bookmarks/{streamkey}", corsHandler(bookmarksHandler))
+	mux.HandleFunc("/api/recordings/{streamkey}", corsHandler(recordingsHandler))
+	mux.HandleFunc("/api/recordings/{streamkey}/events", corsHandler(recordingEventsHandler))
+	mux.HandleFunc("/api/recordings/{streamkey}/heatmap", corsHandler(recordingHeatmapHandler))
+	mux.HandleFunc("/api/bookmarks/{streamkey}/{id}", corsHandler(bookmarksHandler))
+	mux.HandleFunc("/api/clock/{streamkey}", corsHandler(clockHandler))
+	mux.HandleFunc("/api/cohost/{streamkey}", corsHandler(cohostHandler))
 
-	server := &http.Server{
-		Handler: mux,
-		Addr:    os.Getenv("HTTP_ADDRESS"),
-	}
-
-	tlsKey := os.Getenv("SSL_KEY")
-	tlsCert := os.Getenv("SSL_CERT")
-
-	if tlsKey != "" && tlsCert != "" {
-		server.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{},
-		}
-
-		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		server.TLSConfig.Certificates = append(server.TLSConfig.Certificates, cert)
-
-		log.Println("Running HTTPS Server at `" + os.Getenv("HTTP_ADDRESS") + "`")
-		log.Fatal(server.ListenAndServeTLS("", ""))
-	} else {
-		log.Println("Running HTTP Server at `" + os.Getenv("HTTP_ADDRESS") + "`")
-		log.Fatal(server.ListenAndServe())
-	}
+	return mux
 }
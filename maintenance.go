@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/patrikrog/broadcast-box/internal/scheduler"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	expirySweepInterval = 10 * time.Minute
+	retentionInterval   = time.Hour
+	certificateInterval = 12 * time.Hour
+
+	// The certificates job fails this long before a certificate expires, so a broken renewal is noticed
+	certificateRenewBefore = 14 * 24 * time.Hour
+)
+
+// Rows DATA_RETENTION_DAYS prunes, by the column that says how old they are
+var retentionTables = []struct{ table, column string }{
+	{"stream_summaries", "ended_at"},
+	{"recording_events", "stream_started_at"},
+	{"recording_heatmap", "stream_started_at"},
+	{"recording_jobs", "finished_at"},
+	{"recordings", "finished_at"},
+}
+
+// configureMaintenanceJobs schedules sweeping expired streamers and publish links, pruning data older than
+// DATA_RETENTION_DAYS and reloading the certificates of listeners
+func configureMaintenanceJobs(listeners []httpListener) error {
+	scheduler.Register("expired-credentials", expirySweepInterval, func(ctx context.Context) error {
+		streamers, err := webrtc.DeleteExpiredStreamers(dbPool, ctx)
+		if err != nil {
+			return err
+		}
+
+		links, err := webrtc.DeleteExpiredPublishLinks(dbPool, ctx)
+		if err != nil {
+			return err
+		}
+
+		if streamers != 0 || links != 0 {
+			log.Printf("Removed %d expired streamers and %d expired publish links", streamers, links)
+		}
+		return nil
+	})
+
+	if val := os.Getenv("DATA_RETENTION_DAYS"); val != "" {
+		days, err := strconv.ParseUint(val, 10, 16)
+		if err != nil || days == 0 {
+			return errors.New("DATA_RETENTION_DAYS must be a positive number of days")
+		}
+
+		scheduler.Register("retention", retentionInterval, func(ctx context.Context) error {
+			return pruneData(ctx, time.Duration(days)*24*time.Hour)
+		})
+	}
+
+	tlsListeners := []httpListener{}
+	for _, l := range listeners {
+		if l.usesTLS() {
+			tlsListeners = append(tlsListeners, l)
+		}
+	}
+	if len(tlsListeners) != 0 {
+		scheduler.Register("certificates", certificateInterval, func(context.Context) error {
+			return checkCertificates(tlsListeners)
+		})
+	}
+
+	return nil
+}
+
+// pruneData deletes what finished longer than retention ago
+func pruneData(ctx context.Context, retention time.Duration) error {
+	for _, t := range retentionTables {
+		tag, err := dbPool.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE %s < now() - make_interval(secs => @retention)`, t.table, t.column), pgx.NamedArgs{
+			"retention": retention.Seconds(),
+		})
+		if err != nil {
+			return err
+		} else if tag.RowsAffected() != 0 {
+			log.Printf("Removed %d rows older than DATA_RETENTION_DAYS from %s", tag.RowsAffected(), t.table)
+		}
+	}
+
+	return nil
+}
+
+// checkCertificates reloads the certificates of listeners from disk, so renewed ones are served, and fails for
+// certificates that expire within certificateRenewBefore
+func checkCertificates(listeners []httpListener) error {
+	errs := []error{}
+	for _, l := range listeners {
+		notAfter, err := l.loadCertificate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Certificate %s of %s could not be loaded: %w", l.tlsCert, l.address, err))
+		} else if time.Until(notAfter) < certificateRenewBefore {
+			errs = append(errs, fmt.Errorf("Certificate %s of %s expires at %s", l.tlsCert, l.address, notAfter.Format(time.RFC3339)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// jobsHandler lists the maintenance jobs of this instance with how their last run went
+func jobsHandler(res http.ResponseWriter, req *http.Request) {
+	if !adminFromRequest(res, req) {
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(scheduler.Jobs()); err != nil {
+		log.Println(err)
+	}
+}
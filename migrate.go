@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/patrikrog/broadcast-box/internal/migrations"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+// Migrations of large tables may rewrite them
+const migrateTimeout = 5 * time.Minute
+
+// runMigrate runs `broadcast-box migrate`, applying the embedded migrations to POSTGRES_URL. It returns the exit code.
+func runMigrate() int {
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	pool, err := pgxpool.New(ctx, os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer pool.Close()
+
+	applied, hashed, err := migrateDatabase(ctx, pool)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, version := range applied {
+		fmt.Printf("Applied %s\n", version)
+	}
+	if hashed != 0 {
+		fmt.Printf("Hashed %d auth and admin tokens\n", hashed)
+	}
+	if len(applied) == 0 && hashed == 0 {
+		fmt.Println("Schema is up to date")
+	}
+
+	return 0
+}
+
+// migrateDatabase applies the embedded migrations, then hashes the auth and admin tokens that are still stored in
+// plaintext. It returns the versions it applied and how many tokens it hashed.
+func migrateDatabase(ctx context.Context, pool *pgxpool.Pool) ([]string, int, error) {
+	applied, err := migrations.Apply(ctx, pool)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hashed, err := webrtc.HashAuthTokens(pool, ctx)
+	if err != nil {
+		return applied, hashed, fmt.Errorf("Hashing auth tokens failed: %w", err)
+	}
+
+	return applied, hashed, nil
+}
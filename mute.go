@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+type muteRequestJSON struct {
+	Audio bool `json:"audio"`
+	Video bool `json:"video"`
+}
+
+// portalMuteHandler lets a streamer mute the audio or video of one of their live streams
+func portalMuteHandler(res http.ResponseWriter, req *http.Request) {
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	streamKey := req.PathValue("streamkey")
+	if !ownsStreamKey(res, req, account, streamKey) {
+		return
+	}
+
+	muteStream(res, req, streamKey)
+}
+
+// adminMuteHandler lets operators, and tenant admins for the streams of their tenant, mute a live stream
+func adminMuteHandler(res http.ResponseWriter, req *http.Request) {
+	tenant, ok := adminScopeFromRequest(res, req)
+	if !ok {
+		return
+	}
+
+	streamKey := req.PathValue("streamkey")
+	if tenant != "" && webrtc.StreamTenant(streamKey) != tenant {
+		logHTTPError(res, "Stream is not live", http.StatusNotFound)
+		return
+	}
+
+	muteStream(res, req, streamKey)
+}
+
+func muteStream(res http.ResponseWriter, req *http.Request, streamKey string) {
+	if req.Method != http.MethodPut {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var r muteRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := webrtc.SetStreamMute(streamKey, r.Audio, r.Video); err != nil {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	// Mutes audio and video, the publisher stays connected so the stream can be restored
+	panicActionBlank = "blank"
+	// Ends the stream and with it its recordings and restreams
+	panicActionEnd     = "end"
+	panicActionRestore = "restore"
+)
+
+type panicEventJSON struct {
+	Action string `json:"action"`
+}
+
+// panicHandler cuts the feed of a live stream right away, for when something unintended is on screen. Streamers
+// authenticate like for WHIP, or with `?token=<authToken>` so hotkey tools that can only call a URL work too.
+func panicHandler(res http.ResponseWriter, req *http.Request) {
+	// Stream Deck and OBS hotkey plugins only send GET for some actions
+	if req.Method != http.MethodPost && req.Method != http.MethodGet {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamKey := req.PathValue("streamkey")
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+
+	var streamer *webrtc.Streamer
+	if authToken := req.URL.Query().Get("token"); authToken != "" {
+		if streamer = authenticateStreamer(req.Context(), streamKey, authToken); streamer == nil {
+			logHTTPError(res, "Not an authorized streamer", http.StatusForbidden)
+			return
+		}
+	} else if streamer = streamerFromRequest(res, req); streamer == nil {
+		return
+	}
+
+	if streamer.StreamKey != streamKey {
+		logHTTPError(res, "Not an authorized streamer", http.StatusForbidden)
+		return
+	}
+
+	action := req.URL.Query().Get("action")
+	if action == "" {
+		action = panicActionBlank
+	}
+
+	var err error
+	switch action {
+	case panicActionBlank:
+		err = webrtc.SetStreamMute(streamKey, true, true)
+	case panicActionRestore:
+		err = webrtc.SetStreamMute(streamKey, false, false)
+	case panicActionEnd:
+		err = webrtc.WHIPDelete(streamKey, "")
+	default:
+		logHTTPError(res, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		logHTTPError(res, "Stream is not live", http.StatusNotFound)
+		return
+	}
+
+	tenant := ""
+	if streamer.Tenant != nil {
+		tenant = streamer.Tenant.Name
+	}
+
+	log.Printf("Panic button of %s (%s): %s", streamKey, streamer.Name, action)
+	events.Publish(events.Event{Type: events.StreamPanic, StreamKey: streamKey, Streamer: streamer.Name, Tenant: tenant, Data: panicEventJSON{Action: action}})
+
+	res.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/patrikrog/broadcast-box/internal/autostart"
+	"github.com/patrikrog/broadcast-box/internal/notify"
+	"github.com/patrikrog/broadcast-box/internal/postprocess"
+	"github.com/patrikrog/broadcast-box/internal/tokenexchange"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+type (
+	portalStreamJSON struct {
+		StreamKey string                `json:"streamKey"`
+		Metadata  webrtc.StreamMetadata `json:"metadata"`
+		Status    *webrtc.StreamStatus  `json:"status,omitempty"`
+	}
+
+	portalResponseJSON struct {
+		Name    string             `json:"name"`
+		Streams []portalStreamJSON `json:"streams"`
+	}
+
+	portalTokenResponseJSON struct {
+		AuthToken string `json:"authToken"`
+	}
+
+	portalRecordingJSON struct {
+		Record bool `json:"record"`
+	}
+)
+
+// portalHandler lets streamers see their own stream keys, metadata and the live status of them.
+// Requests are authenticated by portalAccountFromRequest.
+func portalHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	streamKeys, err := portalStreamKeys(req, account)
+	if err != nil {
+		logHTTPError(res, "Could not get stream keys", http.StatusInternalServerError)
+		return
+	}
+
+	r := portalResponseJSON{Name: account.Name, Streams: []portalStreamJSON{}}
+	for _, entry := range webrtc.GetDirectory(webrtc.ExpandStreamKeys(streamKeys), false) {
+		stream := portalStreamJSON{StreamKey: entry.StreamKey, Metadata: entry.StreamMetadata}
+		if entry.Live {
+			status := webrtc.GetStreamStatus(entry.StreamKey)
+			stream.Status = &status
+		}
+
+		r.Streams = append(r.Streams, stream)
+	}
+
+	if err := json.NewEncoder(res).Encode(r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// portalRotateTokenHandler replaces the auth token of the requesting streamer. The old token stops working immediately.
+func portalRotateTokenHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	var authToken string
+	var err error
+	if account.AuthToken == "" {
+		authToken, err = webrtc.RotateNamedAuthToken(dbPool, req.Context(), account.Name)
+	} else {
+		authToken, err = store.RotateAuthToken(req.Context(), account.AuthToken)
+	}
+	if err != nil {
+		logHTTPError(res, "Could not rotate token", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(portalTokenResponseJSON{AuthToken: authToken}); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// portalNotificationsHandler manages the Discord/Telegram channels notified when the streamer goes live.
+// Bot tokens are write only and never returned.
+func portalNotificationsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		var n notify.Notification
+		if err := json.NewDecoder(req.Body).Decode(&n); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		added, err := notify.Add(dbPool, req.Context(), account.Name, n)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		added.BotToken = ""
+		res.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(res).Encode(added); err != nil {
+			log.Println(err)
+		}
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(req.PathValue("id"), 10, 64)
+		if err != nil {
+			logHTTPError(res, "Invalid notification id", http.StatusBadRequest)
+			return
+		}
+
+		if err := notify.Delete(dbPool, req.Context(), account.Name, id); err != nil {
+			logHTTPError(res, "Notification does not exist", http.StatusNotFound)
+			return
+		}
+	default:
+		notifications, err := notify.Get(dbPool, req.Context(), account.Name)
+		if err != nil {
+			logHTTPError(res, "Could not get notifications", http.StatusInternalServerError)
+			return
+		}
+
+		for i := range notifications {
+			notifications[i].BotToken = ""
+		}
+
+		if err := json.NewEncoder(res).Encode(notifications); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+// portalSummariesHandler lists how the most recent broadcasts of the requesting streamer went
+func portalSummariesHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	summaries, err := webrtc.GetStreamSummaries(dbPool, req.Context(), account.Name)
+	if err != nil {
+		logHTTPError(res, "Could not get stream summaries", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(summaries); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// portalRecordingHandler toggles recording of every stream of the requesting streamer, like the record flag of the
+// streamer configuration. Changes apply from the next broadcast.
+func portalRecordingHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var r portalRecordingJSON
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := webrtc.SetStreamerRecord(dbPool, req.Context(), account.Name, r.Record); errors.Is(err, pgx.ErrNoRows) {
+			logHTTPError(res, "Streamer does not exist", http.StatusNotFound)
+			return
+		} else if err != nil {
+			logHTTPError(res, "Could not set recording", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(r); err != nil {
+			log.Println(err)
+		}
+	default:
+		config, err := webrtc.GetStreamerConfig(dbPool, req.Context(), account.Name)
+		if errors.Is(err, pgx.ErrNoRows) {
+			logHTTPError(res, "Streamer does not exist", http.StatusNotFound)
+			return
+		} else if err != nil {
+			logHTTPError(res, "Could not get recording", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(portalRecordingJSON{Record: config.Record}); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+// portalAnalyticsHandler combines the summaries of the recent broadcasts of the requesting streamer
+func portalAnalyticsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	analytics, err := webrtc.GetStreamerAnalytics(dbPool, req.Context(), account.Name)
+	if err != nil {
+		logHTTPError(res, "Could not get stream summaries", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(analytics); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// portalRecordingJobsHandler lists how post-processing of the recordings of one of the streamer's stream keys went
+func portalRecordingJobsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	streamKey := req.PathValue("streamkey")
+	if !ownsStreamKey(res, req, account, streamKey) {
+		return
+	}
+
+	jobs, err := postprocess.Get(dbPool, req.Context(), streamKey)
+	if err != nil {
+		logHTTPError(res, "Could not get recording jobs", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(jobs); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// portalAutostartHandler manages the rules that start recordings and restreams whenever the streamer goes live.
+// A single rule is replaced with PUT, its ETag can be passed as If-Match so concurrent changes aren't lost.
+func portalAutostartHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		var r autostart.Rule
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !ownsStreamKey(res, req, account, r.StreamKey) {
+			return
+		}
+
+		added, err := autostart.Add(dbPool, req.Context(), account.Name, r)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(res).Encode(added); err != nil {
+			log.Println(err)
+		}
+	case http.MethodPut:
+		current := autostartRuleFromRequest(res, req, account)
+		if current == nil || preconditionFailed(res, req, etagOf(current)) {
+			return
+		}
+
+		var r autostart.Rule
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.ID = current.ID
+
+		if !ownsStreamKey(res, req, account, r.StreamKey) {
+			return
+		}
+
+		updated, err := autostart.Update(dbPool, req.Context(), account.Name, r)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res.Header().Set("ETag", etagOf(updated))
+		if err := json.NewEncoder(res).Encode(updated); err != nil {
+			log.Println(err)
+		}
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(req.PathValue("id"), 10, 64)
+		if err != nil {
+			logHTTPError(res, "Invalid rule id", http.StatusBadRequest)
+			return
+		}
+
+		if err := autostart.Delete(dbPool, req.Context(), account.Name, id); err != nil {
+			logHTTPError(res, "Rule does not exist", http.StatusNotFound)
+			return
+		}
+	default:
+		if req.PathValue("id") != "" {
+			r := autostartRuleFromRequest(res, req, account)
+			if r == nil {
+				return
+			}
+
+			res.Header().Set("ETag", etagOf(r))
+			if err := json.NewEncoder(res).Encode(r); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+
+		rules, err := autostart.Get(dbPool, req.Context(), account.Name)
+		if err != nil {
+			logHTTPError(res, "Could not get rules", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(rules); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+// portalAliasesHandler manages the aliases of the streamer. Viewers can use an alias wherever they would use the
+// stream key, so public links don't reveal it.
+func portalAliasesHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	alias := req.PathValue("alias")
+	switch req.Method {
+	case http.MethodPut:
+		var a webrtc.StreamAlias
+		if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.Alias = alias
+
+		if !validateStreamKey(a.Alias) {
+			logHTTPError(res, "Invalid alias format", http.StatusBadRequest)
+			return
+		} else if a.StreamKey == "" {
+			logHTTPError(res, "Stream key was not set", http.StatusBadRequest)
+			return
+		} else if !ownsStreamKey(res, req, account, a.StreamKey) {
+			return
+		}
+
+		// Stream keys always resolve to themselves, an alias shadowing one would never be used
+		streamKeys, err := store.GetStreamKeys(req.Context())
+		if err != nil {
+			logHTTPError(res, "Could not get stream keys", http.StatusInternalServerError)
+			return
+		} else if webrtc.MatchStreamKey(streamKeys, a.Alias) {
+			logHTTPError(res, webrtc.ErrStreamAliasTaken.Error(), http.StatusConflict)
+			return
+		}
+
+		if err := webrtc.PutStreamAlias(dbPool, req.Context(), account.Name, a); errors.Is(err, webrtc.ErrStreamAliasTaken) {
+			logHTTPError(res, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(a); err != nil {
+			log.Println(err)
+		}
+	case http.MethodDelete:
+		if err := webrtc.DeleteStreamAlias(dbPool, req.Context(), account.Name, alias); err != nil {
+			logHTTPError(res, "Alias does not exist", http.StatusNotFound)
+			return
+		}
+	default:
+		aliases, err := webrtc.GetStreamAliases(dbPool, req.Context(), account.Name)
+		if err != nil {
+			logHTTPError(res, "Could not get aliases", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(aliases); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+func portalStreamSettingsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	streamKey := req.PathValue("streamkey")
+	if !ownsStreamKey(res, req, account, streamKey) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var settings webrtc.StreamSettings
+		if err := json.NewDecoder(req.Body).Decode(&settings); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		} else if err := settings.Validate(); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := webrtc.PutStreamSettings(dbPool, req.Context(), streamKey, settings); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(settings); err != nil {
+			log.Println(err)
+		}
+	default:
+		settings, err := webrtc.GetStreamSettings(dbPool, req.Context(), streamKey)
+		if err != nil {
+			logHTTPError(res, "Could not get stream settings", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(settings); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+type adBreakRequestJSON struct {
+	State string `json:"state"`
+	// Seconds, optional for the start of a break
+	Duration float64 `json:"duration"`
+}
+
+// portalAdBreaksHandler signals the start or end of an ad break on one of the streamer's live streams
+func portalAdBreaksHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	streamKey := req.PathValue("streamkey")
+	if !ownsStreamKey(res, req, account, streamKey) {
+		return
+	} else if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var r adBreakRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if r.Duration < 0 {
+		logHTTPError(res, "Duration must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var adBreak webrtc.AdBreak
+	var err error
+	switch r.State {
+	case webrtc.AdBreakStart:
+		adBreak, err = webrtc.StartAdBreak(streamKey, time.Duration(r.Duration*float64(time.Second)))
+	case webrtc.AdBreakEnd:
+		adBreak, err = webrtc.EndAdBreak(streamKey)
+	default:
+		logHTTPError(res, "State must be start or end", http.StatusBadRequest)
+		return
+	}
+
+	if errors.Is(err, webrtc.ErrAdBreakActive) || errors.Is(err, webrtc.ErrNoActiveAdBreak) {
+		logHTTPError(res, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(adBreak); err != nil {
+		log.Println(err)
+	}
+}
+
+// portalDiagnosticsHandler streams the connection diagnostics of the publisher of one of the streamer's keys
+// every second, as long as it is live
+func portalDiagnosticsHandler(res http.ResponseWriter, req *http.Request) {
+	account := portalAccountFromRequest(res, req)
+	if account == nil {
+		return
+	}
+
+	streamKey := req.PathValue("streamkey")
+	if !ownsStreamKey(res, req, account, streamKey) {
+		return
+	}
+
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		logHTTPError(res, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+			diagnostics, err := webrtc.GetPublisherDiagnostics(streamKey)
+			if err != nil {
+				continue
+			}
+
+			body, err := json.Marshal(diagnostics)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			fmt.Fprint(res, "event: diagnostics\n")
+			fmt.Fprintf(res, "data: %s\n\n", string(body))
+			flusher.Flush()
+		}
+	}
+}
+
+// portalAccountFromRequest authenticates a streamer by their platform session if SSO_JWT_SECRET or
+// SSO_INTROSPECTION_URL is set, the subject of the session is the name of the streamer. Otherwise the
+// `Bearer <authToken>` Authorization header is used. On failure the error is written to res and nil is returned.
+func portalAccountFromRequest(res http.ResponseWriter, req *http.Request) *webrtc.Streamer {
+	if !tokenexchange.Enabled() {
+		return accountFromRequest(res, req)
+	}
+
+	name, err := tokenexchange.Identify(req)
+	switch {
+	case errors.Is(err, tokenexchange.ErrNoSession):
+		logHTTPError(res, err.Error(), http.StatusUnauthorized)
+		return nil
+	case errors.Is(err, tokenexchange.ErrDenied):
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return nil
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadGateway)
+		return nil
+	}
+
+	if _, err := webrtc.GetNamedStreamerStreamKeys(dbPool, req.Context(), name); errors.Is(err, pgx.ErrNoRows) {
+		logHTTPError(res, "Not an authorized user", http.StatusForbidden)
+		return nil
+	} else if err != nil {
+		logHTTPError(res, "Could not get stream keys", http.StatusInternalServerError)
+		return nil
+	}
+
+	return &webrtc.Streamer{Name: name}
+}
+
+// portalStreamKeys returns the stream keys of an account authenticated by portalAccountFromRequest
+func portalStreamKeys(req *http.Request, account *webrtc.Streamer) ([]string, error) {
+	if account.AuthToken == "" {
+		return webrtc.GetNamedStreamerStreamKeys(dbPool, req.Context(), account.Name)
+	}
+
+	return store.StreamerStreamKeys(req.Context(), account.AuthToken)
+}
+
+// autostartRuleFromRequest returns the rule in the path of req. On failure the error is written to res and nil is returned.
+func autostartRuleFromRequest(res http.ResponseWriter, req *http.Request, account *webrtc.Streamer) *autostart.Rule {
+	id, err := strconv.ParseInt(req.PathValue("id"), 10, 64)
+	if err != nil {
+		logHTTPError(res, "Invalid rule id", http.StatusBadRequest)
+		return nil
+	}
+
+	r, err := autostart.GetRule(dbPool, req.Context(), account.Name, id)
+	if err != nil {
+		logHTTPError(res, "Rule does not exist", http.StatusNotFound)
+		return nil
+	}
+
+	return r
+}
+
+// ownsStreamKey checks that streamKey is empty or one of the account's stream keys. On failure the error is written
+// to res and false is returned.
+func ownsStreamKey(res http.ResponseWriter, req *http.Request, account *webrtc.Streamer, streamKey string) bool {
+	if streamKey == "" {
+		return true
+	}
+
+	streamKeys, err := portalStreamKeys(req, account)
+	if err != nil {
+		logHTTPError(res, "Could not get stream keys", http.StatusInternalServerError)
+		return false
+	} else if !webrtc.MatchStreamKey(streamKeys, streamKey) {
+		logHTTPError(res, "Not an authorized streamer", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
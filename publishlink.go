@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const defaultPublishLinkLifetime = 15 * 60
+
+type (
+	publishLinkRequestJSON struct {
+		StreamKey string `json:"streamKey"`
+		// Streamer name the guest publishes as
+		Name string `json:"name"`
+
+		// Lifetime of the link in seconds
+		ExpiresIn int64 `json:"expiresIn"`
+	}
+
+	publishLinkResponseJSON struct {
+		URL       string `json:"url"`
+		Token     string `json:"token"`
+		ExpiresAt int64  `json:"expiresAt"`
+	}
+)
+
+// publishTemplate is a dependency free page that publishes the camera and microphone of a guest via WHIP
+var publishTemplate = template.Must(template.New("publish").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>Publish to {{.StreamKey}}</title>
+    <style>
+      body { margin: 0; font-family: sans-serif; background: #000; color: #fff; text-align: center; }
+      video { width: 100%; max-height: 80vh; object-fit: contain; }
+      button { margin: 1em; padding: 0.5em 2em; font-size: 1.2em; }
+    </style>
+  </head>
+  <body>
+    <video id="preview" autoplay muted playsinline></video>
+    <div>
+      <button id="start">Go live</button>
+      <button id="stop" disabled>Stop</button>
+    </div>
+    <p id="status"></p>
+    <script>
+      const token = {{.Token}}
+      const status = document.getElementById('status')
+      const startButton = document.getElementById('start')
+      const stopButton = document.getElementById('stop')
+
+      let peerConnection, media, sessionURL
+
+      startButton.onclick = async () => {
+        startButton.disabled = true
+        try {
+          media = await navigator.mediaDevices.getUserMedia({ audio: true, video: true })
+          document.getElementById('preview').srcObject = media
+
+          peerConnection = new RTCPeerConnection()
+          media.getTracks().forEach(track => peerConnection.addTransceiver(track, { direction: 'sendonly' }))
+          await peerConnection.setLocalDescription(await peerConnection.createOffer())
+          await new Promise(resolve => {
+            if (peerConnection.iceGatheringState === 'complete') {
+              return resolve()
+            }
+            peerConnection.onicegatheringstatechange = () => peerConnection.iceGatheringState === 'complete' && resolve()
+          })
+
+          const r = await fetch('/api/whip', {
+            method: 'POST',
+            body: peerConnection.localDescription.sdp,
+            headers: { Authorization: 'Bearer ' + token, 'Content-Type': 'application/sdp' }
+          })
+          if (r.status !== 201) {
+            throw new Error((await r.json()).message)
+          }
+
+          sessionURL = r.headers.get('Location')
+          await peerConnection.setRemoteDescription({ sdp: await r.text(), type: 'answer' })
+          status.textContent = 'Live'
+          stopButton.disabled = false
+        } catch (err) {
+          status.textContent = err.message
+          startButton.disabled = false
+        }
+      }
+
+      stopButton.onclick = () => {
+        stopButton.disabled = true
+        fetch(sessionURL, { method: 'DELETE', headers: { Authorization: 'Bearer ' + token } }).catch(console.error)
+        peerConnection.close()
+        media.getTracks().forEach(track => track.stop())
+        status.textContent = 'Stopped, the link can not be used again'
+      }
+    </script>
+  </body>
+</html>
+`))
+
+// adminPublishLinkHandler creates a one time link that lets a guest publish to a stream key from their browser
+func adminPublishLinkHandler(res http.ResponseWriter, req *http.Request) {
+	if !adminFromRequest(res, req) {
+		return
+	} else if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r := publishLinkRequestJSON{ExpiresIn: defaultPublishLinkLifetime}
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if !validateStreamKey(r.StreamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	} else if r.ExpiresIn <= 0 {
+		logHTTPError(res, "Invalid link lifetime", http.StatusBadRequest)
+		return
+	}
+
+	token, expiresAt, err := webrtc.CreatePublishLink(dbPool, req.Context(), r.StreamKey, r.Name, time.Duration(r.ExpiresIn)*time.Second)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(publishLinkResponseJSON{
+		URL:       scheme + "://" + req.Host + "/publish/" + token,
+		Token:     token,
+		ExpiresAt: expiresAt.Unix(),
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// publishHandler serves the page of a publish link
+func publishHandler(res http.ResponseWriter, req *http.Request) {
+	token := req.PathValue("token")
+	link, err := webrtc.GetPublishLink(dbPool, req.Context(), token)
+	if errors.Is(err, webrtc.ErrInvalidPublishLink) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	} else if link.UsedAt != nil {
+		logHTTPError(res, "Publish link was already used", http.StatusGone)
+		return
+	}
+
+	// The token is in the URL, it must not leak to other sites
+	res.Header().Set("Referrer-Policy", "no-referrer")
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+
+	if err := publishTemplate.Execute(res, struct{ StreamKey, Token string }{link.StreamKey, token}); err != nil {
+		log.Println(err)
+	}
+}
+
+// publisherFromRequest authenticates a publisher like streamerFromRequest, or a guest by the `Bearer <token>` of a
+// publish link. use marks the link as used, each link starts one stream and can then only end it.
+func publisherFromRequest(res http.ResponseWriter, req *http.Request, use bool) *webrtc.Streamer {
+	token, ok := extractBearerToken(req.Header.Get("Authorization"))
+	if !ok || len(token) != 1 {
+		return streamerFromRequest(res, req)
+	}
+
+	getLink := webrtc.GetPublishLink
+	if use {
+		getLink = webrtc.UsePublishLink
+	}
+
+	link, err := getLink(dbPool, req.Context(), token[0])
+	if errors.Is(err, webrtc.ErrInvalidPublishLink) {
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return nil
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	return link.Streamer()
+}
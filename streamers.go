@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+// adminStreamerHandler manages a streamer declaratively. The name in the path is the streamer's stable ID,
+// PUT creates or replaces it and every response carries an ETag usable with If-Match.
+func adminStreamerHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	tenant, ok := adminScopeFromRequest(res, req)
+	if !ok {
+		return
+	}
+
+	name := req.PathValue("name")
+	current, err := webrtc.GetStreamerConfig(dbPool, req.Context(), name)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		logHTTPError(res, "Could not get streamer", http.StatusInternalServerError)
+		return
+	}
+
+	// Streamers of other tenants don't exist for tenant admins, their names can't be taken over either
+	if tenant != "" && current != nil && current.Tenant != tenant {
+		logHTTPError(res, "Streamer does not exist", http.StatusNotFound)
+		return
+	}
+
+	currentETag := ""
+	if current != nil {
+		currentETag = etagOf(current)
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var c webrtc.StreamerConfig
+		if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if c.Name == "" {
+			c.Name = name
+		}
+		if tenant != "" {
+			c.Tenant = tenant
+		}
+
+		switch {
+		case c.Name != name:
+			logHTTPError(res, "Name does not match the URL", http.StatusBadRequest)
+			return
+		case c.AuthToken == "" || len(c.StreamKeys) == 0:
+			logHTTPError(res, "Streamers require an authToken and streamKeys", http.StatusBadRequest)
+			return
+		case preconditionFailed(res, req, currentETag):
+			return
+		}
+
+		if !streamKeysAllowed(res, req, tenant, c.StreamKeys) {
+			return
+		}
+
+		created, err := webrtc.PutStreamerConfig(dbPool, req.Context(), c)
+		if err != nil {
+			logHTTPError(res, "Could not save streamer", http.StatusInternalServerError)
+			return
+		}
+
+		// Read back what was stored so the ETag matches later GETs
+		saved, err := webrtc.GetStreamerConfig(dbPool, req.Context(), name)
+		if err != nil {
+			logHTTPError(res, "Could not get streamer", http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Set("ETag", etagOf(saved))
+		if created {
+			res.WriteHeader(http.StatusCreated)
+		}
+		if err := json.NewEncoder(res).Encode(saved); err != nil {
+			log.Println(err)
+		}
+	case http.MethodDelete:
+		if preconditionFailed(res, req, currentETag) {
+			return
+		}
+
+		if err := webrtc.DeleteStreamer(dbPool, req.Context(), name); err != nil {
+			logHTTPError(res, "Could not delete streamer", http.StatusInternalServerError)
+			return
+		}
+		webrtc.EndStreamsOfStreamer(name)
+
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		if current == nil {
+			logHTTPError(res, "Streamer does not exist", http.StatusNotFound)
+			return
+		}
+
+		res.Header().Set("ETag", currentETag)
+		if etagMatches(req.Header.Get("If-None-Match"), currentETag) {
+			res.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(current); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// streamKeysAllowed checks that a tenant admin may hand out streamKeys, the admin may hand out any
+func streamKeysAllowed(res http.ResponseWriter, req *http.Request, tenant string, streamKeys []string) bool {
+	if tenant == "" {
+		return true
+	}
+
+	// Patterns could match the stream keys of other tenants, only the admin may hand them out
+	if slices.ContainsFunc(streamKeys, webrtc.IsStreamKeyPattern) {
+		logHTTPError(res, "Stream key patterns require ADMIN_TOKEN", http.StatusForbidden)
+		return false
+	}
+
+	taken, err := webrtc.StreamKeysOfOtherTenants(dbPool, req.Context(), tenant, streamKeys)
+	if err != nil {
+		logHTTPError(res, "Could not get stream keys", http.StatusInternalServerError)
+		return false
+	} else if len(taken) != 0 {
+		logHTTPError(res, "Stream keys belong to another tenant", http.StatusConflict)
+		return false
+	}
+
+	return true
+}
+
+// adminStreamersHandler lists the streamers on GET. POST creates one, generating its authToken if the body has none,
+// and fails if the name is taken.
+func adminStreamersHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	tenant, ok := adminScopeFromRequest(res, req)
+	if !ok {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		streamers, err := webrtc.ListStreamerConfigs(dbPool, req.Context(), tenant)
+		if err != nil {
+			logHTTPError(res, "Could not get streamers", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(streamers); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	var c webrtc.StreamerConfig
+	if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if tenant != "" {
+		c.Tenant = tenant
+	}
+
+	if c.Name == "" || len(c.StreamKeys) == 0 {
+		logHTTPError(res, "Streamers require a name and streamKeys", http.StatusBadRequest)
+		return
+	} else if !streamKeysAllowed(res, req, tenant, c.StreamKeys) {
+		return
+	}
+
+	authToken, err := webrtc.CreateStreamerConfig(dbPool, req.Context(), c)
+	if errors.Is(err, webrtc.ErrStreamerExists) {
+		logHTTPError(res, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		logHTTPError(res, "Could not save streamer", http.StatusInternalServerError)
+		return
+	}
+
+	// Read back what was stored so the ETag matches later GETs. Only the hash of the authToken is stored, this is
+	// the only response that contains a generated one.
+	saved, err := webrtc.GetStreamerConfig(dbPool, req.Context(), c.Name)
+	if err != nil {
+		logHTTPError(res, "Could not get streamer", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("ETag", etagOf(saved))
+	saved.AuthToken = authToken
+	res.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(res).Encode(saved); err != nil {
+		log.Println(err)
+	}
+}
+
+// adminStreamerRevokeHandler replaces the authToken of a streamer and ends what it is publishing, the new token is
+// only in the response
+func adminStreamerRevokeHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	tenant, ok := adminScopeFromRequest(res, req)
+	if !ok {
+		return
+	} else if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := req.PathValue("name")
+	current, err := webrtc.GetStreamerConfig(dbPool, req.Context(), name)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && tenant != "" && current.Tenant != tenant) {
+		logHTTPError(res, "Streamer does not exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, "Could not get streamer", http.StatusInternalServerError)
+		return
+	} else if preconditionFailed(res, req, etagOf(current)) {
+		return
+	}
+
+	authToken, err := webrtc.RevokeAuthToken(dbPool, req.Context(), name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		logHTTPError(res, "Streamer does not exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, "Could not revoke streamer", http.StatusInternalServerError)
+		return
+	}
+	webrtc.EndStreamsOfStreamer(name)
+
+	saved, err := webrtc.GetStreamerConfig(dbPool, req.Context(), name)
+	if err != nil {
+		logHTTPError(res, "Could not get streamer", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("ETag", etagOf(saved))
+	saved.AuthToken = authToken
+	if err := json.NewEncoder(res).Encode(saved); err != nil {
+		log.Println(err)
+	}
+}
+
+// adminStreamKeyUsageHandler lists when each stream key was last published to, how often and for how long, so stale
+// keys can be pruned. Pass `?unusedForDays=` to only list keys not used for that many days.
+func adminStreamKeyUsageHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	tenant, ok := adminScopeFromRequest(res, req)
+	if !ok {
+		return
+	}
+
+	unusedFor := time.Duration(0)
+	if v := req.URL.Query().Get("unusedForDays"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			logHTTPError(res, "Invalid unusedForDays", http.StatusBadRequest)
+			return
+		}
+		unusedFor = time.Duration(days) * 24 * time.Hour
+	}
+
+	usage, err := webrtc.GetStreamKeyUsage(dbPool, req.Context(), tenant, unusedFor)
+	if err != nil {
+		logHTTPError(res, "Could not get stream key usage", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(usage); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/patrikrog/broadcast-box/internal/autostart"
+	"github.com/patrikrog/broadcast-box/internal/edge"
+	"github.com/patrikrog/broadcast-box/internal/eventbus"
+	"github.com/patrikrog/broadcast-box/internal/events"
+	"github.com/patrikrog/broadcast-box/internal/hlskeys"
+	"github.com/patrikrog/broadcast-box/internal/icecast"
+	"github.com/patrikrog/broadcast-box/internal/integrations"
+	"github.com/patrikrog/broadcast-box/internal/ldapstore"
+	"github.com/patrikrog/broadcast-box/internal/metrics"
+	"github.com/patrikrog/broadcast-box/internal/mqtt"
+	"github.com/patrikrog/broadcast-box/internal/networktest"
+	"github.com/patrikrog/broadcast-box/internal/notify"
+	"github.com/patrikrog/broadcast-box/internal/playbacktoken"
+	"github.com/patrikrog/broadcast-box/internal/plugin"
+	"github.com/patrikrog/broadcast-box/internal/postprocess"
+	"github.com/patrikrog/broadcast-box/internal/rtmp"
+	"github.com/patrikrog/broadcast-box/internal/scheduler"
+	"github.com/patrikrog/broadcast-box/internal/sessionstore"
+	"github.com/patrikrog/broadcast-box/internal/subsystem"
+	"github.com/patrikrog/broadcast-box/internal/turn"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+const (
+	// Recorders finalize their files when they stop
+	pluginsStopTimeout = 30 * time.Second
+
+	// Requests in flight, like a WHEP offer waiting for ICE gathering, may take this long to complete
+	httpStopTimeout = 15 * time.Second
+)
+
+// registerSubsystems registers the parts of the server in the order they depend on each other. They are stopped in
+// reverse: the HTTP listeners first, so no session starts while the engine shuts down, and the database last.
+func registerSubsystems(listeners []httpListener, responseHeaders http.Header) {
+	subsystem.Register(subsystem.Subsystem{
+		Name: "database",
+		Start: func(ctx context.Context) (err error) {
+			if dbPool, err = newDatabasePool(ctx); err != nil {
+				return err
+			}
+
+			if os.Getenv("MIGRATE_ON_START") == "true" {
+				applied, hashed, err := migrateDatabase(ctx, dbPool)
+				if err != nil {
+					dbPool.Close()
+					return err
+				}
+				for _, version := range applied {
+					log.Printf("Applied migration %s", version)
+				}
+				if hashed != 0 {
+					log.Printf("Hashed the auth tokens of %d streamers", hashed)
+				}
+			}
+
+			metrics.NewGaugeFunc("broadcast_box_database_up", "Whether Postgres is reachable", func() []metrics.Sample {
+				ctx, cancel := context.WithTimeout(context.Background(), databasePingTimeout)
+				defer cancel()
+
+				if err := dbPool.Ping(ctx); err != nil {
+					return []metrics.Sample{{Value: 0}}
+				}
+				return []metrics.Sample{{Value: 1}}
+			})
+			return nil
+		},
+		Stop: func(context.Context) error {
+			dbPool.Close()
+			return nil
+		},
+		Timeout: migrateTimeout,
+	})
+
+	// Redis shares WHEP sessions between instances, the event bus and edge nodes connect this instance to others
+	subsystem.Register(subsystem.Subsystem{
+		Name: "cluster",
+		Start: func(context.Context) error {
+			if err := edge.Configure(); err != nil {
+				return err
+			} else if err = eventbus.Configure(); err != nil {
+				return err
+			}
+
+			return sessionstore.Configure(sessionstore.Callbacks{
+				Layers: whepSessionLayers,
+				ApplyLayerRequest: func(whepSessionId string, body []byte) {
+					if err := applyWHEPLayerRequest(whepSessionId, body); err != nil {
+						log.Println(err)
+					}
+				},
+				Delete: func(whepSessionId string) {
+					if err := webrtc.WHEPDelete(whepSessionId); err != nil {
+						log.Println(err)
+					}
+				},
+			})
+		},
+		Stop: func(ctx context.Context) error {
+			return errors.Join(sessionstore.Close(ctx), eventbus.Close())
+		},
+	})
+
+	subsystem.Register(subsystem.Subsystem{
+		Name:      "webrtc",
+		DependsOn: []string{"database", "cluster"},
+		Start: func(context.Context) error {
+			if err := webrtc.Configure(); err != nil {
+				return err
+			}
+
+			webrtc.ConfigureStreamSummaries(dbPool)
+			webrtc.ConfigureRecordingEvents(dbPool)
+			webrtc.ConfigureTenantWebhooks(dbPool)
+			webrtc.ConfigureStreamGroupWebhooks(dbPool)
+			webrtc.ConfigureOutputAllowlist(dbPool)
+			webrtc.ConfigureStreamKeyUsage(dbPool)
+			webrtc.ConfigureRecordingHeatmaps(dbPool)
+			return nil
+		},
+		Stop: webrtc.Shutdown,
+	})
+
+	// Webhooks, integrations and the services streams are announced to
+	subsystem.Register(subsystem.Subsystem{
+		Name:      "integrations",
+		DependsOn: []string{"database", "webrtc"},
+		Start: func(context.Context) error {
+			events.ConfigureWebhooks()
+			integrations.Configure()
+			if err := hlskeys.Configure(); err != nil {
+				return err
+			} else if err = turn.Configure(); err != nil {
+				return err
+			}
+			icecast.Configure()
+			mqtt.Configure()
+			notify.Configure(dbPool)
+			autostart.Configure(dbPool, func(streamKey, action string) error {
+				switch action {
+				case autostart.ActionRecord:
+					return webrtc.CheckOutputAllowed(streamKey, webrtc.OutputRecording)
+				}
+				return nil
+			})
+			return postprocess.Configure(dbPool)
+		},
+	})
+
+	// Stores, notifiers and recorders. Recordings are stopped before the engine ends their streams, so every file
+	// is finalized while Postgres is still there to note it.
+	subsystem.Register(subsystem.Subsystem{
+		Name:      "plugins",
+		DependsOn: []string{"database", "webrtc", "integrations"},
+		Start: func(context.Context) (err error) {
+			plugin.RegisterStore("postgres", func() (plugin.Store, error) {
+				return plugin.NewPostgresStore(dbPool), nil
+			})
+			plugin.RegisterStore("ldap", ldapstore.New)
+			if diskRecorder := webrtc.ConfiguredDiskRecorder(); diskRecorder != nil {
+				plugin.RegisterRecorder("disk", diskRecorder)
+			}
+			if store, err = plugin.Configure(); err != nil {
+				return err
+			}
+
+			plugin.ConfigureRecordingRecovery(dbPool)
+			return nil
+		},
+		Stop: func(context.Context) error {
+			plugin.StopRecorders()
+			return nil
+		},
+		Timeout: pluginsStopTimeout,
+	})
+
+	subsystem.Register(subsystem.Subsystem{
+		Name:      "jobs",
+		DependsOn: []string{"database", "webrtc", "plugins"},
+		Start: func(context.Context) error {
+			return configureMaintenanceJobs(listeners)
+		},
+		Stop: scheduler.Stop,
+	})
+
+	// Publishers that use RTMP feed their streams like WHIP publishers
+	subsystem.Register(subsystem.Subsystem{
+		Name:      "rtmp",
+		DependsOn: []string{"webrtc", "integrations", "plugins"},
+		Start: func(context.Context) error {
+			return rtmp.Configure(func(ctx context.Context, streamKey, token string) *webrtc.Streamer {
+				if !validateStreamKey(streamKey) {
+					return nil
+				}
+				return authenticateStreamer(ctx, streamKey, token)
+			})
+		},
+		Stop: rtmp.Close,
+	})
+
+	var (
+		servers     []*http.Server
+		serversLock sync.Mutex
+	)
+	subsystem.Register(subsystem.Subsystem{
+		Name:      "http",
+		DependsOn: []string{"webrtc", "cluster", "integrations", "plugins", "jobs"},
+		Start: func(context.Context) error {
+			serversLock.Lock()
+			defer serversLock.Unlock()
+
+			mux := newServeMux()
+			for _, listener := range listeners {
+				server, err := listener.start(responseHeadersHandler(responseHeaders, requestIdHandler(exposureHandler(listener.exposures, mux))))
+				if err != nil {
+					return fmt.Errorf("Listener %s: %w", listener.address, err)
+				}
+				servers = append(servers, server)
+			}
+
+			if os.Getenv("HTTPS_REDIRECT_PORT") != "" || os.Getenv("ENABLE_HTTP_REDIRECT") != "" {
+				server, err := startRedirectServer(responseHeaders)
+				if err != nil {
+					return err
+				}
+				servers = append(servers, server)
+			}
+
+			if os.Getenv("NETWORK_TEST_ON_START") == "true" {
+				startNetworkTest()
+			}
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			serversLock.Lock()
+			defer serversLock.Unlock()
+
+			errs := []error{}
+			for _, server := range servers {
+				errs = append(errs, server.Shutdown(ctx))
+			}
+			return errors.Join(errs...)
+		},
+		Timeout: httpStopTimeout,
+	})
+}
+
+// startRedirectServer redirects HTTP on HTTPS_REDIRECT_PORT, 80 by default, to HTTPS
+func startRedirectServer(responseHeaders http.Header) (*http.Server, error) {
+	httpsRedirectPort := "80"
+	if val := os.Getenv("HTTPS_REDIRECT_PORT"); val != "" {
+		httpsRedirectPort = val
+	}
+
+	redirectServer := &http.Server{
+		Addr: ":" + httpsRedirectPort,
+		Handler: responseHeadersHandler(responseHeaders, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "https://"+r.Host+r.URL.String(), http.StatusMovedPermanently)
+		})),
+	}
+
+	listener, err := net.Listen("tcp", redirectServer.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		log.Println("Running HTTP->HTTPS redirect Server at :" + httpsRedirectPort)
+		if err := redirectServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			subsystem.Fail("http", err)
+		}
+	}()
+
+	return redirectServer, nil
+}
+
+// startNetworkTest connects to this instance like a viewer once it is running, a failed test stops the server
+func startNetworkTest() {
+	fmt.Println(networkTestIntroMessage) //nolint
+
+	go func() {
+		time.Sleep(time.Second * 5)
+
+		networkTestHandler := func(res http.ResponseWriter, req *http.Request) {
+			if playbacktoken.Enabled() {
+				token, _ := playbacktoken.Sign("networktest", time.Now().Add(time.Minute))
+				req.Header.Set("Authorization", "Bearer networktest;"+token)
+			}
+
+			whepHandler(res, req)
+		}
+
+		if networkTestErr := networktest.Run(networkTestHandler); networkTestErr != nil {
+			fmt.Printf(networkTestFailedMessage, networkTestErr.Error())
+			subsystem.Fail("network test", networkTestErr)
+		} else {
+			fmt.Println(networkTestSuccessMessage) //nolint
+		}
+	}()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+)
+
+// adminTenantHandler manages the tenants sharing this deployment. Only operators with ADMIN_TOKEN may use it,
+// tenant admins manage their streamers with their own admin token.
+func adminTenantHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	if !adminFromRequest(res, req) {
+		return
+	}
+
+	name := req.PathValue("name")
+	switch req.Method {
+	case http.MethodPut:
+		var t webrtc.Tenant
+		if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if t.Name == "" {
+			t.Name = name
+		}
+
+		switch {
+		case t.Name != name:
+			logHTTPError(res, "Name does not match the URL", http.StatusBadRequest)
+			return
+		case t.AdminToken == "":
+			logHTTPError(res, "Tenants require an adminToken", http.StatusBadRequest)
+			return
+		}
+
+		created, err := webrtc.PutTenant(dbPool, req.Context(), t)
+		if errors.Is(err, webrtc.ErrAdminTokenInUse) {
+			logHTTPError(res, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			logHTTPError(res, "Could not save tenant", http.StatusInternalServerError)
+			return
+		}
+
+		if created {
+			res.WriteHeader(http.StatusCreated)
+		}
+		if err := json.NewEncoder(res).Encode(t); err != nil {
+			log.Println(err)
+		}
+	case http.MethodDelete:
+		if err := webrtc.DeleteTenant(dbPool, req.Context(), name); err != nil {
+			logHTTPError(res, "Could not delete tenant", http.StatusInternalServerError)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		t, err := webrtc.GetTenant(dbPool, req.Context(), name)
+		if errors.Is(err, pgx.ErrNoRows) {
+			logHTTPError(res, "Tenant does not exist", http.StatusNotFound)
+			return
+		} else if err != nil {
+			logHTTPError(res, "Could not get tenant", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(t); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/patrikrog/broadcast-box/internal/playbacktoken"
+	"github.com/patrikrog/broadcast-box/internal/sessionstore"
+	"github.com/patrikrog/broadcast-box/internal/webrtc"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	wsTypeOffer     = "offer"
+	wsTypeAnswer    = "answer"
+	wsTypeCandidate = "candidate"
+	wsTypeLayer     = "layer"
+	wsTypeError     = "error"
+)
+
+// wsMessageJSON is every message of the WebSocket signaling protocol, Type decides which fields are set
+type wsMessageJSON struct {
+	Type      string `json:"type"`
+	StreamKey string `json:"streamKey,omitempty"`
+	Token     string `json:"token,omitempty"`
+	// Sent with the answer, and with an offer to resume the session of a previous connection
+	ResumeToken string `json:"resumeToken,omitempty"`
+	SDP         string `json:"sdp,omitempty"`
+	Candidate   string `json:"candidate,omitempty"`
+	SessionID   string `json:"sessionId,omitempty"`
+	MediaId     string `json:"mediaId,omitempty"`
+	EncodingId  string `json:"encodingId,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// wsPlayServer accepts connections without an Origin header, native apps don't send one
+var wsPlayServer = websocket.Server{
+	Handler:   wsPlayHandler,
+	Handshake: func(*websocket.Config, *http.Request) error { return nil },
+}
+
+// wsPlayHandler is signaling for players that can't implement WHEP. The client sends an `offer`
+// and receives an `answer`, then may trickle `candidate`s and switch `layer`s. The WHEP session
+// ends with the WebSocket.
+func wsPlayHandler(ws *websocket.Conn) {
+	whepSessionId := ""
+	defer func() {
+		if whepSessionId != "" {
+			if err := webrtc.WHEPClose(whepSessionId); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	sendError := func(err string) {
+		if sendErr := websocket.JSON.Send(ws, wsMessageJSON{Type: wsTypeError, Error: err}); sendErr != nil {
+			log.Println(sendErr)
+		}
+	}
+
+	for {
+		var msg wsMessageJSON
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+
+		switch {
+		case msg.Type == wsTypeOffer && whepSessionId == "":
+			if !validateStreamKey(msg.StreamKey) {
+				sendError("Invalid stream key format")
+				continue
+			}
+
+			// Viewers resuming a session were already authorized
+			streamKey := resolveStreamKey(ws.Request().Context(), msg.StreamKey)
+			resuming := msg.ResumeToken != "" && webrtc.CanResumeWHEP(msg.ResumeToken, streamKey)
+			if playbacktoken.Enabled() && !resuming {
+				if err := playbacktoken.Verify(msg.Token, streamKey); err != nil {
+					sendError(err.Error())
+					continue
+				}
+			}
+			if !resuming {
+				if err := webrtc.CheckOriginAllowed(streamKey, ws.Request().Host, ws.Request().Header.Get("Origin"), ws.Request().Header.Get("Referer")); err != nil {
+					sendError(err.Error())
+					continue
+				}
+			}
+
+			offer := applyNegotiationOverrides(ws.Request().Context(), streamKey, msg.SDP)
+
+			var answer, id string
+			var err error
+			if resuming {
+				answer, id, err = webrtc.WHEPResume(ws.Request().Context(), offer, msg.ResumeToken)
+			} else {
+				answer, id, err = webrtc.WHEP(ws.Request().Context(), offer, streamKey)
+			}
+			if err != nil {
+				sendError(err.Error())
+				continue
+			}
+
+			whepSessionId = id
+			sessionstore.Register(whepSessionId, streamKey)
+			if err := webrtc.RecordViewerDevice(whepSessionId, ws.Request().UserAgent()); err != nil {
+				log.Println(err)
+			}
+			if err := websocket.JSON.Send(ws, wsMessageJSON{Type: wsTypeAnswer, SDP: answer, SessionID: whepSessionId, ResumeToken: webrtc.IssueResumeToken(whepSessionId)}); err != nil {
+				return
+			}
+		case msg.Type == wsTypeOffer:
+			sendError("Session was already negotiated")
+		case whepSessionId == "":
+			sendError("Send an offer first")
+		case msg.Type == wsTypeCandidate:
+			if err := webrtc.WHEPAddICECandidate(whepSessionId, msg.Candidate); err != nil {
+				sendError(err.Error())
+			}
+		case msg.Type == wsTypeLayer:
+			if err := webrtc.WHEPChangeLayer(whepSessionId, msg.MediaId, msg.EncodingId); err != nil {
+				sendError(err.Error())
+			}
+		default:
+			sendError("Unknown message type")
+		}
+	}
+}